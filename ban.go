@@ -6,13 +6,22 @@
 // restoring duplicate address-parts.
 //
 // Existing Bans can be loaded into the Handler with new Bans being saved.
+//
+// Handlers made with NewNamespaced keep separate Bans for the Namespace of each
+// http.Request, like each virtual host.
+//
+// The Handler is an adapter over an Engine, which servers for other protocols
+// can share to enforce the same Bans. Replicators keep the Bans of Engines in
+// several instances the same.
 package ban
 
 import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"time"
 )
 
 // ErrorHandler handles passed errors.
@@ -30,24 +39,132 @@ func StderrErrorHandler(err error) {
 // Ban which can either not ban, ban an IP, or ban a range of IPs by specifying
 // the prefix-length of bits in the IP which matter.
 //
-// An empty Ban bans every IP and shouldn't be used unless that is the desired
-// behavior. IPBan bans only the IP which made the http.Request. A Ban with a
-// specified prefix-length bans a range of IPs where the bits after the
+// An empty Ban issued to an IPv4 address bans every IPv4 address, and issued to
+// an IPv6 address bans every IP, so it shouldn't be used unless that is the
+// desired behavior. IPBan bans only the IP which made the http.Request. A Ban
+// with a specified prefix-length bans a range of IPs where the bits after the
 // prefix-length are ignored when comparing each IP to the one which made the
 // http.Request.
+//
+// The prefix-length is native to the family of the IP which made the
+// http.Request, so a prefix-length of 24 bans an IPv4 /24 for IPv4 addresses
+// and an IPv6 /24 for IPv6 addresses.
+//
+// KeyBan bans only the key of the http.Request found by the KeyExtractor, and
+// AndKey bans the key along with whatever else the Ban bans. FingerprintBan and
+// AndFingerprint do the same for the TLS ClientHello fingerprint of the
+// http.Request's connection.
+//
+// ChallengeBan serves a proof-of-work challenge instead of banning.
+//
+// In limits the IPs banned by a Ban to a Scope, like a path prefix, so they can
+// still use the rest of the site, and For limits how long they are banned.
+// Because records the reason a Ban was issued in the Meta of what it bans.
 type Ban struct {
-	PrefixLength byte
-	shouldntBan  bool
-	shouldBanIP  bool
+	PrefixLength         byte
+	shouldntBan          bool
+	shouldBanIP          bool
+	shouldBanKey         bool
+	shouldBanFingerprint bool
+	shouldntBanIP        bool
+	shouldChallenge      bool
+	// scope is the String form of the Scope of the banned IPs.
+	scope string
+	// duration the IPs, keys, and fingerprints are banned for, which is
+	// forever if 0.
+	duration time.Duration
+	// reason the Ban was issued.
+	reason string
 }
 
 var (
 	// IPBan bans only the IP which made the http.Request.
 	IPBan = Ban{shouldBanIP: true}
+	// KeyBan bans only the key of the http.Request.
+	KeyBan = Ban{shouldBanKey: true, shouldntBanIP: true}
+	// FingerprintBan bans only the TLS ClientHello fingerprint of the
+	// http.Request's connection.
+	FingerprintBan = Ban{shouldBanFingerprint: true, shouldntBanIP: true}
+	// ChallengeBan serves a proof-of-work challenge to the IP which made the
+	// http.Request unless it has the cookie from solving one. IPs which fail
+	// too many challenges are banned.
+	//
+	// Servers for other protocols, which can't serve challenges, reject the
+	// request without banning.
+	ChallengeBan = Ban{shouldChallenge: true, shouldntBanIP: true}
 	// NoBan doesn't ban.
 	NoBan = Ban{shouldntBan: true}
 )
 
+// AndKey returns the Ban which also bans the key of the http.Request.
+func (b Ban) AndKey() Ban {
+	if b == NoBan {
+		return KeyBan
+	}
+	b.shouldBanKey = true
+	return b
+}
+
+// In returns the Ban with the IPs it bans limited to the Scope.
+//
+// Keys and fingerprints aren't limited.
+func (b Ban) In(scope Scope) Ban {
+	if b == NoBan {
+		return b
+	}
+	b.scope = scope.String()
+	return b
+}
+
+// For returns the Ban with the IPs, keys, and fingerprints it bans unbanned
+// after the duration.
+func (b Ban) For(d time.Duration) Ban {
+	if b == NoBan {
+		return b
+	}
+	b.duration = d
+	return b
+}
+
+// AndFingerprint returns the Ban which also bans the TLS ClientHello
+// fingerprint of the http.Request's connection.
+func (b Ban) AndFingerprint() Ban {
+	if b == NoBan {
+		return FingerprintBan
+	}
+	b.shouldBanFingerprint = true
+	return b
+}
+
+// Because returns the Ban with the reason it was issued, like the rule which
+// matched, which is recorded as the Reason in the Meta of what it bans.
+func (b Ban) Because(reason string) Ban {
+	if b == NoBan {
+		return b
+	}
+	b.reason = reason
+	return b
+}
+
+// Reason the Ban was issued, which is "" if none was given with Because.
+func (b Ban) Reason() string {
+	return b.reason
+}
+
+// PrefixedIP the Ban bans when issued to the IP.
+//
+// Returns nil for NoBan and Bans which don't ban IPs or an error if the Ban has
+// a bad prefix-length for the IP's family.
+func (b Ban) PrefixedIP(ip IP) (*PrefixedIP, error) {
+	if b == NoBan || b.shouldntBanIP {
+		return nil, nil
+	}
+	if b.shouldBanIP {
+		return NewPrefixedIP(ip, ip.bitLength())
+	}
+	return NewPrefixedIP(ip, b.PrefixLength)
+}
+
 // Banner issues bans to IPs based on http.Requests.
 type Banner interface {
 	Ban(IP, *http.Request) Ban
@@ -61,121 +178,254 @@ func (f BannerFunc) Ban(ip IP, r *http.Request) Ban {
 	return f(ip, r)
 }
 
-// Config for the wrapper.
+// AddrBannerFunc is a helper type to convert a function accepting a netip.Addr
+// to a Banner.
+type AddrBannerFunc func(netip.Addr, *http.Request) Ban
+
+// Ban calls the converted function with the IP converted to a netip.Addr.
+func (f AddrBannerFunc) Ban(ip IP, r *http.Request) Ban {
+	return f(ip.Addr(), r)
+}
+
+// Config for the Engine.
 type Config struct {
-	// StorePath is the name of file to load and store Bans into.
+	// StorePath is the name of file to load and store Bans into with a
+	// FileStore.
+	//
+	// Files written by earlier versions of the package, where prefix-lengths
+	// are always out of 128 bits, are detected and continue to be read and
+	// written in that form.
 	//
-	// Doesn't load or store if not assigned.
+	// Doesn't load or store if neither StorePath nor Store is assigned.
 	StorePath string
+	// Store to load and store Bans into instead of a file at StorePath.
+	Store Store
 	// ErrorHandler handles errors passed to it.
 	//
 	// Defaults to StderrErrorHandler if not assigned.
 	ErrorHandler ErrorHandler
+	// KeyExtractor finds the key of http.Requests, like an API key, user ID,
+	// or session, so the key can be banned along with or instead of the IP.
+	//
+	// Keys aren't checked or banned by Handlers if not assigned.
+	KeyExtractor KeyExtractor
+	// KeySecret keys the hashes returned by HashKey which keys are banned,
+	// stored, and replicated as, so secrets like API keys are never written.
+	//
+	// Engines sharing a Store or replicating must share a KeySecret. Defaults
+	// to a random KeySecret for each Engine if not assigned, so banned keys
+	// are only checked by the Engine which banned them until it stops.
+	KeySecret []byte
+	// Allowlist exempts http.Requests from being checked for or issued Bans
+	// by Handlers, like CrawlerVerifier.Verified does for crawlers.
+	//
+	// No http.Requests are exempt if not assigned.
+	Allowlist Allowlist
+	// Challenge configures the proof-of-work challenges served for
+	// ChallengeBans.
+	//
+	// Defaults to DefaultChallengeConfig if not assigned.
+	Challenge ChallengeConfig
+	// Tarpit configures Handlers to respond to banned clients slowly,
+	// holding their connections open, instead of rejecting them
+	// immediately.
+	//
+	// Banned clients are rejected immediately if not assigned.
+	Tarpit *TarpitConfig
 }
 
-// DefaultConfig which doesn't load or store Bans and uses StderrErrorHandler.
+// DefaultConfig which doesn't load or store Bans, uses StderrErrorHandler, and
+// doesn't check keys.
 var DefaultConfig = Config{}
 
-// Handler is the wrapping http.Handler which tracks Bans.
+// Handler is the wrapping http.Handler which checks for and issues Bans in an
+// Engine.
 type Handler struct {
-	handler      http.Handler
-	banner       Banner
-	ips          ipMap
-	errorHandler ErrorHandler
-	store        *store
+	handler http.Handler
+	banner  Banner
+	engine  *Engine
+	// selector is nil if the Handler has no Namespaces.
+	selector   NamespaceSelector
+	namespaces map[string]*Handler
 }
 
 // New Handler that wraps the http.Handler to check for Bans issued by the
 // Banner before responding to http.Requests with behavior customized by Config.
+//
+// The Handler has its own Engine, which can be shared with servers for other
+// protocols through Engine.
 func New(h http.Handler, banner Banner, cfg Config) *Handler {
-	var store *store
-	if cfg.StorePath != "" {
-		store = newStore(cfg.StorePath)
-	}
-	errorHandler := cfg.ErrorHandler
-	if errorHandler == nil {
-		errorHandler = StderrErrorHandler
-	}
-	hn := &Handler{
-		handler:      h,
-		banner:       banner,
-		ips:          newTrie(),
-		errorHandler: errorHandler,
-		store:        store,
-	}
-	if hn.store != nil {
-		if err := hn.loadPrefixedIPs(); err != nil {
-			hn.errorHandler(err)
-		}
-	}
-	return hn
+	return NewEngine(cfg).Handler(h, banner)
 }
 
 // ServeHTTP checks if the IP that made the http.Request is banned or if it
 // should be banned before responding and either writes a banned message or the
 // inner http.Handler's response to the http.ResponseWriter.
+//
+// http.Requests exempted by the Allowlist are passed on without being checked.
+// Handlers with Namespaces pass http.Requests which aren't banned to the
+// Handler of their Namespace.
 func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	ip, err := parseRemoteAddress(r.RemoteAddr)
+	ip, err := ParseRemoteAddress(r.RemoteAddr)
 	if err != nil {
-		h.errorHandler(err)
+		h.engine.errorHandler(err)
 		writeError(rw, err)
 		return
 	}
-	if h.ips.Has(ip) {
-		writeBan(rw, ip)
+	if h.engine.allowlist != nil && h.engine.allowlist(ip, r) {
+		h.next(rw, r)
+		return
+	}
+	var path string
+	if r.URL != nil {
+		path = r.URL.Path
+	}
+	if h.engine.Check(ip) || h.engine.CheckScoped(ip, r.Host, r.Method, path) {
+		h.reject(rw, r, ip.String())
+		return
+	}
+	var key string
+	if h.engine.keyExtractor != nil {
+		key = h.engine.keyExtractor(r)
+	}
+	if key != "" && h.engine.CheckKey(key) {
+		h.reject(rw, r, "key")
+		return
+	}
+	fingerprint, _ := FingerprintFromContext(r.Context())
+	if fingerprint != "" && h.engine.CheckFingerprint(fingerprint) {
+		h.reject(rw, r, "fingerprint")
+		return
+	}
+	ban := h.banner.Ban(ip, r)
+	if ban.shouldChallenge && r.Header.Get(challengeSolutionHeader) != "" {
+		h.verifyChallenge(rw, r, ip)
+		return
+	}
+	if ban.shouldChallenge {
+		h.challenge(rw, r, ip)
 		return
 	}
-	if ban := h.banner.Ban(ip, r); ban != NoBan {
-		var pl byte
-		if ban.shouldBanIP {
-			pl = ipLength
-		} else {
-			pl = ban.PrefixLength
+	if ban != NoBan {
+		meta := Meta{Reason: ban.reason, Issuer: "http"}
+		if _, err := h.engine.Issue(ip, ban, meta); err != nil {
+			h.engine.errorHandler(err)
 		}
-		pip, err := NewPrefixedIP(ip, pl)
-		if err != nil {
-			h.errorHandler(err)
-			writeBan(rw, ip)
-			return
+		if ban.shouldBanKey && key != "" {
+			if err := h.engine.issueKey(requestKey, key, ban.duration, meta); err != nil {
+				h.engine.errorHandler(err)
+			}
 		}
-		h.ips.Add(pip)
-		if h.store != nil {
-			if err := h.writePrefixedIP(pip); err != nil {
-				h.errorHandler(err)
+		if ban.shouldBanFingerprint && fingerprint != "" {
+			if err := h.engine.issueKey(fingerprintKey, fingerprint, ban.duration, meta); err != nil {
+				h.engine.errorHandler(err)
 			}
 		}
-		writeBan(rw, ip)
+		switch {
+		case !ban.shouldntBanIP:
+			h.reject(rw, r, ip.String())
+		case ban.shouldBanKey:
+			h.reject(rw, r, "key")
+		default:
+			h.reject(rw, r, "fingerprint")
+		}
 		return
 	}
-	h.handler.ServeHTTP(rw, r)
+	h.next(rw, r)
 }
 
-// writePrefixedIP to the store.
-//
-// Returns any error that happened during writing.
-func (h *Handler) writePrefixedIP(pip *PrefixedIP) error {
-	return h.store.Add(pip)
+// challenge the IP which made the http.Request unless it has solved a
+// challenge, banning it if it has failed too many.
+func (h *Handler) challenge(rw http.ResponseWriter, r *http.Request, ip IP) {
+	c := h.engine.challenger
+	now := time.Now()
+	if c.Passed(r, ip, now) {
+		h.next(rw, r)
+		return
+	}
+	if c.Fail(ip, now) {
+		h.banChallenged(rw, r, ip)
+		return
+	}
+	writeChallenge(rw, c.Challenge(ip, now), c.difficulty)
 }
 
-// loadPrefixedIPs from the store and return an ipMap containing the
-// PrefixedIPs.
-//
-// Returns any error that happened during loading.
-func (h *Handler) loadPrefixedIPs() error {
-	pips, err := h.store.PrefixedIPs()
-	if err != nil {
-		return err
+// verifyChallenge sets the cookie of the IP which made the http.Request if it
+// solved its challenge, banning it if it has failed too many.
+func (h *Handler) verifyChallenge(rw http.ResponseWriter, r *http.Request, ip IP) {
+	c := h.engine.challenger
+	now := time.Now()
+	cookie, ok := c.Verify(
+		r.Header.Get(challengeHeader), r.Header.Get(challengeSolutionHeader),
+		ip, now,
+	)
+	if ok {
+		cookie.Secure = r.TLS != nil
+		http.SetCookie(rw, cookie)
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if c.Fail(ip, now) {
+		h.banChallenged(rw, r, ip)
+		return
 	}
-	for _, pip := range pips {
-		h.ips.Add(pip)
+	rw.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(rw, "bad challenge solution")
+}
+
+// banChallenged bans the IP which made the http.Request for failing too many
+// challenges.
+func (h *Handler) banChallenged(rw http.ResponseWriter, r *http.Request, ip IP) {
+	meta := Meta{Reason: "failed challenges", Issuer: "http"}
+	if _, err := h.engine.Issue(ip, IPBan, meta); err != nil {
+		h.engine.errorHandler(err)
+	}
+	h.reject(rw, r, ip.String())
+}
+
+// reject the http.Request because the subject, either an IP, "key", or
+// "fingerprint", is banned.
+//
+// The response is tarpitted if the Engine has a tarpit with room.
+func (h *Handler) reject(rw http.ResponseWriter, r *http.Request, subject string) {
+	if h.engine.tarpit != nil {
+		if h.engine.tarpit.Write(rw, r, http.StatusForbidden, banMessage(subject)) {
+			return
+		}
 	}
-	return nil
+	writeBan(rw, subject)
 }
 
-// parseRemoteAddress parses the IP from an http.Request's remote-address.
+// Engine the Handler checks for and issues Bans in.
+func (h *Handler) Engine() *Engine {
+	return h.engine
+}
+
+// Add the PrefixedIPs as Bans to the Handler's Engine.
+//
+// Returns any error that happened during writing.
+func (h *Handler) Add(pips ...*PrefixedIP) error {
+	return h.engine.Add(pips...)
+}
+
+// PrefixedIPs banned in the Handler's Engine, IPv4 before IPv6 and each in
+// ascending order.
+func (h *Handler) PrefixedIPs() []*PrefixedIP {
+	return h.engine.PrefixedIPs()
+}
+
+// Banned returns true if the IP is banned in the Handler's Engine.
+func (h *Handler) Banned(ip IP) bool {
+	return h.engine.Check(ip)
+}
+
+// ParseRemoteAddress parses the IP from an http.Request's or net.Conn's
+// remote-address, which is how Handlers find the IPs they check.
+//
+// Zones on link-local IPv6 remote-addresses are dropped like in ParseIP.
 //
 // Returns an error if the remote-address can't be parsed.
-func parseRemoteAddress(addr string) (IP, error) {
+func ParseRemoteAddress(addr string) (IP, error) {
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return IP{}, ErrBadIP
@@ -183,10 +433,18 @@ func parseRemoteAddress(addr string) (IP, error) {
 	return ParseIP(host)
 }
 
-// writeBan writes that the IP is banned to the http.ResponseWriter.
-func writeBan(rw http.ResponseWriter, ip IP) {
+// writeBan writes that the subject, either an IP, "key", or "fingerprint", is
+// banned to the http.ResponseWriter.
+//
+// Keys aren't written since they can be secrets.
+func writeBan(rw http.ResponseWriter, subject string) {
 	rw.WriteHeader(http.StatusForbidden)
-	fmt.Fprintf(rw, fmt.Sprintf("%v is banned", ip))
+	fmt.Fprint(rw, banMessage(subject))
+}
+
+// banMessage is the message that the subject is banned.
+func banMessage(subject string) string {
+	return subject + " is banned"
 }
 
 // writeError to the http.ResponseWriter.
@@ -195,9 +453,11 @@ func writeError(rw http.ResponseWriter, err error) {
 	fmt.Fprintf(rw, "%s", err)
 }
 
-// ipMap is a structure that efficiently supports adding of PrefixedIPs and
-// membership checking of IPs.
+// ipMap is a structure that efficiently supports adding and removing of
+// PrefixedIPs and membership checking of IPs.
 type ipMap interface {
-	Add(*PrefixedIP)
+	Add(*PrefixedIP) bool
+	Remove(*PrefixedIP) bool
 	Has(IP) bool
+	PrefixedIPs() []*PrefixedIP
 }
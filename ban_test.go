@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
 	"strings"
 	"testing"
@@ -149,6 +150,117 @@ func TestBanBanned(t *testing.T) {
 	)
 }
 
+// TestBanIPv4PrefixLength tests that prefix-lengths in Bans issued to IPv4
+// addresses are IPv4-native.
+func TestBanIPv4PrefixLength(t *testing.T) {
+	t.Parallel()
+	testBanner(
+		t,
+		BannerFunc(func(ip IP, r *http.Request) Ban {
+			if ip.String() == "1.2.3.4" {
+				return Ban{PrefixLength: 24}
+			}
+			return NoBan
+		}),
+		[]string{"1.2.3.4", "1.2.3.5", "1.2.4.4", "::1"},
+		[]string{"1.2.3.4 is banned", "1.2.3.5 is banned", "", ""},
+		[]int{http.StatusForbidden, http.StatusForbidden, http.StatusOK, http.StatusOK},
+	)
+}
+
+// TestBanLegacyStore tests that stores written by earlier versions of the
+// package are read and appended to in the legacy form.
+func TestBanLegacyStore(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if err := os.Remove("legacy_store.txt"); err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := ioutil.WriteFile("legacy_store.txt", []byte("1.2.3.0/120\n"), 0777); err != nil {
+		t.Error(err)
+	}
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	b := BannerFunc(func(ip IP, r *http.Request) Ban { return IPBan })
+	testHandler(
+		t,
+		New(h, b, Config{StorePath: "legacy_store.txt"}),
+		"5.6.7.8", "5.6.7.8 is banned", http.StatusForbidden,
+	)
+	b = BannerFunc(func(ip IP, r *http.Request) Ban { return NoBan })
+	wh := New(h, b, Config{StorePath: "legacy_store.txt"})
+	testHandler(t, wh, "1.2.3.4", "1.2.3.4 is banned", http.StatusForbidden)
+	testHandler(t, wh, "5.6.7.8", "5.6.7.8 is banned", http.StatusForbidden)
+	testHandler(t, wh, "5.6.7.9", "", http.StatusOK)
+	bs, err := ioutil.ReadFile("legacy_store.txt")
+	if err != nil {
+		t.Error(err)
+	}
+	if es := "1.2.3.0/120\n5.6.7.8/128\n"; string(bs) != es {
+		t.Errorf("store = %q, want %q", bs, es)
+	}
+}
+
+// TestBanZone tests that zone-qualified remote-addresses are banned regardless
+// of the zone.
+func TestBanZone(t *testing.T) {
+	t.Parallel()
+	testBanner(
+		t,
+		BannerFunc(func(ip IP, r *http.Request) Ban {
+			if ip.String() == "fe80::1" {
+				return IPBan
+			}
+			return NoBan
+		}),
+		[]string{"fe80::1%eth0", "fe80::1%eth1", "fe80::2%eth0"},
+		[]string{"fe80::1 is banned", "fe80::1 is banned", ""},
+		[]int{http.StatusForbidden, http.StatusForbidden, http.StatusOK},
+	)
+}
+
+// TestAddrBannerFunc tests that AddrBannerFunc passes the IP as a netip.Addr.
+func TestAddrBannerFunc(t *testing.T) {
+	t.Parallel()
+	testBanner(
+		t,
+		AddrBannerFunc(func(addr netip.Addr, r *http.Request) Ban {
+			if addr == netip.MustParseAddr("1.2.3.4") {
+				return IPBan
+			}
+			return NoBan
+		}),
+		[]string{"1.2.3.4", "::ffff:1.2.3.5"},
+		[]string{"1.2.3.4 is banned", ""},
+		[]int{http.StatusForbidden, http.StatusOK},
+	)
+}
+
+// TestHandlerAdd tests that PrefixedIPs added to a Handler are banned and
+// stored.
+func TestHandlerAdd(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if err := os.Remove("add_store.txt"); err != nil {
+			t.Error(err)
+		}
+	}()
+	pips, err := ImportCIDRList(strings.NewReader("1.2.3.0/24\n2001:db8::/32\n"))
+	if err != nil {
+		t.Error(err)
+	}
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	b := BannerFunc(func(ip IP, r *http.Request) Ban { return NoBan })
+	wh := New(h, b, Config{StorePath: "add_store.txt"})
+	if err := wh.Add(pips...); err != nil {
+		t.Error(err)
+	}
+	testHandler(t, wh, "1.2.3.4", "1.2.3.4 is banned", http.StatusForbidden)
+	testHandler(t, wh, "1.2.4.4", "", http.StatusOK)
+	wh = New(h, b, Config{StorePath: "add_store.txt"})
+	testHandler(t, wh, "2001:db8::1", "2001:db8::1 is banned", http.StatusForbidden)
+}
+
 // TestBanError tests that errors are correctly written to http.Responses.
 func TestBanError(t *testing.T) {
 	t.Parallel()
@@ -185,8 +297,29 @@ func testHandler(t *testing.T, h http.Handler, ip string, es string, esc int) {
 	if strings.Contains(ip, ":") {
 		ip = "[" + ip + "]"
 	}
+	testRequest(t, h, &http.Request{RemoteAddr: ip + ":"}, es, esc)
+}
+
+// testTarget tests that the http.Handler returns the correct message and code
+// with a GET http.Request from the given IP to the target, which is a path or
+// an absolute URL whose host the http.Request is for, with the header.
+func testTarget(t *testing.T, h http.Handler, ip, target string, header http.Header, es string, esc int) {
+	if strings.Contains(ip, ":") {
+		ip = "[" + ip + "]"
+	}
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = ip + ":1"
+	for k, vs := range header {
+		r.Header[k] = vs
+	}
+	testRequest(t, h, r, es, esc)
+}
+
+// testRequest tests that the http.Handler returns the correct message and code
+// for the http.Request.
+func testRequest(t *testing.T, h http.Handler, r *http.Request, es string, esc int) {
 	rec := httptest.NewRecorder()
-	h.ServeHTTP(rec, &http.Request{RemoteAddr: ip + ":"})
+	h.ServeHTTP(rec, r)
 	bs, err := ioutil.ReadAll(rec.Result().Body)
 	if err != nil {
 		t.Error(err)
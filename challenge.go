@@ -0,0 +1,337 @@
+package ban
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChallengeConfig for Bans which challenge clients with proof-of-work instead
+// of banning them.
+type ChallengeConfig struct {
+	// Secret signs challenges and the cookies of clients which solved them.
+	//
+	// Engines sharing a Secret accept each other's cookies. Defaults to a
+	// random Secret for each Engine if not assigned.
+	Secret []byte
+	// Difficulty is the number of leading zero bits the SHA-256 of a
+	// solution must have.
+	//
+	// Defaults to 16 if not assigned.
+	Difficulty int
+	// TTL is how long the cookie of a client which solved a challenge lets
+	// its requests through.
+	//
+	// Defaults to an hour if not assigned.
+	TTL time.Duration
+	// MaxFailures is the number of challenges an IP can be served without
+	// solving them, or wrong solutions it can send, before it is banned.
+	// Failures are forgotten an hour after an IP's last one.
+	//
+	// Defaults to 5 if not assigned.
+	MaxFailures int
+	// CookieName is the name of the cookie of clients which solved a
+	// challenge.
+	//
+	// Defaults to "ban_challenge" if not assigned.
+	CookieName string
+}
+
+// DefaultChallengeConfig which uses a random Secret, a Difficulty of 16, a TTL
+// of an hour, and bans after 5 failures.
+var DefaultChallengeConfig = ChallengeConfig{}
+
+const (
+	// defaultChallengeDifficulty is the Difficulty if none is assigned.
+	defaultChallengeDifficulty = 16
+	// defaultChallengeTTL is the TTL if none is assigned.
+	defaultChallengeTTL = time.Hour
+	// defaultChallengeMaxFailures is the MaxFailures if none is assigned.
+	defaultChallengeMaxFailures = 5
+	// defaultChallengeCookieName is the CookieName if none is assigned.
+	defaultChallengeCookieName = "ban_challenge"
+	// challengeSecretLength is the number of bytes in random Secrets.
+	challengeSecretLength = 32
+	// challengeTimeout is how long a served challenge can be solved for.
+	challengeTimeout = 5 * time.Minute
+	// challengeFailureTTL is how long the failures of an IP are remembered
+	// after its last one.
+	challengeFailureTTL = time.Hour
+	// challengeMinPruneAt is the fewest remembered IPs or solved challenges
+	// at which expired ones are forgotten.
+	challengeMinPruneAt = 1024
+	// challengeHeader holds the challenge a solution is for.
+	challengeHeader = "X-Ban-Challenge"
+	// challengeSolutionHeader holds the solution to a challenge.
+	challengeSolutionHeader = "X-Ban-Solution"
+)
+
+// challenger serves and verifies proof-of-work challenges.
+//
+// Challenges and cookies are signed and bound to the IP they were issued to so
+// they can be verified without remembering them. Only solved challenges are
+// remembered, until they time out, so each can be solved once.
+type challenger struct {
+	secret      []byte
+	difficulty  int
+	ttl         time.Duration
+	maxFailures int
+	cookieName  string
+
+	// mu guards failures, solved, and the times they are pruned at.
+	mu sync.Mutex
+	// failures of each IP since it last solved a challenge.
+	failures map[IP]challengeFailures
+	// failuresPruneAt is the number of IPs in failures at which expired
+	// ones are forgotten.
+	failuresPruneAt int
+	// solved holds the time each solved challenge, by its nonce, times out.
+	solved map[string]time.Time
+	// solvedPruneAt is the number of challenges in solved at which timed out
+	// ones are forgotten.
+	solvedPruneAt int
+}
+
+// challengeFailures is the number of failures of an IP and the time of its
+// last one.
+type challengeFailures struct {
+	count int
+	last  time.Time
+}
+
+// newChallenger with behavior customized by ChallengeConfig.
+func newChallenger(cfg ChallengeConfig) *challenger {
+	secret := cfg.Secret
+	if len(secret) == 0 {
+		secret = make([]byte, challengeSecretLength)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+	}
+	difficulty := cfg.Difficulty
+	if difficulty == 0 {
+		difficulty = defaultChallengeDifficulty
+	}
+	ttl := cfg.TTL
+	if ttl == 0 {
+		ttl = defaultChallengeTTL
+	}
+	maxFailures := cfg.MaxFailures
+	if maxFailures == 0 {
+		maxFailures = defaultChallengeMaxFailures
+	}
+	cookieName := cfg.CookieName
+	if cookieName == "" {
+		cookieName = defaultChallengeCookieName
+	}
+	return &challenger{
+		secret:      secret,
+		difficulty:  difficulty,
+		ttl:         ttl,
+		maxFailures: maxFailures,
+		cookieName:  cookieName,
+
+		failures:        make(map[IP]challengeFailures),
+		failuresPruneAt: challengeMinPruneAt,
+		solved:          make(map[string]time.Time),
+		solvedPruneAt:   challengeMinPruneAt,
+	}
+}
+
+// Passed returns true if the http.Request has a cookie from solving a
+// challenge which is for the IP and hasn't expired.
+func (c *challenger) Passed(r *http.Request, ip IP, now time.Time) bool {
+	cookie, err := r.Cookie(c.cookieName)
+	if err != nil {
+		return false
+	}
+	expiry, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.Unix() >= unix {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(sign(c.secret, "cookie", ip.String(), expiry)))
+}
+
+// Fail records a failure of the IP now.
+//
+// Failures of IPs whose last was more than challengeFailureTTL ago are
+// forgotten whenever the number of IPs with failures doubles.
+//
+// Returns true if the IP has reached the maximum number of failures, in which
+// case its failures are forgotten.
+func (c *challenger) Fail(ip IP, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.failures[ip]
+	if now.Sub(f.last) > challengeFailureTTL {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+	if f.count >= c.maxFailures {
+		delete(c.failures, ip)
+		return true
+	}
+	c.failures[ip] = f
+	if len(c.failures) >= c.failuresPruneAt {
+		for ip, f := range c.failures {
+			if now.Sub(f.last) > challengeFailureTTL {
+				delete(c.failures, ip)
+			}
+		}
+		c.failuresPruneAt = 2*len(c.failures) + challengeMinPruneAt
+	}
+	return false
+}
+
+// Challenge returns a new challenge for the IP.
+//
+// Challenges are the time they were issued, a random nonce, and a signature of
+// both with the IP, separated by periods.
+func (c *challenger) Challenge(ip IP, now time.Time) string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	issued := strconv.FormatInt(now.Unix(), 10)
+	n := hex.EncodeToString(nonce)
+	return issued + "." + n + "." + sign(c.secret, "challenge", ip.String(), issued, n)
+}
+
+// Verify that the solution solves the challenge, which must be for the IP, not
+// have timed out, and not have been solved before.
+//
+// Returns the cookie for the IP and forgets the IP's failures if it does.
+func (c *challenger) Verify(challenge, solution string, ip IP, now time.Time) (*http.Cookie, bool) {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Sub(time.Unix(issued, 0)) > challengeTimeout {
+		return nil, false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(sign(c.secret, "challenge", ip.String(), parts[0], parts[1]))) {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	if leadingZeros(sum[:]) < c.difficulty {
+		return nil, false
+	}
+	if !c.solve(parts[1], ip, time.Unix(issued, 0).Add(challengeTimeout), now) {
+		return nil, false
+	}
+	expiry := strconv.FormatInt(now.Add(c.ttl).Unix(), 10)
+	return &http.Cookie{
+		Name:     c.cookieName,
+		Value:    expiry + "." + sign(c.secret, "cookie", ip.String(), expiry),
+		Path:     "/",
+		MaxAge:   int(c.ttl / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}, true
+}
+
+// solve the challenge with the nonce, which times out at the time, for the IP
+// and forget the IP's failures.
+//
+// Solved challenges which have timed out are forgotten whenever the number of
+// solved challenges doubles.
+//
+// Returns false if the challenge was already solved.
+func (c *challenger) solve(nonce string, ip IP, timeout, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.solved[nonce]; ok {
+		return false
+	}
+	c.solved[nonce] = timeout
+	delete(c.failures, ip)
+	if len(c.solved) >= c.solvedPruneAt {
+		for nonce, timeout := range c.solved {
+			if now.After(timeout) {
+				delete(c.solved, nonce)
+			}
+		}
+		c.solvedPruneAt = 2*len(c.solved) + challengeMinPruneAt
+	}
+	return true
+}
+
+// leadingZeros returns the number of leading zero bits in the bytes.
+func leadingZeros(bs []byte) int {
+	n := 0
+	for _, b := range bs {
+		if b != 0 {
+			for b&0x80 == 0 {
+				n++
+				b <<= 1
+			}
+			return n
+		}
+		n += bitsPerByte
+	}
+	return n
+}
+
+// writeChallenge writes a page which solves the challenge with JavaScript,
+// sends the solution, and reloads to the http.ResponseWriter.
+//
+// The page needs a secure context, like HTTPS or localhost, for the Web Crypto
+// API.
+func writeChallenge(rw http.ResponseWriter, challenge string, difficulty int) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(rw, challengePage, challenge, difficulty, challengeHeader, challengeSolutionHeader)
+}
+
+// challengePage is the page written by writeChallenge formatted with the
+// challenge, difficulty, and header names.
+const challengePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Checking your browser</title></head>
+<body>
+<p>Checking your browser&hellip;</p>
+<noscript>JavaScript is required to continue.</noscript>
+<script>
+(async function() {
+	var challenge = %q, difficulty = %d, encoder = new TextEncoder();
+	function leadingZeros(bs) {
+		var n = 0;
+		for (var i = 0; i < bs.length; i++) {
+			if (bs[i] !== 0) {
+				return n + Math.clz32(bs[i]) - 24;
+			}
+			n += 8;
+		}
+		return n;
+	}
+	var solution = 0;
+	for (;; solution++) {
+		var sum = await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + solution));
+		if (leadingZeros(new Uint8Array(sum)) >= difficulty) {
+			break;
+		}
+	}
+	var headers = {};
+	headers[%q] = challenge;
+	headers[%q] = String(solution);
+	await fetch(location.href, {method: "POST", headers: headers, credentials: "same-origin"});
+	location.reload();
+})();
+</script>
+</body>
+</html>
+`
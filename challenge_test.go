@@ -0,0 +1,222 @@
+package ban
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestChallenge tests that solving a challenge gives a cookie which lets
+// requests from the same IP through.
+func TestChallenge(t *testing.T) {
+	t.Parallel()
+	h := testChallengeHandler(t)
+	rec := testChallengeRequest(h, "1.2.3.4", nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("rec.Code = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	challenge := testParseChallenge(t, rec.Body.String())
+	rec = testChallengeRequest(h, "1.2.3.4", map[string]string{
+		challengeHeader:         challenge,
+		challengeSolutionHeader: testSolveChallenge(challenge, 4),
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("rec.Code = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != defaultChallengeCookieName {
+		t.Fatalf("rec.Result().Cookies() = %v, want a %v cookie", cookies, defaultChallengeCookieName)
+	}
+	cookie := map[string]string{"Cookie": cookies[0].String()}
+	for i := 0; i < 5; i++ {
+		rec = testChallengeRequest(h, "1.2.3.4", cookie)
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+			t.Errorf("rec = %d %q, want %d ok", rec.Code, rec.Body, http.StatusOK)
+		}
+	}
+	rec = testChallengeRequest(h, "5.6.7.8", cookie)
+	if rec.Code != http.StatusForbidden || rec.Body.String() == "ok" {
+		t.Errorf("rec = %d %q, want %d challenge", rec.Code, rec.Body, http.StatusForbidden)
+	}
+}
+
+// TestChallengeEscalation tests that IPs which fail too many challenges are
+// banned.
+func TestChallengeEscalation(t *testing.T) {
+	t.Parallel()
+	h := testChallengeHandler(t)
+	rec := testChallengeRequest(h, "1.2.3.4", nil)
+	challenge := testParseChallenge(t, rec.Body.String())
+	rec = testChallengeRequest(h, "1.2.3.4", map[string]string{
+		challengeHeader:         challenge,
+		challengeSolutionHeader: testFailChallenge(challenge, 4),
+	})
+	if rec.Code != http.StatusForbidden || rec.Body.String() != "bad challenge solution" {
+		t.Errorf("rec = %d %q, want %d bad challenge solution", rec.Code, rec.Body, http.StatusForbidden)
+	}
+	rec = testChallengeRequest(h, "1.2.3.4", nil)
+	if rec.Body.String() != "1.2.3.4 is banned" {
+		t.Errorf("rec.Body = %q, want 1.2.3.4 is banned", rec.Body)
+	}
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	if !h.Engine().Check(ip) {
+		t.Errorf("h.Engine().Check(%v) = false, want true", ip)
+	}
+}
+
+// TestChallengerExpiry tests that challenges time out and cookies expire.
+func TestChallengerExpiry(t *testing.T) {
+	t.Parallel()
+	c := newChallenger(ChallengeConfig{Difficulty: 4, TTL: time.Minute})
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	now := time.Now()
+	challenge := c.Challenge(ip, now)
+	solution := testSolveChallenge(challenge, 4)
+	if _, ok := c.Verify(challenge, solution, ip, now.Add(2*challengeTimeout)); ok {
+		t.Errorf("c.Verify() = true, want false after the timeout")
+	}
+	cookie, ok := c.Verify(challenge, solution, ip, now)
+	if !ok {
+		t.Fatalf("c.Verify() = false, want true")
+	}
+	r := &http.Request{Header: http.Header{"Cookie": {cookie.String()}}}
+	if !c.Passed(r, ip, now) {
+		t.Errorf("c.Passed() = false, want true")
+	}
+	if c.Passed(r, ip, now.Add(2*time.Minute)) {
+		t.Errorf("c.Passed() = true, want false after the TTL")
+	}
+	other := newChallenger(ChallengeConfig{Difficulty: 4})
+	if other.Passed(r, ip, now) {
+		t.Errorf("other.Passed() = true, want false with another Secret")
+	}
+}
+
+// TestChallengeReplay tests that each challenge can only be solved once.
+func TestChallengeReplay(t *testing.T) {
+	t.Parallel()
+	c := newChallenger(ChallengeConfig{Difficulty: 4})
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	now := time.Now()
+	challenge := c.Challenge(ip, now)
+	solution := testSolveChallenge(challenge, 4)
+	if _, ok := c.Verify(challenge, solution, ip, now); !ok {
+		t.Fatalf("c.Verify() = false, want true")
+	}
+	if _, ok := c.Verify(challenge, solution, ip, now.Add(time.Second)); ok {
+		t.Errorf("c.Verify() = true, want false when replayed")
+	}
+}
+
+// TestChallengeFailures tests that failures are forgotten after
+// challengeFailureTTL.
+func TestChallengeFailures(t *testing.T) {
+	t.Parallel()
+	c := newChallenger(ChallengeConfig{MaxFailures: 2})
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	now := time.Now()
+	if c.Fail(ip, now) {
+		t.Errorf("c.Fail() = true, want false after 1 failure")
+	}
+	if c.Fail(ip, now.Add(2*challengeFailureTTL)) {
+		t.Errorf("c.Fail() = true, want false after the first failure expired")
+	}
+	if !c.Fail(ip, now.Add(2*challengeFailureTTL+time.Second)) {
+		t.Errorf("c.Fail() = false, want true after 2 failures")
+	}
+	for i := 0; i < challengeMinPruneAt-1; i++ {
+		c.Fail(NewIPv4IP(IPv4{10, 0, byte(i >> 8), byte(i)}), now)
+	}
+	c.Fail(ip, now.Add(2*challengeFailureTTL))
+	if got := len(c.failures); got != 1 {
+		t.Errorf("len(c.failures) = %d, want 1 after pruning", got)
+	}
+}
+
+// TestChallengeSolutionWithoutChallenge tests that solutions are only verified
+// for http.Requests the Banner challenges.
+func TestChallengeSolutionWithoutChallenge(t *testing.T) {
+	t.Parallel()
+	h := New(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(rw, "ok")
+		}),
+		BannerFunc(func(ip IP, r *http.Request) Ban { return NoBan }),
+		Config{ErrorHandler: func(err error) { t.Error(err) }},
+	)
+	rec := testChallengeRequest(h, "1.2.3.4", map[string]string{
+		challengeHeader:         "bad",
+		challengeSolutionHeader: "bad",
+	})
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("rec = %d %q, want %d ok", rec.Code, rec.Body, http.StatusOK)
+	}
+}
+
+// testChallengeHandler returns a Handler which challenges every IP with a
+// Difficulty of 4 and bans IPs after 3 failures.
+func testChallengeHandler(t *testing.T) *Handler {
+	return New(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(rw, "ok")
+		}),
+		BannerFunc(func(ip IP, r *http.Request) Ban { return ChallengeBan }),
+		Config{
+			ErrorHandler: func(err error) { t.Error(err) },
+			Challenge:    ChallengeConfig{Difficulty: 4, MaxFailures: 3},
+		},
+	)
+}
+
+// testChallengeRequest returns the response of the Handler to an http.Request
+// from the IP with the headers.
+func testChallengeRequest(h http.Handler, ip string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = ip + ":1"
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// challengePattern matches the challenge in a challenge page.
+var challengePattern = regexp.MustCompile(`var challenge = "([^"]+)"`)
+
+// testParseChallenge returns the challenge in the challenge page.
+func testParseChallenge(t *testing.T, page string) string {
+	m := challengePattern.FindStringSubmatch(page)
+	if m == nil {
+		t.Fatalf("page = %q, want a challenge", page)
+	}
+	return m[1]
+}
+
+// testSolveChallenge returns a solution to the challenge with the difficulty.
+func testSolveChallenge(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		sum := sha256.Sum256([]byte(challenge + ":" + solution))
+		if leadingZeros(sum[:]) >= difficulty {
+			return solution
+		}
+	}
+}
+
+// testFailChallenge returns a solution which doesn't solve the challenge with
+// the difficulty.
+func testFailChallenge(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		solution := "wrong" + strconv.Itoa(i)
+		sum := sha256.Sum256([]byte(challenge + ":" + solution))
+		if leadingZeros(sum[:]) < difficulty {
+			return solution
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package ban
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Allowlist returns true if the http.Request from the IP is exempt from being
+// checked for or issued Bans, like one from a verified crawler.
+type Allowlist func(IP, *http.Request) bool
+
+// Resolver resolves the names of IPs and the IPs of names.
+//
+// *net.Resolver is a Resolver.
+type Resolver interface {
+	// LookupAddr returns the names of the address.
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	// LookupHost returns the addresses of the host.
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Crawler is a search engine's crawler whose IPs can be verified by reverse
+// DNS.
+type Crawler struct {
+	// Name of the Crawler.
+	Name string
+	// UserAgent is the case-insensitive substring of the User-Agent headers
+	// of the Crawler's http.Requests.
+	UserAgent string
+	// Domains the names of the Crawler's IPs are in, like "googlebot.com".
+	Domains []string
+}
+
+var (
+	// Googlebot is Google's crawler.
+	Googlebot = Crawler{
+		Name:      "Googlebot",
+		UserAgent: "Googlebot",
+		Domains:   []string{"googlebot.com", "google.com"},
+	}
+	// Bingbot is Microsoft Bing's crawler.
+	Bingbot = Crawler{Name: "Bingbot", UserAgent: "bingbot", Domains: []string{"search.msn.com"}}
+	// Applebot is Apple's crawler.
+	Applebot = Crawler{Name: "Applebot", UserAgent: "Applebot", Domains: []string{"applebot.apple.com"}}
+	// YandexBot is Yandex's crawler.
+	YandexBot = Crawler{
+		Name:      "YandexBot",
+		UserAgent: "YandexBot",
+		Domains:   []string{"yandex.ru", "yandex.net", "yandex.com"},
+	}
+	// Baiduspider is Baidu's crawler.
+	Baiduspider = Crawler{Name: "Baiduspider", UserAgent: "Baiduspider", Domains: []string{"baidu.com", "baidu.jp"}}
+)
+
+// CrawlerVerifierConfig for CrawlerVerifiers.
+type CrawlerVerifierConfig struct {
+	// Crawlers which are verified.
+	//
+	// Defaults to Googlebot, Bingbot, Applebot, YandexBot, and Baiduspider if
+	// not assigned.
+	Crawlers []Crawler
+	// Resolver looks up the names of IPs and the IPs of names.
+	//
+	// Defaults to net.DefaultResolver if not assigned.
+	Resolver Resolver
+	// CacheTTL is how long the result of verifying an IP is remembered.
+	//
+	// Defaults to an hour if not assigned.
+	CacheTTL time.Duration
+	// CacheSize is the most results remembered.
+	//
+	// Defaults to 10000 if not assigned.
+	CacheSize int
+	// Timeout of the lookups verifying an IP.
+	//
+	// Defaults to 5 seconds if not assigned.
+	Timeout time.Duration
+	// SpooferBan is issued by the CrawlerVerifier to IPs which claim to be a
+	// Crawler but aren't.
+	//
+	// Defaults to IPBan if not assigned.
+	SpooferBan Ban
+}
+
+// DefaultCrawlerVerifierConfig which verifies well-known Crawlers with
+// net.DefaultResolver, remembers 10000 results for an hour, and bans spoofers'
+// IPs.
+var DefaultCrawlerVerifierConfig = CrawlerVerifierConfig{}
+
+const (
+	// defaultCrawlerCacheTTL is the CacheTTL if none is assigned.
+	defaultCrawlerCacheTTL = time.Hour
+	// defaultCrawlerCacheSize is the CacheSize if none is assigned.
+	defaultCrawlerCacheSize = 10000
+	// defaultCrawlerTimeout is the Timeout if none is assigned.
+	defaultCrawlerTimeout = 5 * time.Second
+)
+
+// CrawlerVerifier verifies that http.Requests whose User-Agent claims they are
+// from a Crawler are from one.
+//
+// An IP is verified if one of its names is in one of the Crawler's Domains and
+// that name resolves back to the IP, since anyone can make the names of their
+// own IPs claim to be in any domain.
+//
+// Verified is an Allowlist which exempts Crawlers from Bans, and the
+// CrawlerVerifier is a Banner which bans spoofers.
+type CrawlerVerifier struct {
+	crawlers   []Crawler
+	resolver   Resolver
+	cacheTTL   time.Duration
+	cacheSize  int
+	timeout    time.Duration
+	spooferBan Ban
+
+	// mu guards cache and calls.
+	mu sync.Mutex
+	// cache holds the results of verifying IPs as Crawlers by the IP and
+	// the Crawler's Name.
+	cache map[crawlerClaim]crawlerResult
+	// calls holds the verifications in progress so concurrent http.Requests
+	// with the same crawlerClaim share one.
+	calls map[crawlerClaim]*crawlerCall
+}
+
+// crawlerClaim is an IP claiming to be a Crawler.
+type crawlerClaim struct {
+	ip      IP
+	crawler string
+}
+
+// crawlerResult of verifying a crawlerClaim.
+type crawlerResult struct {
+	verified bool
+	expiry   time.Time
+}
+
+// crawlerCall is a verification of a crawlerClaim in progress.
+type crawlerCall struct {
+	// done is closed once verified and err are assigned.
+	done     chan struct{}
+	verified bool
+	err      error
+}
+
+// NewCrawlerVerifier with behavior customized by CrawlerVerifierConfig.
+func NewCrawlerVerifier(cfg CrawlerVerifierConfig) *CrawlerVerifier {
+	crawlers := cfg.Crawlers
+	if crawlers == nil {
+		crawlers = []Crawler{Googlebot, Bingbot, Applebot, YandexBot, Baiduspider}
+	}
+	resolver := cfg.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	cacheTTL := cfg.CacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = defaultCrawlerCacheTTL
+	}
+	cacheSize := cfg.CacheSize
+	if cacheSize == 0 {
+		cacheSize = defaultCrawlerCacheSize
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultCrawlerTimeout
+	}
+	spooferBan := cfg.SpooferBan
+	if spooferBan == (Ban{}) {
+		spooferBan = IPBan
+	}
+	return &CrawlerVerifier{
+		crawlers:   crawlers,
+		resolver:   resolver,
+		cacheTTL:   cacheTTL,
+		cacheSize:  cacheSize,
+		timeout:    timeout,
+		spooferBan: spooferBan,
+		cache:      make(map[crawlerClaim]crawlerResult),
+		calls:      make(map[crawlerClaim]*crawlerCall),
+	}
+}
+
+// Claimed returns the Crawler the User-Agent claims to be and true if it
+// claims to be one.
+func (v *CrawlerVerifier) Claimed(userAgent string) (Crawler, bool) {
+	userAgent = strings.ToLower(userAgent)
+	for _, c := range v.crawlers {
+		if strings.Contains(userAgent, strings.ToLower(c.UserAgent)) {
+			return c, true
+		}
+	}
+	return Crawler{}, false
+}
+
+// Verify returns true if the IP is the Crawler's.
+//
+// Results are remembered for the CacheTTL. Concurrent verifications of the
+// same IP as the same Crawler share one set of lookups.
+//
+// Returns an error, which isn't remembered, if a lookup failed for a reason
+// other than the name or IP not existing, like a timeout, so whether the IP is
+// the Crawler's isn't known.
+func (v *CrawlerVerifier) Verify(ip IP, c Crawler) (bool, error) {
+	claim := crawlerClaim{ip: ip, crawler: c.Name}
+	v.mu.Lock()
+	if result, ok := v.cache[claim]; ok && time.Now().Before(result.expiry) {
+		v.mu.Unlock()
+		return result.verified, nil
+	}
+	if call, ok := v.calls[claim]; ok {
+		v.mu.Unlock()
+		<-call.done
+		return call.verified, call.err
+	}
+	call := &crawlerCall{done: make(chan struct{})}
+	v.calls[claim] = call
+	v.mu.Unlock()
+	call.verified, call.err = v.verify(ip, c)
+	v.mu.Lock()
+	delete(v.calls, claim)
+	if call.err == nil {
+		now := time.Now()
+		if len(v.cache) >= v.cacheSize {
+			v.evictLocked(now)
+		}
+		v.cache[claim] = crawlerResult{verified: call.verified, expiry: now.Add(v.cacheTTL)}
+	}
+	v.mu.Unlock()
+	close(call.done)
+	return call.verified, call.err
+}
+
+// Verified returns true if the http.Request from the IP claims to be from a
+// Crawler and the IP is the Crawler's.
+//
+// Verified is an Allowlist. IPs which can't be verified because a lookup
+// failed aren't exempt.
+func (v *CrawlerVerifier) Verified(ip IP, r *http.Request) bool {
+	c, ok := v.Claimed(r.UserAgent())
+	if !ok {
+		return false
+	}
+	verified, _ := v.Verify(ip, c)
+	return verified
+}
+
+// Ban issues the SpooferBan to the IP if the http.Request claims to be from a
+// Crawler but the IP isn't the Crawler's.
+//
+// IPs which can't be verified because a lookup failed aren't banned, so real
+// Crawlers are never banned because of problems with DNS.
+func (v *CrawlerVerifier) Ban(ip IP, r *http.Request) Ban {
+	c, ok := v.Claimed(r.UserAgent())
+	if !ok {
+		return NoBan
+	}
+	if verified, err := v.Verify(ip, c); verified || err != nil {
+		return NoBan
+	}
+	return v.spooferBan
+}
+
+// verify that one of the names of the IP is in one of the Crawler's Domains
+// and resolves back to the IP.
+//
+// Returns an error if a lookup failed for a reason other than the name or IP
+// not existing.
+func (v *CrawlerVerifier) verify(ip IP, c Crawler) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+	names, err := v.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return false, lookupError(err)
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !inDomains(name, c.Domains) {
+			continue
+		}
+		addrs, err := v.resolver.LookupHost(ctx, name)
+		if err != nil {
+			if err := lookupError(err); err != nil {
+				return false, err
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			if resolved, err := ParseIP(addr); err == nil && resolved == ip {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// evictLocked removes the expired results from the cache, or an arbitrary one
+// if none have expired.
+//
+// The CrawlerVerifier's lock must be held.
+func (v *CrawlerVerifier) evictLocked(now time.Time) {
+	for claim, result := range v.cache {
+		if !now.Before(result.expiry) {
+			delete(v.cache, claim)
+		}
+	}
+	for claim := range v.cache {
+		if len(v.cache) < v.cacheSize {
+			break
+		}
+		delete(v.cache, claim)
+	}
+}
+
+// inDomains returns true if the name is one of the domains or a subdomain of
+// one.
+func inDomains(name string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupError returns nil if the error is from a name or IP not existing and
+// the error otherwise.
+func lookupError(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
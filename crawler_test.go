@@ -0,0 +1,203 @@
+package ban
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// googlebotUserAgent is the User-Agent of Googlebot.
+const googlebotUserAgent = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+
+// TestCrawlerVerifier tests that IPs claiming to be Crawlers are verified by
+// reverse-then-forward DNS and the results are remembered.
+func TestCrawlerVerifier(t *testing.T) {
+	t.Parallel()
+	resolver := newTestResolver()
+	v := NewCrawlerVerifier(CrawlerVerifierConfig{Resolver: resolver})
+	cases := []struct {
+		IP        string
+		UserAgent string
+		Verified  bool
+		Ban       Ban
+	}{
+		{IP: "66.249.66.1", UserAgent: googlebotUserAgent, Verified: true, Ban: NoBan},
+		{IP: "2001:4860:4801::1", UserAgent: googlebotUserAgent, Verified: true, Ban: NoBan},
+		{IP: "1.2.3.4", UserAgent: googlebotUserAgent, Ban: IPBan},
+		{IP: "5.6.7.8", UserAgent: googlebotUserAgent, Ban: IPBan},
+		{IP: "9.9.9.9", UserAgent: googlebotUserAgent, Ban: NoBan},
+		{IP: "35.1.1.1", UserAgent: googlebotUserAgent, Ban: IPBan},
+		{IP: "66.249.66.1", UserAgent: "Mozilla/5.0 (compatible; bingbot/2.0)", Ban: IPBan},
+		{IP: "1.2.3.4", UserAgent: "curl/8.0", Ban: NoBan},
+	}
+	for i := 0; i < 2; i++ {
+		for _, c := range cases {
+			ip, err := ParseIP(c.IP)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("User-Agent", c.UserAgent)
+			if got := v.Verified(ip, r); got != c.Verified {
+				t.Errorf("v.Verified(%s, %s) = %t, want %t", c.IP, c.UserAgent, got, c.Verified)
+			}
+			if got := v.Ban(ip, r); got != c.Ban {
+				t.Errorf("v.Ban(%s, %s) = %v, want %v", c.IP, c.UserAgent, got, c.Ban)
+			}
+		}
+	}
+	if got := resolver.count("1.2.3.4"); got != 1 {
+		t.Errorf("resolver.count(1.2.3.4) = %d, want 1 with the result remembered", got)
+	}
+	if got := resolver.count("9.9.9.9"); got != 4 {
+		t.Errorf("resolver.count(9.9.9.9) = %d, want 4 with failures forgotten", got)
+	}
+}
+
+// TestCrawlerVerifierConcurrent tests that concurrent verifications of an IP
+// share one set of lookups.
+func TestCrawlerVerifierConcurrent(t *testing.T) {
+	t.Parallel()
+	resolver := newTestResolver()
+	resolver.gate = make(chan struct{})
+	v := NewCrawlerVerifier(CrawlerVerifierConfig{Resolver: resolver})
+	ip := NewIPv4IP(IPv4{66, 249, 66, 1})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if verified, err := v.Verify(ip, Googlebot); !verified || err != nil {
+				t.Errorf("v.Verify(%v, Googlebot) = %t, %v, want true, nil", ip, verified, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(resolver.gate)
+	wg.Wait()
+	if got := resolver.count("66.249.66.1"); got != 1 {
+		t.Errorf("resolver.count(66.249.66.1) = %d, want 1", got)
+	}
+}
+
+// TestCrawlerAllowlist tests that verified Crawlers are never banned by a
+// Handler with the CrawlerVerifier as its Allowlist while spoofers are.
+func TestCrawlerAllowlist(t *testing.T) {
+	t.Parallel()
+	v := NewCrawlerVerifier(CrawlerVerifierConfig{Resolver: newTestResolver(), CacheSize: 1})
+	h := New(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		BannerFunc(func(ip IP, r *http.Request) Ban {
+			if r.URL.Path == "/admin" {
+				return IPBan
+			}
+			return v.Ban(ip, r)
+		}),
+		Config{Allowlist: v.Verified, ErrorHandler: func(err error) { t.Error(err) }},
+	)
+	crawler := NewIPv4IP(IPv4{66, 249, 66, 1})
+	if err := h.Engine().Add(&PrefixedIP{ip: crawler, prefixLength: 128}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		IP        string
+		UserAgent string
+		Path      string
+		Want      int
+	}{
+		{IP: "66.249.66.1", UserAgent: googlebotUserAgent, Path: "/admin", Want: http.StatusOK},
+		{IP: "66.249.66.1", UserAgent: "curl/8.0", Path: "/", Want: http.StatusForbidden},
+		{IP: "1.2.3.4", UserAgent: googlebotUserAgent, Path: "/", Want: http.StatusForbidden},
+		{IP: "1.2.3.4", UserAgent: "curl/8.0", Path: "/", Want: http.StatusForbidden},
+		{IP: "5.6.7.8", UserAgent: "curl/8.0", Path: "/", Want: http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, c.Path, nil)
+		r.RemoteAddr = c.IP + ":1"
+		r.Header.Set("User-Agent", c.UserAgent)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != c.Want {
+			t.Errorf("%s %s %s: rec.Code = %d, want %d", c.IP, c.UserAgent, c.Path, rec.Code, c.Want)
+		}
+	}
+	if got := len(v.cache); got != 1 {
+		t.Errorf("len(v.cache) = %d, want 1", got)
+	}
+}
+
+// testResolver is a Resolver of fixed names which counts reverse lookups.
+type testResolver struct {
+	// names holds the names of each address.
+	names map[string][]string
+	// addrs holds the addresses of each name.
+	addrs map[string][]string
+	// gate blocks reverse lookups until it is closed if it isn't nil.
+	gate chan struct{}
+
+	mu sync.Mutex
+	// lookups holds the number of reverse lookups of each address.
+	lookups map[string]int
+}
+
+// newTestResolver where 66.249.66.1 and 2001:4860:4801::1 are Googlebot's,
+// 1.2.3.4 claims to be Googlebot's without resolving back, 5.6.7.8 has a name
+// outside Googlebot's domains, 35.1.1.1 is a cloud VM of Google's customers,
+// and looking up 9.9.9.9 fails.
+func newTestResolver() *testResolver {
+	return &testResolver{
+		names: map[string][]string{
+			"66.249.66.1":       {"crawl-66-249-66-1.googlebot.com."},
+			"2001:4860:4801::1": {"crawl-v6.Googlebot.com."},
+			"1.2.3.4":           {"crawl-1-2-3-4.googlebot.com."},
+			"5.6.7.8":           {"googlebot.com.example.net."},
+			"35.1.1.1":          {"1.1.1.35.bc.googleusercontent.com."},
+		},
+		addrs: map[string][]string{
+			"crawl-66-249-66-1.googlebot.com":   {"66.249.66.1"},
+			"crawl-v6.googlebot.com":            {"2001:4860:4801:0::1"},
+			"crawl-1-2-3-4.googlebot.com":       {"66.249.66.2"},
+			"googlebot.com.example.net":         {"5.6.7.8"},
+			"1.1.1.35.bc.googleusercontent.com": {"35.1.1.1"},
+		},
+		lookups: make(map[string]int),
+	}
+}
+
+// LookupAddr returns the names of the address.
+func (r *testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	r.lookups[addr]++
+	r.mu.Unlock()
+	if r.gate != nil {
+		<-r.gate
+	}
+	if addr == "9.9.9.9" {
+		return nil, errors.New("timeout")
+	}
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+// LookupHost returns the addresses of the host.
+func (r *testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// count of reverse lookups of the address.
+func (r *testResolver) count(addr string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups[addr]
+}
@@ -0,0 +1,289 @@
+package ban
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrBadStoreEntry is returned if the binary form of a StoreEntry is bad.
+var ErrBadStoreEntry = errors.New("bad store entry")
+
+// storeEntryKind is the first byte of the binary form of a StoreEntry which
+// says what it holds.
+type storeEntryKind byte
+
+const (
+	// storeEntryPrefixedIP is the storeEntryKind of PrefixedIPs banned
+	// without a Scope.
+	storeEntryPrefixedIP storeEntryKind = iota
+	// storeEntryScoped is the storeEntryKind of PrefixedIPs banned in a
+	// Scope.
+	storeEntryScoped
+	// storeEntryKey is the storeEntryKind of keys.
+	storeEntryKey
+	// storeEntryFingerprint is the storeEntryKind of fingerprints.
+	storeEntryFingerprint
+)
+
+// MarshalText returns the string form of the IP.
+func (ip IP) MarshalText() ([]byte, error) {
+	return []byte(ip.String()), nil
+}
+
+// UnmarshalText parses the IP from its string form like ParseIP.
+//
+// Returns an error if an IP couldn't be parsed.
+func (ip *IP) UnmarshalText(text []byte) error {
+	parsed, err := ParseIP(string(text))
+	if err != nil {
+		return err
+	}
+	*ip = parsed
+	return nil
+}
+
+// MarshalJSON returns the string form of the IP as a JSON string.
+func (ip IP) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ip.String())
+}
+
+// UnmarshalJSON parses the IP from its string form in a JSON string.
+//
+// A JSON null leaves the IP unchanged.
+//
+// Returns an error if the JSON isn't a string or an IP couldn't be parsed.
+func (ip *IP) UnmarshalJSON(bs []byte) error {
+	if string(bs) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	return ip.UnmarshalText([]byte(s))
+}
+
+// MarshalBinary returns the 4 bytes of IPv4 IPs and the 16 bytes of other IPs.
+func (ip IP) MarshalBinary() ([]byte, error) {
+	if addr, ok := ip.IPv4(); ok {
+		return addr[:], nil
+	}
+	return ip[:], nil
+}
+
+// UnmarshalBinary reads the IP from the form returned by MarshalBinary.
+//
+// Returns an error if the data isn't 4 or 16 bytes long.
+func (ip *IP) UnmarshalBinary(data []byte) error {
+	switch len(data) {
+	case ipv4Length:
+		var addr IPv4
+		copy(addr[:], data)
+		*ip = NewIPv4IP(addr)
+	case ipv6Length:
+		copy(ip[:], data)
+	default:
+		return ErrBadIP
+	}
+	return nil
+}
+
+// MarshalText returns the string form of the PrefixedIP.
+func (p PrefixedIP) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText parses the PrefixedIP from its string form like
+// ParsePrefixedIP.
+//
+// Returns an error if a PrefixedIP couldn't be parsed.
+func (p *PrefixedIP) UnmarshalText(text []byte) error {
+	parsed, err := ParsePrefixedIP(string(text))
+	if err != nil {
+		return err
+	}
+	*p = *parsed
+	return nil
+}
+
+// MarshalJSON returns the string form of the PrefixedIP as a JSON string.
+func (p PrefixedIP) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON parses the PrefixedIP from its string form in a JSON string.
+//
+// A JSON null leaves the PrefixedIP unchanged.
+//
+// Returns an error if the JSON isn't a string or a PrefixedIP couldn't be
+// parsed.
+func (p *PrefixedIP) UnmarshalJSON(bs []byte) error {
+	if string(bs) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	return p.UnmarshalText([]byte(s))
+}
+
+// MarshalBinary returns the binary form of the masked IP followed by a byte
+// holding the prefix-length.
+//
+// IPv4 PrefixedIPs are 5 bytes with an IPv4-native prefix-length. Other
+// PrefixedIPs are 17 bytes with a prefix-length out of 128 bits.
+func (p PrefixedIP) MarshalBinary() ([]byte, error) {
+	if p.IsIPv4() {
+		addr, _ := p.IP().IPv4()
+		return append(addr[:], p.PrefixLength()), nil
+	}
+	ip := p.IP()
+	return append(ip[:], p.prefixLength), nil
+}
+
+// UnmarshalBinary reads the PrefixedIP from the form returned by
+// MarshalBinary.
+//
+// Returns an error if the data isn't 5 or 17 bytes long or has a bad
+// prefix-length.
+func (p *PrefixedIP) UnmarshalBinary(data []byte) error {
+	var parsed *PrefixedIP
+	var err error
+	switch len(data) {
+	case ipv4Length + 1:
+		var addr IPv4
+		copy(addr[:], data)
+		parsed, err = NewIPv4PrefixedIP(addr, data[ipv4Length])
+	case ipv6Length + 1:
+		var ip IP
+		copy(ip[:], data)
+		parsed, err = newLegacyPrefixedIP(ip, data[ipv6Length])
+	default:
+		return ErrBadPrefixedIP
+	}
+	if err != nil {
+		return err
+	}
+	*p = *parsed
+	return nil
+}
+
+// MarshalBinary returns the compact binary form of the StoreEntry including its
+// Expiry and Meta.
+//
+// The form is a byte saying whether the StoreEntry holds a PrefixedIP,
+// PrefixedIP in a Scope, key, or fingerprint, followed by what it holds, the
+// Expiry in nanoseconds since the Unix epoch or 0, and the Meta. Strings are
+// prefixed by their length as a uvarint.
+func (e StoreEntry) MarshalBinary() ([]byte, error) {
+	var data []byte
+	if kind, key, ok := e.keyOf(); ok {
+		k := storeEntryKey
+		if kind == fingerprintKey {
+			k = storeEntryFingerprint
+		}
+		data = appendBinaryString(append(data, byte(k)), key)
+	} else {
+		if e.PrefixedIP == nil {
+			return nil, ErrBadStoreEntry
+		}
+		if scope := e.scopeKey(); scope != "" {
+			data = appendBinaryString(append(data, byte(storeEntryScoped)), scope)
+		} else {
+			data = append(data, byte(storeEntryPrefixedIP))
+		}
+		pip, _ := e.PrefixedIP.MarshalBinary()
+		data = append(append(data, byte(len(pip))), pip...)
+	}
+	var expiry int64
+	if !e.Expiry.IsZero() {
+		expiry = e.Expiry.UnixNano()
+	}
+	data = binary.AppendVarint(data, expiry)
+	data = appendBinaryString(data, e.Meta.Reason)
+	return appendBinaryString(data, e.Meta.Issuer), nil
+}
+
+// UnmarshalBinary reads the StoreEntry from the form returned by
+// MarshalBinary.
+//
+// Returns ErrBadStoreEntry if the data isn't the binary form of a StoreEntry or
+// an error if its PrefixedIP or Scope is bad.
+func (e *StoreEntry) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return ErrBadStoreEntry
+	}
+	kind, data := storeEntryKind(data[0]), data[1:]
+	var entry StoreEntry
+	var ok bool
+	switch kind {
+	case storeEntryKey, storeEntryFingerprint:
+		var key string
+		if key, data, ok = readBinaryString(data); !ok || key == "" {
+			return ErrBadStoreEntry
+		}
+		entry = StoreEntry{Key: key}
+		if kind == storeEntryFingerprint {
+			entry = StoreEntry{Fingerprint: key}
+		}
+	case storeEntryPrefixedIP, storeEntryScoped:
+		if kind == storeEntryScoped {
+			var s string
+			if s, data, ok = readBinaryString(data); !ok {
+				return ErrBadStoreEntry
+			}
+			scope, err := parseScope(s)
+			if err != nil || s == "" {
+				return ErrBadScope
+			}
+			entry.Scope = &scope
+		}
+		if len(data) == 0 || len(data) < 1+int(data[0]) {
+			return ErrBadStoreEntry
+		}
+		entry.PrefixedIP = &PrefixedIP{}
+		if err := entry.PrefixedIP.UnmarshalBinary(data[1 : 1+data[0]]); err != nil {
+			return err
+		}
+		data = data[1+data[0]:]
+	default:
+		return ErrBadStoreEntry
+	}
+	expiry, n := binary.Varint(data)
+	if n <= 0 {
+		return ErrBadStoreEntry
+	}
+	if expiry != 0 {
+		entry.Expiry = time.Unix(0, expiry)
+	}
+	if entry.Meta.Reason, data, ok = readBinaryString(data[n:]); !ok {
+		return ErrBadStoreEntry
+	}
+	if entry.Meta.Issuer, data, ok = readBinaryString(data); !ok || len(data) != 0 {
+		return ErrBadStoreEntry
+	}
+	*e = entry
+	return nil
+}
+
+// appendBinaryString appends the string prefixed by its length as a uvarint to
+// the data.
+func appendBinaryString(data []byte, s string) []byte {
+	return append(binary.AppendUvarint(data, uint64(len(s))), s...)
+}
+
+// readBinaryString reads a string appended by appendBinaryString from the
+// data.
+//
+// Returns the string, the rest of the data, and false if the data doesn't
+// start with a string.
+func readBinaryString(data []byte) (string, []byte, bool) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return "", nil, false
+	}
+	return string(data[n : n+int(size)]), data[n+int(size):], true
+}
@@ -0,0 +1,271 @@
+package ban
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// encodingIPs are string forms of IPs round-tripped through the encodings.
+var encodingIPs = []string{"1.2.3.4", "0.0.0.0", "::", "::1", "fe80::1", "101::101:101:101:0:0"}
+
+// encodingPrefixedIPs are string forms of PrefixedIPs round-tripped through the
+// encodings.
+var encodingPrefixedIPs = []string{
+	"1.2.3.4/32", "1.2.3.0/24", "0.0.0.0/0", "::/0", "::1/128", "::fffe:0:0/95",
+}
+
+// TestIPText tests that IPs round-trip through their text form.
+func TestIPText(t *testing.T) {
+	t.Parallel()
+	for _, s := range encodingIPs {
+		ip, err := ParseIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		text, err := ip.MarshalText()
+		if err != nil {
+			t.Error(err)
+		}
+		if string(text) != s {
+			t.Errorf("ip.MarshalText() = %s, want %s", text, s)
+		}
+		var got IP
+		if err := got.UnmarshalText(text); err != nil {
+			t.Error(err)
+		}
+		if got != ip {
+			t.Errorf("ip.UnmarshalText(%s) = %v, want %v", text, got, ip)
+		}
+	}
+	var ip IP
+	if err := ip.UnmarshalText([]byte("bad")); err != ErrBadIP {
+		t.Errorf("ip.UnmarshalText(bad) = %v, want ErrBadIP", err)
+	}
+}
+
+// TestIPJSON tests that IPs round-trip through JSON when embedded in other
+// values.
+func TestIPJSON(t *testing.T) {
+	t.Parallel()
+	type payload struct {
+		IP  IP
+		IPs []IP
+	}
+	for _, s := range encodingIPs {
+		ip, err := ParseIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		bs, err := json.Marshal(payload{IP: ip, IPs: []IP{ip}})
+		if err != nil {
+			t.Error(err)
+		}
+		if es := `{"IP":"` + s + `","IPs":["` + s + `"]}`; string(bs) != es {
+			t.Errorf("json.Marshal() = %s, want %s", bs, es)
+		}
+		var got payload
+		if err := json.Unmarshal(bs, &got); err != nil {
+			t.Error(err)
+		}
+		if got.IP != ip || len(got.IPs) != 1 || got.IPs[0] != ip {
+			t.Errorf("json.Unmarshal(%s) = %v, want %v", bs, got, ip)
+		}
+	}
+	var ip IP
+	if err := json.Unmarshal([]byte(`"bad"`), &ip); err != ErrBadIP {
+		t.Errorf("json.Unmarshal(bad) = %v, want ErrBadIP", err)
+	}
+	if err := json.Unmarshal([]byte(`1`), &ip); err == nil {
+		t.Errorf("json.Unmarshal(1) = nil, want error")
+	}
+}
+
+// TestIPBinary tests that IPs round-trip through their compact binary form.
+func TestIPBinary(t *testing.T) {
+	t.Parallel()
+	for _, s := range encodingIPs {
+		ip, err := ParseIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		data, err := ip.MarshalBinary()
+		if err != nil {
+			t.Error(err)
+		}
+		el := ipv6Length
+		if _, ok := ip.IPv4(); ok {
+			el = ipv4Length
+		}
+		if len(data) != el {
+			t.Errorf("len(ip.MarshalBinary()) = %d, want %d", len(data), el)
+		}
+		var got IP
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Error(err)
+		}
+		if got != ip {
+			t.Errorf("ip.UnmarshalBinary(%v) = %v, want %v", data, got, ip)
+		}
+	}
+	var ip IP
+	if err := ip.UnmarshalBinary([]byte{1, 2, 3}); err != ErrBadIP {
+		t.Errorf("ip.UnmarshalBinary(3 bytes) = %v, want ErrBadIP", err)
+	}
+}
+
+// TestPrefixedIPText tests that PrefixedIPs round-trip through their text
+// form.
+func TestPrefixedIPText(t *testing.T) {
+	t.Parallel()
+	for _, s := range encodingPrefixedIPs {
+		pip, err := ParsePrefixedIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		text, err := pip.MarshalText()
+		if err != nil {
+			t.Error(err)
+		}
+		if string(text) != s {
+			t.Errorf("pip.MarshalText() = %s, want %s", text, s)
+		}
+		var got PrefixedIP
+		if err := got.UnmarshalText(text); err != nil {
+			t.Error(err)
+		}
+		if got.String() != pip.String() {
+			t.Errorf("pip.UnmarshalText(%s) = %v, want %v", text, &got, pip)
+		}
+	}
+	var pip PrefixedIP
+	if err := pip.UnmarshalText([]byte("1.2.3.4/33")); err != ErrBadIPv4PrefixLength {
+		t.Errorf(
+			"pip.UnmarshalText(1.2.3.4/33) = %v, want %v",
+			err, ErrBadIPv4PrefixLength,
+		)
+	}
+}
+
+// TestPrefixedIPJSON tests that PrefixedIPs round-trip through JSON when
+// embedded in other values.
+func TestPrefixedIPJSON(t *testing.T) {
+	t.Parallel()
+	type payload struct {
+		PrefixedIP  *PrefixedIP
+		PrefixedIPs []PrefixedIP
+		Value       PrefixedIP
+	}
+	for _, s := range encodingPrefixedIPs {
+		pip, err := ParsePrefixedIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		bs, err := json.Marshal(payload{PrefixedIP: pip, PrefixedIPs: []PrefixedIP{*pip}, Value: *pip})
+		if err != nil {
+			t.Error(err)
+		}
+		if es := `{"PrefixedIP":"` + s + `","PrefixedIPs":["` + s + `"],"Value":"` + s + `"}`; string(bs) != es {
+			t.Errorf("json.Marshal() = %s, want %s", bs, es)
+		}
+		var got payload
+		if err := json.Unmarshal(bs, &got); err != nil {
+			t.Error(err)
+		}
+		if got.PrefixedIP == nil || got.PrefixedIP.String() != s ||
+			len(got.PrefixedIPs) != 1 || got.PrefixedIPs[0].String() != s || got.Value.String() != s {
+			t.Errorf("json.Unmarshal(%s) = %v, want %v", bs, got, pip)
+		}
+	}
+	var pip PrefixedIP
+	if err := json.Unmarshal([]byte(`"1.2.3.4"`), &pip); err != ErrBadPrefixedIP {
+		t.Errorf("json.Unmarshal(1.2.3.4) = %v, want ErrBadPrefixedIP", err)
+	}
+}
+
+// TestPrefixedIPBinary tests that PrefixedIPs round-trip through their compact
+// binary form.
+func TestPrefixedIPBinary(t *testing.T) {
+	t.Parallel()
+	for _, s := range encodingPrefixedIPs {
+		pip, err := ParsePrefixedIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		data, err := pip.MarshalBinary()
+		if err != nil {
+			t.Error(err)
+		}
+		el := ipv6Length + 1
+		if pip.IsIPv4() {
+			el = ipv4Length + 1
+		}
+		if len(data) != el {
+			t.Errorf("len(pip.MarshalBinary()) = %d, want %d", len(data), el)
+		}
+		var got PrefixedIP
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Error(err)
+		}
+		if got.String() != pip.String() {
+			t.Errorf("pip.UnmarshalBinary(%v) = %v, want %v", data, &got, pip)
+		}
+	}
+	var pip PrefixedIP
+	if err := pip.UnmarshalBinary([]byte{1, 2, 3, 4, 33}); err != ErrBadIPv4PrefixLength {
+		t.Errorf(
+			"pip.UnmarshalBinary(1.2.3.4/33) = %v, want %v",
+			err, ErrBadIPv4PrefixLength,
+		)
+	}
+	if err := pip.UnmarshalBinary([]byte{1, 2, 3}); err != ErrBadPrefixedIP {
+		t.Errorf("pip.UnmarshalBinary(3 bytes) = %v, want ErrBadPrefixedIP", err)
+	}
+}
+
+// TestStoreEntryBinary tests that StoreEntries round-trip through their compact
+// binary form with their Expiry and Meta.
+func TestStoreEntryBinary(t *testing.T) {
+	t.Parallel()
+	v4, err := ParsePrefixedIP("1.2.3.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v6, err := ParsePrefixedIP("fe80::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Unix(1700000000, 123456789)
+	meta := Meta{Reason: "scanner", Issuer: "http"}
+	for _, entry := range []StoreEntry{
+		{PrefixedIP: v4},
+		{PrefixedIP: v6, Expiry: expiry, Meta: meta},
+		{PrefixedIP: v4, Scope: &Scope{Host: "a.com", Methods: []string{"POST"}}, Expiry: expiry},
+		{Key: "k", Meta: meta},
+		{Fingerprint: "f"},
+	} {
+		data, err := entry.MarshalBinary()
+		if err != nil {
+			t.Error(err)
+		}
+		var got StoreEntry
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Error(err)
+		}
+		if got.String() != entry.String() || !got.Expiry.Equal(entry.Expiry) || got.Meta != entry.Meta {
+			t.Errorf(
+				"entry.UnmarshalBinary(%v) = %v %v %v, want %v %v %v",
+				data, got, got.Expiry, got.Meta, entry, entry.Expiry, entry.Meta,
+			)
+		}
+	}
+	if _, err := (StoreEntry{}).MarshalBinary(); err != ErrBadStoreEntry {
+		t.Errorf("StoreEntry{}.MarshalBinary() = %v, want ErrBadStoreEntry", err)
+	}
+	var entry StoreEntry
+	for _, data := range [][]byte{nil, {9}, {byte(storeEntryKey), 5, 'k'}, {byte(storeEntryPrefixedIP), 5, 1, 2}} {
+		if err := entry.UnmarshalBinary(data); err != ErrBadStoreEntry {
+			t.Errorf("entry.UnmarshalBinary(%v) = %v, want ErrBadStoreEntry", data, err)
+		}
+	}
+}
@@ -0,0 +1,862 @@
+package ban
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Meta describes why a Ban was issued.
+type Meta struct {
+	// Reason the Ban was issued, like the rule which matched.
+	Reason string
+	// Issuer of the Ban, like the protocol server which issued it.
+	Issuer string
+}
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventIssue happens when a PrefixedIP, key, or fingerprint is banned.
+	EventIssue EventType = iota
+	// EventUnban happens when a PrefixedIP, key, or fingerprint is unbanned.
+	EventUnban
+	// EventBlock happens when a banned IP, key, or fingerprint is checked.
+	EventBlock
+)
+
+// keyKind is the kind of identity a banned key is.
+type keyKind string
+
+const (
+	// requestKey is the keyKind of keys found in http.Requests by a
+	// KeyExtractor.
+	requestKey keyKind = "key"
+	// fingerprintKey is the keyKind of TLS ClientHello fingerprints.
+	fingerprintKey keyKind = "fingerprint"
+)
+
+// String name of the EventType.
+func (t EventType) String() string {
+	switch t {
+	case EventIssue:
+		return "issue"
+	case EventUnban:
+		return "unban"
+	case EventBlock:
+		return "block"
+	}
+	return "unknown"
+}
+
+// Event which happened in an Engine.
+type Event struct {
+	Type EventType
+	// IP the Event happened for.
+	//
+	// Is the zero IP for EventIssues from Add, for EventUnbans, and for
+	// Events about keys and fingerprints.
+	IP IP
+	// PrefixedIP that was banned or unbanned.
+	//
+	// Is nil for EventBlocks and Events about keys and fingerprints.
+	PrefixedIP *PrefixedIP
+	// Scope the PrefixedIP was banned in.
+	//
+	// Is nil for Events about PrefixedIPs banned without a Scope and Events
+	// about keys and fingerprints.
+	Scope *Scope
+	// Key the Event happened for, as its hash with the KeySecret.
+	//
+	// Is only assigned for Events about keys.
+	Key string
+	// Fingerprint the Event happened for.
+	//
+	// Is only assigned for Events about TLS ClientHello fingerprints.
+	Fingerprint string
+	// Meta the PrefixedIP, key, or fingerprint was banned with.
+	//
+	// Is only assigned for EventIssues from Issue, IssueKey, and
+	// IssueFingerprint.
+	Meta Meta
+	// Expiry after which the banned PrefixedIP, key, or fingerprint is
+	// unbanned.
+	//
+	// Is only assigned for EventIssues of StoreEntries which expire.
+	Expiry time.Time
+}
+
+// Hook is called with every Event which happens in an Engine.
+//
+// Hooks are called synchronously after the Event has happened, so they
+// shouldn't block.
+type Hook func(Event)
+
+// Engine tracks, checks, and stores Bans independently of any protocol.
+//
+// Handler adapts an Engine to net/http, and servers for other protocols can
+// share an Engine so Bans issued by any of them are enforced by all of them.
+type Engine struct {
+	errorHandler ErrorHandler
+	keyExtractor KeyExtractor
+	// keySecret keys the hashes keys are banned as.
+	keySecret  []byte
+	allowlist  Allowlist
+	challenger *challenger
+	// tarpit is nil if banned clients are rejected immediately.
+	tarpit *tarpit
+	store  Store
+
+	// mu guards ips, version, scoped, keys, expiries, expiring, feeds,
+	// feedIPs, feedCounts, and hooks.
+	mu  sync.RWMutex
+	ips ipMap
+	// version is incremented every time ips or feedIPs changes.
+	version uint64
+	// scoped holds the IPs banned in each Scope by the Scope's String form.
+	scoped map[string]*scopedIPs
+	keys   map[keyKind]map[string]bool
+	// expiries holds the Expiry of each banned PrefixedIP, key, and
+	// fingerprint which expires by the String form of its StoreEntry.
+	expiries map[string]time.Time
+	// expiring orders the expirations of banned StoreEntries, including ones
+	// which have since been unbanned or extended.
+	expiring expirations
+	// feeds holds the PrefixedIPs of each Feed by its name and the String form
+	// of each PrefixedIP.
+	feeds map[string]map[string]*PrefixedIP
+	// feedIPs holds the PrefixedIPs of every Feed.
+	feedIPs ipMap
+	// feedCounts holds the number of Feeds listing each PrefixedIP by its
+	// String form.
+	feedCounts map[string]int
+	hooks      []Hook
+}
+
+// scopedIPs are the IPs banned in a Scope.
+type scopedIPs struct {
+	scope Scope
+	ips   ipMap
+}
+
+// NewEngine with behavior customized by Config.
+//
+// Bans in the store are loaded before it is returned, and changes to
+// SharedStores made by others are applied as they happen.
+func NewEngine(cfg Config) *Engine {
+	store := cfg.Store
+	if store == nil && cfg.StorePath != "" {
+		store = NewFileStore(cfg.StorePath)
+	}
+	errorHandler := cfg.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = StderrErrorHandler
+	}
+	keySecret := cfg.KeySecret
+	if len(keySecret) == 0 {
+		keySecret = make([]byte, keySecretLength)
+		if _, err := rand.Read(keySecret); err != nil {
+			panic(err)
+		}
+	}
+	var tarpit *tarpit
+	if cfg.Tarpit != nil {
+		tarpit = newTarpit(*cfg.Tarpit)
+	}
+	e := &Engine{
+		errorHandler: errorHandler,
+		keyExtractor: cfg.KeyExtractor,
+		keySecret:    keySecret,
+		allowlist:    cfg.Allowlist,
+		challenger:   newChallenger(cfg.Challenge),
+		tarpit:       tarpit,
+		store:        store,
+		ips:          newTrie(),
+		scoped:       make(map[string]*scopedIPs),
+		keys: map[keyKind]map[string]bool{
+			requestKey:     make(map[string]bool),
+			fingerprintKey: make(map[string]bool),
+		},
+		expiries:   make(map[string]time.Time),
+		feeds:      make(map[string]map[string]*PrefixedIP),
+		feedIPs:    newTrie(),
+		feedCounts: make(map[string]int),
+	}
+	if e.store != nil {
+		if err := e.load(); err != nil {
+			e.errorHandler(err)
+		}
+	}
+	if shared, ok := e.store.(SharedStore); ok {
+		shared.Watch(e.applyShared)
+	}
+	return e
+}
+
+// Handler that wraps the http.Handler to check for Bans in the Engine and
+// issue Bans from the Banner into it.
+func (e *Engine) Handler(h http.Handler, banner Banner) *Handler {
+	return &Handler{handler: h, banner: banner, engine: e}
+}
+
+// OnEvent adds the Hook to be called with every later Event.
+func (e *Engine) OnEvent(hook Hook) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.hooks = append(e.hooks, hook)
+}
+
+// Check returns true if the IP is banned without a Scope or by a Feed.
+//
+// An EventBlock happens if it is.
+func (e *Engine) Check(ip IP) bool {
+	e.expire(time.Now())
+	e.mu.RLock()
+	banned := e.ips.Has(ip) || e.feedIPs.Has(ip)
+	hooks := e.hooks
+	e.mu.RUnlock()
+	if banned {
+		fire(hooks, Event{Type: EventBlock, IP: ip})
+	}
+	return banned
+}
+
+// CheckScoped returns true if the IP is banned in a Scope which matches a
+// request for the host using the method to the path.
+//
+// IPs banned without a Scope aren't checked. An EventBlock happens if the IP is
+// banned.
+func (e *Engine) CheckScoped(ip IP, host, method, path string) bool {
+	e.expire(time.Now())
+	e.mu.RLock()
+	var scope *Scope
+	for _, s := range e.scoped {
+		if s.scope.Matches(host, method, path) && s.ips.Has(ip) {
+			scope = &s.scope
+			break
+		}
+	}
+	hooks := e.hooks
+	e.mu.RUnlock()
+	if scope != nil {
+		fire(hooks, Event{Type: EventBlock, IP: ip, Scope: scope})
+	}
+	return scope != nil
+}
+
+// Issue the Ban to the IP with the Meta.
+//
+// Bans with a Scope are only checked by CheckScoped. Bans with a duration
+// expire after it unless the PrefixedIP is already banned for longer.
+//
+// Returns the banned PrefixedIP, which is nil for NoBan, and an error if the
+// Ban has a bad prefix-length for the IP's family or if writing to the store
+// failed. The PrefixedIP is banned even if writing to the store failed.
+func (e *Engine) Issue(ip IP, b Ban, meta Meta) (*PrefixedIP, error) {
+	pip, err := b.PrefixedIP(ip)
+	if pip == nil || err != nil {
+		return nil, err
+	}
+	entry := StoreEntry{PrefixedIP: pip}
+	if b.scope != "" {
+		scope, err := parseScope(b.scope)
+		if err != nil {
+			return nil, err
+		}
+		entry.Scope = &scope
+	}
+	if b.duration > 0 {
+		entry.Expiry = time.Now().Add(b.duration)
+	}
+	return pip, e.issueEntry(entry, ip, meta, true)
+}
+
+// Add the PrefixedIPs as Bans.
+//
+// The PrefixedIPs are written to the store like issued Bans, so seeding the
+// Engine from an imported ban list only needs to be done once. BatchStores are
+// written to at once. Hooks are only passed EventIssues for the PrefixedIPs
+// which weren't already banned.
+//
+// Returns any error that happened during writing.
+func (e *Engine) Add(pips ...*PrefixedIP) error {
+	var changed []StoreEntry
+	e.mu.Lock()
+	for _, pip := range pips {
+		entry, ok, _ := e.banLocked(StoreEntry{PrefixedIP: pip})
+		if ok {
+			changed = append(changed, entry)
+		}
+	}
+	hooks := e.hooks
+	e.mu.Unlock()
+	for _, entry := range changed {
+		fire(hooks, entryEvent(EventIssue, entry, IP{}, Meta{}))
+	}
+	if e.store == nil || len(changed) == 0 {
+		return nil
+	}
+	if batch, ok := e.store.(BatchStore); ok {
+		return batch.AddAll(changed)
+	}
+	for _, entry := range changed {
+		if err := e.store.Add(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unban the PrefixedIP.
+//
+// Only the exact PrefixedIP is unbanned, so IPs included by other banned
+// PrefixedIPs stay banned. Nothing happens if the PrefixedIP isn't banned.
+//
+// Returns any error that happened during writing.
+func (e *Engine) Unban(pip *PrefixedIP) error {
+	return e.unbanEntry(StoreEntry{PrefixedIP: pip}, true)
+}
+
+// UnbanIn unbans the PrefixedIP in the Scope.
+//
+// Only the exact PrefixedIP is unbanned, like in Unban.
+//
+// Returns any error that happened during writing.
+func (e *Engine) UnbanIn(pip *PrefixedIP, scope Scope) error {
+	return e.unbanEntry(StoreEntry{PrefixedIP: pip, Scope: &scope}, true)
+}
+
+// PrefixedIPsIn returns the PrefixedIPs that are banned in the Scope, ordered
+// like PrefixedIPs.
+func (e *Engine) PrefixedIPsIn(scope Scope) []*PrefixedIP {
+	key := scope.String()
+	if key == "" {
+		return e.PrefixedIPs()
+	}
+	e.expire(time.Now())
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	s, ok := e.scoped[key]
+	if !ok {
+		return nil
+	}
+	return s.ips.PrefixedIPs()
+}
+
+// CheckKey returns true if the key is banned.
+//
+// An EventBlock happens if it is.
+func (e *Engine) CheckKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	return e.checkKey(requestKey, e.hashKey(key))
+}
+
+// IssueKey bans the key, like an API key, user ID, or session, with the Meta.
+//
+// The key is banned as its hash with the KeySecret, which is what Events,
+// stores, and peers get. Empty keys aren't banned.
+//
+// Returns any error that happened during writing. The key is banned even if
+// writing to the store failed.
+func (e *Engine) IssueKey(key string, meta Meta) error {
+	return e.issueKey(requestKey, key, 0, meta)
+}
+
+// UnbanKey unbans the key.
+//
+// Nothing happens if the key isn't banned.
+//
+// Returns any error that happened during writing.
+func (e *Engine) UnbanKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	return e.unbanEntry(keyEntry(requestKey, e.hashKey(key)), true)
+}
+
+// Keys that are banned, as their hashes with the KeySecret, in ascending
+// order.
+func (e *Engine) Keys() []string {
+	return e.keysOf(requestKey)
+}
+
+// CheckFingerprint returns true if the TLS ClientHello fingerprint is banned.
+//
+// An EventBlock happens if it is.
+func (e *Engine) CheckFingerprint(fingerprint string) bool {
+	return e.checkKey(fingerprintKey, fingerprint)
+}
+
+// IssueFingerprint bans the TLS ClientHello fingerprint with the Meta.
+//
+// Empty fingerprints aren't banned.
+//
+// Returns any error that happened during writing. The fingerprint is banned
+// even if writing to the store failed.
+func (e *Engine) IssueFingerprint(fingerprint string, meta Meta) error {
+	return e.issueKey(fingerprintKey, fingerprint, 0, meta)
+}
+
+// UnbanFingerprint unbans the TLS ClientHello fingerprint.
+//
+// Nothing happens if the fingerprint isn't banned.
+//
+// Returns any error that happened during writing.
+func (e *Engine) UnbanFingerprint(fingerprint string) error {
+	if fingerprint == "" {
+		return nil
+	}
+	return e.unbanEntry(keyEntry(fingerprintKey, fingerprint), true)
+}
+
+// Fingerprints that are banned in ascending order.
+func (e *Engine) Fingerprints() []string {
+	return e.keysOf(fingerprintKey)
+}
+
+// PrefixedIPs that are banned, IPv4 before IPv6 and each in ascending order.
+//
+// PrefixedIPs included by shorter banned PrefixedIPs of the same family and
+// PrefixedIPs from Feeds aren't returned.
+func (e *Engine) PrefixedIPs() []*PrefixedIP {
+	e.expire(time.Now())
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.ips.PrefixedIPs()
+}
+
+// issueKey bans the key of the keyKind with the Meta, hashing it if it is a
+// requestKey, for the duration or forever if it is 0.
+//
+// Empty keys aren't banned.
+//
+// Returns any error that happened during writing.
+func (e *Engine) issueKey(kind keyKind, key string, d time.Duration, meta Meta) error {
+	if key == "" {
+		return nil
+	}
+	if kind == requestKey {
+		key = e.hashKey(key)
+	}
+	entry := keyEntry(kind, key)
+	if d > 0 {
+		entry.Expiry = time.Now().Add(d)
+	}
+	return e.issueEntry(entry, IP{}, meta, true)
+}
+
+// issueEntry bans the StoreEntry issued to the IP with the Meta, writing it to
+// the store if persist is true and it changed.
+//
+// Returns any error that happened during writing.
+func (e *Engine) issueEntry(entry StoreEntry, ip IP, meta Meta, persist bool) error {
+	e.mu.Lock()
+	entry, changed, err := e.banLocked(entry)
+	hooks := e.hooks
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	fire(hooks, entryEvent(EventIssue, entry, ip, meta))
+	if !persist || !changed || e.store == nil {
+		return nil
+	}
+	entry.Meta = meta
+	return e.store.Add(entry)
+}
+
+// unbanEntry unbans the StoreEntry, removing it from the store if persist is
+// true and it was banned.
+//
+// Returns any error that happened during writing.
+func (e *Engine) unbanEntry(entry StoreEntry, persist bool) error {
+	e.mu.Lock()
+	entry, removed := e.unbanLocked(entry)
+	hooks := e.hooks
+	e.mu.Unlock()
+	if !removed {
+		return nil
+	}
+	fire(hooks, entryEvent(EventUnban, entry, IP{}, Meta{}))
+	if !persist || e.store == nil {
+		return nil
+	}
+	return e.store.Remove(entry)
+}
+
+// banLocked bans the StoreEntry.
+//
+// StoreEntries keep the later of their Expiries, where never expiring is
+// latest. mu must be held for writing.
+//
+// Returns the StoreEntry with its Scope and Expiry as banned, true if it
+// wasn't banned or its Expiry changed, and ErrBadScope if its Scope is bad.
+func (e *Engine) banLocked(entry StoreEntry) (StoreEntry, bool, error) {
+	entry.Expiry = entry.Expiry.Round(0)
+	var changed bool
+	if kind, key, ok := entry.keyOf(); ok {
+		changed = !e.keys[kind][key]
+		e.keys[kind][key] = true
+	} else {
+		ips := e.ips
+		if key := entry.scopeKey(); key != "" {
+			s, err := e.scopedLocked(key)
+			if err != nil {
+				return entry, false, err
+			}
+			ips, entry.Scope = s.ips, &s.scope
+		} else {
+			entry.Scope = nil
+		}
+		changed = ips.Add(entry.PrefixedIP)
+	}
+	id := entry.String()
+	at, expires := e.expiries[id]
+	switch {
+	case entry.Expiry.IsZero():
+		if expires {
+			delete(e.expiries, id)
+			changed = true
+		}
+	case changed || (expires && entry.Expiry.After(at)):
+		e.expiries[id] = entry.Expiry
+		heap.Push(&e.expiring, expiration{entry: entry, at: entry.Expiry})
+		changed = true
+	case expires:
+		entry.Expiry = at
+	default:
+		entry.Expiry = time.Time{}
+	}
+	if changed && entry.PrefixedIP != nil && entry.Scope == nil {
+		e.version++
+	}
+	return entry, changed, nil
+}
+
+// unbanLocked unbans the StoreEntry.
+//
+// mu must be held for writing.
+//
+// Returns the StoreEntry with its Scope as banned and true if it was banned.
+func (e *Engine) unbanLocked(entry StoreEntry) (StoreEntry, bool) {
+	entry.Expiry = time.Time{}
+	if kind, key, ok := entry.keyOf(); ok {
+		removed := e.keys[kind][key]
+		delete(e.keys[kind], key)
+		delete(e.expiries, entry.String())
+		return entry, removed
+	}
+	ips := e.ips
+	if key := entry.scopeKey(); key != "" {
+		s, ok := e.scoped[key]
+		if !ok {
+			return entry, false
+		}
+		ips, entry.Scope = s.ips, &s.scope
+	} else {
+		entry.Scope = nil
+	}
+	if !ips.Remove(entry.PrefixedIP) {
+		return entry, false
+	}
+	delete(e.expiries, entry.String())
+	if entry.Scope == nil {
+		e.version++
+	}
+	return entry, true
+}
+
+// expire unbans the StoreEntries whose Expiry isn't after now.
+//
+// Expired StoreEntries are removed from the store, and errors that happen
+// during writing are passed to the ErrorHandler.
+func (e *Engine) expire(now time.Time) {
+	e.mu.RLock()
+	due := len(e.expiring) > 0 && !e.expiring[0].at.After(now)
+	e.mu.RUnlock()
+	if !due {
+		return
+	}
+	var expired []StoreEntry
+	e.mu.Lock()
+	for len(e.expiring) > 0 && !e.expiring[0].at.After(now) {
+		x := heap.Pop(&e.expiring).(expiration)
+		if at, ok := e.expiries[x.entry.String()]; !ok || !at.Equal(x.at) {
+			continue
+		}
+		if entry, removed := e.unbanLocked(x.entry); removed {
+			expired = append(expired, entry)
+		}
+	}
+	hooks := e.hooks
+	e.mu.Unlock()
+	for _, entry := range expired {
+		fire(hooks, entryEvent(EventUnban, entry, IP{}, Meta{}))
+		if e.store == nil {
+			continue
+		}
+		if err := e.store.Remove(entry); err != nil {
+			e.errorHandler(err)
+		}
+	}
+}
+
+// applyShared applies the change of the StoreEntry made to the SharedStore by
+// another Engine without writing it back.
+func (e *Engine) applyShared(entry StoreEntry, removed bool) {
+	if removed {
+		e.unbanEntry(entry, false)
+		return
+	}
+	if err := e.issueEntry(entry, IP{}, entry.Meta, false); err != nil {
+		e.errorHandler(err)
+	}
+}
+
+// scopedLocked returns the scopedIPs of the Scope with the String form,
+// creating them if needed.
+//
+// mu must be held for writing.
+//
+// Returns ErrBadScope if the String form can't be parsed.
+func (e *Engine) scopedLocked(key string) (*scopedIPs, error) {
+	if s, ok := e.scoped[key]; ok {
+		return s, nil
+	}
+	scope, err := parseScope(key)
+	if err != nil {
+		return nil, err
+	}
+	s := &scopedIPs{scope: scope, ips: newTrie()}
+	e.scoped[key] = s
+	return s, nil
+}
+
+// checkKey returns true if the key of the keyKind is banned.
+func (e *Engine) checkKey(kind keyKind, key string) bool {
+	e.expire(time.Now())
+	e.mu.RLock()
+	banned := e.keys[kind][key]
+	hooks := e.hooks
+	e.mu.RUnlock()
+	if banned {
+		fire(hooks, entryEvent(EventBlock, keyEntry(kind, key), IP{}, Meta{}))
+	}
+	return banned
+}
+
+// keysOf the keyKind that are banned in ascending order.
+func (e *Engine) keysOf(kind keyKind) []string {
+	e.expire(time.Now())
+	e.mu.RLock()
+	keys := make([]string, 0, len(e.keys[kind]))
+	for key := range e.keys[kind] {
+		keys = append(keys, key)
+	}
+	e.mu.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// snapshot returns the PrefixedIPs banned without a Scope or by a Feed along
+// with the version they are from.
+func (e *Engine) snapshot() ([]*PrefixedIP, uint64) {
+	e.expire(time.Now())
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if len(e.feedCounts) == 0 {
+		return e.ips.PrefixedIPs(), e.version
+	}
+	merged := newTrie()
+	for _, pip := range e.ips.PrefixedIPs() {
+		merged.Add(pip)
+	}
+	for _, pip := range e.feedIPs.PrefixedIPs() {
+		merged.Add(pip)
+	}
+	return merged.PrefixedIPs(), e.version
+}
+
+// addFeed with the name.
+//
+// Returns false if the Engine already has a Feed with the name.
+func (e *Engine) addFeed(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.feeds[name]; ok {
+		return false
+	}
+	e.feeds[name] = make(map[string]*PrefixedIP)
+	return true
+}
+
+// setFeed replaces the PrefixedIPs of the Feed with the name.
+//
+// Returns the number of PrefixedIPs the Feed now has and the number added and
+// removed.
+func (e *Engine) setFeed(name string, pips []*PrefixedIP) (int, int, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old, ok := e.feeds[name]
+	if !ok {
+		return 0, 0, 0
+	}
+	current := make(map[string]*PrefixedIP, len(pips))
+	added, removed := 0, 0
+	for _, pip := range pips {
+		key := pip.String()
+		if _, ok := current[key]; ok {
+			continue
+		}
+		current[key] = pip
+		if _, ok := old[key]; !ok {
+			e.countFeedLocked(key, pip, 1)
+			added++
+		}
+	}
+	for key, pip := range old {
+		if _, ok := current[key]; !ok {
+			e.countFeedLocked(key, pip, -1)
+			removed++
+		}
+	}
+	e.feeds[name] = current
+	return len(current), added, removed
+}
+
+// removeFeed with the name along with its PrefixedIPs.
+func (e *Engine) removeFeed(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, pip := range e.feeds[name] {
+		e.countFeedLocked(key, pip, -1)
+	}
+	delete(e.feeds, name)
+}
+
+// countFeedLocked changes the number of Feeds listing the PrefixedIP with the
+// String form by the delta, adding it to or removing it from feedIPs when the
+// number becomes positive or 0.
+//
+// The Engine's lock must be held.
+func (e *Engine) countFeedLocked(key string, pip *PrefixedIP, delta int) {
+	e.feedCounts[key] += delta
+	switch {
+	case e.feedCounts[key] <= 0:
+		delete(e.feedCounts, key)
+		e.feedIPs.Remove(pip)
+		e.version++
+	case delta > 0 && e.feedCounts[key] == 1:
+		e.feedIPs.Add(pip)
+		e.version++
+	}
+}
+
+// feedPrefixedIPs returns the PrefixedIPs of the Feed with the name, ordered
+// like PrefixedIPs.
+func (e *Engine) feedPrefixedIPs(name string) []*PrefixedIP {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	pips := newTrie()
+	for _, pip := range e.feeds[name] {
+		pips.Add(pip)
+	}
+	return pips.PrefixedIPs()
+}
+
+// load the StoreEntries which haven't expired from the store into the Engine.
+//
+// Returns any error that happened during loading.
+func (e *Engine) load() error {
+	entries, err := e.store.Load()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, entry := range entries {
+		if !entry.Expiry.IsZero() && !entry.Expiry.After(now) {
+			continue
+		}
+		if entry.Key != "" && !isKeyHash(entry.Key) {
+			// Keys stored by earlier versions of the package weren't hashed.
+			entry.Key = e.hashKey(entry.Key)
+		}
+		if _, _, err := e.banLocked(entry); err != nil {
+			return err
+		}
+	}
+	e.version++
+	return nil
+}
+
+// hashKey returns the hash of the key with the KeySecret.
+func (e *Engine) hashKey(key string) string {
+	return HashKey(e.keySecret, key)
+}
+
+// entryEvent returns the Event of the EventType for the StoreEntry issued to
+// the IP with the Meta.
+func entryEvent(t EventType, entry StoreEntry, ip IP, meta Meta) Event {
+	return Event{
+		Type:        t,
+		IP:          ip,
+		PrefixedIP:  entry.PrefixedIP,
+		Scope:       entry.Scope,
+		Key:         entry.Key,
+		Fingerprint: entry.Fingerprint,
+		Meta:        meta,
+		Expiry:      entry.Expiry,
+	}
+}
+
+// fire the Event to the Hooks.
+func fire(hooks []Hook, ev Event) {
+	for _, hook := range hooks {
+		hook(ev)
+	}
+}
+
+// expiration of a banned PrefixedIP at a time.
+type expiration struct {
+	entry StoreEntry
+	at    time.Time
+}
+
+// expirations is a min-heap of expirations ordered by time.
+type expirations []expiration
+
+// Len is the number of expirations.
+func (x expirations) Len() int {
+	return len(x)
+}
+
+// Less returns true if expiration i is before expiration j.
+func (x expirations) Less(i, j int) bool {
+	return x[i].at.Before(x[j].at)
+}
+
+// Swap expirations i and j.
+func (x expirations) Swap(i, j int) {
+	x[i], x[j] = x[j], x[i]
+}
+
+// Push the expiration.
+func (x *expirations) Push(v any) {
+	*x = append(*x, v.(expiration))
+}
+
+// Pop the last expiration.
+func (x *expirations) Pop() any {
+	old := *x
+	v := old[len(old)-1]
+	*x = old[:len(old)-1]
+	return v
+}
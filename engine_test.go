@@ -0,0 +1,214 @@
+package ban
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestEngineIssue tests that Bans issued to an Engine are checked and passed to
+// Hooks.
+func TestEngineIssue(t *testing.T) {
+	t.Parallel()
+	e := NewEngine(Config{ErrorHandler: func(err error) { t.Error(err) }})
+	var events []Event
+	e.OnEvent(func(ev Event) { events = append(events, ev) })
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	if e.Check(ip) {
+		t.Errorf("e.Check(%v) = true, want false", ip)
+	}
+	meta := Meta{Reason: "test", Issuer: "smtp"}
+	if pip, err := e.Issue(ip, NoBan, meta); pip != nil || err != nil {
+		t.Errorf("e.Issue(%v, NoBan) = %v, %v, want nil, nil", ip, pip, err)
+	}
+	pip, err := e.Issue(ip, Ban{PrefixLength: 24}, meta)
+	if err != nil {
+		t.Error(err)
+	}
+	if pip.String() != "1.2.3.0/24" {
+		t.Errorf("e.Issue(%v) = %v, want 1.2.3.0/24", ip, pip)
+	}
+	other := NewIPv4IP(IPv4{1, 2, 3, 5})
+	if !e.Check(other) {
+		t.Errorf("e.Check(%v) = false, want true", other)
+	}
+	if _, err := e.Issue(ip, Ban{PrefixLength: 33}, meta); err != ErrBadIPv4PrefixLength {
+		t.Errorf("e.Issue(%v) = %v, want %v", ip, err, ErrBadIPv4PrefixLength)
+	}
+	want := []Event{
+		{Type: EventIssue, IP: ip, PrefixedIP: pip, Meta: meta},
+		{Type: EventBlock, IP: other},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("events[%d] = %v, want %v", i, events[i], want[i])
+		}
+	}
+}
+
+// TestEngineAdd tests that Hooks are only passed EventIssues for PrefixedIPs
+// added to an Engine which weren't already banned.
+func TestEngineAdd(t *testing.T) {
+	t.Parallel()
+	e := NewEngine(Config{ErrorHandler: func(err error) { t.Error(err) }})
+	var issues int
+	e.OnEvent(func(ev Event) {
+		if ev.Type == EventIssue {
+			issues++
+		}
+	})
+	a, err := ParsePrefixedIP("1.2.3.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParsePrefixedIP("5.6.7.8/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Add(a); err != nil {
+		t.Error(err)
+	}
+	if err := e.Add(a, b); err != nil {
+		t.Error(err)
+	}
+	if issues != 2 {
+		t.Errorf("issues = %d, want 2", issues)
+	}
+}
+
+// TestEngineExpiry tests that Bans issued for a duration are unbanned after it,
+// keep the later of their expiries, and expire after being reloaded from the
+// store.
+func TestEngineExpiry(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if err := os.Remove("expiry_store.txt"); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg := Config{StorePath: "expiry_store.txt", ErrorHandler: func(err error) { t.Error(err) }}
+	e := NewEngine(cfg)
+	var unbans []*PrefixedIP
+	e.OnEvent(func(ev Event) {
+		if ev.Type == EventUnban {
+			unbans = append(unbans, ev.PrefixedIP)
+		}
+	})
+	short := NewIPv4IP(IPv4{1, 1, 1, 1})
+	long := NewIPv4IP(IPv4{2, 2, 2, 2})
+	forever := NewIPv4IP(IPv4{3, 3, 3, 3})
+	issues := []struct {
+		IP  IP
+		Ban Ban
+	}{
+		{IP: short, Ban: IPBan.For(20 * time.Millisecond)},
+		{IP: long, Ban: IPBan.For(time.Hour)},
+		{IP: long, Ban: IPBan.For(time.Millisecond)},
+		{IP: forever, Ban: IPBan.For(time.Millisecond)},
+		{IP: forever, Ban: IPBan},
+	}
+	for _, issue := range issues {
+		if _, err := e.Issue(issue.IP, issue.Ban, Meta{}); err != nil {
+			t.Error(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, c := range []struct {
+		IP   IP
+		Want bool
+	}{{IP: short, Want: false}, {IP: long, Want: true}, {IP: forever, Want: true}} {
+		if got := e.Check(c.IP); got != c.Want {
+			t.Errorf("e.Check(%v) = %t, want %t", c.IP, got, c.Want)
+		}
+	}
+	if len(unbans) != 1 || unbans[0].String() != "1.1.1.1/32" {
+		t.Errorf("unbans = %v, want [1.1.1.1/32]", unbans)
+	}
+	e = NewEngine(cfg)
+	if pips := e.PrefixedIPs(); len(pips) != 2 || pips[0].String() != "2.2.2.2/32" {
+		t.Errorf("e.PrefixedIPs() = %v, want [2.2.2.2/32 3.3.3.3/32]", pips)
+	}
+}
+
+// TestEngineUnban tests that unbanned PrefixedIPs stop being checked, are
+// passed to Hooks, and stay unbanned once reloaded from the store.
+func TestEngineUnban(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if err := os.Remove("unban_store.txt"); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg := Config{StorePath: "unban_store.txt", ErrorHandler: func(err error) { t.Error(err) }}
+	e := NewEngine(cfg)
+	var events []Event
+	e.OnEvent(func(ev Event) { events = append(events, ev) })
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	pip, err := e.Issue(ip, IPBan, Meta{})
+	if err != nil {
+		t.Error(err)
+	}
+	other, err := ParsePrefixedIP("2001:db8::/32")
+	if err != nil {
+		t.Error(err)
+	}
+	if err := e.Add(other); err != nil {
+		t.Error(err)
+	}
+	if err := e.Unban(pip); err != nil {
+		t.Error(err)
+	}
+	if err := e.Unban(pip); err != nil {
+		t.Error(err)
+	}
+	if e.Check(ip) {
+		t.Errorf("e.Check(%v) = true, want false", ip)
+	}
+	if len(events) != 3 || events[2].Type != EventUnban || events[2].PrefixedIP != pip {
+		t.Errorf("events = %v, want an EventUnban for %v last", events, pip)
+	}
+	e = NewEngine(cfg)
+	if e.Check(ip) {
+		t.Errorf("e.Check(%v) = true, want false after reloading", ip)
+	}
+	pips := e.PrefixedIPs()
+	if len(pips) != 1 || pips[0].String() != other.String() {
+		t.Errorf("e.PrefixedIPs() = %v, want [%v]", pips, other)
+	}
+	if _, err := e.Issue(ip, IPBan, Meta{}); err != nil {
+		t.Error(err)
+	}
+	e = NewEngine(cfg)
+	if !e.Check(ip) {
+		t.Errorf("e.Check(%v) = false, want true after reissuing", ip)
+	}
+}
+
+// TestEngineShared tests that Bans issued through a Handler are checked by its
+// Engine.
+func TestEngineShared(t *testing.T) {
+	t.Parallel()
+	e := NewEngine(Config{ErrorHandler: IgnoreErrorHandler})
+	h := e.Handler(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		BannerFunc(func(ip IP, r *http.Request) Ban { return IPBan }),
+	)
+	if h.Engine() != e {
+		t.Errorf("h.Engine() = %p, want %p", h.Engine(), e)
+	}
+	testHandler(t, h, "1.2.3.4", "1.2.3.4 is banned", http.StatusForbidden)
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	if !e.Check(ip) {
+		t.Errorf("e.Check(%v) = false, want true", ip)
+	}
+	if !h.Banned(ip) {
+		t.Errorf("h.Banned(%v) = false, want true", ip)
+	}
+	if pips := h.PrefixedIPs(); len(pips) != 1 || pips[0].String() != "1.2.3.4/32" {
+		t.Errorf("h.PrefixedIPs() = %v, want [1.2.3.4/32]", pips)
+	}
+}
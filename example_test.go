@@ -2,6 +2,7 @@ package ban_test
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/jwowillo/ban"
@@ -33,3 +34,13 @@ func Example() {
 		ban.New(handler, banner, ban.DefaultConfig),
 	)
 }
+
+func ExampleNewListener() {
+	engine := ban.NewEngine(ban.DefaultConfig)
+	handler := engine.Handler(http.HandlerFunc(Handle), ban.BannerFunc(Ban))
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		return
+	}
+	http.Serve(ban.NewListener(l, engine, ban.DefaultListenerConfig), handler)
+}
@@ -0,0 +1,293 @@
+package ban
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format writes PrefixedIPs to an io.Writer in the form of a firewall rule
+// file.
+//
+// Returns an error if the io.Writer fails.
+type Format func(io.Writer, []*PrefixedIP) error
+
+// NftablesFormat writes an nftables script for "nft -f" which defines the
+// table of family inet with interval sets named set+"_v4" and set+"_v6", and
+// replaces their elements with the IPv4 and IPv6 PrefixedIPs.
+//
+// The sets can then be referenced by rules like
+// "ip saddr @banned_v4 drop".
+func NftablesFormat(table, set string) Format {
+	return func(w io.Writer, pips []*PrefixedIP) error {
+		v4, v6 := splitFamilies(pips)
+		bw := bufio.NewWriter(w)
+		fmt.Fprintf(bw, "table inet %s {\n", table)
+		fmt.Fprintf(bw, "\tset %s_v4 {\n\t\ttype ipv4_addr\n\t\tflags interval\n\t}\n", set)
+		fmt.Fprintf(bw, "\tset %s_v6 {\n\t\ttype ipv6_addr\n\t\tflags interval\n\t}\n", set)
+		fmt.Fprintf(bw, "}\n")
+		for _, family := range []struct {
+			Suffix      string
+			PrefixedIPs []*PrefixedIP
+		}{{Suffix: "_v4", PrefixedIPs: v4}, {Suffix: "_v6", PrefixedIPs: v6}} {
+			fmt.Fprintf(bw, "flush set inet %s %s%s\n", table, set, family.Suffix)
+			if len(family.PrefixedIPs) == 0 {
+				continue
+			}
+			elements := make([]string, len(family.PrefixedIPs))
+			for i, pip := range family.PrefixedIPs {
+				elements[i] = pip.String()
+			}
+			fmt.Fprintf(
+				bw, "add element inet %s %s%s { %s }\n",
+				table, set, family.Suffix, strings.Join(elements, ", "),
+			)
+		}
+		return bw.Flush()
+	}
+}
+
+// IPTablesFormat writes an "iptables-restore --noflush" script which replaces
+// the rules of the chain in the filter table with rules dropping the IPv4
+// PrefixedIPs.
+//
+// The chain must be jumped to from a built-in chain like INPUT separately.
+func IPTablesFormat(chain string) Format {
+	return func(w io.Writer, pips []*PrefixedIP) error {
+		v4, _ := splitFamilies(pips)
+		return writeIPTables(w, chain, v4)
+	}
+}
+
+// IP6TablesFormat writes an "ip6tables-restore --noflush" script which
+// replaces the rules of the chain in the filter table with rules dropping the
+// IPv6 PrefixedIPs.
+//
+// The chain must be jumped to from a built-in chain like INPUT separately.
+func IP6TablesFormat(chain string) Format {
+	return func(w io.Writer, pips []*PrefixedIP) error {
+		_, v6 := splitFamilies(pips)
+		return writeIPTables(w, chain, v6)
+	}
+}
+
+// writeIPTables writes the iptables-restore script for the chain and
+// PrefixedIPs.
+func writeIPTables(w io.Writer, chain string, pips []*PrefixedIP) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "*filter\n:%s - [0:0]\n", chain)
+	for _, pip := range pips {
+		fmt.Fprintf(bw, "-A %s -s %v -j DROP\n", chain, pip)
+	}
+	fmt.Fprintf(bw, "COMMIT\n")
+	return bw.Flush()
+}
+
+// IPSetFormat writes an "ipset restore" script which creates the hash:net sets
+// named set+"_v4" and set+"_v6" if they don't exist and replaces their entries
+// with the IPv4 and IPv6 PrefixedIPs.
+//
+// Since hash:net sets can't hold prefix-lengths of 0, those PrefixedIPs are
+// written as both of their halves.
+func IPSetFormat(set string) Format {
+	return func(w io.Writer, pips []*PrefixedIP) error {
+		v4, v6 := splitFamilies(pips)
+		bw := bufio.NewWriter(w)
+		for _, family := range []struct {
+			Suffix      string
+			Family      string
+			PrefixedIPs []*PrefixedIP
+		}{
+			{Suffix: "_v4", Family: "inet", PrefixedIPs: v4},
+			{Suffix: "_v6", Family: "inet6", PrefixedIPs: v6},
+		} {
+			name := set + family.Suffix
+			fmt.Fprintf(bw, "create %s hash:net family %s -exist\n", name, family.Family)
+			fmt.Fprintf(bw, "flush %s\n", name)
+			for _, pip := range family.PrefixedIPs {
+				for _, half := range splitEmptyPrefix(pip) {
+					fmt.Fprintf(bw, "add %s %v\n", name, half)
+				}
+			}
+		}
+		return bw.Flush()
+	}
+}
+
+// NginxFormat writes an nginx include file with a deny directive for every
+// PrefixedIP.
+func NginxFormat(w io.Writer, pips []*PrefixedIP) error {
+	bw := bufio.NewWriter(w)
+	for _, pip := range pips {
+		fmt.Fprintf(bw, "deny %v;\n", pip)
+	}
+	return bw.Flush()
+}
+
+// splitFamilies splits the PrefixedIPs into the IPv4 and IPv6 PrefixedIPs.
+//
+// IPv6 PrefixedIPs which include every IPv4 address are also written as the
+// IPv4 PrefixedIP 0.0.0.0/0, since firewalls match IPv4 traffic by its own
+// family.
+func splitFamilies(pips []*PrefixedIP) ([]*PrefixedIP, []*PrefixedIP) {
+	var v4, v6 []*PrefixedIP
+	includesIPv4, hasEmptyIPv4 := false, false
+	for _, pip := range pips {
+		if pip.IsIPv4() {
+			v4 = append(v4, pip)
+			hasEmptyIPv4 = hasEmptyIPv4 || pip.PrefixLength() == 0
+		} else {
+			v6 = append(v6, pip)
+			includesIPv4 = includesIPv4 || pip.includesIPv4()
+		}
+	}
+	if includesIPv4 && !hasEmptyIPv4 {
+		v4 = append(v4, &PrefixedIP{ip: IP{10: 0xff, 11: 0xff}, prefixLength: ipv4PrefixLength})
+	}
+	return v4, v6
+}
+
+// splitEmptyPrefix returns the two halves of a PrefixedIP with a prefix-length
+// of 0 or the PrefixedIP itself otherwise.
+func splitEmptyPrefix(pip *PrefixedIP) []*PrefixedIP {
+	if pip.PrefixLength() != 0 {
+		return []*PrefixedIP{pip}
+	}
+	low := &PrefixedIP{ip: pip.IP(), prefixLength: pip.prefixLength + 1}
+	high := &PrefixedIP{ip: pip.IP(), prefixLength: pip.prefixLength + 1}
+	i := pip.prefixLength
+	high.ip[i/bitsPerByte] |= 1 << (bitsPerByte - 1 - i%bitsPerByte)
+	return []*PrefixedIP{low, high}
+}
+
+// Exporter periodically writes the Bans of an Engine to a file in a Format
+// so an external reloader can push them to the kernel.
+//
+// The file is only rewritten when the Bans have changed and is replaced
+// atomically, so readers never see a partially written file.
+type Exporter struct {
+	engine   *Engine
+	path     string
+	format   Format
+	interval time.Duration
+
+	// mu guards version and serializes writes.
+	mu sync.Mutex
+	// version of the Engine's Bans last written.
+	version uint64
+	// written is true once the file has been written.
+	written bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// defaultExportInterval is the interval of Exporters if none is given.
+const defaultExportInterval = 10 * time.Second
+
+// NewExporter which writes the Bans of the Engine to the file at path in the
+// Format immediately and then checks for changes every interval.
+//
+// The interval defaults to 10 seconds if it isn't positive. Errors are passed
+// to the Engine's ErrorHandler.
+func NewExporter(engine *Engine, path string, format Format, interval time.Duration) *Exporter {
+	if interval <= 0 {
+		interval = defaultExportInterval
+	}
+	e := &Exporter{
+		engine:   engine,
+		path:     path,
+		format:   format,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if _, err := e.Export(); err != nil {
+		engine.errorHandler(err)
+	}
+	go e.run()
+	return e
+}
+
+// Export writes the Bans to the file if they changed since the last write.
+//
+// Returns true if the file was written and any error that happened during
+// writing.
+func (e *Exporter) Export() (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	pips, version := e.engine.snapshot()
+	if e.written && version == e.version {
+		return false, nil
+	}
+	var buf bytes.Buffer
+	if err := e.format(&buf, pips); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(e.path, buf.Bytes()); err != nil {
+		return false, err
+	}
+	e.version, e.written = version, true
+	return true, nil
+}
+
+// Stop checking for changes.
+//
+// Stopping a stopped Exporter does nothing.
+func (e *Exporter) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stop)
+		<-e.done
+	})
+}
+
+// run exports every interval until stopped.
+func (e *Exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+			if _, err := e.Export(); err != nil {
+				e.engine.errorHandler(err)
+			}
+		}
+	}
+}
+
+// writeFileAtomic replaces the file at path with the data by writing it to a
+// temporary file in the same directory and renaming it.
+//
+// Returns any error that happened during writing.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,156 @@
+package ban
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// exportPrefixedIPs are the string forms of the PrefixedIPs formatted in
+// tests.
+var exportPrefixedIPs = []string{"1.2.3.0/24", "5.6.7.8/32", "2001:db8::/32"}
+
+// TestNftablesFormat tests that NftablesFormat writes the sets and elements.
+func TestNftablesFormat(t *testing.T) {
+	t.Parallel()
+	testFormat(t, NftablesFormat("filter", "banned"), exportPrefixedIPs, `table inet filter {
+	set banned_v4 {
+		type ipv4_addr
+		flags interval
+	}
+	set banned_v6 {
+		type ipv6_addr
+		flags interval
+	}
+}
+flush set inet filter banned_v4
+add element inet filter banned_v4 { 1.2.3.0/24, 5.6.7.8/32 }
+flush set inet filter banned_v6
+add element inet filter banned_v6 { 2001:db8::/32 }
+`)
+	testFormat(t, NftablesFormat("filter", "banned"), []string{"::1/128"}, `table inet filter {
+	set banned_v4 {
+		type ipv4_addr
+		flags interval
+	}
+	set banned_v6 {
+		type ipv6_addr
+		flags interval
+	}
+}
+flush set inet filter banned_v4
+flush set inet filter banned_v6
+add element inet filter banned_v6 { ::1/128 }
+`)
+}
+
+// TestIPTablesFormat tests that IPTablesFormat and IP6TablesFormat write rules
+// for their families.
+func TestIPTablesFormat(t *testing.T) {
+	t.Parallel()
+	testFormat(t, IPTablesFormat("BAN"), exportPrefixedIPs, `*filter
+:BAN - [0:0]
+-A BAN -s 1.2.3.0/24 -j DROP
+-A BAN -s 5.6.7.8/32 -j DROP
+COMMIT
+`)
+	testFormat(t, IP6TablesFormat("BAN"), exportPrefixedIPs, `*filter
+:BAN - [0:0]
+-A BAN -s 2001:db8::/32 -j DROP
+COMMIT
+`)
+}
+
+// TestIPSetFormat tests that IPSetFormat writes sets and entries, splitting
+// prefix-lengths of 0.
+func TestIPSetFormat(t *testing.T) {
+	t.Parallel()
+	testFormat(t, IPSetFormat("banned"), append(exportPrefixedIPs, "0.0.0.0/0", "::/0"), `create banned_v4 hash:net family inet -exist
+flush banned_v4
+add banned_v4 1.2.3.0/24
+add banned_v4 5.6.7.8/32
+add banned_v4 0.0.0.0/1
+add banned_v4 128.0.0.0/1
+create banned_v6 hash:net family inet6 -exist
+flush banned_v6
+add banned_v6 2001:db8::/32
+add banned_v6 ::/1
+add banned_v6 8000::/1
+`)
+}
+
+// TestNginxFormat tests that NginxFormat writes deny directives.
+func TestNginxFormat(t *testing.T) {
+	t.Parallel()
+	testFormat(t, NginxFormat, exportPrefixedIPs, `deny 1.2.3.0/24;
+deny 5.6.7.8/32;
+deny 2001:db8::/32;
+`)
+}
+
+// TestExporter tests that the Exporter writes the Handler's Bans and only
+// rewrites them once they change.
+func TestExporter(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if err := os.Remove("export.conf"); err != nil {
+			t.Error(err)
+		}
+	}()
+	h := New(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		BannerFunc(func(ip IP, r *http.Request) Ban { return IPBan }),
+		Config{ErrorHandler: func(err error) { t.Error(err) }},
+	)
+	e := NewExporter(h.Engine(), "export.conf", NginxFormat, time.Hour)
+	defer e.Stop()
+	testFile(t, "export.conf", "")
+	if written, err := e.Export(); written || err != nil {
+		t.Errorf("e.Export() = %t, %v, want false, nil", written, err)
+	}
+	testHandler(t, h, "1.2.3.4", "1.2.3.4 is banned", http.StatusForbidden)
+	if written, err := e.Export(); !written || err != nil {
+		t.Errorf("e.Export() = %t, %v, want true, nil", written, err)
+	}
+	testFile(t, "export.conf", "deny 1.2.3.4/32;\n")
+	e.Stop()
+	e = NewExporter(h.Engine(), "export.conf", NginxFormat, 0)
+	defer e.Stop()
+	if e.interval != defaultExportInterval {
+		t.Errorf("e.interval = %v, want %v", e.interval, defaultExportInterval)
+	}
+}
+
+// testFormat tests that the Format writes the expected output for the string
+// forms of PrefixedIPs.
+func testFormat(t *testing.T, f Format, ss []string, es string) {
+	var pips []*PrefixedIP
+	for _, s := range ss {
+		pip, err := ParsePrefixedIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		pips = append(pips, pip)
+	}
+	var buf bytes.Buffer
+	if err := f(&buf, pips); err != nil {
+		t.Error(err)
+	}
+	if buf.String() != es {
+		t.Errorf("format = %q, want %q", buf.String(), es)
+	}
+}
+
+// testFile tests that the file at path has the expected contents.
+func testFile(t *testing.T, path string, es string) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(bs) != es {
+		t.Errorf("file = %q, want %q", bs, es)
+	}
+}
@@ -0,0 +1,350 @@
+package ban
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoFeedName is returned if a Feed is made without a Name.
+	ErrNoFeedName = errors.New("feed name must be assigned")
+	// ErrNoFeedURL is returned if a Feed is made without a URL.
+	ErrNoFeedURL = errors.New("feed URL must be assigned")
+	// ErrDuplicateFeed is returned if a Feed is made with the Name of another
+	// Feed of the same Engine.
+	ErrDuplicateFeed = errors.New("feed name is already used")
+	// ErrEmptyFeed is returned if a feed lists no PrefixedIPs.
+	ErrEmptyFeed = errors.New("feed is empty")
+)
+
+// FeedStatusError is the status code of an unsuccessful response to a request
+// for a feed.
+type FeedStatusError int
+
+// Error with the status code.
+func (e FeedStatusError) Error() string {
+	return fmt.Sprintf("feed responded with status %d", int(e))
+}
+
+// FeedConfig for Feeds.
+type FeedConfig struct {
+	// Name of the Feed, which must be unique among the Feeds of an Engine.
+	//
+	// Must be assigned.
+	Name string
+	// URL the feed is fetched from, which is an http or https URL, a file
+	// URL, or the path of a local file.
+	//
+	// Must be assigned.
+	URL string
+	// Importer reads the feed.
+	//
+	// Defaults to ImportCIDRList if not assigned.
+	Importer Importer
+	// Interval between refreshes of the feed.
+	//
+	// Defaults to an hour if not assigned.
+	Interval time.Duration
+	// Client fetches http and https URLs.
+	//
+	// Defaults to an http.Client with a 30 second timeout if not assigned.
+	Client *http.Client
+	// CachePath is the path of a file the last good feed is written to,
+	// which is read if the feed can't be fetched before it has been
+	// applied, like when the server is down when an instance starts.
+	//
+	// Defaults to not caching the feed if not assigned.
+	CachePath string
+}
+
+const (
+	// defaultFeedInterval is the Interval if none is assigned.
+	defaultFeedInterval = time.Hour
+	// defaultFeedTimeout is the timeout of the Client if none is assigned.
+	defaultFeedTimeout = 30 * time.Second
+)
+
+// FeedStats are the metrics of a Feed.
+type FeedStats struct {
+	// PrefixedIPs is the number of PrefixedIPs applied from the feed.
+	PrefixedIPs int
+	// Refreshes is the number of times the feed was refreshed.
+	Refreshes int
+	// Failures is the number of refreshes which failed.
+	Failures int
+	// Added is the number of PrefixedIPs added by every refresh.
+	Added int
+	// Removed is the number of PrefixedIPs removed by every refresh.
+	Removed int
+	// BadLines is the number of lines which couldn't be read the last time
+	// the feed was applied.
+	BadLines int
+	// LastRefresh is the time of the last refresh.
+	LastRefresh time.Time
+	// LastSuccess is the time of the last refresh which didn't fail.
+	LastSuccess time.Time
+	// LastError is the error of the last refresh, which is nil if it didn't
+	// fail.
+	LastError error
+}
+
+// Feed keeps the PrefixedIPs listed by a feed, like a public threat feed,
+// banned in an Engine.
+//
+// The feed is fetched every Interval and the PrefixedIPs added to or removed
+// from it since the last refresh are applied. PrefixedIPs from Feeds are kept
+// apart from issued Bans: they are checked and exported like PrefixedIPs
+// banned without a Scope, but aren't written to the store, don't cause
+// EventIssues or EventUnbans, and aren't replicated. A PrefixedIP stays
+// banned while any Feed lists it.
+//
+// If the feed can't be fetched or read, or lists no PrefixedIPs, the
+// PrefixedIPs last applied are kept. Lines which can't be read are skipped.
+type Feed struct {
+	engine    *Engine
+	name      string
+	url       string
+	importer  Importer
+	interval  time.Duration
+	client    *http.Client
+	cachePath string
+
+	// refreshing serializes refreshes.
+	refreshing sync.Mutex
+	// mu guards stats, etag, applied, and stopped.
+	mu    sync.Mutex
+	stats FeedStats
+	// etag of the feed last applied.
+	etag string
+	// applied is true once the feed has been applied.
+	applied bool
+	// stopped is true once the Feed's PrefixedIPs are unbanned.
+	stopped bool
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewFeed which keeps the PrefixedIPs listed by a feed banned in the Engine
+// with behavior customized by FeedConfig.
+//
+// The feed is refreshed before it is returned. Errors are passed to the
+// Engine's ErrorHandler.
+//
+// Returns ErrNoFeedName or ErrNoFeedURL if either isn't assigned or
+// ErrDuplicateFeed if the Engine already has a Feed with the Name.
+func NewFeed(engine *Engine, cfg FeedConfig) (*Feed, error) {
+	if cfg.Name == "" {
+		return nil, ErrNoFeedName
+	}
+	if cfg.URL == "" {
+		return nil, ErrNoFeedURL
+	}
+	importer := cfg.Importer
+	if importer == nil {
+		importer = ImportCIDRList
+	}
+	interval := cfg.Interval
+	if interval == 0 {
+		interval = defaultFeedInterval
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultFeedTimeout}
+	}
+	if !engine.addFeed(cfg.Name) {
+		return nil, ErrDuplicateFeed
+	}
+	f := &Feed{
+		engine:    engine,
+		name:      cfg.Name,
+		url:       cfg.URL,
+		importer:  importer,
+		interval:  interval,
+		client:    client,
+		cachePath: cfg.CachePath,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if err := f.Refresh(); err != nil {
+		engine.errorHandler(err)
+	}
+	go f.run()
+	return f, nil
+}
+
+// Refresh the feed now.
+//
+// Nothing happens once the Feed is stopped. Returns an ImportError if lines of
+// the feed couldn't be read, in which case the rest were applied, or another
+// error if the feed couldn't be fetched or read, in which case the PrefixedIPs
+// last applied are kept.
+func (f *Feed) Refresh() error {
+	f.refreshing.Lock()
+	defer f.refreshing.Unlock()
+	f.mu.Lock()
+	if f.stopped {
+		f.mu.Unlock()
+		return nil
+	}
+	f.stats.Refreshes++
+	f.stats.LastRefresh = time.Now()
+	etag, applied := f.etag, f.applied
+	f.mu.Unlock()
+	bs, etag, err := f.fetch(etag, applied)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped {
+		return nil
+	}
+	if err == nil && bs != nil {
+		err = f.refresh(bs, etag)
+	}
+	if _, ok := err.(ImportError); err == nil || ok {
+		f.stats.LastSuccess = f.stats.LastRefresh
+		f.stats.LastError = nil
+		return err
+	}
+	f.stats.Failures++
+	f.stats.LastError = err
+	if !f.applied && f.cachePath != "" {
+		if bs, cacheErr := os.ReadFile(f.cachePath); cacheErr == nil {
+			f.apply(bs)
+		}
+	}
+	return err
+}
+
+// Stats of the Feed.
+func (f *Feed) Stats() FeedStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
+
+// PrefixedIPs applied from the feed, ordered like Engine.PrefixedIPs.
+func (f *Feed) PrefixedIPs() []*PrefixedIP {
+	return f.engine.feedPrefixedIPs(f.name)
+}
+
+// Stop refreshing the feed and unban its PrefixedIPs.
+//
+// Stopping a stopped Feed does nothing.
+func (f *Feed) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+		<-f.done
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.stats.PrefixedIPs = 0
+		f.stopped = true
+		f.engine.removeFeed(f.name)
+	})
+}
+
+// run refreshes every Interval until stopped.
+func (f *Feed) run() {
+	defer close(f.done)
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := f.Refresh(); err != nil {
+				f.engine.errorHandler(err)
+			}
+		}
+	}
+}
+
+// refresh applies the fetched feed with the etag and writes it to the cache.
+//
+// mu must be held. Returns errors like Refresh.
+func (f *Feed) refresh(bs []byte, etag string) error {
+	err := f.apply(bs)
+	if _, ok := err.(ImportError); err != nil && !ok {
+		return err
+	}
+	f.etag = etag
+	if f.cachePath != "" {
+		if cacheErr := writeFileAtomic(f.cachePath, bs); cacheErr != nil {
+			f.engine.errorHandler(cacheErr)
+		}
+	}
+	return err
+}
+
+// fetch the feed without holding mu.
+//
+// Requests for http and https URLs are conditional on the etag, and responses
+// saying the feed is unmodified are only trusted if a feed has been applied.
+//
+// Returns the feed, which is nil if it didn't change, and its etag or an error
+// if it couldn't be fetched.
+func (f *Feed) fetch(etag string, applied bool) ([]byte, string, error) {
+	u, err := url.Parse(f.url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		path := f.url
+		if err == nil && u.Scheme == "file" {
+			path = u.Path
+		}
+		bs, err := os.ReadFile(path)
+		return bs, "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && applied {
+		return nil, "", nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", FeedStatusError(resp.StatusCode)
+	}
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return bs, resp.Header.Get("ETag"), nil
+}
+
+// apply the PrefixedIPs in the feed to the Engine.
+//
+// mu must be held. Returns ErrEmptyFeed if the feed lists no PrefixedIPs, an
+// ImportError if lines of the feed couldn't be read, in which case the rest
+// were applied, or another error if the feed couldn't be read.
+func (f *Feed) apply(bs []byte) error {
+	pips, err := f.importer(bytes.NewReader(bs))
+	importErr, partial := err.(ImportError)
+	if err != nil && !partial {
+		return err
+	}
+	if len(pips) == 0 {
+		return ErrEmptyFeed
+	}
+	total, added, removed := f.engine.setFeed(f.name, pips)
+	f.stats.PrefixedIPs = total
+	f.stats.Added += added
+	f.stats.Removed += removed
+	f.stats.BadLines = len(importErr)
+	f.applied = true
+	return err
+}
@@ -0,0 +1,232 @@
+package ban
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestFeed tests that refreshing a Feed applies the PrefixedIPs added to and
+// removed from the feed and keeps the last good feed if fetching fails.
+func TestFeed(t *testing.T) {
+	t.Parallel()
+	feed := &testFeedServer{body: "1.2.3.0/24\n5.6.7.8 # scanner\n"}
+	s := httptest.NewServer(feed)
+	defer s.Close()
+	e := NewEngine(Config{ErrorHandler: IgnoreErrorHandler})
+	if err := e.Add(testFeedPrefixedIP(t, "9.9.9.9/32")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFeed(e, FeedConfig{Name: "threats", URL: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	testFeedBanned(t, e, map[string]bool{"1.2.3.4": true, "5.6.7.8": true, "9.9.9.9": true})
+	if got := len(e.PrefixedIPs()); got != 1 {
+		t.Errorf("len(e.PrefixedIPs()) = %d, want 1 without the feed", got)
+	}
+	feed.set(http.StatusOK, "5.6.7.8\n10.0.0.0/8\nbad\n")
+	if err := f.Refresh(); err == nil {
+		t.Errorf("f.Refresh() = nil, want an ImportError")
+	}
+	testFeedBanned(t, e, map[string]bool{"1.2.3.4": false, "5.6.7.8": true, "10.1.2.3": true})
+	if err := f.Refresh(); err != nil {
+		t.Errorf("f.Refresh() = %v, want nil when unmodified", err)
+	}
+	feed.set(http.StatusInternalServerError, "")
+	if err := f.Refresh(); err != FeedStatusError(http.StatusInternalServerError) {
+		t.Errorf("f.Refresh() = %v, want %v", err, FeedStatusError(http.StatusInternalServerError))
+	}
+	feed.set(http.StatusOK, "# nothing\n")
+	if err := f.Refresh(); err != ErrEmptyFeed {
+		t.Errorf("f.Refresh() = %v, want %v", err, ErrEmptyFeed)
+	}
+	testFeedBanned(t, e, map[string]bool{"5.6.7.8": true, "10.1.2.3": true})
+	stats := f.Stats()
+	if stats.Refreshes != 5 || stats.Failures != 2 || stats.PrefixedIPs != 2 ||
+		stats.Added != 3 || stats.Removed != 1 || stats.BadLines != 1 ||
+		stats.LastError != ErrEmptyFeed || !stats.LastSuccess.Before(stats.LastRefresh) {
+		t.Errorf("f.Stats() = %+v", stats)
+	}
+	if feed.notModified != 1 {
+		t.Errorf("feed.notModified = %d, want 1", feed.notModified)
+	}
+	if _, err := NewFeed(e, FeedConfig{Name: "threats", URL: s.URL}); err != ErrDuplicateFeed {
+		t.Errorf("NewFeed() = %v, want %v", err, ErrDuplicateFeed)
+	}
+}
+
+// TestFeeds tests that PrefixedIPs listed by several Feeds are exported and
+// stay banned until every Feed listing them stops, and that local files are
+// read.
+func TestFeeds(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	e := NewEngine(Config{ErrorHandler: func(err error) { t.Error(err) }})
+	var feeds []*Feed
+	for i, body := range []string{"1.2.3.0/24\n5.6.7.8\n", "5.6.7.8\n"} {
+		path := filepath.Join(dir, fmt.Sprintf("feed%d.txt", i))
+		if err := os.WriteFile(path, []byte(body), 0666); err != nil {
+			t.Fatal(err)
+		}
+		url := path
+		if i == 1 {
+			url = "file://" + path
+		}
+		f, err := NewFeed(e, FeedConfig{Name: url, URL: url})
+		if err != nil {
+			t.Fatal(err)
+		}
+		feeds = append(feeds, f)
+	}
+	testFeedBanned(t, e, map[string]bool{"1.2.3.4": true, "5.6.7.8": true})
+	if pips, _ := e.snapshot(); len(pips) != 2 {
+		t.Errorf("e.snapshot() = %v, want the PrefixedIPs of the Feeds exported", pips)
+	}
+	feeds[0].Stop()
+	testFeedBanned(t, e, map[string]bool{"1.2.3.4": false, "5.6.7.8": true})
+	feeds[1].Stop()
+	testFeedBanned(t, e, map[string]bool{"5.6.7.8": false})
+	if _, err := NewFeed(e, FeedConfig{URL: dir}); err != ErrNoFeedName {
+		t.Errorf("NewFeed() = %v, want %v", err, ErrNoFeedName)
+	}
+}
+
+// TestFeedCache tests that the last good feed is read from the cache if the
+// feed can't be fetched when a Feed is made.
+func TestFeedCache(t *testing.T) {
+	t.Parallel()
+	feed := &testFeedServer{body: "1.2.3.0/24\n"}
+	s := httptest.NewServer(feed)
+	defer s.Close()
+	cache := filepath.Join(t.TempDir(), "feed.txt")
+	cfg := FeedConfig{Name: "threats", URL: s.URL, CachePath: cache, Interval: 10 * time.Millisecond}
+	e := NewEngine(Config{ErrorHandler: func(err error) { t.Error(err) }})
+	f, err := NewFeed(e, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Stop()
+	feed.set(http.StatusServiceUnavailable, "")
+	e = NewEngine(Config{ErrorHandler: IgnoreErrorHandler})
+	f, err = NewFeed(e, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFeedBanned(t, e, map[string]bool{"1.2.3.4": true})
+	feed.set(http.StatusOK, "5.6.7.8\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for !e.Check(NewIPv4IP(IPv4{5, 6, 7, 8})) {
+		if time.Now().After(deadline) {
+			t.Fatal("e.Check(5.6.7.8) = false, want true after a refresh")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	f.Stop()
+	f.Stop()
+	if len(f.PrefixedIPs()) != 0 || e.Check(NewIPv4IP(IPv4{5, 6, 7, 8})) {
+		t.Errorf("f.PrefixedIPs() = %v, want none after f.Stop()", f.PrefixedIPs())
+	}
+}
+
+// TestFeedSlow tests that a Feed's Stats are available while the feed is being
+// fetched.
+func TestFeedSlow(t *testing.T) {
+	t.Parallel()
+	feed := &testFeedServer{body: "1.2.3.0/24\n"}
+	s := httptest.NewServer(feed)
+	defer s.Close()
+	e := NewEngine(Config{ErrorHandler: func(err error) { t.Error(err) }})
+	f, err := NewFeed(e, FeedConfig{Name: "threats", URL: s.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	feed.mu.Lock()
+	refreshed := make(chan error)
+	go func() {
+		refreshed <- f.Refresh()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	stats := make(chan FeedStats)
+	go func() {
+		stats <- f.Stats()
+	}()
+	select {
+	case got := <-stats:
+		if got.PrefixedIPs != 1 {
+			t.Errorf("f.Stats().PrefixedIPs = %d, want 1", got.PrefixedIPs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("f.Stats() blocked while the feed was being fetched")
+	}
+	feed.mu.Unlock()
+	if err := <-refreshed; err != nil {
+		t.Errorf("f.Refresh() = %v, want nil", err)
+	}
+}
+
+// testFeedServer serves a feed with an ETag.
+type testFeedServer struct {
+	mu     sync.Mutex
+	status int
+	body   string
+	// notModified is the number of responses which were 304s.
+	notModified int
+}
+
+// set the status and body served.
+func (s *testFeedServer) set(status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.body = status, body
+}
+
+// ServeHTTP responds with the status and body, or a 304 if the request has the
+// body's ETag, which is its length.
+func (s *testFeedServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != 0 && s.status != http.StatusOK {
+		rw.WriteHeader(s.status)
+		return
+	}
+	etag := fmt.Sprintf(`"%d"`, len(s.body))
+	if r.Header.Get("If-None-Match") == etag {
+		s.notModified++
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("ETag", etag)
+	fmt.Fprint(rw, s.body)
+}
+
+// testFeedBanned fails the test if the Engine's Check of each IP isn't as
+// wanted.
+func testFeedBanned(t *testing.T, e *Engine, want map[string]bool) {
+	t.Helper()
+	for s, banned := range want {
+		ip, err := ParseIP(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.Check(ip); got != banned {
+			t.Errorf("e.Check(%s) = %t, want %t", s, got, banned)
+		}
+	}
+}
+
+// testFeedPrefixedIP parses the PrefixedIP or fails the test.
+func testFeedPrefixedIP(t *testing.T, s string) *PrefixedIP {
+	pip, err := ParsePrefixedIP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pip
+}
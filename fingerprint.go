@@ -0,0 +1,182 @@
+package ban
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrBannedFingerprint is returned during TLS handshakes with clients whose
+// ClientHello fingerprint is banned.
+var ErrBannedFingerprint = errors.New("TLS ClientHello fingerprint is banned")
+
+// maxJA3Version is the greatest TLS version put in fingerprints, since TLS 1.3
+// clients send TLS 1.2 as the version of their ClientHello.
+const maxJA3Version = tls.VersionTLS12
+
+// Fingerprint of the TLS ClientHello in the JA3 style.
+//
+// The fingerprint is the hex MD5 of the TLS version, cipher suites, extensions,
+// supported curves, and point formats, where each list is dash-separated
+// decimals, GREASE values are left out, and the fields are comma-separated.
+// Extensions are sorted like in JA4, since some clients randomize their order,
+// and the rest are in the order the client sent them.
+func Fingerprint(hello *tls.ClientHelloInfo) string {
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	if version > maxJA3Version {
+		version = maxJA3Version
+	}
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, c := range hello.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	extensions := append([]uint16(nil), hello.Extensions...)
+	sort.Slice(extensions, func(i, j int) bool { return extensions[i] < extensions[j] })
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	fields := []string{
+		strconv.Itoa(int(version)),
+		joinJA3(hello.CipherSuites),
+		joinJA3(extensions),
+		joinJA3(curves),
+		joinJA3(points),
+	}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// FingerprintFromContext returns the TLS ClientHello fingerprint of the
+// connection an http.Request's context is from.
+//
+// Returns false if the connection wasn't accepted by a TLSFingerprinter's
+// Listener or hasn't finished its handshake.
+func FingerprintFromContext(ctx context.Context) (string, bool) {
+	conn, ok := ctx.Value(fingerprintContextKey{}).(*fingerprintConn)
+	if !ok {
+		return "", false
+	}
+	fingerprint, ok := conn.fingerprint.Load().(string)
+	return fingerprint, ok
+}
+
+// TLSFingerprinter computes the TLS ClientHello fingerprints of connections so
+// Banners can see them and Bans on them are enforced during handshakes.
+//
+// The net.Listener passed to tls.NewListener or http.Server.ServeTLS must be
+// wrapped by Listener, the tls.Config must be from TLSConfig, and
+// http.Server.ConnContext must be ConnContext.
+type TLSFingerprinter struct {
+	engine *Engine
+}
+
+// NewTLSFingerprinter which enforces the fingerprint Bans of the Engine.
+func NewTLSFingerprinter(e *Engine) *TLSFingerprinter {
+	return &TLSFingerprinter{engine: e}
+}
+
+// Listener wraps the net.Listener so the fingerprints of its connections can
+// be remembered.
+func (f *TLSFingerprinter) Listener(l net.Listener) net.Listener {
+	return &fingerprintListener{Listener: l}
+}
+
+// TLSConfig returns a clone of the tls.Config which computes the fingerprint of
+// every ClientHello and fails handshakes with banned fingerprints with
+// ErrBannedFingerprint.
+//
+// Any GetConfigForClient of the tls.Config is called after the fingerprint is
+// checked.
+func (f *TLSFingerprinter) TLSConfig(cfg *tls.Config) *tls.Config {
+	cfg = cfg.Clone()
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		fingerprint := Fingerprint(hello)
+		if conn, ok := hello.Conn.(*fingerprintConn); ok {
+			conn.fingerprint.Store(fingerprint)
+		}
+		if f.engine.CheckFingerprint(fingerprint) {
+			return nil, ErrBannedFingerprint
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+	return cfg
+}
+
+// ConnContext adds the connection to the context so FingerprintFromContext can
+// find its fingerprint.
+//
+// It has the signature of http.Server.ConnContext.
+func (f *TLSFingerprinter) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return ctx
+	}
+	conn, ok := tc.NetConn().(*fingerprintConn)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, fingerprintContextKey{}, conn)
+}
+
+// fingerprintContextKey is the context key of fingerprintConns.
+type fingerprintContextKey struct{}
+
+// fingerprintListener is a net.Listener which returns fingerprintConns.
+type fingerprintListener struct {
+	net.Listener
+}
+
+// Accept waits for and returns the next connection as a fingerprintConn.
+//
+// Returns any error returned by the wrapped net.Listener's Accept.
+func (l *fingerprintListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &fingerprintConn{Conn: conn}, nil
+}
+
+// fingerprintConn is a net.Conn which remembers the fingerprint of its
+// ClientHello.
+type fingerprintConn struct {
+	net.Conn
+	// fingerprint is stored once the ClientHello has been read.
+	fingerprint atomic.Value
+}
+
+// joinJA3 joins the values which aren't GREASE values as dash-separated
+// decimals.
+func joinJA3(vs []uint16) string {
+	ss := make([]string, 0, len(vs))
+	for _, v := range vs {
+		if !isGREASE(v) {
+			ss = append(ss, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(ss, "-")
+}
+
+// isGREASE returns true if the value is one of the GREASE values clients send
+// to keep servers tolerant of unknown values, which are 0x0a0a, 0x1a1a, and so
+// on up to 0xfafa.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
@@ -0,0 +1,144 @@
+package ban
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestFingerprint tests that Fingerprints leave out GREASE values, sort
+// extensions, and cap the TLS version.
+func TestFingerprint(t *testing.T) {
+	t.Parallel()
+	// The MD5 of "771,4865-4866,0-10-11,29-23,0".
+	const want = "38eaca597c62da4c9db8cfad482f14ad"
+	cases := []*tls.ClientHelloInfo{
+		{
+			SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+			CipherSuites:      []uint16{4865, 4866},
+			Extensions:        []uint16{0, 10, 11},
+			SupportedCurves:   []tls.CurveID{29, 23},
+			SupportedPoints:   []uint8{0},
+		},
+		{
+			SupportedVersions: []uint16{0x3a3a, tls.VersionTLS13},
+			CipherSuites:      []uint16{0x0a0a, 4865, 4866},
+			Extensions:        []uint16{11, 0xfafa, 0, 10},
+			SupportedCurves:   []tls.CurveID{0x1a1a, 29, 23},
+			SupportedPoints:   []uint8{0},
+		},
+	}
+	for _, c := range cases {
+		if got := Fingerprint(c); got != want {
+			t.Errorf("Fingerprint(%v) = %v, want %v", c, got, want)
+		}
+	}
+	other := &tls.ClientHelloInfo{SupportedVersions: []uint16{tls.VersionTLS12}, CipherSuites: []uint16{4865}}
+	if got := Fingerprint(other); got == want {
+		t.Errorf("Fingerprint(%v) = %v, want different", other, got)
+	}
+}
+
+// TestTLSFingerprinter tests that fingerprints are passed to Banners through
+// the context and that Bans on them are enforced in handshakes.
+func TestTLSFingerprinter(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	e := NewEngine(Config{ErrorHandler: func(err error) { t.Error(err) }})
+	fingerprints := make(chan string, 2)
+	h := e.Handler(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		BannerFunc(func(ip IP, r *http.Request) Ban {
+			fingerprint, _ := FingerprintFromContext(r.Context())
+			fingerprints <- fingerprint
+			if r.URL.Path == "/ban" {
+				return FingerprintBan
+			}
+			return NoBan
+		}),
+	)
+	f := NewTLSFingerprinter(e)
+	s := &http.Server{
+		Handler:     h,
+		TLSConfig:   f.TLSConfig(&tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}),
+		ConnContext: f.ConnContext,
+		ErrorLog:    log.New(ioutil.Discard, "", 0),
+	}
+	go s.Serve(tls.NewListener(f.Listener(l), s.TLSConfig))
+	defer s.Close()
+	url := "https://" + l.Addr().String()
+	testTLSGet(t, url+"/", "", http.StatusOK)
+	testTLSGet(t, url+"/ban", "fingerprint is banned", http.StatusForbidden)
+	if first, second := <-fingerprints, <-fingerprints; first == "" || first != second {
+		t.Errorf("fingerprints = %q, %q, want equal and non-empty", first, second)
+	}
+	if resp, err := testTLSClient().Get(url + "/"); err == nil {
+		resp.Body.Close()
+		t.Errorf("client.Get() = %v, want handshake error", resp.Status)
+	}
+	if got := e.Fingerprints(); len(got) != 1 {
+		t.Errorf("e.Fingerprints() = %v, want 1 fingerprint", got)
+	}
+}
+
+// testTLSGet tests that a GET of the URL over a new TLS connection returns the
+// correct message and code.
+func testTLSGet(t *testing.T, url, es string, esc int) {
+	resp, err := testTLSClient().Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(bs) != es {
+		t.Errorf("r.Body = %s, want %v", bs, es)
+	}
+	if resp.StatusCode != esc {
+		t.Errorf("r.StatusCode = %d, want %d", resp.StatusCode, esc)
+	}
+}
+
+// testTLSClient returns an http.Client which makes a new TLS connection for
+// every http.Request and doesn't verify certificates.
+func testTLSClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+}
+
+// testCertificate returns a self-signed tls.Certificate for 127.0.0.1.
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,300 @@
+// Package geoban provides a ban.Banner which bans or blocks IPs by the country
+// and autonomous system they are from, looked up in local MaxMind DBs like
+// GeoLite2-Country and GeoLite2-ASN without any network access.
+//
+// Databases are read into memory and reloaded when their files are replaced,
+// like by geoipupdate.
+package geoban
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jwowillo/ban"
+)
+
+// ErrNoDatabase is returned if neither a CountryPath nor an ASNPath is
+// assigned.
+var ErrNoDatabase = errors.New("a country or ASN database must be assigned")
+
+// Config for Geos.
+type Config struct {
+	// CountryPath is the path of a MaxMind DB of countries, like
+	// GeoLite2-Country or GeoLite2-City.
+	//
+	// Defaults to not looking up countries if not assigned.
+	CountryPath string
+	// ASNPath is the path of a MaxMind DB of autonomous systems, like
+	// GeoLite2-ASN.
+	//
+	// Defaults to not looking up autonomous systems if not assigned.
+	ASNPath string
+	// Countries are the ISO 3166-1 alpha-2 codes of the countries whose IPs
+	// are blocked, like "KP".
+	Countries []string
+	// ASNs are the numbers of the autonomous systems whose IPs are blocked.
+	ASNs []uint
+	// Ban issued by the Geo to blocked IPs.
+	//
+	// Defaults to ban.IPBan if not assigned. ban.NoBan blocks requests with
+	// Handler without banning.
+	Ban ban.Ban
+	// ReloadInterval between checks for replaced databases.
+	//
+	// Defaults to a minute if not assigned.
+	ReloadInterval time.Duration
+	// ErrorHandler handles errors while reloading databases and looking up
+	// IPs.
+	//
+	// Defaults to ban.StderrErrorHandler if not assigned.
+	ErrorHandler ban.ErrorHandler
+}
+
+// defaultReloadInterval is the ReloadInterval if none is assigned.
+const defaultReloadInterval = time.Minute
+
+// countryPaths are the paths in records of country databases of the ISO codes
+// of the country an IP is in and the country it is registered in.
+var countryPaths = [][]string{{"country", "iso_code"}, {"registered_country", "iso_code"}}
+
+// asnPaths are the paths in records of ASN databases of the number and
+// organization of the autonomous system an IP is in.
+var asnPaths = [][]string{{"autonomous_system_number"}, {"autonomous_system_organization"}}
+
+// Record of an IP in the databases.
+type Record struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country the IP is in, or
+	// the country it is registered in if that isn't known.
+	//
+	// Is "" if neither is known.
+	Country string
+	// ASN is the number of the autonomous system the IP is in.
+	//
+	// Is 0 if it isn't known.
+	ASN uint
+	// Organization of the autonomous system the IP is in.
+	Organization string
+}
+
+// Geo is a ban.Banner which issues a Ban to IPs from blocked countries and
+// autonomous systems.
+//
+// IPs which aren't in the databases aren't blocked.
+type Geo struct {
+	countryPath    string
+	asnPath        string
+	countries      map[string]bool
+	asns           map[uint]bool
+	ban            ban.Ban
+	reloadInterval time.Duration
+	errorHandler   ban.ErrorHandler
+
+	// mu guards country and asn.
+	mu      sync.RWMutex
+	country *database
+	asn     *database
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// database is a MaxMind DB read from a file.
+type database struct {
+	db *mmdb
+	// modTime and size of the file when it was read.
+	modTime time.Time
+	size    int64
+}
+
+// New Geo with behavior customized by Config.
+//
+// The databases are read before it is returned.
+//
+// Returns ErrNoDatabase if no database is assigned, ErrBadDatabase if a
+// database is bad, or an error if a database can't be read.
+func New(cfg Config) (*Geo, error) {
+	if cfg.CountryPath == "" && cfg.ASNPath == "" {
+		return nil, ErrNoDatabase
+	}
+	countries := make(map[string]bool)
+	for _, country := range cfg.Countries {
+		countries[strings.ToUpper(country)] = true
+	}
+	asns := make(map[uint]bool)
+	for _, asn := range cfg.ASNs {
+		asns[asn] = true
+	}
+	b := cfg.Ban
+	if b == (ban.Ban{}) {
+		b = ban.IPBan
+	}
+	reloadInterval := cfg.ReloadInterval
+	if reloadInterval == 0 {
+		reloadInterval = defaultReloadInterval
+	}
+	errorHandler := cfg.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = ban.StderrErrorHandler
+	}
+	g := &Geo{
+		countryPath:    cfg.CountryPath,
+		asnPath:        cfg.ASNPath,
+		countries:      countries,
+		asns:           asns,
+		ban:            b,
+		reloadInterval: reloadInterval,
+		errorHandler:   errorHandler,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	go g.run()
+	return g, nil
+}
+
+// Lookup the Record of the IP.
+//
+// Only the fields of the Record are decoded from the databases.
+//
+// Errors from bad databases are passed to the ErrorHandler and leave the
+// Record's fields from them unassigned.
+func (g *Geo) Lookup(ip ban.IP) Record {
+	g.mu.RLock()
+	country, asn := g.country, g.asn
+	g.mu.RUnlock()
+	var record Record
+	if country != nil {
+		fields, err := country.db.LookupFields(ip, countryPaths...)
+		if err != nil {
+			g.errorHandler(err)
+		}
+		record.Country, _ = fields[0].(string)
+		if record.Country == "" {
+			record.Country, _ = fields[1].(string)
+		}
+	}
+	if asn != nil {
+		fields, err := asn.db.LookupFields(ip, asnPaths...)
+		if err != nil {
+			g.errorHandler(err)
+		}
+		number, _ := fields[0].(uint64)
+		record.ASN = uint(number)
+		record.Organization, _ = fields[1].(string)
+	}
+	return record
+}
+
+// Blocked returns true if the IP is from a blocked country or autonomous
+// system.
+func (g *Geo) Blocked(ip ban.IP) bool {
+	record := g.Lookup(ip)
+	return g.countries[record.Country] || g.asns[record.ASN]
+}
+
+// Ban issues the Ban to the IP if it is blocked.
+func (g *Geo) Ban(ip ban.IP, r *http.Request) ban.Ban {
+	if g.Blocked(ip) {
+		return g.ban
+	}
+	return ban.NoBan
+}
+
+// Handler which blocks http.Requests from blocked IPs without banning them
+// and passes other http.Requests to the http.Handler.
+func (g *Geo) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ip, err := ban.ParseRemoteAddress(r.RemoteAddr)
+		if err == nil && g.Blocked(ip) {
+			rw.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(rw, "%s is blocked", ip)
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// Reload the databases whose files were replaced or changed since they were
+// last read.
+//
+// A database which can't be reloaded is kept.
+//
+// Returns ErrBadDatabase if a database is bad or an error if a database can't
+// be read.
+func (g *Geo) Reload() error {
+	g.mu.RLock()
+	country, asn := g.country, g.asn
+	g.mu.RUnlock()
+	country, countryErr := reload(g.countryPath, country)
+	asn, asnErr := reload(g.asnPath, asn)
+	g.mu.Lock()
+	g.country, g.asn = country, asn
+	g.mu.Unlock()
+	if countryErr != nil {
+		return countryErr
+	}
+	return asnErr
+}
+
+// Stop checking for replaced databases.
+//
+// Stopping a stopped Geo does nothing.
+func (g *Geo) Stop() {
+	g.stopOnce.Do(func() {
+		close(g.stop)
+		<-g.done
+	})
+}
+
+// run reloads the databases every ReloadInterval until stopped.
+func (g *Geo) run() {
+	defer close(g.done)
+	ticker := time.NewTicker(g.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+			if err := g.Reload(); err != nil {
+				g.errorHandler(err)
+			}
+		}
+	}
+}
+
+// reload the database at the path if its file changed since the database was
+// read.
+//
+// Returns the database, which is nil if the path is "", and is the database
+// passed in if the file didn't change or an error happened, and ErrBadDatabase
+// if the file is bad or an error if it can't be read.
+func reload(path string, db *database) (*database, error) {
+	if path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return db, err
+	}
+	if db != nil && info.ModTime().Equal(db.modTime) && info.Size() == db.size {
+		return db, nil
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return db, err
+	}
+	parsed, err := parseMMDB(bs)
+	if err != nil {
+		return db, err
+	}
+	return &database{db: parsed, modTime: info.ModTime(), size: info.Size()}, nil
+}
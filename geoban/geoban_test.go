@@ -0,0 +1,359 @@
+package geoban
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jwowillo/ban"
+)
+
+// testCountries are the networks of a test country database.
+var testCountries = []testNetwork{
+	{Prefix: "1.2.3.0/24", Record: testCountry("country", "KP")},
+	{Prefix: "5.6.7.0/24", Record: testCountry("registered_country", "KP")},
+	{Prefix: "8.8.8.0/24", Record: testCountry("country", "US")},
+	{Prefix: "2001:db8::/32", Record: testCountry("country", "KP")},
+}
+
+// testASNs are the networks of a test ASN database.
+var testASNs = []testNetwork{
+	{Prefix: "9.9.0.0/16", Record: map[string]any{
+		"autonomous_system_number":       uint32(64500),
+		"autonomous_system_organization": "Hostile Hosting",
+	}},
+	{Prefix: "8.8.8.0/24", Record: map[string]any{
+		"autonomous_system_number":       uint32(15169),
+		"autonomous_system_organization": "Google",
+	}},
+}
+
+// TestGeo tests that IPs are looked up and banned or blocked by their country
+// and autonomous system.
+func TestGeo(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	countryPath := testWriteMMDB(t, dir, "country.mmdb", testCountries, 6, 28)
+	asnPath := testWriteMMDB(t, dir, "asn.mmdb", testASNs, 4, 24)
+	g, err := New(Config{
+		CountryPath:  countryPath,
+		ASNPath:      asnPath,
+		Countries:    []string{"kp"},
+		ASNs:         []uint{64500},
+		Ban:          ban.IPBan.For(time.Hour),
+		ErrorHandler: func(err error) { t.Error(err) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+	cases := []struct {
+		IP      string
+		Record  Record
+		Blocked bool
+	}{
+		{IP: "1.2.3.4", Record: Record{Country: "KP"}, Blocked: true},
+		{IP: "5.6.7.8", Record: Record{Country: "KP"}, Blocked: true},
+		{IP: "8.8.8.8", Record: Record{Country: "US", ASN: 15169, Organization: "Google"}},
+		{IP: "9.9.1.1", Record: Record{ASN: 64500, Organization: "Hostile Hosting"}, Blocked: true},
+		{IP: "2001:db8::1", Record: Record{Country: "KP"}, Blocked: true},
+		{IP: "2001:db9::1", Record: Record{}},
+		{IP: "10.0.0.1", Record: Record{}},
+	}
+	for _, c := range cases {
+		ip, err := ban.ParseIP(c.IP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := g.Lookup(ip); got != c.Record {
+			t.Errorf("g.Lookup(%s) = %+v, want %+v", c.IP, got, c.Record)
+		}
+		if got := g.Blocked(ip); got != c.Blocked {
+			t.Errorf("g.Blocked(%s) = %t, want %t", c.IP, got, c.Blocked)
+		}
+	}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	h := ban.New(ok, g, ban.Config{ErrorHandler: func(err error) { t.Error(err) }})
+	blocker := g.Handler(ok)
+	for _, c := range []struct {
+		IP   string
+		Want int
+	}{
+		{IP: "1.2.3.4", Want: http.StatusForbidden},
+		{IP: "8.8.8.8", Want: http.StatusOK},
+	} {
+		for _, handler := range []http.Handler{h, blocker} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = c.IP + ":1"
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != c.Want {
+				t.Errorf("%s: rec.Code = %d, want %d", c.IP, rec.Code, c.Want)
+			}
+		}
+	}
+	if pips := h.Engine().PrefixedIPs(); len(pips) != 1 || pips[0].String() != "1.2.3.4/32" {
+		t.Errorf("h.Engine().PrefixedIPs() = %v, want [1.2.3.4/32]", pips)
+	}
+	if _, err := New(Config{}); err != ErrNoDatabase {
+		t.Errorf("New() = %v, want %v", err, ErrNoDatabase)
+	}
+}
+
+// TestRecordSizes tests that IPs are looked up in IPv4 and IPv6 databases with
+// every record size.
+func TestRecordSizes(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			bs := testMMDB(testCountries, ipVersion, recordSize)
+			db, err := parseMMDB(bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for s, want := range map[string]string{"1.2.3.4": "KP", "8.8.8.8": "US", "10.0.0.1": ""} {
+				ip, _ := ban.ParseIP(s)
+				fields, err := db.LookupFields(ip, countryPaths[0])
+				if err != nil {
+					t.Error(err)
+				}
+				if got, _ := fields[0].(string); got != want {
+					t.Errorf("IPv%d %d-bit: db.LookupFields(%s) = %v, want %v", ipVersion, recordSize, s, got, want)
+				}
+			}
+		}
+	}
+	path := filepath.Join(dir, "bad.mmdb")
+	if err := os.WriteFile(path, []byte("bad"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{CountryPath: path}); err != ErrBadDatabase {
+		t.Errorf("New(bad) = %v, want %v", err, ErrBadDatabase)
+	}
+}
+
+// TestReload tests that replaced databases are reloaded and bad replacements
+// are ignored.
+func TestReload(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := testWriteMMDB(t, dir, "country.mmdb", testCountries, 6, 24)
+	g, err := New(Config{
+		CountryPath:    path,
+		Countries:      []string{"KP"},
+		ReloadInterval: 10 * time.Millisecond,
+		ErrorHandler:   ban.IgnoreErrorHandler,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Stop()
+	ip := ban.NewIPv4IP(ban.IPv4{8, 8, 8, 8})
+	if g.Blocked(ip) {
+		t.Errorf("g.Blocked(%v) = true, want false", ip)
+	}
+	testWriteMMDB(t, dir, "country.mmdb", []testNetwork{
+		{Prefix: "8.8.0.0/16", Record: testCountry("country", "KP")},
+	}, 6, 24)
+	deadline := time.Now().Add(5 * time.Second)
+	for !g.Blocked(ip) {
+		if time.Now().After(deadline) {
+			t.Fatalf("g.Blocked(%v) = false, want true after reloading", ip)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := os.WriteFile(path, []byte("bad"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Reload(); err != ErrBadDatabase {
+		t.Errorf("g.Reload() = %v, want %v", err, ErrBadDatabase)
+	}
+	if !g.Blocked(ip) {
+		t.Errorf("g.Blocked(%v) = false, want true with the last good database", ip)
+	}
+	g.Stop()
+}
+
+// testNetwork is a network and its record in a test MaxMind DB.
+type testNetwork struct {
+	Prefix string
+	Record map[string]any
+}
+
+// testCountry returns the record of the country with the ISO code under the
+// key, along with fields which aren't looked up.
+func testCountry(key, code string) map[string]any {
+	return map[string]any{
+		"continent": map[string]any{"code": "AS", "geoname_id": uint32(6255147)},
+		key: map[string]any{
+			"geoname_id": uint32(1873107),
+			"iso_code":   code,
+			"names":      map[string]any{"en": "Country " + code},
+		},
+	}
+}
+
+// testWriteMMDB replaces the file in the directory with a MaxMind DB of the
+// networks.
+//
+// Returns the path of the file.
+func testWriteMMDB(t *testing.T, dir, name string, networks []testNetwork, ipVersion, recordSize int) string {
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, testMMDB(networks, ipVersion, recordSize), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testNode is a node in the search tree of a test MaxMind DB.
+type testNode struct {
+	// children are *testNodes, ints which are indices of records, or nil.
+	children [2]any
+	index    int
+}
+
+// testMMDB returns a MaxMind DB of the networks with the IP version and record
+// size.
+//
+// IPv4 networks are put under ::/96 in IPv6 databases, and strings which
+// repeat are written as pointers.
+func testMMDB(networks []testNetwork, ipVersion, recordSize int) []byte {
+	root := &testNode{}
+	for i, network := range networks {
+		pip, err := ban.ParsePrefixedIP(network.Prefix)
+		if err != nil {
+			panic(err)
+		}
+		ip := pip.IP()
+		addr, pl := ip[:], int(pip.PrefixLength())
+		if v4, ok := ip.IPv4(); ok {
+			addr = v4[:]
+			if ipVersion == 6 {
+				addr, pl = append(make([]byte, 12), v4[:]...), pl+96
+			}
+		} else if ipVersion == 4 {
+			continue
+		}
+		node := root
+		for j := 0; j < pl; j++ {
+			bit := addr[j/8] >> (7 - j%8) & 1
+			if j == pl-1 {
+				node.children[bit] = i
+				break
+			}
+			child, ok := node.children[bit].(*testNode)
+			if !ok {
+				child = &testNode{}
+				node.children[bit] = child
+			}
+			node = child
+		}
+	}
+	nodes := []*testNode{root}
+	for i := 0; i < len(nodes); i++ {
+		nodes[i].index = i
+		for _, child := range nodes[i].children {
+			if n, ok := child.(*testNode); ok {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	e := &testEncoder{strings: make(map[string]int)}
+	offsets := make([]int, len(networks))
+	for i, network := range networks {
+		offsets[i] = len(e.data)
+		e.encode(network.Record)
+	}
+	var tree []byte
+	for _, node := range nodes {
+		var records [2]uint32
+		for bit, child := range node.children {
+			switch c := child.(type) {
+			case *testNode:
+				records[bit] = uint32(c.index)
+			case int:
+				records[bit] = uint32(len(nodes) + mmdbDataSeparator + offsets[c])
+			default:
+				records[bit] = uint32(len(nodes))
+			}
+		}
+		left, right := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			tree = append(tree, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>20&0xf0|right>>24&0x0f), byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			tree = binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(tree, left), right)
+		}
+	}
+	bs := append(tree, make([]byte, mmdbDataSeparator)...)
+	bs = append(bs, e.data...)
+	bs = append(bs, mmdbMetadataMarker...)
+	metadata := &testEncoder{}
+	metadata.encode(map[string]any{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Test",
+	})
+	return append(bs, metadata.data...)
+}
+
+// testEncoder encodes fields of the data section of a test MaxMind DB.
+type testEncoder struct {
+	data []byte
+	// strings holds the offset of each string encoded, which is nil if
+	// strings aren't written as pointers.
+	strings map[string]int
+}
+
+// encode the field.
+func (e *testEncoder) encode(v any) {
+	switch v := v.(type) {
+	case string:
+		if offset, ok := e.strings[v]; ok && offset < 2048 {
+			e.data = append(e.data, byte(mmdbPointer<<5|offset>>8), byte(offset))
+			return
+		}
+		if e.strings != nil {
+			e.strings[v] = len(e.data)
+		}
+		e.control(mmdbString, len(v))
+		e.data = append(e.data, v...)
+	case uint16:
+		e.control(mmdbUint16, 2)
+		e.data = binary.BigEndian.AppendUint16(e.data, v)
+	case uint32:
+		e.control(mmdbUint32, 4)
+		e.data = binary.BigEndian.AppendUint32(e.data, v)
+	case map[string]any:
+		e.control(mmdbMap, len(v))
+		for key, value := range v {
+			e.encode(key)
+			e.encode(value)
+		}
+	default:
+		panic(v)
+	}
+}
+
+// control appends the control byte of a field of the type and size.
+func (e *testEncoder) control(kind, size int) {
+	if size >= 29 {
+		e.data = append(e.data, byte(kind<<5|29), byte(size-29))
+		return
+	}
+	e.data = append(e.data, byte(kind<<5|size))
+}
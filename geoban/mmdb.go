@@ -0,0 +1,397 @@
+package geoban
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/jwowillo/ban"
+)
+
+// ErrBadDatabase is returned if a file isn't a MaxMind DB.
+var ErrBadDatabase = errors.New("bad MaxMind DB")
+
+// mmdbMetadataMarker precedes the metadata at the end of MaxMind DBs.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	// mmdbDataSeparator is the number of zero bytes between the search tree
+	// and the data section.
+	mmdbDataSeparator = 16
+	// mmdbMaxDepth is the deepest nesting of maps, arrays, and pointers
+	// decoded.
+	mmdbMaxDepth = 32
+	// mmdbMaxPrealloc is the most entries allocated for a map or array before
+	// they are decoded, so bad sizes don't allocate too much.
+	mmdbMaxPrealloc = 64
+)
+
+// Types of fields in the data section.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// mmdb is a MaxMind DB read into memory.
+//
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdb struct {
+	bs         []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// data is the data section.
+	data []byte
+	// ipv4Start is the node IPv4 addresses are looked up from in IPv6
+	// databases, which is reached by the 96 zero bits of the IPv4-prefix.
+	ipv4Start uint
+}
+
+// parseMMDB parses the MaxMind DB.
+//
+// Returns ErrBadDatabase if the MaxMind DB is bad.
+func parseMMDB(bs []byte) (*mmdb, error) {
+	i := bytes.LastIndex(bs, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, ErrBadDatabase
+	}
+	d := decoder{data: bs[i+len(mmdbMetadataMarker):]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := v.(map[string]any)
+	if !ok {
+		return nil, ErrBadDatabase
+	}
+	db := &mmdb{bs: bs}
+	nodeCount, ok1 := metadata["node_count"].(uint64)
+	recordSize, ok2 := metadata["record_size"].(uint64)
+	ipVersion, ok3 := metadata["ip_version"].(uint64)
+	if !ok1 || !ok2 || !ok3 || (recordSize != 24 && recordSize != 28 && recordSize != 32) ||
+		(ipVersion != 4 && ipVersion != 6) {
+		return nil, ErrBadDatabase
+	}
+	db.nodeCount, db.recordSize, db.ipVersion = uint(nodeCount), uint(recordSize), uint(ipVersion)
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint(i) {
+		return nil, ErrBadDatabase
+	}
+	db.data = bs[treeSize+mmdbDataSeparator : i]
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < db.nodeCount; j++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// LookupFields of the record of the IP at each path of map keys, decoding only
+// those fields.
+//
+// Returns a field for each path, which is nil if the IP isn't in the MaxMind DB
+// or its record has no field at the path, and ErrBadDatabase if the MaxMind DB
+// is bad.
+func (db *mmdb) LookupFields(ip ban.IP, paths ...[]string) ([]any, error) {
+	fields := make([]any, len(paths))
+	offset, ok, err := db.locate(ip)
+	if !ok || err != nil {
+		return fields, err
+	}
+	d := decoder{data: db.data}
+	for i, path := range paths {
+		if fields[i], err = d.field(offset, path...); err != nil {
+			return fields, err
+		}
+	}
+	return fields, nil
+}
+
+// locate the offset in the data section of the record of the IP.
+//
+// Returns false if the IP isn't in the MaxMind DB and ErrBadDatabase if the
+// MaxMind DB is bad.
+func (db *mmdb) locate(ip ban.IP) (uint, bool, error) {
+	addr, bits, node := ip[:], 128, uint(0)
+	if v4, ok := ip.IPv4(); ok {
+		addr, bits = v4[:], 32
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return 0, false, nil
+	}
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node == db.nodeCount {
+		return 0, false, nil
+	}
+	if node < db.nodeCount {
+		return 0, false, ErrBadDatabase
+	}
+	return node - db.nodeCount - mmdbDataSeparator, true, nil
+}
+
+// record of the node which is followed by the bit.
+func (db *mmdb) record(node, bit uint) uint {
+	size := db.recordSize / 4
+	b := db.bs[node*size : (node+1)*size]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// decoder of fields in a data section.
+type decoder struct {
+	data []byte
+}
+
+// decode the field at the offset nested in the depth of maps and arrays.
+//
+// Maps are decoded as map[string]any, arrays as []any, strings as string,
+// unsigned integers as uint64, int32s as int64, doubles and floats as float64,
+// booleans as bool, and bytes and uint128s as []byte.
+//
+// Returns the field, the offset after it, and ErrBadDatabase if the field is
+// bad.
+func (d decoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, ErrBadDatabase
+	}
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind == mmdbPointer {
+		v, _, err := d.decode(size, depth+1)
+		return v, offset, err
+	}
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]any, min(size, mmdbMaxPrealloc))
+		for i := uint(0); i < size; i++ {
+			var k, v any
+			if k, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, ErrBadDatabase
+			}
+			if v, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, min(size, mmdbMaxPrealloc))
+		for i := uint(0); i < size; i++ {
+			var v any
+			if v, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+	if size > uint(len(d.data))-offset {
+		return nil, 0, ErrBadDatabase
+	}
+	b, end := d.data[offset:offset+size], offset+size
+	switch kind {
+	case mmdbString:
+		return string(b), end, nil
+	case mmdbBytes, mmdbUint128:
+		return b, end, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, ErrBadDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), end, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, ErrBadDatabase
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), end, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		if size > 8 {
+			return nil, 0, ErrBadDatabase
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if kind == mmdbInt32 {
+			return int64(int32(uint32(n))), end, nil
+		}
+		return n, end, nil
+	}
+	return nil, 0, ErrBadDatabase
+}
+
+// field decodes the field at the path of map keys in the field at the offset,
+// skipping the fields which aren't on the path.
+//
+// Returns nil if there is no field at the path and ErrBadDatabase if a field is
+// bad.
+func (d decoder) field(offset uint, path ...string) (any, error) {
+	for _, key := range path {
+		kind, size, next, err := d.control(offset)
+		if err != nil {
+			return nil, err
+		}
+		if kind == mmdbPointer {
+			if kind, size, next, err = d.control(size); err != nil {
+				return nil, err
+			}
+		}
+		if kind != mmdbMap {
+			return nil, nil
+		}
+		found := false
+		for i := uint(0); i < size && !found; i++ {
+			k, value, err := d.decode(next, 0)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := k.(string)
+			if !ok {
+				return nil, ErrBadDatabase
+			}
+			if name == key {
+				offset, found = value, true
+			} else if next, err = d.skip(value, 0); err != nil {
+				return nil, err
+			}
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+	v, _, err := d.decode(offset, 0)
+	return v, err
+}
+
+// skip the field at the offset nested in the depth of maps and arrays without
+// decoding it.
+//
+// Returns the offset after the field and ErrBadDatabase if the field is bad.
+func (d decoder) skip(offset uint, depth int) (uint, error) {
+	if depth > mmdbMaxDepth {
+		return 0, ErrBadDatabase
+	}
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return 0, err
+	}
+	switch kind {
+	case mmdbPointer, mmdbBool:
+		return offset, nil
+	case mmdbMap:
+		size *= 2
+		fallthrough
+	case mmdbArray:
+		for i := uint(0); i < size; i++ {
+			if offset, err = d.skip(offset, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		return offset, nil
+	}
+	if size > uint(len(d.data))-offset {
+		return 0, ErrBadDatabase
+	}
+	return offset + size, nil
+}
+
+// control reads the control byte, and any bytes extending it, of the field at
+// the offset.
+//
+// Returns the type, the size, which is the offset pointed to for pointers, the
+// offset of the field's payload, and ErrBadDatabase if the bytes are bad.
+func (d decoder) control(offset uint) (int, uint, uint, error) {
+	next := func(n uint) ([]byte, bool) {
+		if offset > uint(len(d.data)) || n > uint(len(d.data))-offset {
+			return nil, false
+		}
+		b := d.data[offset : offset+n]
+		offset += n
+		return b, true
+	}
+	b, ok := next(1)
+	if !ok {
+		return 0, 0, 0, ErrBadDatabase
+	}
+	ctrl := b[0]
+	kind := int(ctrl >> 5)
+	if kind == mmdbPointer {
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		b, ok := next(ss + 1)
+		if !ok {
+			return 0, 0, 0, ErrBadDatabase
+		}
+		var p uint
+		for _, c := range b {
+			p = p<<8 | uint(c)
+		}
+		switch ss {
+		case 0:
+			p |= vvv << 8
+		case 1:
+			p = (p | vvv<<16) + 2048
+		case 2:
+			p = (p | vvv<<24) + 526336
+		}
+		return kind, p, offset, nil
+	}
+	if kind == mmdbExtended {
+		b, ok := next(1)
+		if !ok {
+			return 0, 0, 0, ErrBadDatabase
+		}
+		kind = 7 + int(b[0])
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		b, ok := next(size - 28)
+		if !ok {
+			return 0, 0, 0, ErrBadDatabase
+		}
+		var n uint
+		for _, c := range b {
+			n = n<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[size-29] + n
+	}
+	return kind, size, offset, nil
+}
@@ -0,0 +1,213 @@
+// Package grpcban provides gRPC server interceptors which enforce and issue
+// the Bans of a ban.Engine.
+//
+// Sharing the ban.Engine of an HTTP server in the same process means Bans
+// issued by either server take effect in both and are stored in the same
+// place.
+package grpcban
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jwowillo/ban"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Call describes a gRPC call being checked by a Banner.
+type Call struct {
+	// FullMethod is the full name of the called method, like
+	// "/package.Service/Method".
+	FullMethod string
+	// Metadata sent by the client.
+	Metadata metadata.MD
+	// IsStream is true if the call is a streaming call.
+	IsStream bool
+}
+
+// Banner issues bans to IPs based on gRPC calls.
+type Banner interface {
+	Ban(ban.IP, Call) ban.Ban
+}
+
+// BannerFunc is a helper type to convert a function to a Banner.
+type BannerFunc func(ban.IP, Call) ban.Ban
+
+// Ban calls the converted function.
+func (f BannerFunc) Ban(ip ban.IP, c Call) ban.Ban {
+	return f(ip, c)
+}
+
+// Config for the Interceptor.
+type Config struct {
+	// TrustedProxies are the PrefixedIPs of proxies whose forwarded
+	// metadata is used to find the IP of the original client.
+	//
+	// Forwarded metadata is ignored if not assigned.
+	TrustedProxies []*ban.PrefixedIP
+	// ForwardedKey is the metadata key holding the comma-separated chain of
+	// forwarded IPs, appended to by each proxy.
+	//
+	// Defaults to "x-forwarded-for" if not assigned.
+	ForwardedKey string
+	// ErrorHandler handles errors passed to it.
+	//
+	// Defaults to ban.StderrErrorHandler if not assigned.
+	ErrorHandler ban.ErrorHandler
+}
+
+// DefaultConfig which ignores forwarded metadata and uses
+// ban.StderrErrorHandler.
+var DefaultConfig = Config{}
+
+// defaultForwardedKey is the ForwardedKey if none is assigned.
+const defaultForwardedKey = "x-forwarded-for"
+
+// Interceptor checks gRPC calls for Bans in a ban.Engine and issues Bans from
+// a Banner into it.
+//
+// Bans which don't ban the IP, like ban.KeyBan, ban.FingerprintBan, and
+// ban.ChallengeBan, can't be enforced on gRPC calls, so calls they are issued
+// for are let through.
+type Interceptor struct {
+	engine         *ban.Engine
+	banner         Banner
+	trustedProxies []*ban.PrefixedIP
+	forwardedKey   string
+	errorHandler   ban.ErrorHandler
+}
+
+// New Interceptor that checks for Bans in the ban.Engine and issues Bans from
+// the Banner with behavior customized by Config.
+func New(e *ban.Engine, banner Banner, cfg Config) *Interceptor {
+	forwardedKey := cfg.ForwardedKey
+	if forwardedKey == "" {
+		forwardedKey = defaultForwardedKey
+	}
+	errorHandler := cfg.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = ban.StderrErrorHandler
+	}
+	return &Interceptor{
+		engine:         e,
+		banner:         banner,
+		trustedProxies: cfg.TrustedProxies,
+		forwardedKey:   strings.ToLower(forwardedKey),
+		errorHandler:   errorHandler,
+	}
+}
+
+// Unary returns a grpc.UnaryServerInterceptor which rejects calls from banned
+// IPs with codes.PermissionDenied.
+func (i *Interceptor) Unary() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if err := i.check(ctx, info.FullMethod, false); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// Stream returns a grpc.StreamServerInterceptor which rejects calls from
+// banned IPs with codes.PermissionDenied.
+func (i *Interceptor) Stream() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if err := i.check(ss.Context(), info.FullMethod, true); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// check if the IP that made the call is banned or if it should be banned.
+//
+// Returns a codes.PermissionDenied status error if the IP is banned, including
+// by the call's Ban, or a codes.Internal status error if the IP can't be found.
+func (i *Interceptor) check(ctx context.Context, method string, isStream bool) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ip, err := i.clientIP(ctx, md)
+	if err != nil {
+		i.errorHandler(err)
+		return status.Error(codes.Internal, err.Error())
+	}
+	if i.engine.Check(ip) {
+		return banned(ip)
+	}
+	b := i.banner.Ban(ip, Call{FullMethod: method, Metadata: md, IsStream: isStream})
+	if b == ban.NoBan {
+		return nil
+	}
+	reason := b.Reason()
+	if reason == "" {
+		reason = method
+	}
+	meta := ban.Meta{Reason: reason, Issuer: "grpc"}
+	pip, err := i.engine.Issue(ip, b, meta)
+	if err != nil {
+		i.errorHandler(err)
+		return banned(ip)
+	}
+	if pip == nil {
+		return nil
+	}
+	return banned(ip)
+}
+
+// clientIP returns the IP of the client which made the call.
+//
+// If the peer is a trusted proxy, the forwarded chain is walked from the most
+// recently appended IP until an IP which isn't a trusted proxy is found.
+//
+// Returns ban.ErrBadIP if the peer's IP can't be found or a forwarded IP
+// can't be parsed.
+func (i *Interceptor) clientIP(ctx context.Context, md metadata.MD) (ban.IP, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ban.IP{}, ban.ErrBadIP
+	}
+	ip, err := ban.ParseRemoteAddress(p.Addr.String())
+	if err != nil {
+		return ban.IP{}, err
+	}
+	var chain []string
+	for _, value := range md.Get(i.forwardedKey) {
+		for _, s := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(s))
+		}
+	}
+	for j := len(chain) - 1; j >= 0 && i.isTrustedProxy(ip); j-- {
+		if ip, err = ban.ParseIP(chain[j]); err != nil {
+			return ban.IP{}, err
+		}
+	}
+	return ip, nil
+}
+
+// isTrustedProxy returns true if the IP is one of the trusted proxies.
+func (i *Interceptor) isTrustedProxy(ip ban.IP) bool {
+	for _, pip := range i.trustedProxies {
+		if pip.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// banned returns the status error for a banned IP.
+func banned(ip ban.IP) error {
+	return status.Errorf(codes.PermissionDenied, "%v is banned", ip)
+}
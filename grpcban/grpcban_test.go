@@ -0,0 +1,189 @@
+package grpcban
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jwowillo/ban"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// TestUnary tests that the unary interceptor issues and enforces Bans.
+func TestUnary(t *testing.T) {
+	t.Parallel()
+	i := New(testHandler().Engine(), testBanner(), Config{ErrorHandler: ban.IgnoreErrorHandler})
+	testUnary(t, i, testContext("5.6.7.8:1", nil), "/test.Service/Allowed", codes.OK)
+	testUnary(t, i, testContext("1.2.3.4:1", nil), "/test.Service/Allowed", codes.OK)
+	testUnary(t, i, testContext("1.2.3.4:1", nil), "/test.Service/Banned", codes.PermissionDenied)
+	testUnary(t, i, testContext("1.2.3.4:1", nil), "/test.Service/Allowed", codes.PermissionDenied)
+	testUnary(t, i, context.Background(), "/test.Service/Allowed", codes.Internal)
+}
+
+// TestStream tests that the stream interceptor issues and enforces Bans.
+func TestStream(t *testing.T) {
+	t.Parallel()
+	i := New(testHandler().Engine(), testBanner(), Config{ErrorHandler: ban.IgnoreErrorHandler})
+	testStream(t, i, testContext("1.2.3.4:1", nil), "/test.Service/Allowed", codes.OK)
+	testStream(t, i, testContext("1.2.3.4:1", nil), "/test.Service/Banned", codes.PermissionDenied)
+	testStream(t, i, testContext("1.2.3.4:1", nil), "/test.Service/Allowed", codes.PermissionDenied)
+}
+
+// TestIPlessBans tests that calls issued Bans which don't ban the IP are let
+// through without banning it.
+func TestIPlessBans(t *testing.T) {
+	t.Parallel()
+	for _, b := range []ban.Ban{ban.KeyBan, ban.FingerprintBan, ban.ChallengeBan} {
+		e := testHandler().Engine()
+		i := New(e, BannerFunc(func(ip ban.IP, c Call) ban.Ban { return b }), Config{ErrorHandler: ban.IgnoreErrorHandler})
+		testUnary(t, i, testContext("1.2.3.4:1", nil), "/test.Service/Method", codes.OK)
+		if pips := e.PrefixedIPs(); len(pips) != 0 {
+			t.Errorf("e.PrefixedIPs() = %v, want none after %v", pips, b)
+		}
+	}
+}
+
+// TestSharedHandler tests that Bans issued over HTTP are enforced over gRPC and
+// the reverse.
+func TestSharedHandler(t *testing.T) {
+	t.Parallel()
+	h := testHandler()
+	i := New(h.Engine(), testBanner(), Config{ErrorHandler: ban.IgnoreErrorHandler})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, &http.Request{RemoteAddr: "1.2.3.4:1"})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("rec.Code = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	testUnary(t, i, testContext("1.2.3.4:1", nil), "/test.Service/Allowed", codes.PermissionDenied)
+	testUnary(t, i, testContext("5.6.7.8:1", nil), "/test.Service/Banned", codes.PermissionDenied)
+	ip, err := ban.ParseIP("5.6.7.8")
+	if err != nil {
+		t.Error(err)
+	}
+	if !h.Engine().Check(ip) {
+		t.Errorf("h.Engine().Check(%v) = false, want true", ip)
+	}
+}
+
+// TestForwarded tests that forwarded metadata is only used from trusted
+// proxies.
+func TestForwarded(t *testing.T) {
+	t.Parallel()
+	proxies, err := ban.ParsePrefixedIP("10.0.0.0/8")
+	if err != nil {
+		t.Error(err)
+	}
+	var got ban.IP
+	b := BannerFunc(func(ip ban.IP, c Call) ban.Ban {
+		got = ip
+		return ban.NoBan
+	})
+	i := New(testHandler().Engine(), b, Config{
+		TrustedProxies: []*ban.PrefixedIP{proxies},
+		ErrorHandler:   ban.IgnoreErrorHandler,
+	})
+	cases := []struct {
+		Peer      string
+		Forwarded []string
+		Want      string
+	}{
+		{Peer: "10.0.0.1:1", Forwarded: []string{"1.2.3.4"}, Want: "1.2.3.4"},
+		{Peer: "10.0.0.1:1", Forwarded: []string{"9.9.9.9, 1.2.3.4, 10.0.0.2"}, Want: "1.2.3.4"},
+		{Peer: "10.0.0.1:1", Forwarded: []string{"9.9.9.9", "1.2.3.4"}, Want: "1.2.3.4"},
+		{Peer: "10.0.0.1:1", Forwarded: []string{"10.0.0.3"}, Want: "10.0.0.3"},
+		{Peer: "10.0.0.1:1", Forwarded: nil, Want: "10.0.0.1"},
+		{Peer: "5.6.7.8:1", Forwarded: []string{"1.2.3.4"}, Want: "5.6.7.8"},
+		{Peer: "[2001:db8::1]:1", Forwarded: []string{"1.2.3.4"}, Want: "2001:db8::1"},
+	}
+	for _, c := range cases {
+		testUnary(t, i, testContext(c.Peer, c.Forwarded), "/test.Service/Allowed", codes.OK)
+		if got.String() != c.Want {
+			t.Errorf("ip = %v, want %v for %v %v", got, c.Want, c.Peer, c.Forwarded)
+		}
+	}
+	testUnary(
+		t, i, testContext("10.0.0.1:1", []string{"bad"}),
+		"/test.Service/Allowed", codes.Internal,
+	)
+}
+
+// testHandler returns a ban.Handler which bans every IP making an
+// http.Request.
+func testHandler() *ban.Handler {
+	return ban.New(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		ban.BannerFunc(func(ip ban.IP, r *http.Request) ban.Ban { return ban.IPBan }),
+		ban.Config{ErrorHandler: ban.IgnoreErrorHandler},
+	)
+}
+
+// testBanner returns a Banner which bans IPs calling the method
+// "/test.Service/Banned".
+func testBanner() Banner {
+	return BannerFunc(func(ip ban.IP, c Call) ban.Ban {
+		if c.FullMethod == "/test.Service/Banned" {
+			return ban.IPBan
+		}
+		return ban.NoBan
+	})
+}
+
+// testContext returns an incoming context from the peer address with the
+// forwarded metadata.
+func testContext(addr string, forwarded []string) context.Context {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: tcpAddr})
+	md := metadata.MD{}
+	for _, f := range forwarded {
+		md.Append(defaultForwardedKey, f)
+	}
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+// testUnary tests that a unary call to the method with the context gets the
+// code.
+func testUnary(t *testing.T, i *Interceptor, ctx context.Context, method string, code codes.Code) {
+	_, err := i.Unary()(
+		ctx, nil, &grpc.UnaryServerInfo{FullMethod: method},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		},
+	)
+	if status.Code(err) != code {
+		t.Errorf("unary %s = %v, want %v", method, err, code)
+	}
+}
+
+// testServerStream is a grpc.ServerStream with a fixed context.
+type testServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the fixed context.
+func (s *testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// testStream tests that a streaming call to the method with the context gets
+// the code.
+func testStream(t *testing.T, i *Interceptor, ctx context.Context, method string, code codes.Code) {
+	err := i.Stream()(
+		nil, &testServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: method},
+		func(srv interface{}, ss grpc.ServerStream) error {
+			return nil
+		},
+	)
+	if status.Code(err) != code {
+		t.Errorf("stream %s = %v, want %v", method, err, code)
+	}
+}
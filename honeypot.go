@@ -0,0 +1,268 @@
+package ban
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// DefaultHoneypotPaths are paths which scanners probe for but few sites serve,
+// like the admin pages of software the site doesn't run and files which should
+// never be served.
+var DefaultHoneypotPaths = []string{
+	"/.env",
+	"/.git",
+	"/.svn",
+	"/.hg",
+	"/.aws",
+	"/.ssh",
+	"/.htaccess",
+	"/.htpasswd",
+	"/.DS_Store",
+	"/wp-admin",
+	"/wp-login.php",
+	"/wp-config.php",
+	"/xmlrpc.php",
+	"/phpmyadmin",
+	"/pma",
+	"/phpinfo.php",
+	"/config.php",
+	"/server-status",
+	"/cgi-bin",
+	"/vendor/phpunit",
+	"/boaform",
+	"/HNAP1",
+}
+
+// HoneypotConfig for Honeypots.
+type HoneypotConfig struct {
+	// Paths which are traps, along with every path under them, compared
+	// case-insensitively.
+	//
+	// Defaults to DefaultHoneypotPaths if not assigned.
+	Paths []string
+	// Patterns which are traps if they match a path.
+	//
+	// Defaults to no Patterns if not assigned.
+	Patterns []*regexp.Regexp
+	// LinkPath is a trap linked to by hidden links injected into HTML
+	// responses by Handler, which people can't see but scrapers follow.
+	//
+	// Crawlers follow the links too, so the LinkPath should be disallowed in
+	// robots.txt and verified crawlers exempted with an Allowlist like
+	// CrawlerVerifier.Verified.
+	//
+	// Links aren't injected if not assigned.
+	LinkPath string
+	// Ban issued by the Honeypot to IPs which requested a trap.
+	//
+	// Defaults to IPBan if not assigned.
+	Ban Ban
+}
+
+// DefaultHoneypotConfig which bans the IPs which request DefaultHoneypotPaths
+// and doesn't inject links.
+var DefaultHoneypotConfig = HoneypotConfig{}
+
+// maxHoneypotBuffer is the most bytes of an HTML response buffered by Handler
+// before it gives up injecting a link and passes the response on.
+const maxHoneypotBuffer = 1 << 20
+
+// Honeypot is a Banner which bans IPs that request trap paths.
+//
+// The Bans are issued because of "honeypot" and the trap which fired, like
+// "honeypot /.env".
+type Honeypot struct {
+	paths    []string
+	patterns []*regexp.Regexp
+	linkPath string
+	ban      Ban
+	// link is the hidden link injected into HTML responses.
+	link []byte
+}
+
+// NewHoneypot with behavior customized by HoneypotConfig.
+func NewHoneypot(cfg HoneypotConfig) *Honeypot {
+	paths := cfg.Paths
+	if paths == nil {
+		paths = DefaultHoneypotPaths
+	}
+	b := cfg.Ban
+	if b == (Ban{}) {
+		b = IPBan
+	}
+	h := &Honeypot{paths: paths, patterns: cfg.Patterns, linkPath: cfg.LinkPath, ban: b}
+	if h.linkPath != "" {
+		h.link = []byte(`<a href="` + html.EscapeString(h.linkPath) +
+			`" style="display:none" rel="nofollow" aria-hidden="true" tabindex="-1"></a>`)
+	}
+	return h
+}
+
+// Trap returns the trap the http.Request fired, either a path or the String
+// of a pattern, and true if it fired one.
+//
+// The path is cleaned before it is matched, so traps can't be dodged with
+// paths like "//.env" or "/static/../.env".
+func (h *Honeypot) Trap(r *http.Request) (string, bool) {
+	if r.URL == nil {
+		return "", false
+	}
+	path := cleanPath(r.URL.Path)
+	if h.linkPath != "" && path == cleanPath(h.linkPath) {
+		return h.linkPath, true
+	}
+	for _, trap := range h.paths {
+		if len(path) >= len(trap) && strings.EqualFold(path[:len(trap)], trap) &&
+			(len(path) == len(trap) || path[len(trap)] == '/') {
+			return trap, true
+		}
+	}
+	for _, pattern := range h.patterns {
+		if pattern.MatchString(path) {
+			return pattern.String(), true
+		}
+	}
+	return "", false
+}
+
+// Ban issues the Ban to the IP if the http.Request fired a trap.
+func (h *Honeypot) Ban(ip IP, r *http.Request) Ban {
+	trap, ok := h.Trap(r)
+	if !ok {
+		return NoBan
+	}
+	return h.ban.Because("honeypot " + trap)
+}
+
+// Handler which injects hidden links to the LinkPath into the HTML responses
+// of the http.Handler.
+//
+// Links are injected before the closing body tag, or at the end if there is
+// none. Compressed responses and HTML responses larger than a megabyte are
+// passed on unchanged.
+func (h *Honeypot) Handler(next http.Handler) http.Handler {
+	if h.link == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := &honeypotWriter{ResponseWriter: rw, link: h.link}
+		next.ServeHTTP(w, r)
+		w.finish()
+	})
+}
+
+// honeypotWriter is an http.ResponseWriter which buffers HTML responses to
+// inject a link into them.
+type honeypotWriter struct {
+	http.ResponseWriter
+	link []byte
+
+	code        int
+	wroteHeader bool
+	// passing is true once the response is being passed on without being
+	// buffered.
+	passing bool
+	buf     bytes.Buffer
+}
+
+// WriteHeader starts buffering the response if it is HTML and passes it on
+// otherwise.
+//
+// Informational responses, like 103 Early Hints, are passed on without
+// affecting the final response.
+func (w *honeypotWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if code >= 100 && code < http.StatusOK && code != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+	w.code = code
+	header := w.Header()
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	if !strings.HasPrefix(contentType, "text/html") || header.Get("Content-Encoding") != "" ||
+		code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified {
+		w.passing = true
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	header.Del("Content-Length")
+}
+
+// Write the bytes to the buffer, or pass them on if the response isn't being
+// buffered.
+func (w *honeypotWriter) Write(bs []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(bs))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passing {
+		return w.ResponseWriter.Write(bs)
+	}
+	w.buf.Write(bs)
+	if w.buf.Len() > maxHoneypotBuffer {
+		w.pass()
+	}
+	return len(bs), nil
+}
+
+// Flush gives up injecting the link and flushes the response.
+func (w *honeypotWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.passing {
+		w.pass()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped http.ResponseWriter so http.ResponseController
+// can reach it.
+func (w *honeypotWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// pass on the buffered response without injecting the link.
+func (w *honeypotWriter) pass() {
+	w.passing = true
+	w.ResponseWriter.WriteHeader(w.code)
+	w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+// finish writing the buffered response with the link injected.
+func (w *honeypotWriter) finish() {
+	if !w.wroteHeader || w.passing {
+		return
+	}
+	bs := w.buf.Bytes()
+	i := lastIndexFold(bs, []byte("</body>"))
+	if i < 0 {
+		i = len(bs)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	w.ResponseWriter.Write(bs[:i])
+	w.ResponseWriter.Write(w.link)
+	w.ResponseWriter.Write(bs[i:])
+}
+
+// lastIndexFold returns the index of the last instance of the ASCII sub in the
+// bytes compared case-insensitively, or -1 if there is none.
+func lastIndexFold(bs, sub []byte) int {
+	for i := len(bs) - len(sub); i >= 0; i-- {
+		if bytes.EqualFold(bs[i:i+len(sub)], sub) {
+			return i
+		}
+	}
+	return -1
+}
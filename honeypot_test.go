@@ -0,0 +1,166 @@
+package ban
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestHoneypot tests that Honeypots ban IPs which request traps because of the
+// trap which fired.
+func TestHoneypot(t *testing.T) {
+	t.Parallel()
+	h := NewHoneypot(HoneypotConfig{
+		Paths:    append([]string{"/old-admin"}, DefaultHoneypotPaths...),
+		Patterns: []*regexp.Regexp{regexp.MustCompile(`\.(bak|sql)$`)},
+		LinkPath: "/trap",
+	})
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	cases := []struct {
+		Path string
+		Ban  Ban
+	}{
+		{Path: "/.env", Ban: IPBan.Because("honeypot /.env")},
+		{Path: "/.git/config", Ban: IPBan.Because("honeypot /.git")},
+		{Path: "/WP-ADMIN/install.php", Ban: IPBan.Because("honeypot /wp-admin")},
+		{Path: "/old-admin", Ban: IPBan.Because("honeypot /old-admin")},
+		{Path: "/backup/site.sql", Ban: IPBan.Because(`honeypot \.(bak|sql)$`)},
+		{Path: "/trap", Ban: IPBan.Because("honeypot /trap")},
+		{Path: "//.env", Ban: IPBan.Because("honeypot /.env")},
+		{Path: "/static/../.env", Ban: IPBan.Because("honeypot /.env")},
+		{Path: "/./wp-admin/", Ban: IPBan.Because("honeypot /wp-admin")},
+		{Path: "/trap/", Ban: IPBan.Because("honeypot /trap")},
+		{Path: "//trap", Ban: IPBan.Because("honeypot /trap")},
+		{Path: "/", Ban: NoBan},
+		{Path: "/.environment", Ban: NoBan},
+		{Path: "/blog/wp-admin", Ban: NoBan},
+		{Path: "/trap/more", Ban: NoBan},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, c.Path, nil)
+		if got := h.Ban(ip, r); got != c.Ban {
+			t.Errorf("h.Ban(%s) = %v, want %v", c.Path, got, c.Ban)
+		}
+	}
+	unclean := NewHoneypot(HoneypotConfig{Paths: []string{}, LinkPath: "/trap/"})
+	r := httptest.NewRequest(http.MethodGet, "/trap", nil)
+	if got, want := unclean.Ban(ip, r), IPBan.Because("honeypot /trap/"); got != want {
+		t.Errorf("unclean.Ban(/trap) = %v, want %v", got, want)
+	}
+	custom := NewHoneypot(HoneypotConfig{Paths: []string{"/secret"}, Ban: IPBan.For(0).AndKey()})
+	r = httptest.NewRequest(http.MethodGet, "/.env", nil)
+	if got := custom.Ban(ip, r); got != NoBan {
+		t.Errorf("custom.Ban(/.env) = %v, want %v", got, NoBan)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/secret", nil)
+	if got, want := custom.Ban(ip, r), IPBan.AndKey().Because("honeypot /secret"); got != want {
+		t.Errorf("custom.Ban(/secret) = %v, want %v", got, want)
+	}
+}
+
+// TestHoneypotHandler tests that Handlers ban IPs which request traps with the
+// trap as the Reason and that hidden links are only injected into HTML.
+func TestHoneypotHandler(t *testing.T) {
+	t.Parallel()
+	hp := NewHoneypot(HoneypotConfig{LinkPath: "/trap"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Length", "38")
+		io.WriteString(rw, "<html><BODY><p>hi</p></BODY></html>\n\n")
+	})
+	mux.HandleFunc("/fragment", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(rw, "<p>hi</p>")
+	})
+	mux.HandleFunc("/json", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		io.WriteString(rw, `{"body": "</body>"}`)
+	})
+	h := New(hp.Handler(mux), hp, Config{ErrorHandler: func(err error) { t.Error(err) }})
+	var reasons []string
+	h.Engine().OnEvent(func(e Event) {
+		if e.Type == EventIssue {
+			reasons = append(reasons, e.Meta.Reason)
+		}
+	})
+	link := `<a href="/trap" style="display:none" rel="nofollow" aria-hidden="true" tabindex="-1"></a>`
+	cases := []struct {
+		IP   string
+		Path string
+		Code int
+		Body string
+	}{
+		{IP: "1.1.1.1", Path: "/page", Code: http.StatusOK, Body: "<html><BODY><p>hi</p>" + link + "</BODY></html>\n\n"},
+		{IP: "1.1.1.1", Path: "/fragment", Code: http.StatusOK, Body: "<p>hi</p>" + link},
+		{IP: "1.1.1.1", Path: "/json", Code: http.StatusOK, Body: `{"body": "</body>"}`},
+		{IP: "1.1.1.1", Path: "/trap", Code: http.StatusForbidden, Body: "1.1.1.1 is banned"},
+		{IP: "1.1.1.1", Path: "/page", Code: http.StatusForbidden, Body: "1.1.1.1 is banned"},
+		{IP: "2.2.2.2", Path: "/.git/config", Code: http.StatusForbidden, Body: "2.2.2.2 is banned"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, c.Path, nil)
+		r.RemoteAddr = c.IP + ":1"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != c.Code {
+			t.Errorf("%s %s: rec.Code = %d, want %d", c.IP, c.Path, rec.Code, c.Code)
+		}
+		if got := rec.Body.String(); got != c.Body {
+			t.Errorf("%s %s: rec.Body = %q, want %q", c.IP, c.Path, got, c.Body)
+		}
+		if got := rec.Header().Get("Content-Length"); got != "" {
+			t.Errorf("%s %s: Content-Length = %s, want none", c.IP, c.Path, got)
+		}
+	}
+	if got, want := strings.Join(reasons, ", "), "honeypot /trap, honeypot /.git"; got != want {
+		t.Errorf("reasons = %s, want %s", got, want)
+	}
+	rec := httptest.NewRecorder()
+	w := &honeypotWriter{ResponseWriter: rec, link: hp.link}
+	if got := w.Unwrap(); got != rec {
+		t.Errorf("w.Unwrap() = %v, want %v", got, rec)
+	}
+}
+
+// TestHoneypotInformational tests that informational responses are passed on
+// without being taken for the final response.
+func TestHoneypotInformational(t *testing.T) {
+	t.Parallel()
+	hp := NewHoneypot(HoneypotConfig{LinkPath: "/trap"})
+	h := hp.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusEarlyHints)
+		rw.Header().Set("Content-Type", "text/html")
+		rw.WriteHeader(http.StatusAccepted)
+		io.WriteString(rw, "<p>hi</p>")
+	}))
+	rec := &testInformationalRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(rec.informational) != 1 || rec.informational[0] != http.StatusEarlyHints {
+		t.Errorf("rec.informational = %v, want [%d]", rec.informational, http.StatusEarlyHints)
+	}
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("rec.Code = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if got, want := rec.Body.String(), "<p>hi</p>"+string(hp.link); got != want {
+		t.Errorf("rec.Body = %q, want %q", got, want)
+	}
+}
+
+// testInformationalRecorder is an httptest.ResponseRecorder which records
+// informational responses apart from the final one.
+type testInformationalRecorder struct {
+	*httptest.ResponseRecorder
+	informational []int
+}
+
+// WriteHeader records informational codes and passes on others.
+func (r *testInformationalRecorder) WriteHeader(code int) {
+	if code < http.StatusOK {
+		r.informational = append(r.informational, code)
+		return
+	}
+	r.ResponseRecorder.WriteHeader(code)
+}
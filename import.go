@@ -0,0 +1,276 @@
+package ban
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// ErrUnsupportedRule is returned for lines of ban lists which block something
+// that can't be represented by PrefixedIPs.
+var ErrUnsupportedRule = errors.New("unsupported rule")
+
+// LineError is an error on a line of a ban list.
+type LineError struct {
+	// Line is the 1-based number of the line.
+	Line int
+	// Text of the line.
+	Text string
+	// Err is the error with the line.
+	Err error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %q: %v", e.Line, e.Text, e.Err)
+}
+
+// Unwrap returns the error with the line.
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// ImportError is every LineError from importing a ban list.
+type ImportError []*LineError
+
+func (e ImportError) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%v (and %d more errors)", e[0], len(e)-1)
+}
+
+// Importer reads PrefixedIPs from a ban list.
+//
+// Lines which can't be read don't stop the import. The PrefixedIPs from every
+// good line are returned along with an ImportError listing the bad lines.
+// Addresses without a prefix-length are imported with the full prefix-length of
+// their family.
+//
+// Returns an error other than an ImportError if the io.Reader fails.
+type Importer func(io.Reader) ([]*PrefixedIP, error)
+
+// maxImportLine is the most bytes in a line of a ban list, which is large since
+// tools like fail2ban list every banned IP on one line.
+const maxImportLine = 64 << 20
+
+// importLines reads the io.Reader line by line and imports the addresses
+// returned by parseLine for each line.
+//
+// Returns an ImportError if any line is bad or an error if the io.Reader fails.
+func importLines(r io.Reader, parseLine func(string) ([]string, error)) ([]*PrefixedIP, error) {
+	var pips []*PrefixedIP
+	var errs ImportError
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxImportLine)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		addrs, err := parseLine(line)
+		if err != nil {
+			errs = append(errs, &LineError{Line: n, Text: line, Err: err})
+			continue
+		}
+		for _, addr := range addrs {
+			pip, err := parseAddress(addr)
+			if err != nil {
+				errs = append(errs, &LineError{Line: n, Text: line, Err: err})
+				continue
+			}
+			pips = append(pips, pip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return pips, err
+	}
+	if len(errs) > 0 {
+		return pips, errs
+	}
+	return pips, nil
+}
+
+// parseAddress parses a PrefixedIP from the string form of either a
+// PrefixedIP or an IP, which is given the full prefix-length of its family.
+//
+// Returns an error if neither could be parsed.
+func parseAddress(addr string) (*PrefixedIP, error) {
+	if strings.Contains(addr, "/") {
+		return ParsePrefixedIP(addr)
+	}
+	ip, err := ParseIP(addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewPrefixedIP(ip, ip.bitLength())
+}
+
+// stripComment removes everything on the line after any of the comment
+// markers and surrounding whitespace.
+func stripComment(line string, markers string) string {
+	if i := strings.IndexAny(line, markers); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// ImportCIDRList reads a list with one IP or PrefixedIP per line.
+//
+// Comments start with '#' or ';' and run to the end of the line.
+func ImportCIDRList(r io.Reader) ([]*PrefixedIP, error) {
+	return importLines(r, func(line string) ([]string, error) {
+		fields := strings.Fields(stripComment(line, "#;"))
+		if len(fields) > 1 {
+			return nil, ErrBadPrefixedIP
+		}
+		return fields, nil
+	})
+}
+
+// spamhausEntry is a line of the JSON form of a Spamhaus DROP list.
+type spamhausEntry struct {
+	CIDR string `json:"cidr"`
+}
+
+// ImportSpamhausDROP reads a Spamhaus DROP or EDROP list in either the
+// text form, like "1.10.16.0/20 ; SBL256894", or the JSON form with one
+// object per line.
+func ImportSpamhausDROP(r io.Reader) ([]*PrefixedIP, error) {
+	return importLines(r, func(line string) ([]string, error) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "{") {
+			var entry spamhausEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				return nil, err
+			}
+			// The metadata line at the end has no CIDR.
+			if entry.CIDR == "" {
+				return nil, nil
+			}
+			return []string{entry.CIDR}, nil
+		}
+		fields := strings.Fields(stripComment(line, ";"))
+		if len(fields) > 1 {
+			return nil, ErrBadPrefixedIP
+		}
+		return fields, nil
+	})
+}
+
+// ImportNginxDeny reads the deny directives of an nginx configuration,
+// like "deny 1.2.3.0/24;".
+//
+// Other directives are ignored. "deny all;" is reported as an
+// ErrUnsupportedRule.
+func ImportNginxDeny(r io.Reader) ([]*PrefixedIP, error) {
+	return importLines(r, func(line string) ([]string, error) {
+		var addrs []string
+		isEnd := func(r rune) bool { return r == ';' || r == '{' || r == '}' }
+		for _, directive := range strings.FieldsFunc(stripComment(line, "#"), isEnd) {
+			fields := strings.Fields(directive)
+			if len(fields) == 0 || fields[0] != "deny" {
+				continue
+			}
+			if len(fields) != 2 {
+				return nil, ErrBadPrefixedIP
+			}
+			if fields[1] == "all" {
+				return nil, ErrUnsupportedRule
+			}
+			addrs = append(addrs, fields[1])
+		}
+		return addrs, nil
+	})
+}
+
+// ImportIPTablesSave reads the output of iptables-save or ip6tables-save
+// and imports the sources of rules which jump to DROP or REJECT, like
+// "-A INPUT -s 1.2.3.4/32 -j DROP".
+//
+// Rules without a source are ignored. Rules with a negated source are
+// reported as an ErrUnsupportedRule.
+func ImportIPTablesSave(r io.Reader) ([]*PrefixedIP, error) {
+	return importLines(r, func(line string) ([]string, error) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "-A" && fields[0] != "-I" {
+			return nil, nil
+		}
+		var source, target string
+		negated := false
+		for i := 1; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "-s", "--source":
+				source = fields[i+1]
+				negated = fields[i-1] == "!"
+			case "-j", "--jump":
+				target = fields[i+1]
+			}
+		}
+		if source == "" || target != "DROP" && target != "REJECT" {
+			return nil, nil
+		}
+		if negated {
+			return nil, ErrUnsupportedRule
+		}
+		return strings.Split(source, ","), nil
+	})
+}
+
+// ImportIPSetSave reads the output of "ipset save" and imports the entry
+// of every add command, like "add blocklist 1.2.3.0/24".
+//
+// Entries which aren't a single IP or PrefixedIP, like ranges or entries
+// with ports, are reported as an ErrUnsupportedRule.
+func ImportIPSetSave(r io.Reader) ([]*PrefixedIP, error) {
+	return importLines(r, func(line string) ([]string, error) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "add" {
+			return nil, nil
+		}
+		if len(fields) < 3 {
+			return nil, ErrBadPrefixedIP
+		}
+		if strings.ContainsAny(fields[2], ",-") {
+			return nil, ErrUnsupportedRule
+		}
+		return fields[2:3], nil
+	})
+}
+
+var (
+	// fail2banJail matches a jail and its list of addresses in the output of
+	// "fail2ban-client banned".
+	fail2banJail = regexp.MustCompile(`'[^']*'\s*:\s*\[([^\]]*)\]`)
+	// fail2banAddress matches a quoted address in a list of addresses.
+	fail2banAddress = regexp.MustCompile(`'([^']*)'`)
+)
+
+// ImportFail2ban reads the text output of fail2ban-client.
+//
+// The "Banned IP list:" lines of "fail2ban-client status <jail>", the
+// output of "fail2ban-client banned", and the whitespace-separated output
+// of "fail2ban-client get <jail> banip" are all understood.
+func ImportFail2ban(r io.Reader) ([]*PrefixedIP, error) {
+	return importLines(r, func(line string) ([]string, error) {
+		const bannedList = "Banned IP list:"
+		if i := strings.Index(line, bannedList); i >= 0 {
+			return strings.Fields(line[i+len(bannedList):]), nil
+		}
+		if jails := fail2banJail.FindAllStringSubmatch(line, -1); jails != nil {
+			var addrs []string
+			for _, jail := range jails {
+				for _, addr := range fail2banAddress.FindAllStringSubmatch(jail[1], -1) {
+					addrs = append(addrs, addr[1])
+				}
+			}
+			return addrs, nil
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "Status") ||
+			strings.ContainsAny(trimmed[:1], "|`[") {
+			return nil, nil
+		}
+		return strings.Fields(trimmed), nil
+	})
+}
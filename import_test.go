@@ -0,0 +1,193 @@
+package ban
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// importCase is a ban list with the PrefixedIPs and line numbers of errors
+// expected from importing it.
+type importCase struct {
+	List        string
+	PrefixedIPs []string
+	ErrorLines  []int
+}
+
+// TestImportCIDRList tests that ImportCIDRList reads plain lists with
+// comments.
+func TestImportCIDRList(t *testing.T) {
+	t.Parallel()
+	testImporter(t, ImportCIDRList, importCase{
+		List: `# blocklist
+1.2.3.4
+10.0.0.0/8 # private
+
+; other comment
+2001:db8::/32
+bad
+1.2.3.4 5.6.7.8
+1.2.3.4/33`,
+		PrefixedIPs: []string{"1.2.3.4/32", "10.0.0.0/8", "2001:db8::/32"},
+		ErrorLines:  []int{7, 8, 9},
+	})
+}
+
+// TestImportSpamhausDROP tests that ImportSpamhausDROP reads the text and JSON
+// forms of Spamhaus DROP lists.
+func TestImportSpamhausDROP(t *testing.T) {
+	t.Parallel()
+	testImporter(t, ImportSpamhausDROP, importCase{
+		List: `; Spamhaus DROP List 2024/01/01 - (c) 2024 The Spamhaus Project
+; Last-Modified: Mon, 01 Jan 2024 00:00:00 GMT
+1.10.16.0/20 ; SBL256894
+2.56.192.0/22 ; SBL459831
+{"cidr":"2a06:e480::/29","sblid":"SBL301771","rir":"ripencc"}
+{"type":"metadata","timestamp":1704067200,"size":1,"records":1}
+{"cidr":"bad"}
+{bad`,
+		PrefixedIPs: []string{"1.10.16.0/20", "2.56.192.0/22", "2a06:e480::/29"},
+		ErrorLines:  []int{7, 8},
+	})
+}
+
+// TestImportNginxDeny tests that ImportNginxDeny reads deny directives.
+func TestImportNginxDeny(t *testing.T) {
+	t.Parallel()
+	testImporter(t, ImportNginxDeny, importCase{
+		List: `# blocked
+deny 1.2.3.4;
+deny 10.0.0.0/8; deny 2001:db8::/32;
+    allow 192.168.0.0/16;
+deny all;
+deny bad;
+location / { deny 5.6.7.8; }`,
+		PrefixedIPs: []string{
+			"1.2.3.4/32", "10.0.0.0/8", "2001:db8::/32", "5.6.7.8/32",
+		},
+		ErrorLines: []int{5, 6},
+	})
+}
+
+// TestImportIPTablesSave tests that ImportIPTablesSave reads the sources of
+// DROP and REJECT rules.
+func TestImportIPTablesSave(t *testing.T) {
+	t.Parallel()
+	testImporter(t, ImportIPTablesSave, importCase{
+		List: `# Generated by iptables-save v1.8.7
+*filter
+:INPUT ACCEPT [0:0]
+-A INPUT -s 1.2.3.4/32 -j DROP
+-A INPUT -s 10.0.0.0/8 -p tcp -m tcp --dport 22 -j REJECT --reject-with icmp-port-unreachable
+-A INPUT -s 5.6.7.8/32 -j ACCEPT
+-A INPUT -p tcp -j DROP
+-I INPUT --source 9.9.9.9,8.8.8.0/24 --jump DROP
+-A INPUT ! -s 192.168.0.0/16 -j DROP
+-A INPUT -s bad -j DROP
+COMMIT`,
+		PrefixedIPs: []string{"1.2.3.4/32", "10.0.0.0/8", "9.9.9.9/32", "8.8.8.0/24"},
+		ErrorLines:  []int{9, 10},
+	})
+}
+
+// TestImportIPSetSave tests that ImportIPSetSave reads add commands.
+func TestImportIPSetSave(t *testing.T) {
+	t.Parallel()
+	testImporter(t, ImportIPSetSave, importCase{
+		List: `create blocklist hash:net family inet hashsize 1024 maxelem 65536
+add blocklist 1.2.3.4
+add blocklist 10.0.0.0/8 timeout 0
+add blocklist 1.2.3.4-1.2.3.10
+add blocklist 1.2.3.4,tcp:80
+add blocklist
+create blocklist6 hash:net family inet6
+add blocklist6 2001:db8::/32`,
+		PrefixedIPs: []string{"1.2.3.4/32", "10.0.0.0/8", "2001:db8::/32"},
+		ErrorLines:  []int{4, 5, 6},
+	})
+}
+
+// TestImportFail2ban tests that ImportFail2ban reads the output of
+// fail2ban-client.
+func TestImportFail2ban(t *testing.T) {
+	t.Parallel()
+	testImporter(t, ImportFail2ban, importCase{
+		List: "Status for the jail: sshd\n" +
+			"|- Filter\n" +
+			"|  |- Currently failed:\t0\n" +
+			"|  `- File list:\t/var/log/auth.log\n" +
+			"`- Actions\n" +
+			"   |- Currently banned:\t2\n" +
+			"   `- Banned IP list:\t1.2.3.4 5.6.7.8\n" +
+			"[{'sshd': ['9.9.9.9', '2001:db8::1']}, {'nginx': []}]\n" +
+			"10.0.0.1 10.0.0.2\n" +
+			"bad\n",
+		PrefixedIPs: []string{
+			"1.2.3.4/32", "5.6.7.8/32", "9.9.9.9/32", "2001:db8::1/128",
+			"10.0.0.1/32", "10.0.0.2/32",
+		},
+		ErrorLines: []int{10},
+	})
+	var ips []string
+	for i := 0; i < 10000; i++ {
+		ips = append(ips, fmt.Sprintf("10.%d.%d.1", i/256, i%256))
+	}
+	pips, err := ImportFail2ban(strings.NewReader("   `- Banned IP list:\t" + strings.Join(ips, " ") + "\n"))
+	if len(pips) != len(ips) || err != nil {
+		t.Errorf("ImportFail2ban(long line) = %d PrefixedIPs, %v, want %d, nil", len(pips), err, len(ips))
+	}
+}
+
+// TestImportError tests that ImportErrors describe the bad lines and unwrap to
+// the errors with them.
+func TestImportError(t *testing.T) {
+	t.Parallel()
+	_, err := ImportNginxDeny(strings.NewReader("deny all;\ndeny bad;\n"))
+	var ie ImportError
+	if !errors.As(err, &ie) {
+		t.Fatalf("ImportNginxDeny() = %v, want ImportError", err)
+	}
+	if !errors.Is(ie[0], ErrUnsupportedRule) {
+		t.Errorf("ie[0] = %v, want %v", ie[0], ErrUnsupportedRule)
+	}
+	if !errors.Is(ie[1], ErrBadIP) {
+		t.Errorf("ie[1] = %v, want %v", ie[1], ErrBadIP)
+	}
+	es := `line 1: "deny all;": unsupported rule (and 1 more errors)`
+	if err.Error() != es {
+		t.Errorf("err.Error() = %v, want %v", err, es)
+	}
+}
+
+// testImporter tests that the Importer reads the PrefixedIPs from the list and
+// reports errors on the expected lines.
+func testImporter(t *testing.T, imp Importer, c importCase) {
+	pips, err := imp(strings.NewReader(c.List))
+	if len(pips) != len(c.PrefixedIPs) {
+		t.Errorf("len(pips) = %d, want %d", len(pips), len(c.PrefixedIPs))
+	}
+	for i := 0; i < len(pips) && i < len(c.PrefixedIPs); i++ {
+		if pips[i].String() != c.PrefixedIPs[i] {
+			t.Errorf("pips[%d] = %v, want %v", i, pips[i], c.PrefixedIPs[i])
+		}
+	}
+	if len(c.ErrorLines) == 0 {
+		if err != nil {
+			t.Errorf("err = %v, want nil", err)
+		}
+		return
+	}
+	ie, ok := err.(ImportError)
+	if !ok {
+		t.Fatalf("err = %v, want ImportError", err)
+	}
+	if len(ie) != len(c.ErrorLines) {
+		t.Errorf("len(err) = %d, want %d: %v", len(ie), len(c.ErrorLines), ie)
+	}
+	for i := 0; i < len(ie) && i < len(c.ErrorLines); i++ {
+		if ie[i].Line != c.ErrorLines[i] {
+			t.Errorf("err[%d].Line = %d, want %d", i, ie[i].Line, c.ErrorLines[i])
+		}
+	}
+}
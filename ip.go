@@ -3,7 +3,7 @@ package ban
 import (
 	"errors"
 	"fmt"
-	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 )
@@ -17,6 +17,10 @@ const (
 	ipv6Length = 16
 	// ipLength is the number of bits in an IP.
 	ipLength = ipv6Length * bitsPerByte
+	// ipv4BitLength is the number of bits in an IPv4 address.
+	ipv4BitLength = ipv4Length * bitsPerByte
+	// ipv4PrefixLength is the number of bits in the IPv4-prefix.
+	ipv4PrefixLength = ipLength - ipv4BitLength
 )
 
 var (
@@ -26,6 +30,8 @@ var (
 	ErrBadPrefixedIP = errors.New("bad prefixed IP")
 	// ErrBadPrefixLength is given if a bad prefix-length is given.
 	ErrBadPrefixLength = errors.New("prefix-length must be an integer less than or equal to 128")
+	// ErrBadIPv4PrefixLength is given if a bad IPv4 prefix-length is given.
+	ErrBadIPv4PrefixLength = errors.New("IPv4 prefix-length must be an integer less than or equal to 32")
 )
 
 // IPv4 is a 4-byte IP.
@@ -53,39 +59,115 @@ func NewIPv4IP(addr IPv4) IP {
 	return ip
 }
 
+// IPv4 returns the IPv4 bytes of the IP and true if the IP has the
+// IPv4-prefix.
+func (ip IP) IPv4() (IPv4, bool) {
+	var addr IPv4
+	for i := 0; i < ipv6Length-ipv4Length; i++ {
+		if ip[i] != ipv4Prefix[i] {
+			return addr, false
+		}
+	}
+	copy(addr[:], ip[ipv6Length-ipv4Length:])
+	return addr, true
+}
+
+// bitLength is the number of bits in the address of the IP's family.
+func (ip IP) bitLength() byte {
+	if _, ok := ip.IPv4(); ok {
+		return ipv4BitLength
+	}
+	return ipLength
+}
+
 // ParseIP from the string form of the IPv4 or IPv6 address.
 //
+// IPv6 addresses may be qualified with a zone, like "fe80::1%eth0". The zone is
+// dropped since an IP bans the address regardless of the interface it was seen
+// on.
+//
 // Returns an error if an IP couldn't be parsed from the string.
 func ParseIP(sip string) (IP, error) {
-	nip := net.ParseIP(sip)
-	if nip == nil {
+	addr, err := netip.ParseAddr(sip)
+	if err != nil {
 		return IP{}, ErrBadIP
 	}
-	ip := ipv4Prefix
-	for i := len(ip) - 1; i >= len(ip)-len(nip); i-- {
-		ip[i] = nip[i-(len(ip)-len(nip))]
+	return IPFromAddr(addr)
+}
+
+// IPFromAddr converts the netip.Addr to an IP.
+//
+// IPv4 and IPv4-mapped IPv6 addresses both become IPv4 IPs. Zones are dropped
+// like in ParseIP.
+//
+// Returns an error if the netip.Addr is the zero value.
+func IPFromAddr(addr netip.Addr) (IP, error) {
+	if !addr.IsValid() {
+		return IP{}, ErrBadIP
 	}
-	return ip, nil
+	return IP(addr.WithZone("").As16()), nil
+}
+
+// Addr converts the IP to a netip.Addr.
+//
+// IPv4 IPs become IPv4 netip.Addrs rather than IPv4-mapped IPv6 netip.Addrs.
+func (ip IP) Addr() netip.Addr {
+	return netip.AddrFrom16(ip).Unmap()
 }
 
 func (ip IP) String() string {
-	return net.IP(ip[:]).String()
+	return ip.Addr().String()
 }
 
 // PrefixedIP is an IP with a prefix-length that determines the amount of
 // relevant bits in the address.
+//
+// Prefix-lengths are native to the family of the IP, so IPv4 PrefixedIPs have
+// prefix-lengths out of 32 bits and IPv6 PrefixedIPs have prefix-lengths out of
+// 128 bits.
 type PrefixedIP struct {
-	ip           IP
+	ip IP
+	// prefixLength is always out of the 128 bits in an IP, including the
+	// IPv4-prefix for IPv4 PrefixedIPs.
 	prefixLength byte
 }
 
 // NewPrefixedIP where the relevant bits from the IP are included.
 //
-// The prefix-length must be greater than or equal to 0 and less than or equal
-// to 128, since that is the number of bits in an IP.
+// If the IP is an IPv4 address, the prefix-length must be greater than or
+// equal to 0 and less than or equal to 32. Otherwise, the prefix-length must be
+// greater than or equal to 0 and less than or equal to 128, since that is the
+// number of bits in an IP.
 //
 // Returns an error if an invalid prefix-length is given.
 func NewPrefixedIP(ip IP, pl byte) (*PrefixedIP, error) {
+	if _, ok := ip.IPv4(); ok {
+		if pl > ipv4BitLength {
+			return nil, ErrBadIPv4PrefixLength
+		}
+		return &PrefixedIP{ip: ip, prefixLength: pl + ipv4PrefixLength}, nil
+	}
+	if pl > ipLength {
+		return nil, ErrBadPrefixLength
+	}
+	return &PrefixedIP{ip: ip, prefixLength: pl}, nil
+}
+
+// NewIPv4PrefixedIP where the relevant bits from the IPv4 address are included.
+//
+// The prefix-length must be greater than or equal to 0 and less than or equal
+// to 32.
+//
+// Returns an error if an invalid prefix-length is given.
+func NewIPv4PrefixedIP(addr IPv4, pl byte) (*PrefixedIP, error) {
+	return NewPrefixedIP(NewIPv4IP(addr), pl)
+}
+
+// newLegacyPrefixedIP where the prefix-length is out of the 128 bits in an IP
+// regardless of the family of the IP.
+//
+// Returns an error if an invalid prefix-length is given.
+func newLegacyPrefixedIP(ip IP, pl byte) (*PrefixedIP, error) {
 	if pl > ipLength {
 		return nil, ErrBadPrefixLength
 	}
@@ -95,24 +177,89 @@ func NewPrefixedIP(ip IP, pl byte) (*PrefixedIP, error) {
 // ParsePrefixedIP from the string form of the IPv4 or IPv6 address with prefix
 // appended after a slash.
 //
+// The prefix-length is native to the family of the address, so "1.2.3.0/24"
+// includes the IPv4 addresses from 1.2.3.0 to 1.2.3.255.
+//
 // Returns an erorr if a PrefixedIP couldn't be parsed from the string.
 func ParsePrefixedIP(pip string) (*PrefixedIP, error) {
+	ip, pl, err := splitPrefixedIP(pip)
+	if err != nil {
+		return nil, err
+	}
+	return NewPrefixedIP(ip, pl)
+}
+
+// ParseLegacyPrefixedIP from the string form of the IPv4 or IPv6 address with
+// prefix appended after a slash where the prefix-length is out of the 128 bits
+// in an IP regardless of the family of the address.
+//
+// This is the form written by earlier versions of the package, where
+// "1.2.3.0/120" includes the IPv4 addresses from 1.2.3.0 to 1.2.3.255.
+//
+// Returns an erorr if a PrefixedIP couldn't be parsed from the string.
+func ParseLegacyPrefixedIP(pip string) (*PrefixedIP, error) {
+	ip, pl, err := splitPrefixedIP(pip)
+	if err != nil {
+		return nil, err
+	}
+	return newLegacyPrefixedIP(ip, pl)
+}
+
+// splitPrefixedIP into the IP and prefix-length of its string form.
+//
+// Returns an error if the string form is malformed.
+func splitPrefixedIP(pip string) (IP, byte, error) {
 	split := strings.Split(pip, "/")
 	if len(split) != 2 {
-		return nil, ErrBadPrefixedIP
+		return IP{}, 0, ErrBadPrefixedIP
 	}
 	ip, err := ParseIP(split[0])
 	if err != nil {
-		return nil, err
+		return IP{}, 0, err
 	}
 	pl, err := strconv.Atoi(split[1])
 	if err != nil {
-		return nil, ErrBadPrefixLength
+		return IP{}, 0, ErrBadPrefixLength
 	}
 	if pl < 0 || pl > ipLength {
-		return nil, ErrBadPrefixLength
+		if _, ok := ip.IPv4(); ok {
+			return IP{}, 0, ErrBadIPv4PrefixLength
+		}
+		return IP{}, 0, ErrBadPrefixLength
 	}
-	return NewPrefixedIP(ip, byte(pl))
+	return ip, byte(pl), nil
+}
+
+// PrefixedIPFromPrefix converts the netip.Prefix to a PrefixedIP.
+//
+// IPv4 netip.Prefixes have IPv4-native prefix-lengths and IPv4-mapped IPv6
+// netip.Prefixes have prefix-lengths out of 128 bits, so both convert without
+// loss.
+//
+// Returns an error if the netip.Prefix is invalid.
+func PrefixedIPFromPrefix(p netip.Prefix) (*PrefixedIP, error) {
+	if !p.IsValid() {
+		return nil, ErrBadPrefixedIP
+	}
+	ip, err := IPFromAddr(p.Addr())
+	if err != nil {
+		return nil, err
+	}
+	if p.Addr().Is4In6() {
+		return newLegacyPrefixedIP(ip, byte(p.Bits()))
+	}
+	return NewPrefixedIP(ip, byte(p.Bits()))
+}
+
+// Prefix converts the PrefixedIP to a masked netip.Prefix.
+//
+// IPv4 PrefixedIPs become IPv4 netip.Prefixes with the same IPv4-native
+// prefix-length.
+func (p *PrefixedIP) Prefix() netip.Prefix {
+	if p.IsIPv4() {
+		return netip.PrefixFrom(p.IP().Addr(), int(p.PrefixLength()))
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(p.IP()), int(p.prefixLength))
 }
 
 // IP with all bits with all bits after the prefix masked.
@@ -125,10 +272,45 @@ func (p *PrefixedIP) IP() IP {
 }
 
 // PrefixLength is the number of bits in the PrefixedIP that matter.
+//
+// The prefix-length is out of 32 bits for IPv4 PrefixedIPs and out of 128 bits
+// otherwise.
 func (p *PrefixedIP) PrefixLength() byte {
+	if p.IsIPv4() {
+		return p.prefixLength - ipv4PrefixLength
+	}
 	return p.prefixLength
 }
 
+// Contains returns true if the IP is included by the PrefixedIP.
+func (p *PrefixedIP) Contains(ip IP) bool {
+	masked := PrefixedIP{ip: ip, prefixLength: p.prefixLength}
+	return masked.IP() == p.IP()
+}
+
+// IsIPv4 returns true if every IP included by the PrefixedIP is an IPv4
+// address.
+func (p *PrefixedIP) IsIPv4() bool {
+	_, ok := p.ip.IPv4()
+	return ok && p.prefixLength >= ipv4PrefixLength
+}
+
+// includesIPv4 returns true if every IPv4 address is included by the
+// PrefixedIP.
+func (p *PrefixedIP) includesIPv4() bool {
+	if p.prefixLength > ipv4PrefixLength {
+		return false
+	}
+	mapped := PrefixedIP{ip: ipv4Prefix, prefixLength: p.prefixLength}
+	return mapped.IP() == p.IP()
+}
+
 func (p *PrefixedIP) String() string {
+	return fmt.Sprintf("%s/%d", p.IP(), p.PrefixLength())
+}
+
+// legacyString is the string form of the PrefixedIP read by
+// ParseLegacyPrefixedIP.
+func (p *PrefixedIP) legacyString() string {
 	return fmt.Sprintf("%s/%d", p.IP(), p.prefixLength)
 }
@@ -35,7 +35,7 @@ func testPartialPrefix(t *testing.T, c ipMapConstructor) {
 	t.Parallel()
 	const n = 100
 	m := c()
-	pip1, err := ParsePrefixedIP("0.0.0.0/120")
+	pip1, err := ParsePrefixedIP("0.0.0.0/24")
 	if err != nil {
 		t.Error(err)
 	}
@@ -84,7 +84,7 @@ func testFullPrefix(t *testing.T, c ipMapConstructor) {
 	t.Parallel()
 	const n = 100
 	m := c()
-	pip1, err := ParsePrefixedIP("255.255.255.255/128")
+	pip1, err := ParsePrefixedIP("255.255.255.255/32")
 	if err != nil {
 		t.Error(err)
 	}
@@ -117,7 +117,7 @@ func testFullPrefix(t *testing.T, c ipMapConstructor) {
 func testIPv4IPv6Different(t *testing.T, c ipMapConstructor) {
 	t.Parallel()
 	m1 := c()
-	ipv4Zero, err := ParsePrefixedIP("0.0.0.0/128")
+	ipv4Zero, err := ParsePrefixedIP("0.0.0.0/32")
 	if err != nil {
 		t.Error(err)
 	}
@@ -125,7 +125,7 @@ func testIPv4IPv6Different(t *testing.T, c ipMapConstructor) {
 	if err != nil {
 		t.Error(err)
 	}
-	ipv4Full, err := ParsePrefixedIP("255.255.255.255/128")
+	ipv4Full, err := ParsePrefixedIP("255.255.255.255/32")
 	if err != nil {
 		t.Error(err)
 	}
@@ -152,12 +152,115 @@ func testIPv4IPv6Different(t *testing.T, c ipMapConstructor) {
 	}
 }
 
+// testIPv6IncludesIPv4 tests that an ipMap constructed by the
+// ipMapConstructor correctly handles IPv6 PrefixedIPs which include every IPv4
+// address.
+func testIPv6IncludesIPv4(t *testing.T, c ipMapConstructor) {
+	t.Parallel()
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	// The legacy form is needed since "::ffff:0:0" parses as an IPv4 address.
+	for _, s := range []string{"::/0", "::/80", "::ffff:0:0/88"} {
+		pip, err := ParseLegacyPrefixedIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		m := c()
+		m.Add(pip)
+		if !m.Has(ip) {
+			t.Errorf("m.Has(%v) = false, want true after adding %v", ip, s)
+		}
+	}
+	pip, err := ParsePrefixedIP("::fffe:0:0/96")
+	if err != nil {
+		t.Error(err)
+	}
+	m := c()
+	m.Add(pip)
+	if m.Has(ip) {
+		t.Errorf("m.Has(%v) = true, want false after adding %v", ip, pip)
+	}
+}
+
+// testPrefixedIPs tests that an ipMap constructed by the ipMapConstructor
+// returns the added PrefixedIPs which aren't included by shorter PrefixedIPs in
+// order.
+func testPrefixedIPs(t *testing.T, c ipMapConstructor) {
+	t.Parallel()
+	m := c()
+	adds := []string{
+		"2001:db8::1/128", "::1/128", "1.2.3.4/32", "1.2.3.0/24", "10.0.0.0/8",
+		"2001:db8::/32",
+	}
+	for _, s := range adds {
+		pip, err := ParsePrefixedIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		m.Add(pip)
+	}
+	want := []string{"1.2.3.0/24", "10.0.0.0/8", "::1/128", "2001:db8::/32"}
+	got := m.PrefixedIPs()
+	if len(got) != len(want) {
+		t.Fatalf("m.PrefixedIPs() = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i].String() != want[i] {
+			t.Errorf("m.PrefixedIPs()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// testRemove tests that an ipMap constructed by the ipMapConstructor removes
+// only the exact PrefixedIP.
+func testRemove(t *testing.T, c ipMapConstructor) {
+	t.Parallel()
+	cases := []struct {
+		Adds   []string
+		Remove string
+		IP     string
+		Want   bool
+		WantOK bool
+	}{
+		{Adds: []string{"1.2.3.4/32"}, Remove: "1.2.3.4/32", IP: "1.2.3.4", Want: false, WantOK: true},
+		{Adds: []string{"1.2.3.0/24", "1.2.3.4/32"}, Remove: "1.2.3.4/32", IP: "1.2.3.4", Want: true, WantOK: true},
+		{Adds: []string{"1.2.3.0/24", "1.2.3.4/32"}, Remove: "1.2.3.0/24", IP: "1.2.3.4", Want: true, WantOK: true},
+		{Adds: []string{"1.2.3.0/24", "1.2.3.4/32"}, Remove: "1.2.3.0/24", IP: "1.2.3.5", Want: false, WantOK: true},
+		{Adds: []string{"1.2.3.0/24"}, Remove: "1.2.3.4/32", IP: "1.2.3.4", Want: true, WantOK: false},
+		{Adds: []string{"::/0"}, Remove: "::/0", IP: "1.2.3.4", Want: false, WantOK: true},
+		{Adds: []string{"2001:db8::/32"}, Remove: "2001:db8::/32", IP: "2001:db8::1", Want: false, WantOK: true},
+	}
+	for _, tc := range cases {
+		m := c()
+		for _, s := range tc.Adds {
+			pip, err := ParsePrefixedIP(s)
+			if err != nil {
+				t.Error(err)
+			}
+			m.Add(pip)
+		}
+		pip, err := ParsePrefixedIP(tc.Remove)
+		if err != nil {
+			t.Error(err)
+		}
+		if ok := m.Remove(pip); ok != tc.WantOK {
+			t.Errorf("m.Remove(%v) = %t, want %t after adding %v", pip, ok, tc.WantOK, tc.Adds)
+		}
+		ip, err := ParseIP(tc.IP)
+		if err != nil {
+			t.Error(err)
+		}
+		if got := m.Has(ip); got != tc.Want {
+			t.Errorf("m.Has(%v) = %t, want %t after removing %v", ip, got, tc.Want, pip)
+		}
+	}
+}
+
 // testIPExists thats that an ipMap constructed by the ipMapConstructor handles
 // the same IP being added more than once.
 func testIPExists(t *testing.T, c ipMapConstructor) {
 	t.Parallel()
 	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
-	pip, err := NewPrefixedIP(ip, ipLength)
+	pip, err := NewPrefixedIP(ip, ipv4BitLength)
 	if err != nil {
 		t.Error(err)
 	}
@@ -180,7 +283,7 @@ func testRandom(t *testing.T, c ipMapConstructor) {
 	}
 	m := c()
 	for _, ip := range ips {
-		pip, err := NewPrefixedIP(ip, 128)
+		pip, err := NewPrefixedIP(ip, ip.bitLength())
 		if err != nil {
 			t.Error(err)
 		}
@@ -199,7 +302,8 @@ func benchmarkAdd(b *testing.B, c ipMapConstructor) {
 	const n = 10000
 	ips := make([]*PrefixedIP, n)
 	for i := range ips {
-		pip, err := NewPrefixedIP(randomIP(), ipLength)
+		ip := randomIP()
+		pip, err := NewPrefixedIP(ip, ip.bitLength())
 		if err != nil {
 			b.Error(err)
 		}
@@ -218,7 +322,8 @@ func benchmarkHas(b *testing.B, c ipMapConstructor) {
 	pips := make([]*PrefixedIP, n)
 	ips := make([]IP, n)
 	for i := range ips {
-		pip, err := NewPrefixedIP(randomIP(), ipLength)
+		ip := randomIP()
+		pip, err := NewPrefixedIP(ip, ip.bitLength())
 		if err != nil {
 			b.Error(err)
 		}
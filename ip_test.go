@@ -1,6 +1,7 @@
 package ban
 
 import (
+	"net/netip"
 	"testing"
 )
 
@@ -83,7 +84,7 @@ func TestPrefixedIP(t *testing.T) {
 	for i := byte(0); i <= ipLength; i++ {
 		pip, err := NewPrefixedIP(ip, i)
 		if err != nil {
-			t.Errorf("NewPrefixedIP(%v, %d) = %s, want nil", ip, i)
+			t.Errorf("NewPrefixedIP(%v, %d) = %v, want nil", ip, i, err)
 		}
 		mip := pip.IP()
 		for j := i + 1; j < byte(ipLength); j++ {
@@ -105,7 +106,7 @@ func TestPrefixedIP(t *testing.T) {
 		if err != ErrBadPrefixLength {
 			t.Errorf(
 				"NewPrefixedIP(%v, %d) = %v, want %v",
-				err, ErrBadPrefixLength,
+				ip, i, err, ErrBadPrefixLength,
 			)
 		}
 	}
@@ -143,11 +144,16 @@ func TestParsePrefixedIP(t *testing.T) {
 		t.Error(err)
 	}
 	goods = append(goods, parsePrefixedIPCase{PrefixedIP: pip3, String: "::1/127"})
-	pip4, err := NewPrefixedIP(NewIPv4IP(IPv4{1, 2, 3, 4}), 128)
+	pip4, err := NewPrefixedIP(NewIPv4IP(IPv4{1, 2, 3, 4}), 32)
 	if err != nil {
 		t.Error(err)
 	}
-	goods = append(goods, parsePrefixedIPCase{PrefixedIP: pip4, String: "1.2.3.4/128"})
+	goods = append(goods, parsePrefixedIPCase{PrefixedIP: pip4, String: "1.2.3.4/32"})
+	pip5, err := NewPrefixedIP(NewIPv4IP(IPv4{1, 2, 3, 0}), 24)
+	if err != nil {
+		t.Error(err)
+	}
+	goods = append(goods, parsePrefixedIPCase{PrefixedIP: pip5, String: "1.2.3.4/24"})
 	for _, good := range goods {
 		pip, err := ParsePrefixedIP(good.String)
 		if err != nil {
@@ -170,8 +176,10 @@ func TestParsePrefixedIP(t *testing.T) {
 		{String: "1.2.3.4", Error: ErrBadPrefixedIP},
 		{String: "1.2.3.4/0/0", Error: ErrBadPrefixedIP},
 		{String: "1.2.3.4/a", Error: ErrBadPrefixLength},
-		{String: "1.2.3.4/-256", Error: ErrBadPrefixLength},
-		{String: "1.2.3.4/129", Error: ErrBadPrefixLength},
+		{String: "1.2.3.4/-256", Error: ErrBadIPv4PrefixLength},
+		{String: "1.2.3.4/33", Error: ErrBadIPv4PrefixLength},
+		{String: "1.2.3.4/128", Error: ErrBadIPv4PrefixLength},
+		{String: "::/129", Error: ErrBadPrefixLength},
 		{String: "1.2.3.a/128", Error: ErrBadIP},
 		{String: "1111::1111::/128", Error: ErrBadIP},
 	}
@@ -206,16 +214,21 @@ func TestPrefixedIPString(t *testing.T) {
 		t.Error(err)
 	}
 	pips = append(pips, parsePrefixedIPCase{PrefixedIP: pip3, String: "101::101:101:101:0:0/120"})
-	pip4, err := NewPrefixedIP(NewIPv4IP(IPv4{0, 0, 0, 0}), 96)
+	pip4, err := NewPrefixedIP(NewIPv4IP(IPv4{0, 0, 0, 0}), 0)
+	if err != nil {
+		t.Error(err)
+	}
+	pips = append(pips, parsePrefixedIPCase{PrefixedIP: pip4, String: "0.0.0.0/0"})
+	pip5, err := NewPrefixedIP(NewIPv4IP(IPv4{1, 2, 3, 4}), 32)
 	if err != nil {
 		t.Error(err)
 	}
-	pips = append(pips, parsePrefixedIPCase{PrefixedIP: pip4, String: "0.0.0.0/96"})
-	pip5, err := NewPrefixedIP(NewIPv4IP(IPv4{1, 2, 3, 4}), 128)
+	pips = append(pips, parsePrefixedIPCase{PrefixedIP: pip5, String: "1.2.3.4/32"})
+	pip6, err := NewPrefixedIP(NewIPv4IP(IPv4{1, 2, 3, 4}), 24)
 	if err != nil {
 		t.Error(err)
 	}
-	pips = append(pips, parsePrefixedIPCase{PrefixedIP: pip5, String: "1.2.3.4/128"})
+	pips = append(pips, parsePrefixedIPCase{PrefixedIP: pip6, String: "1.2.3.0/24"})
 	for _, pip := range pips {
 		if pip.PrefixedIP.String() != pip.String {
 			t.Errorf(
@@ -225,3 +238,263 @@ func TestPrefixedIPString(t *testing.T) {
 		}
 	}
 }
+
+// TestIPIPv4 tests that IPv4 returns the IPv4 bytes only for IPs with the
+// IPv4-prefix.
+func TestIPIPv4(t *testing.T) {
+	t.Parallel()
+	addr, ok := NewIPv4IP(IPv4{1, 2, 3, 4}).IPv4()
+	if !ok || addr != (IPv4{1, 2, 3, 4}) {
+		t.Errorf("ip.IPv4() = %v, %t, want %v, true", addr, ok, IPv4{1, 2, 3, 4})
+	}
+	ip := IP{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 1, 2, 3, 4}
+	if _, ok := ip.IPv4(); ok {
+		t.Errorf("ip.IPv4() = _, true, want _, false")
+	}
+}
+
+// TestNewIPv4PrefixedIP tests that NewIPv4PrefixedIP is equivalent to
+// NewPrefixedIP with the IPv4 address.
+func TestNewIPv4PrefixedIP(t *testing.T) {
+	t.Parallel()
+	addr := IPv4{1, 2, 3, 4}
+	for i := byte(0); i <= ipv4BitLength; i++ {
+		pip1, err := NewIPv4PrefixedIP(addr, i)
+		if err != nil {
+			t.Error(err)
+		}
+		pip2, err := NewPrefixedIP(NewIPv4IP(addr), i)
+		if err != nil {
+			t.Error(err)
+		}
+		if *pip1 != *pip2 {
+			t.Errorf(
+				"NewIPv4PrefixedIP(%v, %d) = %v, want %v",
+				addr, i, pip1, pip2,
+			)
+		}
+		if !pip1.IsIPv4() {
+			t.Errorf("pip.IsIPv4() = false, want true")
+		}
+		if pip1.PrefixLength() != i {
+			t.Errorf(
+				"pip.PrefixLength() = %d, want %d",
+				pip1.PrefixLength(), i,
+			)
+		}
+	}
+	if _, err := NewIPv4PrefixedIP(addr, ipv4BitLength+1); err != ErrBadIPv4PrefixLength {
+		t.Errorf(
+			"NewIPv4PrefixedIP(%v, %d) = %v, want %v",
+			addr, ipv4BitLength+1, err, ErrBadIPv4PrefixLength,
+		)
+	}
+}
+
+// TestPrefixedIPIsIPv4 tests that only PrefixedIPs which include nothing but
+// IPv4 addresses are IPv4.
+func TestPrefixedIPIsIPv4(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		String string
+		IsIPv4 bool
+	}{
+		{String: "1.2.3.4/32", IsIPv4: true},
+		{String: "1.2.3.0/24", IsIPv4: true},
+		{String: "0.0.0.0/0", IsIPv4: true},
+		{String: "::fffe:0:0/95", IsIPv4: false},
+		{String: "::/0", IsIPv4: false},
+		{String: "::1/128", IsIPv4: false},
+	}
+	for _, c := range cases {
+		pip, err := ParsePrefixedIP(c.String)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if pip.IsIPv4() != c.IsIPv4 {
+			t.Errorf(
+				"ParsePrefixedIP(%v).IsIPv4() = %t, want %t",
+				c.String, pip.IsIPv4(), c.IsIPv4,
+			)
+		}
+	}
+}
+
+// TestParseLegacyPrefixedIP tests that ParseLegacyPrefixedIP reads
+// prefix-lengths out of 128 bits and matches the legacy string form.
+func TestParseLegacyPrefixedIP(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Legacy string
+		String string
+	}{
+		{Legacy: "1.2.3.4/128", String: "1.2.3.4/32"},
+		{Legacy: "1.2.3.4/120", String: "1.2.3.0/24"},
+		{Legacy: "0.0.0.0/96", String: "0.0.0.0/0"},
+		{Legacy: "1.2.3.4/95", String: "::fffe:0:0/95"},
+		{Legacy: "1.2.3.4/0", String: "::/0"},
+		{Legacy: "::1/127", String: "::/127"},
+	}
+	for _, c := range cases {
+		pip, err := ParseLegacyPrefixedIP(c.Legacy)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if pip.String() != c.String {
+			t.Errorf(
+				"ParseLegacyPrefixedIP(%v) = %v, want %v",
+				c.Legacy, pip, c.String,
+			)
+		}
+		again, err := ParseLegacyPrefixedIP(pip.legacyString())
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if again.String() != pip.String() {
+			t.Errorf(
+				"ParseLegacyPrefixedIP(%v) = %v, want %v",
+				pip.legacyString(), again, pip,
+			)
+		}
+	}
+	if _, err := ParseLegacyPrefixedIP("1.2.3.4/129"); err != ErrBadIPv4PrefixLength {
+		t.Errorf(
+			"ParseLegacyPrefixedIP(1.2.3.4/129) = %v, want %v",
+			err, ErrBadIPv4PrefixLength,
+		)
+	}
+}
+
+// TestParseIPZone tests that ParseIP drops the zones of zone-qualified IPv6
+// addresses.
+func TestParseIPZone(t *testing.T) {
+	t.Parallel()
+	ip, err := ParseIP("fe80::1%eth0")
+	if err != nil {
+		t.Error(err)
+	}
+	if ip.String() != "fe80::1" {
+		t.Errorf("ParseIP(fe80::1%%eth0) = %v, want fe80::1", ip)
+	}
+	if _, err := ParseIP("1.2.3.4%eth0"); err != ErrBadIP {
+		t.Errorf("ParseIP(1.2.3.4%%eth0) = %v, want ErrBadIP", err)
+	}
+}
+
+// TestIPAddr tests that IPs convert to and from netip.Addrs without loss.
+func TestIPAddr(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Addr netip.Addr
+		IP   IP
+	}{
+		{Addr: netip.MustParseAddr("1.2.3.4"), IP: NewIPv4IP(IPv4{1, 2, 3, 4})},
+		{Addr: netip.MustParseAddr("::"), IP: IP{}},
+		{Addr: netip.MustParseAddr("::1"), IP: IP{15: 1}},
+	}
+	for _, c := range cases {
+		ip, err := IPFromAddr(c.Addr)
+		if err != nil {
+			t.Error(err)
+		}
+		if ip != c.IP {
+			t.Errorf("IPFromAddr(%v) = %v, want %v", c.Addr, ip, c.IP)
+		}
+		if ip.Addr() != c.Addr {
+			t.Errorf("ip.Addr() = %v, want %v", ip.Addr(), c.Addr)
+		}
+	}
+	ip, err := IPFromAddr(netip.MustParseAddr("::ffff:1.2.3.4"))
+	if err != nil {
+		t.Error(err)
+	}
+	if ip != NewIPv4IP(IPv4{1, 2, 3, 4}) {
+		t.Errorf("IPFromAddr(::ffff:1.2.3.4) = %v, want 1.2.3.4", ip)
+	}
+	if _, err := IPFromAddr(netip.Addr{}); err != ErrBadIP {
+		t.Errorf("IPFromAddr(netip.Addr{}) = %v, want ErrBadIP", err)
+	}
+}
+
+// TestPrefixedIPPrefix tests that PrefixedIPs convert to and from
+// netip.Prefixes without loss.
+func TestPrefixedIPPrefix(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Prefix netip.Prefix
+		String string
+	}{
+		{Prefix: netip.MustParsePrefix("1.2.3.0/24"), String: "1.2.3.0/24"},
+		{Prefix: netip.MustParsePrefix("0.0.0.0/0"), String: "0.0.0.0/0"},
+		{Prefix: netip.MustParsePrefix("::/0"), String: "::/0"},
+		{Prefix: netip.MustParsePrefix("::1/128"), String: "::1/128"},
+		{Prefix: netip.MustParsePrefix("::ffff:1.2.3.0/120"), String: "1.2.3.0/24"},
+		{Prefix: netip.MustParsePrefix("::fffe:0:0/95"), String: "::fffe:0:0/95"},
+	}
+	for _, c := range cases {
+		pip, err := PrefixedIPFromPrefix(c.Prefix)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if pip.String() != c.String {
+			t.Errorf("PrefixedIPFromPrefix(%v) = %v, want %v", c.Prefix, pip, c.String)
+		}
+		again, err := PrefixedIPFromPrefix(pip.Prefix())
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if again.String() != pip.String() {
+			t.Errorf("PrefixedIPFromPrefix(%v) = %v, want %v", pip.Prefix(), again, pip)
+		}
+	}
+	pip, err := ParsePrefixedIP("1.2.3.4/24")
+	if err != nil {
+		t.Error(err)
+	}
+	if p := netip.MustParsePrefix("1.2.3.0/24"); pip.Prefix() != p {
+		t.Errorf("pip.Prefix() = %v, want %v", pip.Prefix(), p)
+	}
+	if _, err := PrefixedIPFromPrefix(netip.Prefix{}); err != ErrBadPrefixedIP {
+		t.Errorf("PrefixedIPFromPrefix(netip.Prefix{}) = %v, want ErrBadPrefixedIP", err)
+	}
+}
+
+// TestPrefixedIPContains tests that PrefixedIPs contain only the IPs in their
+// range.
+func TestPrefixedIPContains(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		PrefixedIP string
+		IP         string
+		Contains   bool
+	}{
+		{PrefixedIP: "1.2.3.0/24", IP: "1.2.3.4", Contains: true},
+		{PrefixedIP: "1.2.3.0/24", IP: "1.2.4.4", Contains: false},
+		{PrefixedIP: "0.0.0.0/0", IP: "1.2.3.4", Contains: true},
+		{PrefixedIP: "0.0.0.0/0", IP: "::1", Contains: false},
+		{PrefixedIP: "::/0", IP: "1.2.3.4", Contains: true},
+		{PrefixedIP: "2001:db8::/32", IP: "2001:db8::1", Contains: true},
+		{PrefixedIP: "2001:db8::/32", IP: "2001:db9::1", Contains: false},
+	}
+	for _, c := range cases {
+		pip, err := ParsePrefixedIP(c.PrefixedIP)
+		if err != nil {
+			t.Error(err)
+		}
+		ip, err := ParseIP(c.IP)
+		if err != nil {
+			t.Error(err)
+		}
+		if pip.Contains(ip) != c.Contains {
+			t.Errorf(
+				"ParsePrefixedIP(%v).Contains(%v) = %t, want %t",
+				c.PrefixedIP, c.IP, pip.Contains(ip), c.Contains,
+			)
+		}
+	}
+}
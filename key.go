@@ -0,0 +1,87 @@
+package ban
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// keyHashPrefix begins the keyed hashes which keys are banned as.
+const keyHashPrefix = "hmac-sha256:"
+
+// keySecretLength is the number of bytes in random KeySecrets.
+const keySecretLength = 32
+
+// KeyExtractor finds the key of an http.Request, like an API key, user ID, or
+// session, which identifies the client independently of its IP.
+//
+// Returns "" if the http.Request has no key.
+type KeyExtractor func(*http.Request) string
+
+// HeaderKey returns a KeyExtractor which uses the value of the header with the
+// name.
+func HeaderKey(name string) KeyExtractor {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// CookieKey returns a KeyExtractor which uses the value of the cookie with the
+// name.
+func CookieKey(name string) KeyExtractor {
+	return func(r *http.Request) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// AuthSubjectKey is a KeyExtractor which uses the subject of the
+// Authorization header, which is the username for basic authentication and the
+// token for bearer authentication.
+func AuthSubjectKey(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// HashKey returns the HMAC-SHA256 of the key with the secret, which is what
+// Engines with the secret as their KeySecret ban, store, and replicate instead
+// of the key.
+func HashKey(secret []byte, key string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+	return keyHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign the purpose and fields, each separated by a zero byte, with the secret.
+//
+// Returns the hex HMAC-SHA256.
+func sign(secret []byte, purpose string, fields ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	for _, f := range fields {
+		mac.Write([]byte{0})
+		mac.Write([]byte(f))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isKeyHash returns true if the key is a hash returned by HashKey.
+func isKeyHash(key string) bool {
+	hash, ok := strings.CutPrefix(key, keyHashPrefix)
+	if !ok || len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,160 @@
+package ban
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestKeyExtractors tests that the KeyExtractors find keys in http.Requests.
+func TestKeyExtractors(t *testing.T) {
+	t.Parallel()
+	basic := &http.Request{Header: http.Header{}}
+	basic.SetBasicAuth("alice", "secret")
+	cases := []struct {
+		Name      string
+		Extractor KeyExtractor
+		Request   *http.Request
+		Want      string
+	}{
+		{
+			Name:      "header",
+			Extractor: HeaderKey("X-API-Key"),
+			Request:   &http.Request{Header: http.Header{"X-Api-Key": {"abc"}}},
+			Want:      "abc",
+		},
+		{
+			Name:      "missing header",
+			Extractor: HeaderKey("X-API-Key"),
+			Request:   &http.Request{Header: http.Header{}},
+			Want:      "",
+		},
+		{
+			Name:      "cookie",
+			Extractor: CookieKey("session"),
+			Request:   &http.Request{Header: http.Header{"Cookie": {"a=b; session=xyz"}}},
+			Want:      "xyz",
+		},
+		{
+			Name:      "missing cookie",
+			Extractor: CookieKey("session"),
+			Request:   &http.Request{Header: http.Header{"Cookie": {"a=b"}}},
+			Want:      "",
+		},
+		{
+			Name:      "basic",
+			Extractor: AuthSubjectKey,
+			Request:   basic,
+			Want:      "alice",
+		},
+		{
+			Name:      "bearer",
+			Extractor: AuthSubjectKey,
+			Request:   &http.Request{Header: http.Header{"Authorization": {"bearer tok"}}},
+			Want:      "tok",
+		},
+		{
+			Name:      "other scheme",
+			Extractor: AuthSubjectKey,
+			Request:   &http.Request{Header: http.Header{"Authorization": {"Digest x"}}},
+			Want:      "",
+		},
+	}
+	for _, c := range cases {
+		if got := c.Extractor(c.Request); got != c.Want {
+			t.Errorf("%s: key = %q, want %q", c.Name, got, c.Want)
+		}
+	}
+}
+
+// TestKeyBan tests that Bans targeting keys ban the key, the IP, or both and
+// are stored.
+func TestKeyBan(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if err := os.Remove("key_store.txt"); err != nil {
+			t.Error(err)
+		}
+	}()
+	cfg := Config{
+		StorePath:    "key_store.txt",
+		ErrorHandler: func(err error) { t.Error(err) },
+		KeyExtractor: HeaderKey("X-API-Key"),
+		KeySecret:    []byte("secret"),
+	}
+	b := BannerFunc(func(ip IP, r *http.Request) Ban {
+		switch r.URL.Path {
+		case "/key":
+			return KeyBan
+		case "/both":
+			return IPBan.AndKey()
+		}
+		return NoBan
+	})
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	wh := New(h, b, cfg)
+	testTarget(t, wh, "1.2.3.4", "/key", http.Header{"X-Api-Key": {"a"}}, "key is banned", http.StatusForbidden)
+	testTarget(t, wh, "5.6.7.8", "/", http.Header{"X-Api-Key": {"a"}}, "key is banned", http.StatusForbidden)
+	testTarget(t, wh, "1.2.3.4", "/", nil, "", http.StatusOK)
+	testTarget(t, wh, "1.2.3.4", "/both", http.Header{"X-Api-Key": {"b"}}, "1.2.3.4 is banned", http.StatusForbidden)
+	testTarget(t, wh, "5.6.7.8", "/", http.Header{"X-Api-Key": {"b"}}, "key is banned", http.StatusForbidden)
+	testTarget(t, wh, "1.2.3.4", "/", http.Header{"X-Api-Key": {"c"}}, "1.2.3.4 is banned", http.StatusForbidden)
+	if err := wh.Engine().UnbanKey("a"); err != nil {
+		t.Error(err)
+	}
+	wh = New(h, b, cfg)
+	testTarget(t, wh, "5.6.7.8", "/", http.Header{"X-Api-Key": {"a"}}, "", http.StatusOK)
+	testTarget(t, wh, "5.6.7.8", "/", http.Header{"X-Api-Key": {"b"}}, "key is banned", http.StatusForbidden)
+	if keys := wh.Engine().Keys(); len(keys) != 1 || keys[0] != HashKey(cfg.KeySecret, "b") {
+		t.Errorf("wh.Engine().Keys() = %q, want [%s]", keys, HashKey(cfg.KeySecret, "b"))
+	}
+	bs, err := os.ReadFile(cfg.StorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(bs), `"a"`) || strings.Contains(string(bs), `"b"`) {
+		t.Errorf("store = %q, want keys hashed", bs)
+	}
+	info, err := os.Stat(cfg.StorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != 0600 {
+		t.Errorf("store mode = %v, want %v", got, os.FileMode(0600))
+	}
+}
+
+// TestKeyBanExpiry tests that keys banned for a duration expire and stay
+// expired once reloaded from the store.
+func TestKeyBanExpiry(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		StorePath:    filepath.Join(t.TempDir(), "store.txt"),
+		ErrorHandler: func(err error) { t.Error(err) },
+		KeyExtractor: HeaderKey("X-API-Key"),
+		KeySecret:    []byte("secret"),
+	}
+	b := BannerFunc(func(ip IP, r *http.Request) Ban {
+		switch r.URL.Path {
+		case "/short":
+			return KeyBan.For(20 * time.Millisecond)
+		case "/long":
+			return KeyBan.For(time.Hour)
+		}
+		return NoBan
+	})
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	wh := New(h, b, cfg)
+	testTarget(t, wh, "1.2.3.4", "/short", http.Header{"X-Api-Key": {"a"}}, "key is banned", http.StatusForbidden)
+	testTarget(t, wh, "1.2.3.4", "/long", http.Header{"X-Api-Key": {"b"}}, "key is banned", http.StatusForbidden)
+	time.Sleep(50 * time.Millisecond)
+	testTarget(t, wh, "1.2.3.4", "/", http.Header{"X-Api-Key": {"a"}}, "", http.StatusOK)
+	testTarget(t, wh, "1.2.3.4", "/", http.Header{"X-Api-Key": {"b"}}, "key is banned", http.StatusForbidden)
+	wh = New(h, b, cfg)
+	if keys := wh.Engine().Keys(); len(keys) != 1 || keys[0] != HashKey(cfg.KeySecret, "b") {
+		t.Errorf("wh.Engine().Keys() = %q, want [%s]", keys, HashKey(cfg.KeySecret, "b"))
+	}
+}
@@ -0,0 +1,564 @@
+// Package kvban provides a ban.BatchStore which keeps Bans in a directory as a
+// binary log of changes and a snapshot, so large ban lists load in
+// milliseconds instead of being rescanned line by line like a ban.FileStore.
+//
+// Changes are appended to the log as they happen. Once the log holds enough
+// records, a snapshot of every StoreEntry is written and the log is emptied,
+// so loading only reads the snapshot and the changes since.
+package kvban
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jwowillo/ban"
+)
+
+var (
+	// ErrBadLog is returned if a record in the log is corrupt.
+	ErrBadLog = errors.New("bad log")
+	// ErrBadSnapshot is returned if the snapshot is corrupt.
+	ErrBadSnapshot = errors.New("bad snapshot")
+	// ErrClosed is returned if a closed Store is written to.
+	ErrClosed = errors.New("store is closed")
+)
+
+// Config for the Store.
+type Config struct {
+	// SnapshotThreshold is the number of records in the log after which a
+	// snapshot is written.
+	//
+	// Defaults to 10000 if not assigned.
+	SnapshotThreshold int
+	// Sync makes writes to the log wait until they reach the disk.
+	//
+	// Defaults to false if not assigned, like ban.FileStore.
+	Sync bool
+}
+
+// DefaultConfig which snapshots every 10000 records and doesn't sync writes.
+var DefaultConfig = Config{}
+
+// defaultSnapshotThreshold is the SnapshotThreshold if none is assigned.
+const defaultSnapshotThreshold = 10000
+
+const (
+	// logName is the name of the log in the directory.
+	logName = "log"
+	// snapshotName is the name of the snapshot in the directory.
+	snapshotName = "snapshot"
+	// logMagic begins logs.
+	logMagic = "BANLOG1\n"
+	// snapshotMagic begins snapshots.
+	snapshotMagic = "BANSNAP1"
+)
+
+// op of a record.
+type op byte
+
+const (
+	// opAdd adds the StoreEntry of a record.
+	opAdd op = iota + 1
+	// opRemove removes the StoreEntry of a record.
+	opRemove
+)
+
+// Store is a ban.BatchStore which keeps StoreEntries, with their Expiry and
+// Meta, in a directory.
+//
+// Records in the log and snapshot are an op byte, the length of the binary
+// form of the StoreEntry as a uvarint, the binary form, and the CRC-32 of all
+// of them. A record cut short at the end of the log, like by a crash during a
+// write, is dropped when the Store is opened.
+//
+// A directory must only be used by one Store at a time.
+type Store struct {
+	dir               string
+	snapshotThreshold int
+	sync              bool
+
+	mu  sync.Mutex
+	log *os.File
+	// entries holds the StoreEntries which are added by their String form.
+	entries map[string]entry
+	// next is the sequence number of the next StoreEntry added which isn't
+	// already.
+	next uint64
+	// logged is the number of records in the log.
+	logged int
+}
+
+// entry is a StoreEntry in a Store.
+type entry struct {
+	ban.StoreEntry
+	// seq orders the StoreEntries by when they were first added.
+	seq uint64
+}
+
+// New Store in the directory, which is created if it doesn't exist, with
+// behavior customized by Config.
+//
+// The snapshot and log are read before it is returned, and a snapshot is
+// written if the log holds more than the SnapshotThreshold of records.
+//
+// Returns ErrBadSnapshot or ErrBadLog if either is corrupt or an error if the
+// directory can't be read or written to.
+func New(dir string, cfg Config) (*Store, error) {
+	snapshotThreshold := cfg.SnapshotThreshold
+	if snapshotThreshold == 0 {
+		snapshotThreshold = defaultSnapshotThreshold
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:               dir,
+		snapshotThreshold: snapshotThreshold,
+		sync:              cfg.Sync,
+		entries:           make(map[string]entry),
+	}
+	if err := s.readSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.openLog(); err != nil {
+		return nil, err
+	}
+	if s.logged >= s.snapshotThreshold {
+		if err := s.snapshot(); err != nil {
+			s.log.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Convert the ban.FileStore at path to a Store in the directory.
+//
+// StoreEntries already in the directory are kept, so the same file shouldn't
+// be converted twice into it.
+//
+// Returns an error if the file can't be read or the directory can't be written
+// to.
+func Convert(path, dir string) error {
+	entries, err := ban.NewFileStore(path).Load()
+	if err != nil {
+		return err
+	}
+	s, err := New(dir, Config{})
+	if err != nil {
+		return err
+	}
+	if err := s.AddAll(entries); err != nil {
+		s.Close()
+		return err
+	}
+	if err := s.Snapshot(); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+// Load the StoreEntries which haven't expired in the order they were first
+// added with the Expiry and Meta they were last added with.
+//
+// Never returns an error since the StoreEntries were read by New.
+func (s *Store) Load() ([]ban.StoreEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []ban.StoreEntry
+	for _, e := range s.live(time.Now()) {
+		entries = append(entries, e.StoreEntry)
+	}
+	return entries, nil
+}
+
+// Add the StoreEntry to the Store.
+//
+// Returns an error if the log can't be written to.
+func (s *Store) Add(entry ban.StoreEntry) error {
+	return s.AddAll([]ban.StoreEntry{entry})
+}
+
+// AddAll adds the StoreEntries to the Store with one write to the log.
+//
+// Returns an error if the log can't be written to.
+func (s *Store) AddAll(entries []ban.StoreEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf []byte
+	for _, entry := range entries {
+		var err error
+		if buf, err = appendRecord(buf, opAdd, entry); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(buf, len(entries)); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		s.apply(opAdd, entry)
+	}
+	return s.maybeSnapshot()
+}
+
+// Remove the StoreEntry from the Store.
+//
+// Returns an error if the log can't be written to.
+func (s *Store) Remove(entry ban.StoreEntry) error {
+	entry.Expiry, entry.Meta = time.Time{}, ban.Meta{}
+	buf, err := appendRecord(nil, opRemove, entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(buf, 1); err != nil {
+		return err
+	}
+	s.apply(opRemove, entry)
+	return s.maybeSnapshot()
+}
+
+// Snapshot writes every StoreEntry which hasn't expired to the snapshot and
+// empties the log.
+//
+// Returns an error if the directory can't be written to.
+func (s *Store) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		return ErrClosed
+	}
+	return s.snapshot()
+}
+
+// Close the log.
+//
+// Returns an error if the log can't be closed.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
+
+// append the buffer holding n records to the log.
+//
+// Returns an error if the log can't be written to.
+func (s *Store) append(buf []byte, n int) error {
+	if s.log == nil {
+		return ErrClosed
+	}
+	if _, err := s.log.Write(buf); err != nil {
+		return err
+	}
+	if s.sync {
+		if err := s.log.Sync(); err != nil {
+			return err
+		}
+	}
+	s.logged += n
+	return nil
+}
+
+// apply the op to the StoreEntry in memory.
+func (s *Store) apply(o op, entry ban.StoreEntry) {
+	id := entry.String()
+	if o == opRemove {
+		delete(s.entries, id)
+		return
+	}
+	e, ok := s.entries[id]
+	if !ok {
+		e.seq = s.next
+		s.next++
+	}
+	e.StoreEntry = entry
+	s.entries[id] = e
+}
+
+// live returns the entries which haven't expired by the time in the order they
+// were first added.
+func (s *Store) live(now time.Time) []entry {
+	entries := make([]entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		if e.Expiry.IsZero() || e.Expiry.After(now) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	return entries
+}
+
+// maybeSnapshot writes a snapshot if the log holds the SnapshotThreshold of
+// records.
+//
+// Returns an error if the snapshot can't be written.
+func (s *Store) maybeSnapshot() error {
+	if s.logged < s.snapshotThreshold {
+		return nil
+	}
+	return s.snapshot()
+}
+
+// snapshot writes every StoreEntry which hasn't expired to a temporary file
+// which replaces the snapshot before the log is emptied.
+//
+// The directory is synced after the rename so the snapshot reaches the disk
+// before the log is emptied. A crash before the log is emptied leaves records
+// which are already in the snapshot, and replaying them onto it changes
+// nothing.
+//
+// Returns an error if the directory can't be written to.
+func (s *Store) snapshot() error {
+	live := s.live(time.Now())
+	buf := binary.AppendUvarint([]byte(snapshotMagic), uint64(len(live)))
+	for _, e := range live {
+		var err error
+		if buf, err = appendRecord(buf, opAdd, e.StoreEntry); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(s.dir, snapshotName)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, buf); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	if err := s.log.Truncate(int64(len(logMagic))); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	s.logged = 0
+	s.entries = make(map[string]entry, len(live))
+	s.next = 0
+	for _, e := range live {
+		s.apply(opAdd, e.StoreEntry)
+	}
+	return nil
+}
+
+// readSnapshot into memory if there is one.
+//
+// Returns ErrBadSnapshot if the snapshot is corrupt or an error if it can't be
+// read.
+func (s *Store) readSnapshot() error {
+	bs, err := os.ReadFile(filepath.Join(s.dir, snapshotName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(bs, []byte(snapshotMagic)) {
+		return ErrBadSnapshot
+	}
+	bs = bs[len(snapshotMagic):]
+	count, n := binary.Uvarint(bs)
+	if n <= 0 {
+		return ErrBadSnapshot
+	}
+	bs = bs[n:]
+	for i := uint64(0); i < count; i++ {
+		o, entry, size, err := readRecord(bs)
+		if err != nil || size == 0 || o != opAdd {
+			return ErrBadSnapshot
+		}
+		s.apply(o, entry)
+		bs = bs[size:]
+	}
+	if len(bs) != 0 {
+		return ErrBadSnapshot
+	}
+	return nil
+}
+
+// openLog for appending, creating it if it doesn't exist, and replay its
+// records onto the snapshot in memory.
+//
+// A record cut short at the end of the log is truncated.
+//
+// Returns ErrBadLog if a record is corrupt, including one which seems cut short
+// but is followed by whole records, or an error if the log can't be read
+// or written to.
+func (s *Store) openLog() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, logName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := s.replay(f); err != nil {
+		f.Close()
+		return err
+	}
+	s.log = f
+	return nil
+}
+
+// replay the records of the log onto the snapshot in memory, leaving the log
+// positioned after the last whole record.
+//
+// Returns ErrBadLog if a record is corrupt or an error if the log can't be read
+// or written to.
+func (s *Store) replay(f *os.File) error {
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(bs) < len(logMagic) {
+		if !bytes.HasPrefix([]byte(logMagic), bs) {
+			return ErrBadLog
+		}
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		_, err := f.WriteAt([]byte(logMagic), 0)
+		if err != nil {
+			return err
+		}
+		_, err = f.Seek(0, io.SeekEnd)
+		return err
+	}
+	if string(bs[:len(logMagic)]) != logMagic {
+		return ErrBadLog
+	}
+	offset := len(logMagic)
+	for offset < len(bs) {
+		o, entry, size, err := readRecord(bs[offset:])
+		if err != nil {
+			return ErrBadLog
+		}
+		if size == 0 {
+			// Only the last record can be cut short, so a whole record
+			// after this one means its length is corrupt.
+			if recordFollows(bs[offset+1:]) {
+				return ErrBadLog
+			}
+			break
+		}
+		s.apply(o, entry)
+		s.logged++
+		offset += size
+	}
+	if err := f.Truncate(int64(offset)); err != nil {
+		return err
+	}
+	_, err = f.Seek(int64(offset), io.SeekStart)
+	return err
+}
+
+// appendRecord appends the record of the op on the StoreEntry to the buffer.
+//
+// Returns an error if the StoreEntry can't be encoded.
+func appendRecord(buf []byte, o op, entry ban.StoreEntry) ([]byte, error) {
+	data, err := entry.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	start := len(buf)
+	buf = binary.AppendUvarint(append(buf, byte(o)), uint64(len(data)))
+	buf = append(buf, data...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:])), nil
+}
+
+// readRecord reads the record at the start of the buffer.
+//
+// Returns the op, the StoreEntry, and the size of the record, which is 0 if the
+// record is cut short, or an error if the record is corrupt.
+func readRecord(bs []byte) (op, ban.StoreEntry, int, error) {
+	if len(bs) < 2 {
+		return 0, ban.StoreEntry{}, 0, nil
+	}
+	length, n := binary.Uvarint(bs[1:])
+	if n == 0 {
+		return 0, ban.StoreEntry{}, 0, nil
+	}
+	if n < 0 {
+		return 0, ban.StoreEntry{}, 0, ErrBadLog
+	}
+	end := 1 + n + int(length)
+	if length > uint64(len(bs)) || len(bs) < end+crc32.Size {
+		return 0, ban.StoreEntry{}, 0, nil
+	}
+	if crc32.ChecksumIEEE(bs[:end]) != binary.BigEndian.Uint32(bs[end:]) {
+		return 0, ban.StoreEntry{}, 0, ErrBadLog
+	}
+	o := op(bs[0])
+	if o != opAdd && o != opRemove {
+		return 0, ban.StoreEntry{}, 0, ErrBadLog
+	}
+	var entry ban.StoreEntry
+	if err := entry.UnmarshalBinary(bs[1+n : end]); err != nil {
+		return 0, ban.StoreEntry{}, 0, err
+	}
+	return o, entry, end + crc32.Size, nil
+}
+
+// recordFollows returns true if a whole record with a valid CRC-32 starts
+// anywhere in the buffer.
+func recordFollows(bs []byte) bool {
+	for i := range bs {
+		if _, _, size, err := readRecord(bs[i:]); err == nil && size != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// syncDir waits until the entries of the directory, like renamed files, reach
+// the disk.
+//
+// Returns an error if the directory can't be synced.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileSync writes the data to a new file at the path and waits until it
+// reaches the disk.
+//
+// Returns an error if the file can't be written.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,185 @@
+package kvban
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jwowillo/ban"
+)
+
+// TestStore tests that StoreEntries are added with their Meta and Expiry,
+// removed, and loaded in order after reopening, including after snapshots and
+// a write cut short.
+func TestStore(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s, err := New(dir, Config{SnapshotThreshold: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pip, err := ban.ParsePrefixedIP("1.2.3.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Hour)
+	meta := ban.Meta{Reason: "scanner", Issuer: "http"}
+	entries := []ban.StoreEntry{
+		{PrefixedIP: pip, Meta: meta},
+		{PrefixedIP: pip, Scope: &ban.Scope{PathPrefix: "/login"}, Expiry: expiry},
+		{Key: "k"},
+		{Fingerprint: "f"},
+		{PrefixedIP: pip, Scope: &ban.Scope{Host: "a.com"}, Expiry: time.Now().Add(-time.Second)},
+	}
+	if err := s.AddAll(entries[:3]); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries[3:] {
+		if err := s.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Remove(entries[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(ban.StoreEntry{PrefixedIP: pip, Meta: ban.Meta{Reason: "later"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(entries[2]); err != ErrClosed {
+		t.Errorf("s.Add() = %v, want %v", err, ErrClosed)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := appendRecord(nil, opAdd, entries[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(record[:len(record)-1])
+	f.Close()
+	s, err = New(dir, Config{SnapshotThreshold: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	loaded, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ban.StoreEntry{
+		{PrefixedIP: pip, Meta: ban.Meta{Reason: "later"}},
+		entries[1],
+		entries[3],
+	}
+	if len(loaded) != len(want) {
+		t.Fatalf("s.Load() = %v, want %v", loaded, want)
+	}
+	for i, entry := range loaded {
+		w := want[i]
+		if entry.String() != w.String() || !entry.Expiry.Equal(w.Expiry) || entry.Meta != w.Meta {
+			t.Errorf(
+				"s.Load()[%d] = %v %v %v, want %v %v %v",
+				i, entry, entry.Expiry, entry.Meta, w, w.Expiry, w.Meta,
+			)
+		}
+	}
+	if err := s.Add(entries[2]); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := s.Load(); len(loaded) != 4 {
+		t.Errorf("s.Load() = %v, want 4 StoreEntries after the cut write", loaded)
+	}
+}
+
+// TestCorrupt tests that corrupt logs and snapshots aren't loaded, including
+// logs with a corrupt length before their last record.
+func TestCorrupt(t *testing.T) {
+	t.Parallel()
+	record, err := appendRecord([]byte(logMagic), opAdd, ban.StoreEntry{Key: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record[len(record)-1] ^= 1
+	records, err := appendRecord([]byte(logMagic), opAdd, ban.StoreEntry{Key: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records, err = appendRecord(records, opAdd, ban.StoreEntry{Key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	records[len(logMagic)+1] = 0x7f
+	for _, c := range []struct {
+		Name string
+		Data []byte
+		Want error
+	}{
+		{Name: logName, Data: []byte("BANLOG2\n"), Want: ErrBadLog},
+		{Name: logName, Data: record, Want: ErrBadLog},
+		{Name: logName, Data: records, Want: ErrBadLog},
+		{Name: snapshotName, Data: []byte(snapshotMagic + "\x01"), Want: ErrBadSnapshot},
+		{Name: snapshotName, Data: []byte("snapshot"), Want: ErrBadSnapshot},
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, c.Name), c.Data, 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(dir, Config{}); err != c.Want {
+			t.Errorf("New(%s %q) = %v, want %v", c.Name, c.Data, err, c.Want)
+		}
+	}
+}
+
+// TestConvert tests that a ban.FileStore converted to a Store is loaded by a
+// ban.Engine.
+func TestConvert(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "store.txt")
+	fs := ban.NewFileStore(path)
+	pips := make([]*ban.PrefixedIP, 100)
+	for i := range pips {
+		var err error
+		pips[i], err = ban.NewPrefixedIP(ban.NewIPv4IP(ban.IPv4{10, 0, byte(i), 0}), 24)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Add(ban.StoreEntry{PrefixedIP: pips[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Remove(ban.StoreEntry{PrefixedIP: pips[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Add(ban.StoreEntry{Key: "k"}); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "bans")
+	if err := Convert(path, dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(dir, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.logged != 0 {
+		t.Errorf("s.logged = %d, want 0 after the snapshot", s.logged)
+	}
+	e := ban.NewEngine(ban.Config{Store: s, ErrorHandler: func(err error) { t.Error(err) }})
+	if e.Check(ban.NewIPv4IP(ban.IPv4{10, 0, 0, 1})) {
+		t.Errorf("e.Check(10.0.0.1) = true, want false")
+	}
+	if !e.Check(ban.NewIPv4IP(ban.IPv4{10, 0, 99, 1})) {
+		t.Errorf("e.Check(10.0.99.1) = false, want true")
+	}
+	if !e.CheckKey("k") {
+		t.Errorf("e.CheckKey(k) = false, want true")
+	}
+	if got := len(e.PrefixedIPs()); got != len(pips)-1 {
+		t.Errorf("len(e.PrefixedIPs()) = %d, want %d", got, len(pips)-1)
+	}
+}
@@ -0,0 +1,94 @@
+package ban
+
+import (
+	"net"
+	"time"
+)
+
+// ListenerConfig for the Listener.
+type ListenerConfig struct {
+	// Delay before connections from banned IPs are closed.
+	//
+	// Delaying holds the banned client's connection open without serving
+	// it. Closes immediately if not assigned.
+	Delay time.Duration
+	// MaxDelayed is the number of connections which can be delayed at once.
+	// Connections from banned IPs past the limit are closed immediately.
+	//
+	// Defaults to 100 if not assigned.
+	MaxDelayed int
+}
+
+// DefaultListenerConfig which closes connections from banned IPs immediately.
+var DefaultListenerConfig = ListenerConfig{}
+
+// defaultListenerMaxDelayed is the MaxDelayed if none is assigned.
+const defaultListenerMaxDelayed = 100
+
+// Listener is a net.Listener wrapper which closes connections from IPs banned
+// in an Engine before they are returned by Accept.
+//
+// Bans issued into the Engine take effect for the next connection accepted, so
+// banned clients are rejected before any TLS handshake or HTTP parsing.
+type Listener struct {
+	net.Listener
+	engine *Engine
+	delay  time.Duration
+	// delayed holds a value for every connection being delayed.
+	delayed chan struct{}
+}
+
+// NewListener that wraps the net.Listener to close connections from IPs
+// banned in the Engine with behavior customized by ListenerConfig.
+func NewListener(l net.Listener, e *Engine, cfg ListenerConfig) *Listener {
+	maxDelayed := cfg.MaxDelayed
+	if maxDelayed == 0 {
+		maxDelayed = defaultListenerMaxDelayed
+	}
+	return &Listener{
+		Listener: l,
+		engine:   e,
+		delay:    cfg.Delay,
+		delayed:  make(chan struct{}, maxDelayed),
+	}
+}
+
+// Accept waits for and returns the next connection from an IP which isn't
+// banned.
+//
+// Connections without an IP remote-address, like those of Unix sockets, are
+// always returned.
+//
+// Returns any error returned by the wrapped net.Listener's Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, err := ParseRemoteAddress(conn.RemoteAddr().String())
+		if err != nil || !l.engine.Check(ip) {
+			return conn, nil
+		}
+		l.close(conn)
+	}
+}
+
+// close the connection after the delay, or immediately if there is no delay or
+// too many connections are already being delayed.
+func (l *Listener) close(conn net.Conn) {
+	if l.delay == 0 {
+		conn.Close()
+		return
+	}
+	select {
+	case l.delayed <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	time.AfterFunc(l.delay, func() {
+		conn.Close()
+		<-l.delayed
+	})
+}
@@ -0,0 +1,159 @@
+package ban
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestListener tests that the Listener closes connections from banned IPs and
+// returns the rest.
+func TestListener(t *testing.T) {
+	t.Parallel()
+	h := testListenerHandler(t, "1.2.3.4/32")
+	banned, bannedClient := testConn("1.2.3.4:1")
+	allowed, _ := testConn("5.6.7.8:1")
+	l := NewListener(
+		&testListener{conns: []net.Conn{banned, allowed}},
+		h.Engine(), DefaultListenerConfig,
+	)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+	}
+	if conn != allowed {
+		t.Errorf("l.Accept() = %v, want %v", conn.RemoteAddr(), allowed.RemoteAddr())
+	}
+	if _, err := bannedClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("bannedClient.Read() = %v, want io.EOF", err)
+	}
+	if _, err := l.Accept(); err != errTestListenerDone {
+		t.Errorf("l.Accept() = %v, want %v", err, errTestListenerDone)
+	}
+}
+
+// TestListenerDelay tests that the Listener closes connections from banned IPs
+// after the delay, and immediately once too many are being delayed.
+func TestListenerDelay(t *testing.T) {
+	t.Parallel()
+	const delay = 50 * time.Millisecond
+	h := testListenerHandler(t, "1.2.3.0/24")
+	banned, bannedClient := testConn("1.2.3.4:1")
+	extra, extraClient := testConn("1.2.3.5:1")
+	l := NewListener(
+		&testListener{conns: []net.Conn{banned, extra}},
+		h.Engine(), ListenerConfig{Delay: delay, MaxDelayed: 1},
+	)
+	start := time.Now()
+	if _, err := l.Accept(); err != errTestListenerDone {
+		t.Errorf("l.Accept() = %v, want %v", err, errTestListenerDone)
+	}
+	if _, err := extraClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("extraClient.Read() = %v, want io.EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("closed the extra connection after %v, want less than %v", elapsed, delay)
+	}
+	if _, err := bannedClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("bannedClient.Read() = %v, want io.EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("closed after %v, want at least %v", elapsed, delay)
+	}
+}
+
+// TestListenerSharesHandler tests that Bans issued by the Handler take effect
+// in the Listener.
+func TestListenerSharesHandler(t *testing.T) {
+	t.Parallel()
+	h := testListenerHandler(t)
+	testHandler(t, h, "1.2.3.4", "1.2.3.4 is banned", http.StatusForbidden)
+	banned, _ := testConn("1.2.3.4:1")
+	l := NewListener(&testListener{conns: []net.Conn{banned}}, h.Engine(), DefaultListenerConfig)
+	if _, err := l.Accept(); err != errTestListenerDone {
+		t.Errorf("l.Accept() = %v, want %v", err, errTestListenerDone)
+	}
+}
+
+// testListenerHandler returns a Handler which bans every IP it serves with
+// the string forms of PrefixedIPs already added.
+func testListenerHandler(t *testing.T, ss ...string) *Handler {
+	h := New(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		BannerFunc(func(ip IP, r *http.Request) Ban { return IPBan }),
+		Config{ErrorHandler: IgnoreErrorHandler},
+	)
+	for _, s := range ss {
+		pip, err := ParsePrefixedIP(s)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := h.Add(pip); err != nil {
+			t.Error(err)
+		}
+	}
+	return h
+}
+
+// errTestListenerDone is returned by testListener's Accept once it has no more
+// connections.
+var errTestListenerDone = errors.New("done")
+
+// testListener is a net.Listener which accepts a fixed list of connections.
+type testListener struct {
+	conns []net.Conn
+	// block, if not nil, is waited on once there are no more connections
+	// until the testListener is closed.
+	block chan struct{}
+}
+
+// Accept the next connection or return errTestListenerDone if there are none.
+func (l *testListener) Accept() (net.Conn, error) {
+	if len(l.conns) == 0 {
+		if l.block != nil {
+			<-l.block
+		}
+		return nil, errTestListenerDone
+	}
+	conn := l.conns[0]
+	l.conns = l.conns[1:]
+	return conn, nil
+}
+
+// Close unblocks Accept if it blocks.
+func (l *testListener) Close() error {
+	if l.block != nil {
+		close(l.block)
+	}
+	return nil
+}
+
+// Addr returns nil.
+func (l *testListener) Addr() net.Addr {
+	return nil
+}
+
+// testAddrConn is a net.Conn with a fixed remote-address.
+type testAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+// RemoteAddr returns the fixed remote-address.
+func (c *testAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// testConn returns the server end of an in-memory connection from the
+// remote-address and the client end.
+func testConn(addr string) (net.Conn, net.Conn) {
+	server, client := net.Pipe()
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	return &testAddrConn{Conn: server, addr: tcpAddr}, client
+}
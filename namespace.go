@@ -0,0 +1,104 @@
+package ban
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NamespaceSelector selects the name of the namespace of an http.Request.
+type NamespaceSelector func(*http.Request) string
+
+// HostNamespace is a NamespaceSelector which uses the lower-cased host of the
+// http.Request without the port.
+func HostNamespace(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// Namespace of Bans with its own Banner and Engine so Bans issued in it don't
+// affect other Namespaces.
+type Namespace struct {
+	// Banner issues Bans in the Namespace.
+	Banner Banner
+	// Config of the Namespace's Engine.
+	//
+	// Namespaces should have different StorePaths so their Bans are stored
+	// separately.
+	Config Config
+}
+
+// NamespaceConfig for Handlers which check and issue Bans in the Namespace of
+// each http.Request.
+type NamespaceConfig struct {
+	// Selector selects the name of the Namespace of http.Requests.
+	//
+	// Defaults to HostNamespace if not assigned.
+	Selector NamespaceSelector
+	// Namespaces by name.
+	//
+	// http.Requests whose name isn't in Namespaces are only checked against
+	// the Global Namespace.
+	Namespaces map[string]Namespace
+	// Global Namespace which is checked for, and can issue Bans to, every
+	// http.Request before its own Namespace.
+	//
+	// There is no Global Namespace if not assigned.
+	Global *Namespace
+}
+
+// NewNamespaced Handler that wraps the http.Handler to check for Bans in the
+// Namespace of each http.Request, selected and customized by NamespaceConfig.
+//
+// The Handler's Engine is the Global Namespace's. It is an empty Engine without
+// a store if there is no Global Namespace.
+func NewNamespaced(h http.Handler, cfg NamespaceConfig) *Handler {
+	global := cfg.Global
+	if global == nil {
+		global = &Namespace{Banner: BannerFunc(func(IP, *http.Request) Ban {
+			return NoBan
+		})}
+	}
+	selector := cfg.Selector
+	if selector == nil {
+		selector = HostNamespace
+	}
+	namespaces := make(map[string]*Handler, len(cfg.Namespaces))
+	for name, ns := range cfg.Namespaces {
+		namespaces[name] = New(h, ns.Banner, ns.Config)
+	}
+	gh := New(h, global.Banner, global.Config)
+	gh.selector = selector
+	gh.namespaces = namespaces
+	return gh
+}
+
+// Namespace returns the Handler for the Namespace with the name.
+//
+// Returns nil if the Handler has no Namespace with the name.
+func (h *Handler) Namespace(name string) *Handler {
+	return h.namespaces[name]
+}
+
+// next serves the http.Request with the Handler of its Namespace if it has one
+// or the wrapped http.Handler otherwise.
+func (h *Handler) next(rw http.ResponseWriter, r *http.Request) {
+	if ns, ok := h.namespaces[h.selectNamespace(r)]; ok {
+		ns.ServeHTTP(rw, r)
+		return
+	}
+	h.handler.ServeHTTP(rw, r)
+}
+
+// selectNamespace returns the name of the http.Request's Namespace.
+//
+// Returns "" if the Handler has no Namespaces.
+func (h *Handler) selectNamespace(r *http.Request) string {
+	if h.selector == nil {
+		return ""
+	}
+	return h.selector(r)
+}
@@ -0,0 +1,115 @@
+package ban
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestHostNamespace tests that HostNamespace selects the lower-cased host
+// without the port.
+func TestHostNamespace(t *testing.T) {
+	t.Parallel()
+	cases := map[string]string{
+		"example.com":      "example.com",
+		"Example.COM:8080": "example.com",
+		"[::1]:80":         "::1",
+		"":                 "",
+	}
+	for host, want := range cases {
+		if got := HostNamespace(&http.Request{Host: host}); got != want {
+			t.Errorf("HostNamespace(%v) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+// TestNamespaced tests that Bans issued in a Namespace only affect it, that
+// Bans issued in the Global Namespace affect every Namespace, and that each
+// Namespace stores its Bans separately.
+func TestNamespaced(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		for _, path := range []string{"namespace_a.txt", "namespace_b.txt"} {
+			if err := os.Remove(path); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	banPath := func(path string) Banner {
+		return BannerFunc(func(ip IP, r *http.Request) Ban {
+			if r.URL.Path == path {
+				return IPBan
+			}
+			return NoBan
+		})
+	}
+	errorHandler := func(err error) { t.Error(err) }
+	cfg := NamespaceConfig{
+		Namespaces: map[string]Namespace{
+			"a.com": {
+				Banner: banPath("/a"),
+				Config: Config{StorePath: "namespace_a.txt", ErrorHandler: errorHandler},
+			},
+			"b.com": {
+				Banner: banPath("/b"),
+				Config: Config{StorePath: "namespace_b.txt", ErrorHandler: errorHandler},
+			},
+		},
+		Global: &Namespace{
+			Banner: banPath("/global"),
+			Config: Config{ErrorHandler: errorHandler},
+		},
+	}
+	wh := NewNamespaced(h, cfg)
+	testTarget(t, wh, "1.1.1.1", "http://a.com/a", nil, "1.1.1.1 is banned", http.StatusForbidden)
+	testTarget(t, wh, "1.1.1.1", "http://a.com:80/", nil, "1.1.1.1 is banned", http.StatusForbidden)
+	testTarget(t, wh, "1.1.1.1", "http://b.com/", nil, "", http.StatusOK)
+	testTarget(t, wh, "1.1.1.1", "http://c.com/a", nil, "", http.StatusOK)
+	testTarget(t, wh, "2.2.2.2", "http://b.com/b", nil, "2.2.2.2 is banned", http.StatusForbidden)
+	testTarget(t, wh, "2.2.2.2", "http://a.com/", nil, "", http.StatusOK)
+	testTarget(t, wh, "3.3.3.3", "http://c.com/global", nil, "3.3.3.3 is banned", http.StatusForbidden)
+	testTarget(t, wh, "3.3.3.3", "http://a.com/", nil, "3.3.3.3 is banned", http.StatusForbidden)
+	testTarget(t, wh, "3.3.3.3", "http://b.com/", nil, "3.3.3.3 is banned", http.StatusForbidden)
+	if ns := wh.Namespace("c.com"); ns != nil {
+		t.Errorf("wh.Namespace(c.com) = %v, want nil", ns)
+	}
+	wh = NewNamespaced(h, cfg)
+	testTarget(t, wh, "1.1.1.1", "http://a.com/", nil, "1.1.1.1 is banned", http.StatusForbidden)
+	testTarget(t, wh, "1.1.1.1", "http://b.com/", nil, "", http.StatusOK)
+	testTarget(t, wh, "3.3.3.3", "http://b.com/", nil, "", http.StatusOK)
+	pips := wh.Namespace("b.com").Engine().PrefixedIPs()
+	if len(pips) != 1 || pips[0].String() != "2.2.2.2/32" {
+		t.Errorf("wh.Namespace(b.com).Engine().PrefixedIPs() = %v, want [2.2.2.2/32]", pips)
+	}
+}
+
+// TestNamespacedWithoutGlobal tests that Handlers without a Global Namespace
+// still dispatch to their Namespaces and have an empty Engine.
+func TestNamespacedWithoutGlobal(t *testing.T) {
+	t.Parallel()
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	wh := NewNamespaced(h, NamespaceConfig{
+		Selector: NamespaceSelector(HeaderKey("X-Tenant")),
+		Namespaces: map[string]Namespace{
+			"a": {Banner: BannerFunc(func(ip IP, r *http.Request) Ban { return IPBan })},
+		},
+	})
+	for _, c := range []struct {
+		Tenant string
+		Want   int
+	}{{Tenant: "a", Want: http.StatusForbidden}, {Tenant: "b", Want: http.StatusOK}} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "1.1.1.1:1"
+		r.Header.Set("X-Tenant", c.Tenant)
+		rec := httptest.NewRecorder()
+		wh.ServeHTTP(rec, r)
+		if rec.Code != c.Want {
+			t.Errorf("%s: rec.Code = %d, want %d", c.Tenant, rec.Code, c.Want)
+		}
+	}
+	if pips := wh.Engine().PrefixedIPs(); len(pips) != 0 {
+		t.Errorf("wh.Engine().PrefixedIPs() = %v, want []", pips)
+	}
+}
@@ -0,0 +1,404 @@
+package ban
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrBadProxyHeader is returned if a malformed PROXY protocol header is
+	// read.
+	ErrBadProxyHeader = errors.New("bad PROXY protocol header")
+	// ErrUntrustedProxyHeader is returned if a PROXY protocol header is sent
+	// by an address which isn't trusted.
+	ErrUntrustedProxyHeader = errors.New("PROXY protocol header from untrusted address")
+	// ErrMissingProxyHeader is returned if a trusted address doesn't send a
+	// PROXY protocol header when one is required.
+	ErrMissingProxyHeader = errors.New("missing PROXY protocol header")
+)
+
+var (
+	// proxyV1Signature begins PROXY protocol v1 headers.
+	proxyV1Signature = []byte("PROXY ")
+	// proxyV2Signature begins PROXY protocol v2 headers.
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// proxyV1MaxLength is the maximum number of bytes in a PROXY protocol v1
+	// header.
+	proxyV1MaxLength = 107
+	// proxyV2HeaderLength is the number of bytes in a PROXY protocol v2
+	// header before the addresses.
+	proxyV2HeaderLength = 16
+	// proxyMaxPending is the number of accepted connections which can be
+	// waiting for their header to be read or to be returned by Accept.
+	proxyMaxPending = 1024
+)
+
+// ProxyConfig for the ProxyListener.
+type ProxyConfig struct {
+	// Trusted PrefixedIPs of upstreams, like load balancers, whose PROXY
+	// protocol headers are read.
+	//
+	// Connections from other addresses which send a PROXY protocol header
+	// are rejected.
+	Trusted []*PrefixedIP
+	// RequireHeader rejects connections from trusted upstreams which don't
+	// send a PROXY protocol header.
+	//
+	// Connections from trusted upstreams without a header keep their own
+	// remote-address if not assigned.
+	RequireHeader bool
+	// HeaderTimeout is how long to wait for the PROXY protocol header.
+	//
+	// Defaults to 5 seconds if not assigned.
+	HeaderTimeout time.Duration
+}
+
+// defaultProxyHeaderTimeout is the HeaderTimeout if none is assigned.
+const defaultProxyHeaderTimeout = 5 * time.Second
+
+// ProxyListener is a net.Listener wrapper which reads HAProxy PROXY protocol
+// v1 and v2 headers from connections from trusted upstreams.
+//
+// The remote-addresses of the returned connections are the addresses of the
+// original clients, so the remote-addresses of http.Requests served from the
+// ProxyListener are the IPs that Handlers check and pass to Banners.
+//
+// Headers from trusted upstreams are read in the background, within the
+// HeaderTimeout, before their connections are returned by Accept, so slow
+// upstreams can't block other connections from being accepted and RemoteAddr
+// never blocks. Connections whose headers are bad or missing when required are
+// closed and return the error from Read. Connections from other addresses are
+// returned immediately and checked for a header on the first Read.
+type ProxyListener struct {
+	net.Listener
+	trusted       ipMap
+	requireHeader bool
+	headerTimeout time.Duration
+
+	// start starts accepting in the background on the first Accept.
+	start sync.Once
+	// pending holds a value for every connection accepted but not returned.
+	pending chan struct{}
+	// conns receives connections ready to be returned.
+	conns chan net.Conn
+	// errs receives errors from the wrapped net.Listener's Accept.
+	errs      chan error
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewProxyListener that wraps the net.Listener to read PROXY protocol headers
+// with behavior customized by ProxyConfig.
+func NewProxyListener(l net.Listener, cfg ProxyConfig) *ProxyListener {
+	trusted := newTrie()
+	for _, pip := range cfg.Trusted {
+		trusted.Add(pip)
+	}
+	headerTimeout := cfg.HeaderTimeout
+	if headerTimeout == 0 {
+		headerTimeout = defaultProxyHeaderTimeout
+	}
+	return &ProxyListener{
+		Listener:      l,
+		trusted:       trusted,
+		requireHeader: cfg.RequireHeader,
+		headerTimeout: headerTimeout,
+		pending:       make(chan struct{}, proxyMaxPending),
+		conns:         make(chan net.Conn),
+		errs:          make(chan error),
+		closed:        make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection whose header, if it is from
+// a trusted upstream, has been read.
+//
+// Returns any error returned by the wrapped net.Listener's Accept, or
+// net.ErrClosed once the ProxyListener is closed.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	l.start.Do(func() { go l.accept() })
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close the wrapped net.Listener and stop accepting.
+//
+// Returns any error returned by the wrapped net.Listener's Close.
+func (l *ProxyListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// accept connections until the ProxyListener is closed, reading the headers of
+// ones from trusted upstreams in their own goroutines.
+func (l *ProxyListener) accept() {
+	for {
+		select {
+		case l.pending <- struct{}{}:
+		case <-l.closed:
+			return
+		}
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			<-l.pending
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			continue
+		}
+		trusted := false
+		if ip, err := ParseRemoteAddress(conn.RemoteAddr().String()); err == nil {
+			trusted = l.trusted.Has(ip)
+		}
+		c := &proxyConn{
+			Conn:          conn,
+			trusted:       trusted,
+			requireHeader: l.requireHeader,
+			headerTimeout: l.headerTimeout,
+			r:             bufio.NewReader(conn),
+			remoteAddr:    conn.RemoteAddr(),
+		}
+		go func() {
+			defer func() { <-l.pending }()
+			if c.trusted {
+				c.once.Do(c.readHeader)
+			}
+			select {
+			case l.conns <- c:
+			case <-l.closed:
+				c.Close()
+			}
+		}()
+	}
+}
+
+// proxyConn is a net.Conn which reads a PROXY protocol header before any
+// data.
+type proxyConn struct {
+	net.Conn
+	trusted       bool
+	requireHeader bool
+	headerTimeout time.Duration
+
+	once sync.Once
+	// err is any error from reading the header.
+	err error
+	// r holds data read after the header.
+	r *bufio.Reader
+	// remoteAddr is the address of the original client.
+	remoteAddr net.Addr
+}
+
+// Read data after the PROXY protocol header.
+//
+// Returns any error from reading the header or the data.
+func (c *proxyConn) Read(bs []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(bs)
+}
+
+// RemoteAddr returns the address of the original client.
+//
+// Headers of connections from trusted addresses are read before they are
+// returned by Accept, and connections from untrusted addresses always return
+// their own remote-address.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readHeader reads the PROXY protocol header and closes the connection if it
+// must be rejected.
+//
+// Only trusted connections have the header timeout, since untrusted
+// connections are only checked for a header once data is read.
+func (c *proxyConn) readHeader() {
+	if c.trusted {
+		if err := c.SetReadDeadline(time.Now().Add(c.headerTimeout)); err != nil {
+			c.err = err
+			return
+		}
+	}
+	addr, err := c.parseHeader()
+	if c.trusted {
+		// Clearing the deadline fails if the client already closed its end,
+		// which later reads report.
+		c.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		c.err = err
+		c.Conn.Close()
+		return
+	}
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+}
+
+// parseHeader reads the PROXY protocol header if there is one.
+//
+// Returns the address of the original client, which is nil if the connection's
+// own remote-address should be used, or an error if the header is bad, is sent
+// by an untrusted address, or is missing when required.
+func (c *proxyConn) parseHeader() (net.Addr, error) {
+	v1, err := hasPrefix(c.r, proxyV1Signature)
+	if err != nil {
+		return nil, err
+	}
+	v2 := false
+	if !v1 {
+		if v2, err = hasPrefix(c.r, proxyV2Signature); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case (v1 || v2) && !c.trusted:
+		return nil, ErrUntrustedProxyHeader
+	case v1:
+		return parseProxyV1(c.r)
+	case v2:
+		return parseProxyV2(c.r)
+	case c.trusted && c.requireHeader:
+		return nil, ErrMissingProxyHeader
+	}
+	return nil, nil
+}
+
+// hasPrefix returns true if the next bytes in the bufio.Reader are the prefix.
+//
+// Bytes are peeked one at a time so only data that matches the prefix so far is
+// waited for.
+//
+// Returns an error if the bufio.Reader fails before the prefix is determined.
+func hasPrefix(r *bufio.Reader, prefix []byte) (bool, error) {
+	for i := 1; i <= len(prefix); i++ {
+		bs, err := r.Peek(i)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if bs[i-1] != prefix[i-1] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// parseProxyV1 parses a PROXY protocol v1 header like
+// "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n".
+//
+// Returns nil for "PROXY UNKNOWN" headers or an error if the header is bad.
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, ErrBadProxyHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, ErrBadProxyHeader
+	}
+	ip, err := ParseIP(fields[2])
+	if err != nil || strings.Contains(fields[2], "%") {
+		return nil, ErrBadProxyHeader
+	}
+	_, isIPv4 := ip.IPv4()
+	if fields[1] == "TCP4" && !isIPv4 || fields[1] == "TCP6" && isIPv4 ||
+		fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, ErrBadProxyHeader
+	}
+	if _, err := ParseIP(fields[3]); err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ErrBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip[:], Port: int(port)}, nil
+}
+
+// parseProxyV2 parses a binary PROXY protocol v2 header.
+//
+// Returns nil for LOCAL commands and address families other than TCP or UDP
+// over IPv4 or IPv6, or an error if the header is bad.
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, ErrBadProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch versionCommand & 0xf {
+	case 0:
+		// LOCAL connections are from the upstream itself.
+		return nil, nil
+	case 1:
+	default:
+		return nil, ErrBadProxyHeader
+	}
+	var ip IP
+	var port uint16
+	switch family >> 4 {
+	case 1:
+		if len(body) < 2*ipv4Length+4 {
+			return nil, ErrBadProxyHeader
+		}
+		var addr IPv4
+		copy(addr[:], body)
+		ip = NewIPv4IP(addr)
+		port = binary.BigEndian.Uint16(body[2*ipv4Length:])
+	case 2:
+		if len(body) < 2*ipv6Length+4 {
+			return nil, ErrBadProxyHeader
+		}
+		copy(ip[:], body)
+		port = binary.BigEndian.Uint16(body[2*ipv6Length:])
+	default:
+		return nil, nil
+	}
+	if family&0xf == 2 {
+		return &net.UDPAddr{IP: ip[:], Port: int(port)}, nil
+	}
+	return &net.TCPAddr{IP: ip[:], Port: int(port)}, nil
+}
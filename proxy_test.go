@@ -0,0 +1,257 @@
+package ban
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyCase is data sent from a remote-address through a ProxyListener with
+// the remote-address, data or error expected.
+type proxyCase struct {
+	Name          string
+	RemoteAddr    string
+	Send          string
+	RequireHeader bool
+	WantAddr      string
+	WantData      string
+	WantErr       error
+}
+
+// TestProxyListener tests that the ProxyListener reads headers from trusted
+// addresses and rejects headers from untrusted ones.
+func TestProxyListener(t *testing.T) {
+	t.Parallel()
+	cases := []proxyCase{
+		{
+			Name:       "v1 TCP4",
+			RemoteAddr: "10.0.0.1:1",
+			Send:       "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nhello",
+			WantAddr:   "1.2.3.4:1234",
+			WantData:   "hello",
+		},
+		{
+			Name:       "v1 TCP6",
+			RemoteAddr: "10.0.0.1:1",
+			Send:       "PROXY TCP6 2001:db8::1 2001:db8::2 1234 80\r\nhello",
+			WantAddr:   "[2001:db8::1]:1234",
+			WantData:   "hello",
+		},
+		{
+			Name:       "v1 UNKNOWN",
+			RemoteAddr: "10.0.0.1:1",
+			Send:       "PROXY UNKNOWN\r\nhello",
+			WantAddr:   "10.0.0.1:1",
+			WantData:   "hello",
+		},
+		{
+			Name:       "v2 TCP4",
+			RemoteAddr: "10.0.0.1:1",
+			Send:       proxyV2Header(0x21, 0x11, []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0xd2, 0, 80}) + "hello",
+			WantAddr:   "1.2.3.4:1234",
+			WantData:   "hello",
+		},
+		{
+			Name:       "v2 TCP6 with TLVs",
+			RemoteAddr: "10.0.0.1:1",
+			Send: proxyV2Header(0x21, 0x21, append(append(
+				[]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+				make([]byte, ipv6Length)...), 0x04, 0xd2, 0, 80, 0x04, 0, 1, 0)) + "hello",
+			WantAddr: "[2001:db8::1]:1234",
+			WantData: "hello",
+		},
+		{
+			Name:       "v2 LOCAL",
+			RemoteAddr: "10.0.0.1:1",
+			Send:       proxyV2Header(0x20, 0x00, nil) + "hello",
+			WantAddr:   "10.0.0.1:1",
+			WantData:   "hello",
+		},
+		{
+			Name:       "trusted without header",
+			RemoteAddr: "10.0.0.1:1",
+			Send:       "hello",
+			WantAddr:   "10.0.0.1:1",
+			WantData:   "hello",
+		},
+		{
+			Name:          "trusted without required header",
+			RemoteAddr:    "10.0.0.1:1",
+			Send:          "hello",
+			RequireHeader: true,
+			WantAddr:      "10.0.0.1:1",
+			WantErr:       ErrMissingProxyHeader,
+		},
+		{
+			Name:       "untrusted without header",
+			RemoteAddr: "1.1.1.1:1",
+			Send:       "PROXIMITY",
+			WantAddr:   "1.1.1.1:1",
+			WantData:   "PROXIMITY",
+		},
+		{
+			Name:       "untrusted v1",
+			RemoteAddr: "1.1.1.1:1",
+			Send:       "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nhello",
+			WantAddr:   "1.1.1.1:1",
+			WantErr:    ErrUntrustedProxyHeader,
+		},
+		{
+			Name:       "untrusted v2",
+			RemoteAddr: "1.1.1.1:1",
+			Send:       proxyV2Header(0x21, 0x11, make([]byte, 12)),
+			WantAddr:   "1.1.1.1:1",
+			WantErr:    ErrUntrustedProxyHeader,
+		},
+		{
+			Name:       "v1 mismatched family",
+			RemoteAddr: "10.0.0.1:1",
+			Send:       "PROXY TCP6 1.2.3.4 5.6.7.8 1234 80\r\nhello",
+			WantAddr:   "10.0.0.1:1",
+			WantErr:    ErrBadProxyHeader,
+		},
+		{
+			Name:       "v1 too long",
+			RemoteAddr: "10.0.0.1:1",
+			Send:       "PROXY " + strings.Repeat("x", proxyV1MaxLength) + "\r\n",
+			WantAddr:   "10.0.0.1:1",
+			WantErr:    ErrBadProxyHeader,
+		},
+		{
+			Name:       "v2 bad version",
+			RemoteAddr: "10.0.0.1:1",
+			Send:       proxyV2Header(0x11, 0x11, make([]byte, 12)),
+			WantAddr:   "10.0.0.1:1",
+			WantErr:    ErrBadProxyHeader,
+		},
+	}
+	for _, c := range cases {
+		testProxyCase(t, c)
+	}
+}
+
+// TestProxyListenerHandler tests that Handlers served from a ProxyListener see
+// the IPs of the original clients.
+func TestProxyListenerHandler(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	trusted, err := ParsePrefixedIP("127.0.0.1/32")
+	if err != nil {
+		t.Error(err)
+	}
+	h := New(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		BannerFunc(func(ip IP, r *http.Request) Ban {
+			if ip.String() == "1.2.3.4" {
+				return IPBan
+			}
+			return NoBan
+		}),
+		Config{ErrorHandler: IgnoreErrorHandler},
+	)
+	s := &http.Server{Handler: h}
+	go s.Serve(NewProxyListener(l, ProxyConfig{Trusted: []*PrefixedIP{trusted}}))
+	defer s.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 1.2.3.4 127.0.0.1 1234 80\r\n")
+	io.WriteString(conn, "GET / HTTP/1.0\r\n\r\n")
+	bs, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.HasSuffix(string(bs), "1.2.3.4 is banned") {
+		t.Errorf("response = %q, want 1.2.3.4 is banned", bs)
+	}
+}
+
+// TestProxyListenerSlowUpstream tests that a trusted upstream which is slow to
+// send its header doesn't block other connections from being accepted through
+// a Listener.
+func TestProxyListenerSlowUpstream(t *testing.T) {
+	t.Parallel()
+	trusted, err := ParsePrefixedIP("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, slowClient := testConn("10.0.0.1:1")
+	defer slowClient.Close()
+	fast, fastClient := testConn("10.0.0.2:1")
+	go io.WriteString(fastClient, "PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n")
+	l := NewListener(
+		NewProxyListener(
+			&testListener{conns: []net.Conn{slow, fast}, block: make(chan struct{})},
+			ProxyConfig{Trusted: []*PrefixedIP{trusted}, HeaderTimeout: time.Hour},
+		),
+		testListenerHandler(t).Engine(), DefaultListenerConfig,
+	)
+	defer l.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	select {
+	case conn := <-accepted:
+		if addr := conn.RemoteAddr().String(); addr != "1.2.3.4:1234" {
+			t.Errorf("conn.RemoteAddr() = %v, want 1.2.3.4:1234", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("l.Accept() blocked on the slow upstream")
+	}
+}
+
+// testProxyCase tests that the proxyCase gives the expected results.
+func testProxyCase(t *testing.T, c proxyCase) {
+	trusted, err := ParsePrefixedIP("10.0.0.0/8")
+	if err != nil {
+		t.Error(err)
+	}
+	server, client := testConn(c.RemoteAddr)
+	l := NewProxyListener(
+		&testListener{conns: []net.Conn{server}, block: make(chan struct{})},
+		ProxyConfig{Trusted: []*PrefixedIP{trusted}, RequireHeader: c.RequireHeader},
+	)
+	defer l.Close()
+	go func() {
+		io.WriteString(client, c.Send)
+		client.Close()
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := conn.RemoteAddr().String(); addr != c.WantAddr {
+		t.Errorf("%s: conn.RemoteAddr() = %v, want %v", c.Name, addr, c.WantAddr)
+	}
+	bs, err := ioutil.ReadAll(conn)
+	if err != c.WantErr {
+		t.Errorf("%s: ioutil.ReadAll(conn) = %v, want %v", c.Name, err, c.WantErr)
+	}
+	if string(bs) != c.WantData {
+		t.Errorf("%s: ioutil.ReadAll(conn) = %q, want %q", c.Name, bs, c.WantData)
+	}
+}
+
+// proxyV2Header returns a PROXY protocol v2 header with the version and
+// command byte, family byte and body.
+func proxyV2Header(versionCommand, family byte, body []byte) string {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, versionCommand, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return string(append(header, body...))
+}
@@ -0,0 +1,585 @@
+// Package redisban provides a ban.SharedStore which keeps Bans in Redis so a
+// fleet of instances shares them.
+//
+// Every banned PrefixedIP, PrefixedIP in a Scope, key, and fingerprint is a
+// Redis key which expires with the ban, and every change is published so
+// instances apply changes made by the others as they happen.
+package redisban
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jwowillo/ban"
+)
+
+// Config for the Store.
+type Config struct {
+	// Addr of Redis.
+	//
+	// Defaults to "localhost:6379" if not assigned.
+	Addr string
+	// Password to authenticate to Redis with.
+	//
+	// Doesn't authenticate if not assigned.
+	Password string
+	// DB is the number of the database to select.
+	//
+	// Defaults to 0 if not assigned.
+	DB int
+	// Prefix of the Redis keys of StoreEntries and of the channel changes are
+	// published to, so instances with different Prefixes don't share Bans.
+	//
+	// Defaults to "ban" if not assigned.
+	Prefix string
+	// DialTimeout is how long connecting to Redis can take.
+	//
+	// Defaults to 5 seconds if not assigned.
+	DialTimeout time.Duration
+	// Timeout is how long each command sent to Redis can take before it fails
+	// and its connection is closed.
+	//
+	// Defaults to 5 seconds if not assigned.
+	Timeout time.Duration
+	// ReconnectInterval between attempts to reconnect the subscription to
+	// changes after it fails.
+	//
+	// Defaults to a second if not assigned.
+	ReconnectInterval time.Duration
+	// ErrorHandler handles errors with the subscription to changes, which
+	// are retried.
+	//
+	// Defaults to ban.StderrErrorHandler if not assigned.
+	ErrorHandler ban.ErrorHandler
+}
+
+// DefaultConfig which uses database 0 of Redis at localhost:6379 without a
+// password with the Prefix "ban".
+var DefaultConfig = Config{}
+
+const (
+	// defaultAddr is the Addr if none is assigned.
+	defaultAddr = "localhost:6379"
+	// defaultPrefix is the Prefix if none is assigned.
+	defaultPrefix = "ban"
+	// defaultDialTimeout is the DialTimeout if none is assigned.
+	defaultDialTimeout = 5 * time.Second
+	// defaultTimeout is the Timeout if none is assigned.
+	defaultTimeout = 5 * time.Second
+	// defaultReconnectInterval is the ReconnectInterval if none is assigned.
+	defaultReconnectInterval = time.Second
+	// minPruneAt is the fewest known StoreEntries at which expired ones are
+	// forgotten.
+	minPruneAt = 1024
+	// scanCount is the number of keys asked for by each SCAN.
+	scanCount = "1000"
+	// added marks published changes which add a StoreEntry.
+	added = "+"
+	// removed marks published changes which remove a StoreEntry.
+	removed = "-"
+)
+
+// Store is a ban.SharedStore which keeps StoreEntries in Redis.
+//
+// Each StoreEntry is kept at the Prefix, ":entry:", and its String form, with
+// the Unix milliseconds of its Expiry, or 0, as the value. Keys of StoreEntries
+// with an Expiry expire with them.
+//
+// Changes are published to the channel at the Prefix and ":changes" as the ID
+// of the Store which made them, added or removed, the Unix milliseconds of the
+// Expiry, and the String form of the StoreEntry separated by spaces.
+//
+// Commands which fail because the connection broke or took longer than the
+// Timeout are retried once on a new connection, and the subscription to changes
+// is reconnected until the Store is closed. Once each subscription is
+// confirmed, Redis is loaded again and compared with the StoreEntries the Store
+// knew of, so StoreEntries added or removed since it last loaded or while it
+// was disconnected are applied.
+type Store struct {
+	addr              string
+	password          string
+	db                int
+	prefix            string
+	dialTimeout       time.Duration
+	timeout           time.Duration
+	reconnectInterval time.Duration
+	errorHandler      ban.ErrorHandler
+	// id of the Store, which marks changes it published.
+	id string
+
+	// mu guards conn.
+	mu sync.Mutex
+	// conn sends commands and is nil until connected.
+	conn *conn
+
+	// stateMu guards entries and changed.
+	stateMu sync.Mutex
+	// entries holds the StoreEntries known to be in Redis by their String
+	// form.
+	entries map[string]ban.StoreEntry
+	// pruneAt is the number of known StoreEntries at which expired ones are
+	// forgotten.
+	pruneAt int
+	// changed holds the String forms of StoreEntries the Store added or
+	// removed while resyncing, which is nil when not resyncing.
+	changed map[string]bool
+
+	// subMu guards sub and closed.
+	subMu sync.Mutex
+	// sub is the connection of the subscription to changes, which is nil
+	// when not connected.
+	sub    *conn
+	closed bool
+	// watching is done once the subscription to changes stops.
+	watching sync.WaitGroup
+}
+
+// New Store with behavior customized by Config.
+//
+// Redis isn't connected to until the Store is used.
+func New(cfg Config) *Store {
+	addr := cfg.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	dialTimeout := cfg.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	reconnectInterval := cfg.ReconnectInterval
+	if reconnectInterval == 0 {
+		reconnectInterval = defaultReconnectInterval
+	}
+	errorHandler := cfg.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = ban.StderrErrorHandler
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return &Store{
+		addr:              addr,
+		password:          cfg.Password,
+		db:                cfg.DB,
+		prefix:            prefix,
+		dialTimeout:       dialTimeout,
+		timeout:           timeout,
+		reconnectInterval: reconnectInterval,
+		errorHandler:      errorHandler,
+		id:                hex.EncodeToString(id),
+		entries:           make(map[string]ban.StoreEntry),
+		pruneAt:           minPruneAt,
+	}
+}
+
+// Load the StoreEntries in Redis which haven't expired.
+//
+// Returns an error if Redis fails or holds a bad StoreEntry.
+func (s *Store) Load() ([]ban.StoreEntry, error) {
+	entries, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.entries = make(map[string]ban.StoreEntry, len(entries))
+	for _, entry := range entries {
+		s.entries[entry.String()] = entry
+	}
+	return entries, nil
+}
+
+// load the StoreEntries in Redis which haven't expired without remembering
+// them.
+//
+// Returns an error if Redis fails or holds a bad StoreEntry.
+func (s *Store) load() ([]ban.StoreEntry, error) {
+	keyPrefix := s.entryKey("")
+	match := escapeGlob(keyPrefix) + "*"
+	var entries []ban.StoreEntry
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", match, "COUNT", scanCount)
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return nil, ErrBadReply
+		}
+		next, ok := page[0].([]byte)
+		if !ok {
+			return nil, ErrBadReply
+		}
+		keys, ok := page[1].([]any)
+		if !ok {
+			return nil, ErrBadReply
+		}
+		if len(keys) != 0 {
+			args := []string{"MGET"}
+			for _, key := range keys {
+				bs, ok := key.([]byte)
+				if !ok {
+					return nil, ErrBadReply
+				}
+				args = append(args, string(bs))
+			}
+			reply, err := s.do(args...)
+			if err != nil {
+				return nil, err
+			}
+			values, ok := reply.([]any)
+			if !ok || len(values) != len(keys) {
+				return nil, ErrBadReply
+			}
+			for i, v := range values {
+				bs, ok := v.([]byte)
+				if !ok {
+					// The key expired or was removed since SCAN.
+					continue
+				}
+				entry, err := parseEntry(strings.TrimPrefix(args[i+1], keyPrefix), string(bs))
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, entry)
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return entries, nil
+		}
+	}
+}
+
+// Add the StoreEntry to Redis, expiring at its Expiry, and publish the change.
+//
+// Returns an error if Redis fails.
+func (s *Store) Add(entry ban.StoreEntry) error {
+	expiry := expiryMillis(entry.Expiry)
+	args := []string{"SET", s.entryKey(entry.String()), expiry}
+	if !entry.Expiry.IsZero() {
+		args = append(args, "PXAT", expiry)
+	}
+	if _, err := s.do(args...); err != nil {
+		return err
+	}
+	s.remember(entry, false)
+	return s.publish(added, expiry, entry)
+}
+
+// Remove the StoreEntry from Redis and publish the change.
+//
+// Returns an error if Redis fails.
+func (s *Store) Remove(entry ban.StoreEntry) error {
+	if _, err := s.do("DEL", s.entryKey(entry.String())); err != nil {
+		return err
+	}
+	s.remember(entry, true)
+	return s.publish(removed, "0", entry)
+}
+
+// Watch calls the function with every StoreEntry added to or removed from
+// Redis by other Stores until the Store is closed.
+func (s *Store) Watch(f func(entry ban.StoreEntry, removed bool)) {
+	s.watching.Add(1)
+	go func() {
+		defer s.watching.Done()
+		s.watch(f)
+	}()
+}
+
+// Close the Store's connections and stop watching for changes.
+//
+// Returns any error that happened while closing.
+func (s *Store) Close() error {
+	s.subMu.Lock()
+	s.closed = true
+	if s.sub != nil {
+		s.sub.Close()
+	}
+	s.subMu.Unlock()
+	s.watching.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// watch calls the function with every change published by other Stores,
+// reconnecting every reconnectInterval after failures until the Store is
+// closed.
+//
+// StoreEntries are resynced after subscribing so ones added or removed since
+// they were loaded or while disconnected aren't missed.
+func (s *Store) watch(f func(ban.StoreEntry, bool)) {
+	for {
+		err := s.subscribe(f)
+		s.subMu.Lock()
+		closed := s.closed
+		s.sub = nil
+		s.subMu.Unlock()
+		if closed {
+			return
+		}
+		s.errorHandler(err)
+		time.Sleep(s.reconnectInterval)
+	}
+}
+
+// subscribe to changes and call the function with every change published by
+// other Stores, first resyncing once the subscription is confirmed.
+//
+// Returns the error which ended the subscription.
+func (s *Store) subscribe(f func(ban.StoreEntry, bool)) error {
+	c, err := dial(s.addr, s.password, s.db, s.dialTimeout, s.timeout)
+	if err != nil {
+		return err
+	}
+	s.subMu.Lock()
+	if s.closed {
+		s.subMu.Unlock()
+		c.Close()
+		return nil
+	}
+	s.sub = c
+	s.subMu.Unlock()
+	defer c.Close()
+	if _, err := c.do("SUBSCRIBE", s.channel()); err != nil {
+		return err
+	}
+	// Changes can take any amount of time to be published.
+	if err := c.c.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if err := s.resync(f); err != nil {
+		return err
+	}
+	for {
+		reply, err := c.read()
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]any)
+		if !ok || len(msg) != 3 {
+			continue
+		}
+		if kind, _ := msg[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		payload, _ := msg[2].([]byte)
+		entry, change, ok := s.parseChange(string(payload))
+		if !ok {
+			continue
+		}
+		s.remember(entry, change == removed)
+		f(entry, change == removed)
+	}
+}
+
+// resync loads Redis again and calls the function with every StoreEntry which
+// was added or removed since the Store last knew of it.
+//
+// StoreEntries the Store itself adds or removes while loading are left as they
+// are.
+//
+// Returns an error if Redis fails or holds a bad StoreEntry.
+func (s *Store) resync(f func(ban.StoreEntry, bool)) error {
+	s.stateMu.Lock()
+	s.changed = make(map[string]bool)
+	s.stateMu.Unlock()
+	entries, err := s.load()
+	s.stateMu.Lock()
+	changed := s.changed
+	s.changed = nil
+	if err != nil {
+		s.stateMu.Unlock()
+		return err
+	}
+	now := time.Now()
+	loaded := make(map[string]bool, len(entries))
+	var appeared, vanished []ban.StoreEntry
+	for _, entry := range entries {
+		id := entry.String()
+		loaded[id] = true
+		if changed[id] {
+			continue
+		}
+		if known, ok := s.entries[id]; !ok || !known.Expiry.Equal(entry.Expiry) {
+			appeared = append(appeared, entry)
+		}
+		s.entries[id] = entry
+	}
+	for id, entry := range s.entries {
+		if loaded[id] || changed[id] {
+			continue
+		}
+		delete(s.entries, id)
+		if !expired(entry, now) {
+			vanished = append(vanished, entry)
+		}
+	}
+	s.stateMu.Unlock()
+	for _, entry := range vanished {
+		f(entry, true)
+	}
+	for _, entry := range appeared {
+		f(entry, false)
+	}
+	return nil
+}
+
+// remember that the StoreEntry was added to or removed from Redis.
+//
+// Expired StoreEntries are forgotten whenever the number of known StoreEntries
+// doubles.
+func (s *Store) remember(entry ban.StoreEntry, removed bool) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	id := entry.String()
+	if s.changed != nil {
+		s.changed[id] = true
+	}
+	if removed {
+		delete(s.entries, id)
+		return
+	}
+	s.entries[id] = entry
+	if len(s.entries) < s.pruneAt {
+		return
+	}
+	now := time.Now()
+	for id, entry := range s.entries {
+		if expired(entry, now) {
+			delete(s.entries, id)
+		}
+	}
+	s.pruneAt = 2*len(s.entries) + minPruneAt
+}
+
+// publish the change of the StoreEntry with the Expiry in Unix milliseconds.
+//
+// Returns an error if Redis fails.
+func (s *Store) publish(change, expiry string, entry ban.StoreEntry) error {
+	_, err := s.do("PUBLISH", s.channel(), s.id+" "+change+" "+expiry+" "+entry.String())
+	return err
+}
+
+// parseChange parses a published change.
+//
+// Returns the StoreEntry, whether it was added or removed, and false if the
+// change is bad or was published by the Store itself.
+func (s *Store) parseChange(payload string) (ban.StoreEntry, string, bool) {
+	parts := strings.SplitN(payload, " ", 4)
+	if len(parts) != 4 || parts[0] == s.id || (parts[1] != added && parts[1] != removed) {
+		return ban.StoreEntry{}, "", false
+	}
+	entry, err := parseEntry(parts[3], parts[2])
+	if err != nil {
+		return ban.StoreEntry{}, "", false
+	}
+	return entry, parts[1], true
+}
+
+// do sends the command with the arguments on the Store's connection and reads
+// its reply.
+//
+// Commands which fail because the connection broke or took longer than the
+// timeout are retried once on a new connection, so a stalled Redis holds mu for
+// at most twice the timeout and the dialTimeout.
+//
+// Returns the reply like conn.do.
+func (s *Store) do(args ...string) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			s.conn, err = dial(s.addr, s.password, s.db, s.dialTimeout, s.timeout)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var reply any
+		reply, err = s.conn.do(args...)
+		if _, ok := err.(ReplyError); err == nil || ok {
+			return reply, err
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return nil, err
+}
+
+// entryKey is the Redis key of the StoreEntry with the String form.
+func (s *Store) entryKey(entry string) string {
+	return s.prefix + ":entry:" + entry
+}
+
+// channel changes are published to.
+func (s *Store) channel() string {
+	return s.prefix + ":changes"
+}
+
+// parseEntry parses the String form of a StoreEntry with the Expiry in Unix
+// milliseconds, which is 0 if it doesn't expire.
+//
+// Returns an error if either is bad.
+func parseEntry(s, expiry string) (ban.StoreEntry, error) {
+	entry, err := ban.ParseStoreEntry(s)
+	if err != nil {
+		return ban.StoreEntry{}, err
+	}
+	ms, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return ban.StoreEntry{}, ErrBadReply
+	}
+	if ms != 0 {
+		entry.Expiry = time.UnixMilli(ms)
+	}
+	return entry, nil
+}
+
+// expired returns true if the StoreEntry's Expiry isn't after now.
+func expired(entry ban.StoreEntry, now time.Time) bool {
+	return !entry.Expiry.IsZero() && !entry.Expiry.After(now)
+}
+
+// expiryMillis is the Expiry in Unix milliseconds, which is 0 if it is the zero
+// time.Time.
+func expiryMillis(expiry time.Time) string {
+	if expiry.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(expiry.UnixMilli(), 10)
+}
+
+// escapeGlob escapes the characters of the string which are special in Redis
+// glob-style patterns.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,460 @@
+package redisban
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jwowillo/ban"
+)
+
+// TestStore tests that StoreEntries are added, removed, expire, and are
+// loaded.
+func TestStore(t *testing.T) {
+	t.Parallel()
+	r := newTestRedis(t)
+	s := New(Config{Addr: r.Addr(), ErrorHandler: func(err error) { t.Error(err) }})
+	defer s.Close()
+	pip, err := ban.ParsePrefixedIP("1.2.3.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	entries := []ban.StoreEntry{
+		{PrefixedIP: pip},
+		{PrefixedIP: pip, Scope: &ban.Scope{PathPrefix: "/login"}, Expiry: expiry},
+		{Key: "k"},
+		{Fingerprint: "f"},
+		{PrefixedIP: pip, Scope: &ban.Scope{Host: "a.com"}, Expiry: time.Now().Add(-time.Second)},
+	}
+	for _, entry := range entries {
+		if err := s.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Remove(entries[2]); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]time.Time{
+		entries[0].String(): {},
+		entries[1].String(): expiry,
+		entries[3].String(): {},
+	}
+	if len(loaded) != len(want) {
+		t.Fatalf("s.Load() = %v, want %d StoreEntries", loaded, len(want))
+	}
+	for _, entry := range loaded {
+		at, ok := want[entry.String()]
+		if !ok || !at.Equal(entry.Expiry) {
+			t.Errorf("s.Load() has %v expiring at %v, want %v", entry, entry.Expiry, at)
+		}
+	}
+}
+
+// TestSharedEngines tests that Bans issued and unbanned by one ban.Engine are
+// applied to another sharing the Store, including after the connections to
+// Redis break and StoreEntries are added or removed while they are broken.
+func TestSharedEngines(t *testing.T) {
+	t.Parallel()
+	r := newTestRedis(t)
+	cfg := Config{
+		Addr:              r.Addr(),
+		ReconnectInterval: 10 * time.Millisecond,
+		ErrorHandler:      ban.IgnoreErrorHandler,
+	}
+	sa, sb := New(cfg), New(cfg)
+	defer sa.Close()
+	defer sb.Close()
+	secret := []byte("secret")
+	a := ban.NewEngine(ban.Config{Store: sa, KeySecret: secret, ErrorHandler: func(err error) { t.Error(err) }})
+	b := ban.NewEngine(ban.Config{Store: sb, KeySecret: secret, ErrorHandler: func(err error) { t.Error(err) }})
+	r.WaitSubscribers(t, 2)
+	ip := ban.NewIPv4IP(ban.IPv4{1, 2, 3, 4})
+	if _, err := a.Issue(ip, ban.IPBan.For(time.Hour), ban.Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	testEventually(t, "b.Check(1.2.3.4)", func() bool { return b.Check(ip) })
+	pip, err := ban.NewPrefixedIP(ip, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unban(pip); err != nil {
+		t.Fatal(err)
+	}
+	testEventually(t, "!a.Check(1.2.3.4)", func() bool { return !a.Check(ip) })
+	r.Kill()
+	if err := a.IssueKey("k", ban.Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	testEventually(t, "b.CheckKey(k)", func() bool { return b.CheckKey("k") })
+	r.WaitSubscribers(t, 2)
+	r.mu.Lock()
+	delete(r.values, sa.entryKey(ban.StoreEntry{Key: ban.HashKey(secret, "k")}.String()))
+	r.mu.Unlock()
+	r.Kill()
+	testEventually(t, "!b.CheckKey(k)", func() bool { return !b.CheckKey("k") })
+	if err := a.IssueKey("k", ban.Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	sc := New(cfg)
+	defer sc.Close()
+	c := ban.NewEngine(ban.Config{Store: sc, KeySecret: secret})
+	if !c.CheckKey("k") || c.Check(ip) {
+		t.Errorf("c = %v %v, want only k banned", c.Keys(), c.PrefixedIPs())
+	}
+}
+
+// TestWatchAfterLoad tests that changes made between Load and Watch are passed
+// to the function once the subscription is confirmed.
+func TestWatchAfterLoad(t *testing.T) {
+	t.Parallel()
+	r := newTestRedis(t)
+	cfg := Config{Addr: r.Addr(), ErrorHandler: func(err error) { t.Error(err) }}
+	sa, sb := New(cfg), New(cfg)
+	defer sa.Close()
+	defer sb.Close()
+	kept, removed := ban.StoreEntry{Key: "kept"}, ban.StoreEntry{Key: "removed"}
+	added := ban.StoreEntry{Key: "added"}
+	for _, entry := range []ban.StoreEntry{kept, removed} {
+		if err := sb.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sa.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Add(added); err != nil {
+		t.Fatal(err)
+	}
+	if err := sb.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var changes []string
+	sa.Watch(func(entry ban.StoreEntry, removed bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, entry.String()+" "+strconv.FormatBool(removed))
+	})
+	want := removed.String() + " true, " + added.String() + " false"
+	testEventually(t, "changes", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(changes) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(changes, ", "); got != want {
+		t.Errorf("changes = %s, want %s", got, want)
+	}
+}
+
+// TestExpiry tests that PrefixedIPs banned for a duration expire in Redis and
+// in every ban.Engine.
+func TestExpiry(t *testing.T) {
+	t.Parallel()
+	r := newTestRedis(t)
+	s := New(Config{Addr: r.Addr()})
+	defer s.Close()
+	h := ban.New(
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		ban.BannerFunc(func(ip ban.IP, r *http.Request) ban.Ban {
+			if r.URL.Path == "/bad" {
+				return ban.IPBan.For(50 * time.Millisecond)
+			}
+			return ban.NoBan
+		}),
+		ban.Config{Store: s, ErrorHandler: func(err error) { t.Error(err) }},
+	)
+	for _, c := range []struct {
+		Path  string
+		Sleep time.Duration
+		Want  int
+	}{
+		{Path: "/bad", Want: http.StatusForbidden},
+		{Path: "/", Want: http.StatusForbidden},
+		{Path: "/", Sleep: 100 * time.Millisecond, Want: http.StatusOK},
+	} {
+		time.Sleep(c.Sleep)
+		req := httptest.NewRequest(http.MethodGet, c.Path, nil)
+		req.RemoteAddr = "1.2.3.4:1"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.Want {
+			t.Errorf("%s: rec.Code = %d, want %d", c.Path, rec.Code, c.Want)
+		}
+	}
+	entries, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("s.Load() = %v, want []", entries)
+	}
+}
+
+// TestTimeout tests that commands to a stalled Redis fail within the Timeout.
+func TestTimeout(t *testing.T) {
+	t.Parallel()
+	r := newTestRedis(t)
+	r.stalled = true
+	s := New(Config{Addr: r.Addr(), Timeout: 20 * time.Millisecond})
+	defer s.Close()
+	start := time.Now()
+	if err := s.Add(ban.StoreEntry{Key: "k"}); err == nil {
+		t.Error("s.Add(k) = nil, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("s.Add(k) took %v, want less than %v", elapsed, time.Second)
+	}
+}
+
+// testEventually fails the test if the condition with the name isn't true
+// within a few seconds.
+func testEventually(t *testing.T, name string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = false, want true", name)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// testRedis is an in-process stand-in for Redis supporting the commands used by
+// Stores.
+type testRedis struct {
+	l net.Listener
+
+	mu sync.Mutex
+	// values holds the value of each key.
+	values map[string]string
+	// expiries holds the expiry of each key which expires.
+	expiries map[string]time.Time
+	// subscribers holds the connections subscribed to each channel.
+	subscribers map[string][]*testRedisConn
+	conns       map[*testRedisConn]bool
+	// stalled is true if commands are never replied to.
+	stalled bool
+}
+
+// testRedisConn is a connection to a testRedis.
+type testRedisConn struct {
+	c net.Conn
+	// mu serializes writes.
+	mu sync.Mutex
+}
+
+// newTestRedis listening on localhost until the test ends.
+func newTestRedis(t *testing.T) *testRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRedis{
+		l:           l,
+		values:      make(map[string]string),
+		expiries:    make(map[string]time.Time),
+		subscribers: make(map[string][]*testRedisConn),
+		conns:       make(map[*testRedisConn]bool),
+	}
+	t.Cleanup(func() {
+		l.Close()
+		r.Kill()
+	})
+	go r.serve()
+	return r
+}
+
+// Addr the testRedis listens on.
+func (r *testRedis) Addr() string {
+	return r.l.Addr().String()
+}
+
+// Kill every connection.
+func (r *testRedis) Kill() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c := range r.conns {
+		c.c.Close()
+	}
+	r.conns = make(map[*testRedisConn]bool)
+	r.subscribers = make(map[string][]*testRedisConn)
+}
+
+// WaitSubscribers until there are n subscribed connections.
+func (r *testRedis) WaitSubscribers(t *testing.T, n int) {
+	testEventually(t, "subscribed", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		count := 0
+		for _, subs := range r.subscribers {
+			count += len(subs)
+		}
+		return count >= n
+	})
+}
+
+// serve connections until the listener is closed.
+func (r *testRedis) serve() {
+	for {
+		c, err := r.l.Accept()
+		if err != nil {
+			return
+		}
+		rc := &testRedisConn{c: c}
+		r.mu.Lock()
+		r.conns[rc] = true
+		r.mu.Unlock()
+		go r.handle(rc)
+	}
+}
+
+// handle the commands sent on the connection until it is closed.
+func (r *testRedis) handle(c *testRedisConn) {
+	defer c.c.Close()
+	br := bufio.NewReader(c.c)
+	for {
+		args, err := testReadCommand(br)
+		if err != nil {
+			return
+		}
+		if reply := r.exec(c, args); reply != "" {
+			c.write(reply)
+		}
+	}
+}
+
+// exec the command with the arguments sent on the connection.
+//
+// Returns the RESP reply, which is "" if the testRedis is stalled.
+func (r *testRedis) exec(c *testRedisConn, args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stalled {
+		return ""
+	}
+	now := time.Now()
+	for key, at := range r.expiries {
+		if !at.After(now) {
+			delete(r.values, key)
+			delete(r.expiries, key)
+		}
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		r.values[args[1]] = args[2]
+		delete(r.expiries, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PXAT" {
+			ms, err := strconv.ParseInt(args[4], 10, 64)
+			if err != nil {
+				return "-ERR value is not an integer\r\n"
+			}
+			r.expiries[args[1]] = time.UnixMilli(ms)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := r.values[key]; ok {
+				delete(r.values, key)
+				delete(r.expiries, key)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "MGET":
+		reply := "*" + strconv.Itoa(len(args)-1) + "\r\n"
+		for _, key := range args[1:] {
+			v, ok := r.values[key]
+			if !ok {
+				reply += "$-1\r\n"
+				continue
+			}
+			reply += testBulk(v)
+		}
+		return reply
+	case "SCAN":
+		prefix := strings.TrimSuffix(strings.ReplaceAll(args[3], `\`, ""), "*")
+		var keys []string
+		for key := range r.values {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		reply := "*2\r\n" + testBulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, key := range keys {
+			reply += testBulk(key)
+		}
+		return reply
+	case "PUBLISH":
+		subs := r.subscribers[args[1]]
+		msg := "*3\r\n" + testBulk("message") + testBulk(args[1]) + testBulk(args[2])
+		for _, sub := range subs {
+			sub.write(msg)
+		}
+		return ":" + strconv.Itoa(len(subs)) + "\r\n"
+	case "SUBSCRIBE":
+		if r.conns[c] {
+			r.subscribers[args[1]] = append(r.subscribers[args[1]], c)
+		}
+		return "*3\r\n" + testBulk("subscribe") + testBulk(args[1]) + ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// write the reply to the connection.
+func (c *testRedisConn) write(reply string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	io.WriteString(c.c, reply)
+}
+
+// testReadCommand reads a command sent as an array of bulk strings.
+//
+// Returns an error if the command can't be read.
+func testReadCommand(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		bs := make([]byte, size+2)
+		if _, err := io.ReadFull(br, bs); err != nil {
+			return nil, err
+		}
+		args[i] = string(bs[:size])
+	}
+	return args, nil
+}
+
+// testBulk is the RESP bulk string of the string.
+func testBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
@@ -0,0 +1,150 @@
+package redisban
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ErrBadReply is returned if a reply from Redis can't be parsed.
+var ErrBadReply = errors.New("bad Redis reply")
+
+// ReplyError is an error reply from Redis.
+type ReplyError string
+
+// Error message from Redis.
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// conn to Redis which sends commands and reads replies in RESP.
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+	// timeout is how long each command sent by do can take.
+	timeout time.Duration
+}
+
+// dial Redis at the address within the dialTimeout and authenticate with the
+// password and select the database if they are assigned, with each command
+// taking at most the timeout.
+//
+// Returns an error if Redis can't be reached or rejects the password or
+// database.
+func dial(addr, password string, db int, dialTimeout, timeout time.Duration) (*conn, error) {
+	c, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &conn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c), timeout: timeout}
+	if password != "" {
+		if _, err := rc.do("AUTH", password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do sends the command with the arguments and reads its reply within the
+// conn's timeout.
+//
+// Returns the reply, which is a string for simple strings, an int64 for
+// integers, a []byte or nil for bulk strings, and a []any for arrays, or an
+// error if the command couldn't be sent, the reply couldn't be read, or the
+// reply is a ReplyError.
+func (c *conn) do(args ...string) (any, error) {
+	if err := c.c.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// send the command with the arguments as an array of bulk strings.
+//
+// Returns an error if the command couldn't be written.
+func (c *conn) send(args ...string) error {
+	c.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		c.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return c.w.Flush()
+}
+
+// read a reply.
+//
+// Returns the reply like do.
+func (c *conn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrBadReply
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, ReplyError(rest)
+	case ':':
+		n, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, ErrBadReply
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 {
+			return nil, ErrBadReply
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		bs := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, bs); err != nil {
+			return nil, err
+		}
+		return bs[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 {
+			return nil, ErrBadReply
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		values := make([]any, n)
+		for i := range values {
+			v, err := c.read()
+			if err != nil {
+				if _, ok := err.(ReplyError); !ok {
+					return nil, err
+				}
+				v = err
+			}
+			values[i] = v
+		}
+		return values, nil
+	}
+	return nil, ErrBadReply
+}
+
+// Close the connection.
+func (c *conn) Close() error {
+	return c.c.Close()
+}
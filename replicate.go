@@ -0,0 +1,573 @@
+package ban
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoReplicationSecret is returned if a Replicator is made without a
+	// Secret.
+	ErrNoReplicationSecret = errors.New("replication secret must be assigned")
+	// ErrBadReplicationSignature is returned if a message between Replicators
+	// isn't signed with the Secret or is too old.
+	ErrBadReplicationSignature = errors.New("bad replication signature")
+	// ErrBadReplicationMessage is returned if a message between Replicators
+	// can't be parsed.
+	ErrBadReplicationMessage = errors.New("bad replication message")
+	// ErrPeerFailed is returned if a peer responds with an error.
+	ErrPeerFailed = errors.New("replication peer failed")
+	// ErrReplicationQueueFull is returned if changes were dropped because too
+	// many were waiting to be pushed.
+	ErrReplicationQueueFull = errors.New("replication queue full")
+)
+
+// ReplicationConfig for Replicators.
+type ReplicationConfig struct {
+	// Peers are the base URLs the other instances serve their Replicators
+	// at, not including this instance.
+	Peers []string
+	// Secret every instance shares, which signs the messages between them.
+	//
+	// Must be assigned.
+	Secret []byte
+	// Client sends messages to Peers.
+	//
+	// Defaults to an http.Client with a 10 second timeout if not assigned.
+	Client *http.Client
+	// SyncInterval between anti-entropy syncs with every peer.
+	//
+	// Defaults to a minute if not assigned.
+	SyncInterval time.Duration
+	// QueueSize is the most changes which can wait to be pushed. The oldest
+	// are dropped when more happen and are pulled by peers in the next sync
+	// instead.
+	//
+	// Defaults to 10000 if not assigned.
+	QueueSize int
+}
+
+const (
+	// defaultSyncInterval is the SyncInterval if none is assigned.
+	defaultSyncInterval = time.Minute
+	// defaultReplicationTimeout is the timeout of the Client if none is
+	// assigned.
+	defaultReplicationTimeout = 10 * time.Second
+	// defaultQueueSize is the QueueSize if none is assigned.
+	defaultQueueSize = 10000
+	// replicationMaxSkew is how far the time a message was signed can be from
+	// the time it is received.
+	replicationMaxSkew = 5 * time.Minute
+	// replicationMaxBody is the largest message body which is read.
+	replicationMaxBody = 64 << 20
+	// replicationEventsPath is the path, under a peer's base URL, changes are
+	// pushed to.
+	replicationEventsPath = "/events"
+	// replicationStatePath is the path, under a peer's base URL, every change
+	// is pulled from.
+	replicationStatePath = "/state"
+	// replicationTimestampHeader holds the Unix time a request was signed.
+	replicationTimestampHeader = "X-Ban-Timestamp"
+	// replicationSignatureHeader holds the signature of a request or
+	// response.
+	replicationSignatureHeader = "X-Ban-Signature"
+)
+
+// Replicator replicates the Bans of an Engine between instances.
+//
+// Every ban and unban of a PrefixedIP, PrefixedIP in a Scope, key, or
+// fingerprint is queued and pushed to every peer in batches as it happens.
+// Every SyncInterval, and
+// once when the Replicator is made, the changes known by every peer are pulled
+// so instances which missed pushes, like ones which were down, catch up.
+//
+// Conflicting changes to the same entry are resolved by keeping the latest,
+// with unbans winning ties, so instances' clocks should be synchronized.
+// Entries which were banned before the Replicator was made are older than any
+// change. Changes are forgotten once the entries they ban, or unban, have
+// expired, so unbans of entries which never expire are remembered.
+//
+// Replicators are http.Handlers which must be served at the base URLs peers
+// are configured with.
+type Replicator struct {
+	engine       *Engine
+	peers        []string
+	secret       []byte
+	client       *http.Client
+	syncInterval time.Duration
+	queueSize    int
+
+	// mu guards changes, queue, dropped, and stopped.
+	mu sync.Mutex
+	// changes holds the latest change of each entry by its line.
+	changes map[string]replicaChange
+	// queue holds the changes waiting to be pushed, oldest first.
+	queue []replicaChange
+	// dropped is the number of changes dropped from the queue since it was
+	// last pushed.
+	dropped int
+	// stopped is true once the Replicator stops pushing changes.
+	stopped bool
+
+	// queued is signaled when a change is queued.
+	queued chan struct{}
+	// flushes receives channels which are closed once the queue is pushed.
+	flushes chan chan struct{}
+	// pushed is closed once the queue stops being pushed.
+	pushed   chan struct{}
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// replicaChange is the ban or unban of an entry at a time.
+type replicaChange struct {
+	// entry which was banned or unbanned, with the Expiry it was last banned
+	// with for unbans.
+	entry   StoreEntry
+	removed bool
+	// time of the change in Unix nanoseconds, which is 0 for entries banned
+	// before the Replicator was made.
+	time int64
+}
+
+// NewReplicator which replicates the Bans of the Engine with behavior
+// customized by ReplicationConfig.
+//
+// Changes are pulled from every peer before it is returned. Errors are passed
+// to the Engine's ErrorHandler.
+//
+// Returns ErrNoReplicationSecret if the Secret isn't assigned.
+func NewReplicator(engine *Engine, cfg ReplicationConfig) (*Replicator, error) {
+	if len(cfg.Secret) == 0 {
+		return nil, ErrNoReplicationSecret
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultReplicationTimeout}
+	}
+	syncInterval := cfg.SyncInterval
+	if syncInterval == 0 {
+		syncInterval = defaultSyncInterval
+	}
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultQueueSize
+	}
+	r := &Replicator{
+		engine:       engine,
+		peers:        cfg.Peers,
+		secret:       cfg.Secret,
+		client:       client,
+		syncInterval: syncInterval,
+		queueSize:    queueSize,
+		changes:      make(map[string]replicaChange),
+		queued:       make(chan struct{}, 1),
+		flushes:      make(chan chan struct{}),
+		pushed:       make(chan struct{}),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	engine.OnEvent(r.observe)
+	r.seed()
+	if err := r.Sync(); err != nil {
+		engine.errorHandler(err)
+	}
+	go r.run()
+	go r.pushQueue()
+	return r, nil
+}
+
+// ServeHTTP serves changes pushed by peers and the state pulled by them.
+//
+// Requests which aren't signed with the Secret are rejected.
+func (r *Replicator) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, replicationMaxBody))
+	if err != nil {
+		writeError(rw, err)
+		return
+	}
+	timestamp := req.Header.Get(replicationTimestampHeader)
+	if !r.verify(timestamp, req.Header.Get(replicationSignatureHeader), time.Now(),
+		"request", req.Method, timestamp, string(body)) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, replicationEventsPath):
+		changes, err := parseReplicaChanges(body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.merge(changes)
+		rw.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, replicationStatePath):
+		state := formatReplicaChanges(r.state())
+		rw.Header().Set(replicationSignatureHeader, sign(r.secret, "response", timestamp, string(state)))
+		rw.Write(state)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// Sync pulls the changes known by every peer.
+//
+// Returns the last error that happened while pulling from a peer.
+func (r *Replicator) Sync() error {
+	var last error
+	for _, peer := range r.peers {
+		changes, err := r.pull(peer)
+		if err != nil {
+			last = err
+			continue
+		}
+		r.merge(changes)
+	}
+	return last
+}
+
+// Flush pushes the queued changes to every peer and returns once they, and any
+// changes already being pushed, have been pushed.
+//
+// Returns immediately once the Replicator is stopped.
+func (r *Replicator) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case r.flushes <- flushed:
+		<-flushed
+	case <-r.pushed:
+	}
+}
+
+// Stop syncing and pushing changes.
+//
+// Waits for queued changes to be pushed. Stopping a stopped Replicator does
+// nothing.
+func (r *Replicator) Stop() {
+	r.stopOnce.Do(func() {
+		r.mu.Lock()
+		r.stopped = true
+		r.mu.Unlock()
+		close(r.stop)
+		<-r.done
+		<-r.pushed
+	})
+}
+
+// run forgets expired changes and syncs every syncInterval until stopped.
+func (r *Replicator) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.prune(now)
+			if err := r.Sync(); err != nil {
+				r.engine.errorHandler(err)
+			}
+		}
+	}
+}
+
+// pushQueue pushes the queued changes whenever a change is queued or a Flush
+// is requested until stopped, and once more after.
+func (r *Replicator) pushQueue() {
+	defer close(r.pushed)
+	for {
+		select {
+		case <-r.stop:
+			r.flush()
+			return
+		case <-r.queued:
+			r.flush()
+		case flushed := <-r.flushes:
+			r.flush()
+			close(flushed)
+		}
+	}
+}
+
+// flush pushes every queued change to every peer in one batch.
+//
+// ErrReplicationQueueFull is passed to the Engine's ErrorHandler if changes
+// were dropped.
+func (r *Replicator) flush() {
+	r.mu.Lock()
+	changes, dropped := r.queue, r.dropped
+	r.queue, r.dropped = nil, 0
+	r.mu.Unlock()
+	if dropped != 0 {
+		r.engine.errorHandler(ErrReplicationQueueFull)
+	}
+	if len(changes) == 0 {
+		return
+	}
+	r.push(changes)
+}
+
+// prune forgets the changes of entries which expired before now.
+func (r *Replicator) prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, change := range r.changes {
+		if expiry := change.entry.Expiry; !expiry.IsZero() && expiry.Before(now) {
+			delete(r.changes, id)
+		}
+	}
+}
+
+// seed the changes with the entries banned in the Engine before the Replicator
+// was made.
+func (r *Replicator) seed() {
+	e := r.engine
+	var entries []StoreEntry
+	e.mu.RLock()
+	for _, pip := range e.ips.PrefixedIPs() {
+		entries = append(entries, StoreEntry{PrefixedIP: pip})
+	}
+	for _, s := range e.scoped {
+		for _, pip := range s.ips.PrefixedIPs() {
+			entries = append(entries, StoreEntry{PrefixedIP: pip, Scope: &s.scope})
+		}
+	}
+	for kind, keys := range e.keys {
+		for key := range keys {
+			entries = append(entries, keyEntry(kind, key))
+		}
+	}
+	for i, entry := range entries {
+		entries[i].Expiry = e.expiries[entry.String()]
+	}
+	e.mu.RUnlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range entries {
+		id := entry.String()
+		if _, ok := r.changes[id]; !ok {
+			r.changes[id] = replicaChange{entry: entry}
+		}
+	}
+}
+
+// observe Events in the Engine and queue the changes they make which aren't
+// already known to be pushed.
+//
+// Changes merged from peers are known before they are applied, so they aren't
+// pushed back. The oldest queued change is dropped if the queue is full.
+func (r *Replicator) observe(ev Event) {
+	if ev.Type == EventBlock {
+		return
+	}
+	entry := StoreEntry{
+		PrefixedIP:  ev.PrefixedIP,
+		Scope:       ev.Scope,
+		Key:         ev.Key,
+		Fingerprint: ev.Fingerprint,
+		Expiry:      ev.Expiry,
+	}
+	removed := ev.Type == EventUnban
+	id := entry.String()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last, ok := r.changes[id]
+	if r.stopped || (ok && last.removed == removed && (removed || last.entry.Expiry.Equal(entry.Expiry))) {
+		return
+	}
+	if removed && ok && entry.Expiry.IsZero() {
+		entry.Expiry = last.entry.Expiry
+	}
+	change := replicaChange{entry: entry, removed: removed, time: time.Now().UnixNano()}
+	if change.time <= last.time {
+		change.time = last.time + 1
+	}
+	r.changes[id] = change
+	if len(r.queue) == r.queueSize {
+		r.queue = r.queue[1:]
+		r.dropped++
+	}
+	r.queue = append(r.queue, change)
+	select {
+	case r.queued <- struct{}{}:
+	default:
+	}
+}
+
+// push the changes to every peer.
+func (r *Replicator) push(changes []replicaChange) {
+	body := formatReplicaChanges(changes)
+	for _, peer := range r.peers {
+		resp, err := r.send(http.MethodPost, peer+replicationEventsPath, body)
+		if err != nil {
+			r.engine.errorHandler(err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			r.engine.errorHandler(ErrPeerFailed)
+		}
+	}
+}
+
+// pull the changes known by the peer.
+//
+// Returns an error if the peer can't be reached, fails, or responds without
+// being signed with the Secret.
+func (r *Replicator) pull(peer string) ([]replicaChange, error) {
+	resp, err := r.send(http.MethodGet, peer+replicationStatePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrPeerFailed
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, replicationMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := resp.Request.Header.Get(replicationTimestampHeader)
+	if !hmac.Equal(
+		[]byte(resp.Header.Get(replicationSignatureHeader)),
+		[]byte(sign(r.secret, "response", timestamp, string(body))),
+	) {
+		return nil, ErrBadReplicationSignature
+	}
+	return parseReplicaChanges(body)
+}
+
+// send a signed request with the method and body to the URL.
+//
+// Returns an error if the request can't be sent.
+func (r *Replicator) send(method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(replicationTimestampHeader, timestamp)
+	req.Header.Set(replicationSignatureHeader, sign(r.secret, "request", method, timestamp, string(body)))
+	return r.client.Do(req)
+}
+
+// merge the changes which are later than the known changes of their entries
+// and apply them to the Engine.
+func (r *Replicator) merge(changes []replicaChange) {
+	var apply []replicaChange
+	r.mu.Lock()
+	for _, change := range changes {
+		id := change.entry.String()
+		last, ok := r.changes[id]
+		if ok && !change.after(last) {
+			continue
+		}
+		r.changes[id] = change
+		apply = append(apply, change)
+	}
+	r.mu.Unlock()
+	for _, change := range apply {
+		if err := r.apply(change); err != nil {
+			r.engine.errorHandler(err)
+		}
+	}
+}
+
+// apply the change to the Engine.
+//
+// Returns any error that happened during writing.
+func (r *Replicator) apply(change replicaChange) error {
+	if change.removed {
+		return r.engine.unbanEntry(change.entry, true)
+	}
+	return r.engine.issueEntry(change.entry, IP{}, Meta{Issuer: "replication"}, true)
+}
+
+// state is the latest change of every entry.
+func (r *Replicator) state() []replicaChange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changes := make([]replicaChange, 0, len(r.changes))
+	for _, change := range r.changes {
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// verify that the signature signs the purpose and fields with the Secret and
+// that the Unix timestamp is within replicationMaxSkew of now.
+func (r *Replicator) verify(timestamp, signature string, now time.Time, purpose string, fields ...string) bool {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(unix, 0))
+	if skew > replicationMaxSkew || skew < -replicationMaxSkew {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(sign(r.secret, purpose, fields...)))
+}
+
+// after returns true if the change should replace the other change of the same
+// entry, which is when it is later or at the same time and an unban.
+func (c replicaChange) after(other replicaChange) bool {
+	if c.time != other.time {
+		return c.time > other.time
+	}
+	return c.removed && !other.removed
+}
+
+// formatReplicaChanges formats the changes as lines of the time and the line of
+// the entry, prefixed by storeRemoval for unbans, separated by a space.
+func formatReplicaChanges(changes []replicaChange) []byte {
+	var buf bytes.Buffer
+	for _, change := range changes {
+		buf.WriteString(strconv.FormatInt(change.time, 10))
+		buf.WriteByte(' ')
+		if change.removed {
+			buf.WriteString(storeRemoval)
+		}
+		buf.WriteString(change.entry.line(false))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// parseReplicaChanges parses changes formatted by formatReplicaChanges.
+//
+// Returns ErrBadReplicationMessage if a line is bad.
+func parseReplicaChanges(bs []byte) ([]replicaChange, error) {
+	var changes []replicaChange
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	scanner.Buffer(nil, replicationMaxBody)
+	for scanner.Scan() {
+		t, line, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil, ErrBadReplicationMessage
+		}
+		unix, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return nil, ErrBadReplicationMessage
+		}
+		removed := strings.HasPrefix(line, storeRemoval)
+		entry, err := parseStoreEntry(strings.TrimPrefix(line, storeRemoval), false)
+		if err != nil {
+			return nil, ErrBadReplicationMessage
+		}
+		changes = append(changes, replicaChange{entry: entry, removed: removed, time: unix})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, ErrBadReplicationMessage
+	}
+	return changes, nil
+}
@@ -0,0 +1,290 @@
+package ban
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReplication tests that Bans issued and unbanned on one instance are
+// replicated to every other and that instances made later catch up.
+func TestReplication(t *testing.T) {
+	t.Parallel()
+	c := newTestCluster(t, 4, []byte("secret"))
+	engines := c.engines
+	a, err := ParsePrefixedIP("1.2.3.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParsePrefixedIP("2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope := Scope{PathPrefix: "/login"}
+	for i := 0; i < 3; i++ {
+		c.start(t, i)
+	}
+	if err := engines[0].Add(a, b); err != nil {
+		t.Error(err)
+	}
+	if _, err := engines[1].Issue(NewIPv4IP(IPv4{5, 6, 7, 8}), IPBan.In(scope), Meta{}); err != nil {
+		t.Error(err)
+	}
+	if err := engines[2].IssueKey("k", Meta{}); err != nil {
+		t.Error(err)
+	}
+	c.wait()
+	if err := engines[1].Unban(a); err != nil {
+		t.Error(err)
+	}
+	c.wait()
+	c.start(t, 3)
+	for i, e := range engines {
+		if pips := e.PrefixedIPs(); len(pips) != 1 || pips[0].String() != b.String() {
+			t.Errorf("engines[%d].PrefixedIPs() = %v, want [%v]", i, pips, b)
+		}
+		if pips := e.PrefixedIPsIn(scope); len(pips) != 1 || pips[0].String() != "5.6.7.8/32" {
+			t.Errorf("engines[%d].PrefixedIPsIn(%v) = %v, want [5.6.7.8/32]", i, scope, pips)
+		}
+		if !e.CheckKey("k") {
+			t.Errorf("engines[%d].CheckKey(k) = false, want true", i)
+		}
+	}
+}
+
+// TestReplicationConflicts tests that the latest change of an entry wins and
+// that unbans win ties.
+func TestReplicationConflicts(t *testing.T) {
+	t.Parallel()
+	e := NewEngine(Config{ErrorHandler: func(err error) { t.Error(err) }})
+	r, err := NewReplicator(e, ReplicationConfig{Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	pip, err := ParsePrefixedIP("1.2.3.4/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := StoreEntry{PrefixedIP: pip}
+	cases := []struct {
+		Change replicaChange
+		Want   bool
+	}{
+		{Change: replicaChange{entry: entry, time: 10}, Want: true},
+		{Change: replicaChange{entry: entry, removed: true, time: 5}, Want: true},
+		{Change: replicaChange{entry: entry, removed: true, time: 10}, Want: false},
+		{Change: replicaChange{entry: entry, time: 10}, Want: false},
+		{Change: replicaChange{entry: entry, time: 11}, Want: true},
+	}
+	ip := NewIPv4IP(IPv4{1, 2, 3, 4})
+	for i, c := range cases {
+		r.merge([]replicaChange{c.Change})
+		if got := e.Check(ip); got != c.Want {
+			t.Errorf("%d: e.Check(%v) = %t, want %t", i, ip, got, c.Want)
+		}
+	}
+}
+
+// TestReplicationQueue tests that changes are pushed in batches and that the
+// oldest are dropped when too many are waiting.
+func TestReplicationQueue(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	var batches atomic.Int32
+	peer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		<-release
+		batches.Add(1)
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer peer.Close()
+	var dropped atomic.Int32
+	e := NewEngine(Config{ErrorHandler: func(err error) {
+		if err == ErrReplicationQueueFull {
+			dropped.Add(1)
+		}
+	}})
+	r, err := NewReplicator(e, ReplicationConfig{Peers: []string{peer.URL}, Secret: []byte("secret"), QueueSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	if err := e.IssueKey("a", Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		r.mu.Lock()
+		n := len(r.queue)
+		r.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, key := range []string{"b", "c", "d", "e"} {
+		if err := e.IssueKey(key, Meta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+	r.Flush()
+	if got := batches.Load(); got != 2 {
+		t.Errorf("batches.Load() = %d, want 2", got)
+	}
+	if got := dropped.Load(); got != 1 {
+		t.Errorf("dropped.Load() = %d, want 1", got)
+	}
+}
+
+// TestReplicationPrune tests that changes are forgotten once their entries
+// expire.
+func TestReplicationPrune(t *testing.T) {
+	t.Parallel()
+	e := NewEngine(Config{ErrorHandler: func(err error) { t.Error(err) }})
+	r, err := NewReplicator(e, ReplicationConfig{Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	if _, err := e.Issue(NewIPv4IP(IPv4{1, 2, 3, 4}), IPBan.For(time.Hour), Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Issue(NewIPv4IP(IPv4{5, 6, 7, 8}), IPBan.For(time.Hour), Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	pip, err := ParsePrefixedIP("5.6.7.8/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Unban(pip); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.IssueKey("k", Meta{}); err != nil {
+		t.Fatal(err)
+	}
+	r.prune(time.Now())
+	if got := len(r.state()); got != 3 {
+		t.Errorf("len(r.state()) = %d, want 3 before expiring", got)
+	}
+	r.prune(time.Now().Add(2 * time.Hour))
+	if got := r.state(); len(got) != 1 || got[0].entry.Key == "" {
+		t.Errorf("r.state() = %v, want only k", got)
+	}
+	r.Stop()
+}
+
+// TestReplicationSignature tests that messages not signed with the Secret are
+// rejected.
+func TestReplicationSignature(t *testing.T) {
+	t.Parallel()
+	if _, err := NewReplicator(NewEngine(DefaultConfig), ReplicationConfig{}); err != ErrNoReplicationSecret {
+		t.Errorf("NewReplicator() = %v, want %v", err, ErrNoReplicationSecret)
+	}
+	c := newTestCluster(t, 1, []byte("secret"))
+	c.start(t, 0)
+	engines, urls := c.engines, c.urls
+	other, err := NewReplicator(
+		NewEngine(Config{ErrorHandler: IgnoreErrorHandler}),
+		ReplicationConfig{Peers: urls, Secret: []byte("other")},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+	if err := other.Sync(); err != ErrPeerFailed {
+		t.Errorf("other.Sync() = %v, want %v", err, ErrPeerFailed)
+	}
+	body := formatReplicaChanges([]replicaChange{{entry: StoreEntry{Key: "k"}, time: 1}})
+	resp, err := other.send(http.MethodPost, urls[0]+replicationEventsPath, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("resp.StatusCode = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if engines[0].CheckKey("k") {
+		t.Errorf("engines[0].CheckKey(k) = true, want false")
+	}
+}
+
+// testCluster of Engines with servers which serve their Replicators once they
+// are started.
+type testCluster struct {
+	secret  []byte
+	engines []*Engine
+	reps    []*Replicator
+	ready   []atomic.Pointer[Replicator]
+	urls    []string
+}
+
+// newTestCluster of n Engines with the Secret whose servers act like empty
+// Replicators until theirs are started.
+func newTestCluster(t *testing.T, n int, secret []byte) *testCluster {
+	empty := &Replicator{secret: secret}
+	c := &testCluster{
+		secret:  secret,
+		engines: make([]*Engine, n),
+		reps:    make([]*Replicator, n),
+		ready:   make([]atomic.Pointer[Replicator], n),
+		urls:    make([]string, n),
+	}
+	for i := range c.engines {
+		c.engines[i] = NewEngine(Config{KeySecret: secret, ErrorHandler: func(err error) { t.Error(err) }})
+		ready := &c.ready[i]
+		s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rep := ready.Load()
+			if rep == nil && r.Method == http.MethodGet {
+				timestamp := r.Header.Get(replicationTimestampHeader)
+				rw.Header().Set(replicationSignatureHeader, sign(empty.secret, "response", timestamp, ""))
+				return
+			}
+			if rep == nil {
+				rw.WriteHeader(http.StatusNoContent)
+				return
+			}
+			rep.ServeHTTP(rw, r)
+		}))
+		t.Cleanup(s.Close)
+		c.urls[i] = s.URL
+	}
+	t.Cleanup(func() {
+		for _, r := range c.reps {
+			if r != nil {
+				r.Stop()
+			}
+		}
+	})
+	return c
+}
+
+// start the Replicator of the ith Engine with every other Engine as a peer.
+func (c *testCluster) start(t *testing.T, i int) {
+	var peers []string
+	for j, url := range c.urls {
+		if j != i {
+			peers = append(peers, url)
+		}
+	}
+	r, err := NewReplicator(c.engines[i], ReplicationConfig{Peers: peers, Secret: c.secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.reps[i] = r
+	c.ready[i].Store(r)
+}
+
+// wait for every change being pushed to finish.
+func (c *testCluster) wait() {
+	for _, r := range c.reps {
+		if r != nil {
+			r.Flush()
+		}
+	}
+}
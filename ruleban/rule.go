@@ -0,0 +1,387 @@
+package ruleban
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jwowillo/ban"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrNoName is returned if a Rule has no Name.
+	ErrNoName = errors.New("rule has no name")
+	// ErrNoMatchers is returned if a Rule has nothing to match, which would
+	// match every http.Request.
+	ErrNoMatchers = errors.New("rule matches every request")
+	// ErrBadPrefix is returned if a Rule's Ban has a prefix-length for IPv4
+	// addresses outside of 1 to 32 or for IPv6 addresses outside of 1 to 128.
+	ErrBadPrefix = errors.New("bad prefix-length")
+	// ErrBadBodySize is returned if a Rule's MinBodySize is larger than its
+	// MaxBodySize.
+	ErrBadBodySize = errors.New("bad body size")
+)
+
+// RuleError is an error with a Rule.
+type RuleError struct {
+	// Index is the 1-based position of the Rule.
+	Index int
+	// Name of the Rule.
+	Name string
+	// Err is the error with the Rule.
+	Err error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("rule %d (%q): %v", e.Index, e.Name, e.Err)
+}
+
+// Unwrap returns the error with the Rule.
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// Rule matches http.Requests which are issued its Ban.
+//
+// Every assigned matcher must match an http.Request for the Rule to match it,
+// and at least one must be assigned.
+type Rule struct {
+	// Name of the Rule, which is the reason of its Ban unless the Ban has
+	// one.
+	//
+	// Must be assigned.
+	Name string `json:"name" yaml:"name"`
+	// Methods one of which the http.Request must use, compared
+	// case-insensitively.
+	Methods []string `json:"methods,omitempty" yaml:"methods,omitempty"`
+	// Path is a regular expression the http.Request's path must match.
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+	// Query maps parameters the http.Request's query must have to regular
+	// expressions one of their values must match.
+	//
+	// The empty regular expression matches any value.
+	Query map[string]string `json:"query,omitempty" yaml:"query,omitempty"`
+	// Headers maps headers the http.Request must have to regular
+	// expressions one of their values must match.
+	//
+	// The empty regular expression matches any value.
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// UserAgent is a regular expression the http.Request's User-Agent must
+	// match.
+	UserAgent string `json:"user_agent,omitempty" yaml:"user_agent,omitempty"`
+	// MinBodySize is the fewest bytes the http.Request's Content-Length can
+	// be.
+	//
+	// http.Requests of unknown length, like chunked ones, are assumed to be
+	// large enough, so they match unless MaxBodySize is also assigned.
+	MinBodySize int64 `json:"min_body_size,omitempty" yaml:"min_body_size,omitempty"`
+	// MaxBodySize is the most bytes the http.Request's Content-Length can
+	// be.
+	//
+	// http.Requests of unknown length don't match if assigned.
+	MaxBodySize int64 `json:"max_body_size,omitempty" yaml:"max_body_size,omitempty"`
+	// Ban issued to IPs whose http.Requests match the Rule.
+	Ban Action `json:"ban" yaml:"ban"`
+}
+
+// Action describes the ban.Ban issued by a Rule.
+type Action struct {
+	// Prefix is the prefix-length of the range of IPs banned for both IPv4
+	// and IPv6 addresses, so it must be at most 32 unless Prefix4 is
+	// assigned.
+	//
+	// Defaults to banning only the IP if not assigned.
+	Prefix int `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	// Prefix4 is the prefix-length of the range of IPs banned for IPv4
+	// addresses, which is at most 32.
+	//
+	// Defaults to Prefix if not assigned.
+	Prefix4 int `json:"prefix4,omitempty" yaml:"prefix4,omitempty"`
+	// Prefix6 is the prefix-length of the range of IPs banned for IPv6
+	// addresses, which is at most 128.
+	//
+	// Defaults to Prefix if not assigned.
+	Prefix6 int `json:"prefix6,omitempty" yaml:"prefix6,omitempty"`
+	// Duration the IPs are banned for, like "1h30m".
+	//
+	// Defaults to forever if not assigned.
+	Duration string `json:"duration,omitempty" yaml:"duration,omitempty"`
+	// Reason the ban.Ban is issued.
+	//
+	// Defaults to the Rule's Name if not assigned.
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// rules is the form of files of Rules.
+type rules struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// ParseJSON parses Rules from a JSON object with a "rules" array.
+//
+// Returns an error if the JSON is bad or has unknown fields.
+func ParseJSON(data []byte) ([]Rule, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	var rs rules
+	if err := d.Decode(&rs); err != nil {
+		return nil, err
+	}
+	return rs.Rules, nil
+}
+
+// ParseYAML parses Rules from a YAML mapping with a "rules" sequence.
+//
+// Returns an error if the YAML is bad or has unknown fields.
+func ParseYAML(data []byte) ([]Rule, error) {
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	var rs rules
+	if err := d.Decode(&rs); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return rs.Rules, nil
+}
+
+// RuleSet is a ban.Banner of compiled Rules which issues the Ban of the first
+// Rule matching an http.Request.
+type RuleSet struct {
+	rules []*compiledRule
+}
+
+// compiledRule is a Rule with its matchers compiled.
+type compiledRule struct {
+	name      string
+	methods   map[string]bool
+	path      *regexp.Regexp
+	query     map[string]*regexp.Regexp
+	headers   map[string]*regexp.Regexp
+	userAgent *regexp.Regexp
+	minBody   int64
+	maxBody   int64
+	// ban4 and ban6 are issued to IPv4 and IPv6 addresses.
+	ban4 ban.Ban
+	ban6 ban.Ban
+}
+
+// Compile the Rules into a RuleSet.
+//
+// Returns a RuleError for the first bad Rule.
+func Compile(rules []Rule) (*RuleSet, error) {
+	set := &RuleSet{rules: make([]*compiledRule, 0, len(rules))}
+	for i, rule := range rules {
+		c, err := compile(rule)
+		if err != nil {
+			return nil, &RuleError{Index: i + 1, Name: rule.Name, Err: err}
+		}
+		set.rules = append(set.rules, c)
+	}
+	return set, nil
+}
+
+// Match returns the Name of the first Rule matching the http.Request made by
+// the IP, its Ban for the IP's family, and true if one matched.
+func (s *RuleSet) Match(ip ban.IP, r *http.Request) (string, ban.Ban, bool) {
+	var query url.Values
+	for _, rule := range s.rules {
+		if !rule.matches(r, &query) {
+			continue
+		}
+		if _, ok := ip.IPv4(); ok {
+			return rule.name, rule.ban4, true
+		}
+		return rule.name, rule.ban6, true
+	}
+	return "", ban.NoBan, false
+}
+
+// Ban issues the Ban of the first Rule matching the http.Request.
+func (s *RuleSet) Ban(ip ban.IP, r *http.Request) ban.Ban {
+	_, b, _ := s.Match(ip, r)
+	return b
+}
+
+// compile the Rule.
+//
+// Returns ErrNoName, ErrNoMatchers, ErrBadPrefix, or ErrBadBodySize if the
+// Rule is bad, or an error if a regular expression or the Duration is bad.
+func compile(rule Rule) (*compiledRule, error) {
+	if rule.Name == "" {
+		return nil, ErrNoName
+	}
+	if len(rule.Methods) == 0 && rule.Path == "" && len(rule.Query) == 0 &&
+		len(rule.Headers) == 0 && rule.UserAgent == "" && rule.MinBodySize == 0 &&
+		rule.MaxBodySize == 0 {
+		return nil, ErrNoMatchers
+	}
+	if rule.MinBodySize < 0 || rule.MaxBodySize < 0 ||
+		(rule.MaxBodySize != 0 && rule.MinBodySize > rule.MaxBodySize) {
+		return nil, ErrBadBodySize
+	}
+	c := &compiledRule{name: rule.Name, minBody: rule.MinBodySize, maxBody: rule.MaxBodySize}
+	if len(rule.Methods) != 0 {
+		c.methods = make(map[string]bool)
+		for _, method := range rule.Methods {
+			c.methods[strings.ToUpper(method)] = true
+		}
+	}
+	var err error
+	if c.path, err = compileOptional(rule.Path); err != nil {
+		return nil, err
+	}
+	if c.userAgent, err = compileOptional(rule.UserAgent); err != nil {
+		return nil, err
+	}
+	if c.query, err = compileAll(rule.Query, func(k string) string { return k }); err != nil {
+		return nil, err
+	}
+	if c.headers, err = compileAll(rule.Headers, http.CanonicalHeaderKey); err != nil {
+		return nil, err
+	}
+	if c.ban4, c.ban6, err = rule.Ban.bans(rule.Name); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// matches returns true if every matcher of the compiledRule matches the
+// http.Request.
+//
+// The query is parsed from the http.Request if it is nil and is kept for the
+// next compiledRule.
+func (c *compiledRule) matches(r *http.Request, query *url.Values) bool {
+	if c.methods != nil && !c.methods[strings.ToUpper(r.Method)] {
+		return false
+	}
+	if r.ContentLength < 0 && c.maxBody != 0 {
+		return false
+	}
+	if r.ContentLength >= 0 && (r.ContentLength < c.minBody ||
+		(c.maxBody != 0 && r.ContentLength > c.maxBody)) {
+		return false
+	}
+	if c.userAgent != nil && !c.userAgent.MatchString(r.UserAgent()) {
+		return false
+	}
+	if c.path != nil || c.query != nil {
+		if r.URL == nil {
+			return false
+		}
+		if c.path != nil && !c.path.MatchString(r.URL.Path) {
+			return false
+		}
+		if c.query != nil {
+			if *query == nil {
+				*query = r.URL.Query()
+			}
+			if !matchesAny(c.query, *query) {
+				return false
+			}
+		}
+	}
+	return c.headers == nil || matchesAny(c.headers, r.Header)
+}
+
+// bans the Action describes for IPv4 and IPv6 addresses for the Rule with the
+// name.
+//
+// Returns ErrBadPrefix if a prefix-length is bad or an error if the Duration is
+// bad.
+func (a Action) bans(name string) (ban.Ban, ban.Ban, error) {
+	prefix4, prefix6 := a.Prefix4, a.Prefix6
+	if prefix4 == 0 {
+		prefix4 = a.Prefix
+	}
+	if prefix6 == 0 {
+		prefix6 = a.Prefix
+	}
+	b4, err := a.ban(name, prefix4, 32)
+	if err != nil {
+		return ban.NoBan, ban.NoBan, err
+	}
+	b6, err := a.ban(name, prefix6, 128)
+	if err != nil {
+		return ban.NoBan, ban.NoBan, err
+	}
+	return b4, b6, nil
+}
+
+// ban.Ban the Action describes with the prefix-length, which is at most the
+// bit-length, for the Rule with the name.
+//
+// Returns ErrBadPrefix if the prefix-length is bad or an error if the Duration
+// is bad.
+func (a Action) ban(name string, prefix, bitLength int) (ban.Ban, error) {
+	b := ban.IPBan
+	if prefix != 0 {
+		if prefix < 1 || prefix > bitLength {
+			return ban.NoBan, ErrBadPrefix
+		}
+		b = ban.Ban{PrefixLength: byte(prefix)}
+	}
+	if a.Duration != "" {
+		d, err := time.ParseDuration(a.Duration)
+		if err != nil {
+			return ban.NoBan, err
+		}
+		b = b.For(d)
+	}
+	reason := a.Reason
+	if reason == "" {
+		reason = name
+	}
+	return b.Because(reason), nil
+}
+
+// compileOptional compiles the regular expression, which is nil if it is "".
+func compileOptional(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// compileAll compiles the regular expressions by their keys, which are
+// normalized by the function.
+//
+// Returns nil if there are no regular expressions.
+func compileAll(exprs map[string]string, normalize func(string) string) (map[string]*regexp.Regexp, error) {
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	compiled := make(map[string]*regexp.Regexp, len(exprs))
+	for k, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		compiled[normalize(k)] = re
+	}
+	return compiled, nil
+}
+
+// matchesAny returns true if every key of the regular expressions has a value
+// matching its regular expression.
+func matchesAny(exprs map[string]*regexp.Regexp, values map[string][]string) bool {
+	for k, re := range exprs {
+		found := false
+		for _, v := range values[k] {
+			if re.MatchString(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
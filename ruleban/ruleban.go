@@ -0,0 +1,211 @@
+// Package ruleban provides a ban.Banner which matches http.Requests against
+// declarative Rules loaded from a JSON or YAML file, so detection rules can be
+// written without writing Go.
+//
+// Rules match on the method, path, query, headers, User-Agent, and body size of
+// http.Requests, and each issues its own Ban with a prefix-length, duration,
+// and reason. They are compiled once when loaded and reloaded when their file
+// is replaced.
+//
+// A YAML file of Rules looks like:
+//
+//	rules:
+//	  - name: sqlmap
+//	    user_agent: '(?i)sqlmap'
+//	    ban:
+//	      prefix: 24
+//	      duration: 24h
+//	  - name: sql injection
+//	    path: '^/search'
+//	    query:
+//	      q: '(?i)union\s+select'
+//	    ban:
+//	      reason: sql injection in search
+package ruleban
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jwowillo/ban"
+)
+
+var (
+	// ErrNoPath is returned if no Path is assigned.
+	ErrNoPath = errors.New("a path must be assigned")
+	// ErrUnknownFormat is returned if the Path's extension isn't ".json",
+	// ".yaml", or ".yml".
+	ErrUnknownFormat = errors.New("unknown rules format")
+	// ErrEmptyFile is returned if the file of Rules is empty, like while it is
+	// being rewritten in place.
+	ErrEmptyFile = errors.New("rules file is empty")
+)
+
+// Config for Rules.
+type Config struct {
+	// Path of the file of Rules, which is read as JSON if it ends in ".json"
+	// and as YAML if it ends in ".yaml" or ".yml".
+	//
+	// Must be assigned.
+	Path string
+	// ReloadInterval between checks for a replaced file.
+	//
+	// Defaults to 10 seconds if not assigned.
+	ReloadInterval time.Duration
+	// ErrorHandler handles errors while reloading the file.
+	//
+	// Defaults to ban.StderrErrorHandler if not assigned.
+	ErrorHandler ban.ErrorHandler
+}
+
+// defaultReloadInterval is the ReloadInterval if none is assigned.
+const defaultReloadInterval = 10 * time.Second
+
+// Rules is a ban.Banner which issues the Ban of the first Rule in a file
+// matching an http.Request.
+//
+// Reloading replaces the RuleSet without affecting http.Requests being matched
+// against the previous one.
+type Rules struct {
+	path           string
+	parse          func([]byte) ([]Rule, error)
+	reloadInterval time.Duration
+	errorHandler   ban.ErrorHandler
+
+	// mu guards set, modTime, and size.
+	mu  sync.RWMutex
+	set *RuleSet
+	// modTime and size of the file when it was read.
+	modTime time.Time
+	size    int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// New Rules with behavior customized by Config.
+//
+// The file is read before it is returned.
+//
+// Returns ErrNoPath if no Path is assigned, ErrUnknownFormat if the Path has an
+// unknown extension, ErrEmptyFile if the file is empty, a RuleError if a Rule
+// is bad, or an error if the file can't be read or parsed.
+func New(cfg Config) (*Rules, error) {
+	if cfg.Path == "" {
+		return nil, ErrNoPath
+	}
+	var parse func([]byte) ([]Rule, error)
+	switch strings.ToLower(filepath.Ext(cfg.Path)) {
+	case ".json":
+		parse = ParseJSON
+	case ".yaml", ".yml":
+		parse = ParseYAML
+	default:
+		return nil, ErrUnknownFormat
+	}
+	reloadInterval := cfg.ReloadInterval
+	if reloadInterval == 0 {
+		reloadInterval = defaultReloadInterval
+	}
+	errorHandler := cfg.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = ban.StderrErrorHandler
+	}
+	rs := &Rules{
+		path:           cfg.Path,
+		parse:          parse,
+		reloadInterval: reloadInterval,
+		errorHandler:   errorHandler,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	if err := rs.Reload(); err != nil {
+		return nil, err
+	}
+	go rs.run()
+	return rs, nil
+}
+
+// RuleSet currently loaded from the file.
+func (rs *Rules) RuleSet() *RuleSet {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.set
+}
+
+// Ban issues the Ban of the first Rule matching the http.Request.
+func (rs *Rules) Ban(ip ban.IP, r *http.Request) ban.Ban {
+	return rs.RuleSet().Ban(ip, r)
+}
+
+// Reload the file if it was replaced or changed since it was last read.
+//
+// The RuleSet is kept if the file can't be reloaded.
+//
+// Returns ErrEmptyFile if the file is empty, a RuleError if a Rule is bad, or
+// an error if the file can't be read or parsed.
+func (rs *Rules) Reload() error {
+	info, err := os.Stat(rs.path)
+	if err != nil {
+		return err
+	}
+	rs.mu.RLock()
+	unchanged := rs.set != nil && info.ModTime().Equal(rs.modTime) && info.Size() == rs.size
+	rs.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	bs, err := os.ReadFile(rs.path)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(bs)) == 0 {
+		return ErrEmptyFile
+	}
+	rules, err := rs.parse(bs)
+	if err != nil {
+		return err
+	}
+	set, err := Compile(rules)
+	if err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	rs.set, rs.modTime, rs.size = set, info.ModTime(), info.Size()
+	rs.mu.Unlock()
+	return nil
+}
+
+// Stop checking for a replaced file.
+//
+// Stopping stopped Rules does nothing.
+func (rs *Rules) Stop() {
+	rs.stopOnce.Do(func() {
+		close(rs.stop)
+		<-rs.done
+	})
+}
+
+// run reloads the file every ReloadInterval until stopped.
+func (rs *Rules) run() {
+	defer close(rs.done)
+	ticker := time.NewTicker(rs.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+			if err := rs.Reload(); err != nil {
+				rs.errorHandler(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package ruleban
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwowillo/ban"
+)
+
+// testYAML is a file of Rules in YAML.
+const testYAML = `rules:
+  - name: scanner
+    user_agent: '(?i)sqlmap|nikto'
+    ban:
+      prefix: 24
+      prefix6: 48
+      duration: 1h
+  - name: sql injection
+    methods: [get, POST]
+    path: '^/search'
+    query:
+      q: '(?i)union\s+select'
+    ban:
+      reason: sql injection in search
+  - name: big upload
+    methods: [POST]
+    path: '^/upload$'
+    headers:
+      x-debug: ''
+    min_body_size: 1000
+    max_body_size: 2000
+  - name: huge upload
+    methods: [PUT]
+    min_body_size: 1000000
+`
+
+// testJSON is testYAML in JSON.
+const testJSON = `{"rules": [
+	{"name": "scanner", "user_agent": "(?i)sqlmap|nikto", "ban": {"prefix": 24, "prefix6": 48, "duration": "1h"}},
+	{
+		"name": "sql injection",
+		"methods": ["get", "POST"],
+		"path": "^/search",
+		"query": {"q": "(?i)union\\s+select"},
+		"ban": {"reason": "sql injection in search"}
+	},
+	{
+		"name": "big upload",
+		"methods": ["POST"],
+		"path": "^/upload$",
+		"headers": {"x-debug": ""},
+		"min_body_size": 1000,
+		"max_body_size": 2000
+	},
+	{"name": "huge upload", "methods": ["PUT"], "min_body_size": 1000000}
+]}`
+
+// TestRuleSet tests that RuleSets issue the Ban of the first Rule matching
+// http.Requests from both JSON and YAML.
+func TestRuleSet(t *testing.T) {
+	t.Parallel()
+	fromYAML, err := ParseYAML([]byte(testYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := ParseJSON([]byte(testJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Fatalf("ParseYAML(testYAML) = %+v, want %+v", fromYAML, fromJSON)
+	}
+	set, err := Compile(fromYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		// IP defaults to 1.2.3.4 if not assigned.
+		IP        string
+		Method    string
+		Target    string
+		UserAgent string
+		Headers   map[string]string
+		Body      int
+		Ban       ban.Ban
+	}{
+		{
+			Method: http.MethodGet, Target: "/", UserAgent: "sqlmap/1.7",
+			Ban: ban.Ban{PrefixLength: 24}.For(time.Hour).Because("scanner"),
+		},
+		{
+			IP: "2001:db8::1", Method: http.MethodGet, Target: "/", UserAgent: "sqlmap/1.7",
+			Ban: ban.Ban{PrefixLength: 48}.For(time.Hour).Because("scanner"),
+		},
+		{
+			Method: http.MethodGet, Target: "/search?q=1+UNION+SELECT+pw",
+			Ban: ban.IPBan.Because("sql injection in search"),
+		},
+		{
+			Method: http.MethodPost, Target: "/search?x=1&q=a&q=union%20select",
+			Ban: ban.IPBan.Because("sql injection in search"),
+		},
+		{Method: http.MethodPut, Target: "/search?q=union+select", Ban: ban.NoBan},
+		{Method: http.MethodGet, Target: "/search?q=onion+select", Ban: ban.NoBan},
+		{
+			Method: http.MethodPost, Target: "/upload", Headers: map[string]string{"X-Debug": "1"},
+			Body: 1500, Ban: ban.IPBan.Because("big upload"),
+		},
+		{Method: http.MethodPost, Target: "/upload", Body: 1500, Ban: ban.NoBan},
+		{
+			Method: http.MethodPost, Target: "/upload", Headers: map[string]string{"X-Debug": "1"},
+			Body: 2500, Ban: ban.NoBan,
+		},
+		{
+			Method: http.MethodPost, Target: "/upload", Headers: map[string]string{"X-Debug": "1"},
+			Body: -1, Ban: ban.NoBan,
+		},
+		{Method: http.MethodPut, Target: "/upload", Body: -1, Ban: ban.IPBan.Because("huge upload")},
+		{Method: http.MethodPut, Target: "/upload", Body: 1500, Ban: ban.NoBan},
+		{Method: http.MethodGet, Target: "/", UserAgent: "curl/8.0", Ban: ban.NoBan},
+	}
+	for _, c := range cases {
+		if c.IP == "" {
+			c.IP = "1.2.3.4"
+		}
+		ip, err := ban.ParseIP(c.IP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(c.Method, c.Target, nil)
+		r.Header.Set("User-Agent", c.UserAgent)
+		for k, v := range c.Headers {
+			r.Header.Set(k, v)
+		}
+		r.ContentLength = int64(c.Body)
+		if got := set.Ban(ip, r); got != c.Ban {
+			t.Errorf("set.Ban(%s, %s %s) = %v, want %v", c.IP, c.Method, c.Target, got, c.Ban)
+		}
+	}
+}
+
+// TestBadRules tests that bad Rules aren't compiled.
+func TestBadRules(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Rule Rule
+		Err  error
+	}{
+		{Rule: Rule{Path: "^/"}, Err: ErrNoName},
+		{Rule: Rule{Name: "all"}, Err: ErrNoMatchers},
+		{Rule: Rule{Name: "prefix", Path: "^/", Ban: Action{Prefix: 129}}, Err: ErrBadPrefix},
+		{Rule: Rule{Name: "prefix", Path: "^/", Ban: Action{Prefix: 48}}, Err: ErrBadPrefix},
+		{Rule: Rule{Name: "prefix4", Path: "^/", Ban: Action{Prefix4: 33}}, Err: ErrBadPrefix},
+		{Rule: Rule{Name: "prefix6", Path: "^/", Ban: Action{Prefix4: 24, Prefix6: 129}}, Err: ErrBadPrefix},
+		{Rule: Rule{Name: "size", MinBodySize: 2, MaxBodySize: 1}, Err: ErrBadBodySize},
+		{Rule: Rule{Name: "regexp", Path: "("}},
+		{Rule: Rule{Name: "duration", Path: "^/", Ban: Action{Duration: "forever"}}},
+	}
+	for _, c := range cases {
+		_, err := Compile([]Rule{{Name: "good", Path: "^/good"}, c.Rule})
+		var ruleErr *RuleError
+		if !errors.As(err, &ruleErr) || ruleErr.Index != 2 || ruleErr.Name != c.Rule.Name {
+			t.Errorf("Compile(%s) = %v, want a RuleError for rule 2", c.Rule.Name, err)
+			continue
+		}
+		if c.Err != nil && !errors.Is(err, c.Err) {
+			t.Errorf("Compile(%s) = %v, want %v", c.Rule.Name, err, c.Err)
+		}
+	}
+	if _, err := ParseYAML([]byte("rules:\n  - name: typo\n    pth: '^/'\n")); err == nil {
+		t.Error("ParseYAML(unknown field) = nil, want an error")
+	}
+	if _, err := ParseJSON([]byte(`{"rules": [{"name": "typo", "pth": "^/"}]}`)); err == nil {
+		t.Error("ParseJSON(unknown field) = nil, want an error")
+	}
+}
+
+// TestReload tests that Rules are reloaded when their file is replaced and
+// kept when the replacement is bad.
+func TestReload(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	if _, err := New(Config{Path: filepath.Join(dir, "rules.txt")}); err != ErrUnknownFormat {
+		t.Errorf("New(rules.txt) = %v, want %v", err, ErrUnknownFormat)
+	}
+	path := filepath.Join(dir, "rules.yaml")
+	if err := os.WriteFile(path, []byte(testYAML), 0666); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := New(Config{
+		Path:           path,
+		ReloadInterval: 10 * time.Millisecond,
+		ErrorHandler:   ban.IgnoreErrorHandler,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Stop()
+	ip := ban.NewIPv4IP(ban.IPv4{1, 2, 3, 4})
+	r := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	if got := rs.Ban(ip, r); got != ban.NoBan {
+		t.Errorf("rs.Ban(/admin) = %v, want %v", got, ban.NoBan)
+	}
+	previous := rs.RuleSet()
+	replaced := strings.Replace(testYAML, "'^/search'", "'^/(search|admin)'", 1)
+	if err := os.WriteFile(path, []byte(replaced+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	want := ban.IPBan.Because("sql injection in search")
+	r = httptest.NewRequest(http.MethodGet, "/admin?q=union+select", nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for rs.Ban(ip, r) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("rs.Ban(/admin) = %v, want %v after reloading", rs.Ban(ip, r), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := previous.Ban(ip, r); got != ban.NoBan {
+		t.Errorf("previous.Ban(/admin) = %v, want %v unchanged by reloading", got, ban.NoBan)
+	}
+	if err := os.WriteFile(path, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Reload(); err != ErrEmptyFile {
+		t.Errorf("rs.Reload() = %v, want %v", err, ErrEmptyFile)
+	}
+	if err := os.WriteFile(path, []byte("rules:\n  - name: bad\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Reload(); !errors.Is(err, ErrNoMatchers) {
+		t.Errorf("rs.Reload() = %v, want %v", err, ErrNoMatchers)
+	}
+	if got := rs.Ban(ip, r); got != want {
+		t.Errorf("rs.Ban(/admin) = %v, want %v with the last good Rules", got, want)
+	}
+	rs.Stop()
+}
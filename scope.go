@@ -0,0 +1,116 @@
+package ban
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ErrBadScope is returned if a Scope can't be parsed.
+var ErrBadScope = errors.New("bad scope")
+
+// Scope limits a Ban to part of a site.
+//
+// Every assigned field must match a request for the Ban to apply to it. The
+// empty Scope matches every request.
+type Scope struct {
+	// PathPrefix the request's cleaned path must be or be under, matching
+	// whole segments so "/admin" covers "/admin/users" but not
+	// "/administrator".
+	//
+	// Matches every path if not assigned.
+	PathPrefix string
+	// Host the request must be for, compared case-insensitively and without
+	// the port.
+	//
+	// Matches every host if not assigned.
+	Host string
+	// Methods one of which the request must use.
+	//
+	// Matches every method if not assigned.
+	Methods []string
+}
+
+// String form of the Scope which is the same for equal Scopes.
+//
+// The form is URL-encoded with the keys "host", "methods", and "path", where
+// methods are upper-cased, sorted, and comma-separated.
+func (s Scope) String() string {
+	v := url.Values{}
+	if s.Host != "" {
+		v.Set("host", strings.ToLower(s.Host))
+	}
+	if len(s.Methods) != 0 {
+		methods := make([]string, len(s.Methods))
+		for i, m := range s.Methods {
+			methods[i] = strings.ToUpper(m)
+		}
+		sort.Strings(methods)
+		v.Set("methods", strings.Join(methods, ","))
+	}
+	if s.PathPrefix != "" {
+		v.Set("path", s.PathPrefix)
+	}
+	return v.Encode()
+}
+
+// Matches returns true if a request for the host using the method to the path
+// is in the Scope.
+//
+// The path is cleaned first, so paths like "//admin" and "/x/../admin" can't
+// escape a PathPrefix of "/admin".
+func (s Scope) Matches(host, method, p string) bool {
+	if s.Host != "" {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(s.Host, host) {
+			return false
+		}
+	}
+	if !underPath(cleanPath(p), s.PathPrefix) {
+		return false
+	}
+	if len(s.Methods) == 0 {
+		return true
+	}
+	for _, m := range s.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath is the shortest rooted path equivalent to the path.
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// underPath returns true if the cleaned path is the prefix or is under it,
+// matching whole segments.
+func underPath(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// parseScope parses the String form of a Scope.
+//
+// Returns ErrBadScope if the string isn't the String form of a Scope.
+func parseScope(s string) (Scope, error) {
+	v, err := url.ParseQuery(s)
+	if err != nil {
+		return Scope{}, ErrBadScope
+	}
+	scope := Scope{Host: v.Get("host"), PathPrefix: v.Get("path")}
+	if methods := v.Get("methods"); methods != "" {
+		scope.Methods = strings.Split(methods, ",")
+	}
+	if scope.String() != s {
+		return Scope{}, ErrBadScope
+	}
+	return scope, nil
+}
@@ -0,0 +1,114 @@
+package ban
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+// TestScopeString tests that equal Scopes have the same String form which
+// parses back to them.
+func TestScopeString(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Scope Scope
+		Want  string
+	}{
+		{Scope: Scope{}, Want: ""},
+		{Scope: Scope{PathPrefix: "/login"}, Want: "path=%2Flogin"},
+		{Scope: Scope{Host: "Example.com"}, Want: "host=example.com"},
+		{
+			Scope: Scope{Host: "a.com", PathPrefix: "/x y", Methods: []string{"post", "GET"}},
+			Want:  "host=a.com&methods=GET%2CPOST&path=%2Fx+y",
+		},
+	}
+	for _, c := range cases {
+		s := c.Scope.String()
+		if s != c.Want {
+			t.Errorf("%#v.String() = %v, want %v", c.Scope, s, c.Want)
+		}
+		scope, err := parseScope(s)
+		if err != nil {
+			t.Error(err)
+		}
+		if scope.String() != s {
+			t.Errorf("parseScope(%v) = %#v, want %#v", s, scope, c.Scope)
+		}
+	}
+	if _, err := parseScope("path=%2Fa&unknown=1"); err != ErrBadScope {
+		t.Errorf("parseScope() = %v, want %v", err, ErrBadScope)
+	}
+}
+
+// TestScopeMatches tests that Scopes match requests where every assigned field
+// matches.
+func TestScopeMatches(t *testing.T) {
+	t.Parallel()
+	scope := Scope{Host: "example.com", PathPrefix: "/login", Methods: []string{"POST"}}
+	cases := []struct {
+		Scope  Scope
+		Host   string
+		Method string
+		Path   string
+		Want   bool
+	}{
+		{Scope: Scope{}, Host: "a.com", Method: "GET", Path: "/", Want: true},
+		{Scope: scope, Host: "example.com", Method: "POST", Path: "/login", Want: true},
+		{Scope: scope, Host: "EXAMPLE.com:8080", Method: "post", Path: "/login/2fa", Want: true},
+		{Scope: scope, Host: "other.com", Method: "POST", Path: "/login", Want: false},
+		{Scope: scope, Host: "example.com", Method: "GET", Path: "/login", Want: false},
+		{Scope: scope, Host: "example.com", Method: "POST", Path: "/docs", Want: false},
+		{Scope: scope, Host: "example.com", Method: "POST", Path: "/loginx", Want: false},
+		{Scope: scope, Host: "example.com", Method: "POST", Path: "//login", Want: true},
+		{Scope: scope, Host: "example.com", Method: "POST", Path: "/x/../login/", Want: true},
+		{Scope: Scope{PathPrefix: "/login/"}, Host: "a.com", Method: "GET", Path: "/login", Want: true},
+		{Scope: Scope{PathPrefix: "/"}, Host: "a.com", Method: "GET", Path: "", Want: true},
+	}
+	for _, c := range cases {
+		if got := c.Scope.Matches(c.Host, c.Method, c.Path); got != c.Want {
+			t.Errorf(
+				"%v.Matches(%v, %v, %v) = %t, want %t",
+				c.Scope, c.Host, c.Method, c.Path, got, c.Want,
+			)
+		}
+	}
+}
+
+// TestScopedBan tests that Bans in a Scope only block matching requests, are
+// stored, and can be unbanned.
+func TestScopedBan(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if err := os.Remove("scope_store.txt"); err != nil {
+			t.Error(err)
+		}
+	}()
+	scope := Scope{PathPrefix: "/login"}
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	b := BannerFunc(func(ip IP, r *http.Request) Ban {
+		if r.URL.Path == "/login/bad" {
+			return Ban{PrefixLength: 24}.In(scope)
+		}
+		return NoBan
+	})
+	cfg := Config{StorePath: "scope_store.txt", ErrorHandler: func(err error) { t.Error(err) }}
+	wh := New(h, b, cfg)
+	testTarget(t, wh, "1.2.3.4", "/login/bad", nil, "1.2.3.4 is banned", http.StatusForbidden)
+	testTarget(t, wh, "1.2.3.5", "/login", nil, "1.2.3.5 is banned", http.StatusForbidden)
+	testTarget(t, wh, "1.2.3.5", "/docs", nil, "", http.StatusOK)
+	testTarget(t, wh, "1.2.4.4", "/login", nil, "", http.StatusOK)
+	wh = New(h, b, cfg)
+	testTarget(t, wh, "1.2.3.5", "/login", nil, "1.2.3.5 is banned", http.StatusForbidden)
+	if pips := wh.Engine().PrefixedIPs(); len(pips) != 0 {
+		t.Errorf("wh.Engine().PrefixedIPs() = %v, want []", pips)
+	}
+	pips := wh.Engine().PrefixedIPsIn(scope)
+	if len(pips) != 1 || pips[0].String() != "1.2.3.0/24" {
+		t.Fatalf("wh.Engine().PrefixedIPsIn(%v) = %v, want [1.2.3.0/24]", scope, pips)
+	}
+	if err := wh.Engine().UnbanIn(pips[0], scope); err != nil {
+		t.Error(err)
+	}
+	wh = New(h, b, cfg)
+	testTarget(t, wh, "1.2.3.5", "/login", nil, "", http.StatusOK)
+}
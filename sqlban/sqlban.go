@@ -0,0 +1,584 @@
+// Package sqlban provides a ban.SharedStore which keeps Bans in a SQL database
+// through database/sql, like Postgres or SQLite, where the reason, issuer, and
+// expiry of each can be queried.
+//
+// Bans are kept in a table with a row for each banned PrefixedIP, PrefixedIP in
+// a Scope, key, and fingerprint. Every change is also appended to a changes
+// table which Stores poll to apply changes made by other processes.
+package sqlban
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jwowillo/ban"
+)
+
+// ErrBadTable is returned if a Table isn't a plain SQL identifier.
+var ErrBadTable = errors.New("table must be a plain SQL identifier")
+
+// Dialect of SQL spoken by a database.
+type Dialect struct {
+	// serial is the column definition of auto-incrementing primary keys.
+	serial string
+}
+
+var (
+	// SQLite is the Dialect of SQLite.
+	SQLite = Dialect{serial: "INTEGER PRIMARY KEY AUTOINCREMENT"}
+	// Postgres is the Dialect of PostgreSQL.
+	Postgres = Dialect{serial: "BIGSERIAL PRIMARY KEY"}
+)
+
+// Config for the Store.
+type Config struct {
+	// Dialect of the database.
+	//
+	// Defaults to SQLite if not assigned.
+	Dialect Dialect
+	// Table is the name of the table of Bans, which prefixes the names of
+	// the tables of changes and the schema version.
+	//
+	// Defaults to "bans" if not assigned.
+	Table string
+	// PollInterval between polls for changes made by other processes.
+	//
+	// Defaults to a second if not assigned.
+	PollInterval time.Duration
+	// BatchSize is the most rows inserted by one statement in AddAll.
+	//
+	// Defaults to 100 if not assigned.
+	BatchSize int
+	// ChangeRetention is how long changes are kept for processes to poll.
+	//
+	// Defaults to a day if not assigned.
+	ChangeRetention time.Duration
+	// ErrorHandler handles errors while polling, which is retried.
+	//
+	// Defaults to ban.StderrErrorHandler if not assigned.
+	ErrorHandler ban.ErrorHandler
+}
+
+// DefaultConfig which uses SQLite tables named after "bans", polls every
+// second, inserts 100 rows at a time, and keeps changes for a day.
+var DefaultConfig = Config{}
+
+const (
+	// defaultTable is the Table if none is assigned.
+	defaultTable = "bans"
+	// defaultPollInterval is the PollInterval if none is assigned.
+	defaultPollInterval = time.Second
+	// defaultBatchSize is the BatchSize if none is assigned.
+	defaultBatchSize = 100
+	// defaultChangeRetention is the ChangeRetention if none is assigned.
+	defaultChangeRetention = 24 * time.Hour
+)
+
+// identifier matches plain SQL identifiers.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Store is a ban.SharedStore and ban.BatchStore which keeps StoreEntries in a
+// SQL database.
+//
+// The table of Bans has the columns:
+//
+//   - entry: the String form of the StoreEntry, which is the primary key
+//   - prefixed_ip, scope, ban_key, fingerprint: the parts of the StoreEntry,
+//     which are NULL if not assigned, with prefixed_ip and ban_key indexed
+//   - reason, issuer: the Meta the StoreEntry was banned with
+//   - expires_at: the Unix milliseconds of the Expiry, which is indexed and
+//     NULL if the StoreEntry doesn't expire
+//   - banned_at: the Unix milliseconds the StoreEntry was last added
+//
+// Rows of expired StoreEntries are deleted once an Engine notices they expired,
+// so queries should filter on expires_at.
+//
+// Changes are polled in the order of their auto-incremented IDs, so with
+// databases like Postgres, where IDs can be committed out of order, a change
+// committed after a later ID was polled is only applied by processes which load
+// the Store again.
+type Store struct {
+	db              *sql.DB
+	dialect         Dialect
+	table           string
+	pollInterval    time.Duration
+	batchSize       int
+	changeRetention time.Duration
+	errorHandler    ban.ErrorHandler
+	// id of the Store, which marks changes it made.
+	id string
+
+	// mu guards cursor and loaded.
+	mu sync.Mutex
+	// cursor is the ID of the last change known.
+	cursor int64
+	// loaded is true once cursor was assigned by Load.
+	loaded bool
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	watching  sync.WaitGroup
+}
+
+// New Store in the database with behavior customized by Config.
+//
+// The schema is created or migrated to the latest version before it is
+// returned. Processes sharing the database shouldn't migrate at the same time.
+//
+// Returns ErrBadTable if the Table is bad or an error if migrating failed.
+func New(db *sql.DB, cfg Config) (*Store, error) {
+	dialect := cfg.Dialect
+	if dialect == (Dialect{}) {
+		dialect = SQLite
+	}
+	table := cfg.Table
+	if table == "" {
+		table = defaultTable
+	}
+	if !identifier.MatchString(table) {
+		return nil, ErrBadTable
+	}
+	pollInterval := cfg.PollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultPollInterval
+	}
+	batchSize := cfg.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultBatchSize
+	}
+	changeRetention := cfg.ChangeRetention
+	if changeRetention == 0 {
+		changeRetention = defaultChangeRetention
+	}
+	errorHandler := cfg.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = ban.StderrErrorHandler
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	s := &Store{
+		db:              db,
+		dialect:         dialect,
+		table:           table,
+		pollInterval:    pollInterval,
+		batchSize:       batchSize,
+		changeRetention: changeRetention,
+		errorHandler:    errorHandler,
+		id:              hex.EncodeToString(id),
+		stop:            make(chan struct{}),
+	}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrations create and change the schema, where the schema at version i is
+// made by the first i migrations, formatted with the table and Dialect.
+var migrations = []func(table string, d Dialect) []string{
+	func(table string, d Dialect) []string {
+		return []string{
+			`CREATE TABLE ` + table + ` (
+				entry TEXT PRIMARY KEY,
+				prefixed_ip TEXT,
+				scope TEXT,
+				ban_key TEXT,
+				fingerprint TEXT,
+				reason TEXT NOT NULL,
+				issuer TEXT NOT NULL,
+				expires_at BIGINT,
+				banned_at BIGINT NOT NULL
+			)`,
+			`CREATE INDEX ` + table + `_prefixed_ip ON ` + table + ` (prefixed_ip)`,
+			`CREATE INDEX ` + table + `_ban_key ON ` + table + ` (ban_key)`,
+			`CREATE INDEX ` + table + `_expires_at ON ` + table + ` (expires_at)`,
+			`CREATE TABLE ` + table + `_changes (
+				id ` + d.serial + `,
+				entry TEXT NOT NULL,
+				removed INTEGER NOT NULL,
+				reason TEXT NOT NULL,
+				issuer TEXT NOT NULL,
+				expires_at BIGINT,
+				origin TEXT NOT NULL,
+				changed_at BIGINT NOT NULL
+			)`,
+			`CREATE INDEX ` + table + `_changes_changed_at ON ` + table + `_changes (changed_at)`,
+		}
+	},
+}
+
+// migrate the schema to the latest version.
+//
+// Returns any error that happened while migrating.
+func (s *Store) migrate() error {
+	schema := s.table + "_schema"
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS ` + schema + ` (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM ` + schema).Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range migrations[version](s.table, s.dialect) {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO `+schema+` (version) VALUES ($1)`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load the StoreEntries which haven't expired with their Meta.
+//
+// Changes made before loading aren't passed to the function being watched
+// with.
+//
+// Returns any error from the database.
+func (s *Store) Load() ([]ban.StoreEntry, error) {
+	var cursor int64
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM ` + s.table + `_changes`).Scan(&cursor); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(
+		`SELECT entry, reason, issuer, expires_at FROM `+s.table+`
+		WHERE expires_at IS NULL OR expires_at > $1 ORDER BY banned_at`,
+		time.Now().UnixMilli(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []ban.StoreEntry
+	for rows.Next() {
+		var line, reason, issuer string
+		var expiry sql.NullInt64
+		if err := rows.Scan(&line, &reason, &issuer, &expiry); err != nil {
+			return nil, err
+		}
+		entry, err := parseEntry(line, reason, issuer, expiry)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.cursor, s.loaded = cursor, true
+	s.mu.Unlock()
+	return entries, nil
+}
+
+// Lookup the StoreEntry with the same String form as the StoreEntry.
+//
+// Returns the StoreEntry with its Expiry and Meta, false if it isn't banned or
+// expired, and any error from the database.
+func (s *Store) Lookup(entry ban.StoreEntry) (ban.StoreEntry, bool, error) {
+	var reason, issuer string
+	var expiry sql.NullInt64
+	err := s.db.QueryRow(
+		`SELECT reason, issuer, expires_at FROM `+s.table+`
+		WHERE entry = $1 AND (expires_at IS NULL OR expires_at > $2)`,
+		entry.String(), time.Now().UnixMilli(),
+	).Scan(&reason, &issuer, &expiry)
+	if err == sql.ErrNoRows {
+		return ban.StoreEntry{}, false, nil
+	}
+	if err != nil {
+		return ban.StoreEntry{}, false, err
+	}
+	found, err := parseEntry(entry.String(), reason, issuer, expiry)
+	return found, err == nil, err
+}
+
+// Add the StoreEntry, replacing its Expiry and Meta if it was already added.
+//
+// Returns any error from the database.
+func (s *Store) Add(entry ban.StoreEntry) error {
+	return s.AddAll([]ban.StoreEntry{entry})
+}
+
+// AddAll adds the StoreEntries like Add in one transaction, inserting at most
+// BatchSize rows with each statement.
+//
+// Returns any error from the database.
+func (s *Store) AddAll(entries []ban.StoreEntry) error {
+	// Postgres can't upsert the same row twice in one statement, so only the
+	// last of each StoreEntry is kept.
+	last := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		last[entry.String()] = i
+	}
+	var unique []ban.StoreEntry
+	for i, entry := range entries {
+		if last[entry.String()] == i {
+			unique = append(unique, entry)
+		}
+	}
+	now := time.Now().UnixMilli()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(unique); start += s.batchSize {
+		batch := unique[start:min(start+s.batchSize, len(unique))]
+		if err := s.insertBans(tx, batch, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := s.insertChanges(tx, batch, false, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Remove the StoreEntry.
+//
+// Returns any error from the database.
+func (s *Store) Remove(entry ban.StoreEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM `+s.table+` WHERE entry = $1`, entry.String()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	entry.Expiry, entry.Meta = time.Time{}, ban.Meta{}
+	if err := s.insertChanges(tx, []ban.StoreEntry{entry}, true, time.Now().UnixMilli()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Watch calls the function with every StoreEntry added to or removed from the
+// database by other Stores every PollInterval until the Store is closed.
+//
+// Changes made since the Store was loaded are polled, or since Watch was
+// called if it wasn't.
+func (s *Store) Watch(f func(entry ban.StoreEntry, removed bool)) {
+	s.mu.Lock()
+	loaded := s.loaded
+	s.mu.Unlock()
+	if !loaded {
+		var cursor int64
+		err := s.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM ` + s.table + `_changes`).Scan(&cursor)
+		if err != nil {
+			s.errorHandler(err)
+		}
+		s.mu.Lock()
+		s.cursor = cursor
+		s.mu.Unlock()
+	}
+	s.watching.Add(1)
+	go func() {
+		defer s.watching.Done()
+		ticker := time.NewTicker(s.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if err := s.poll(f); err != nil {
+					s.errorHandler(err)
+				}
+			}
+		}
+	}()
+}
+
+// Close the Store, stopping polling for changes.
+//
+// The database isn't closed, and closing a closed Store does nothing.
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.watching.Wait()
+	})
+	return nil
+}
+
+// poll the changes made by other Stores since the last one known, calling the
+// function with each, and delete changes older than the ChangeRetention.
+//
+// Returns any error from the database.
+func (s *Store) poll(f func(ban.StoreEntry, bool)) error {
+	s.mu.Lock()
+	cursor := s.cursor
+	s.mu.Unlock()
+	rows, err := s.db.Query(
+		`SELECT id, entry, removed, reason, issuer, expires_at, origin FROM `+s.table+`_changes
+		WHERE id > $1 ORDER BY id`,
+		cursor,
+	)
+	if err != nil {
+		return err
+	}
+	type change struct {
+		entry   ban.StoreEntry
+		removed bool
+	}
+	var changes []change
+	for rows.Next() {
+		var id int64
+		var line, reason, issuer, origin string
+		var removed int
+		var expiry sql.NullInt64
+		if err := rows.Scan(&id, &line, &removed, &reason, &issuer, &expiry, &origin); err != nil {
+			rows.Close()
+			return err
+		}
+		cursor = id
+		if origin == s.id {
+			continue
+		}
+		entry, err := parseEntry(line, reason, issuer, expiry)
+		if err != nil {
+			s.errorHandler(err)
+			continue
+		}
+		changes = append(changes, change{entry: entry, removed: removed != 0})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cursor = cursor
+	s.mu.Unlock()
+	for _, c := range changes {
+		f(c.entry, c.removed)
+	}
+	_, err = s.db.Exec(
+		`DELETE FROM `+s.table+`_changes WHERE changed_at < $1`,
+		time.Now().Add(-s.changeRetention).UnixMilli(),
+	)
+	return err
+}
+
+// insertBans upserts the rows of the StoreEntries, which must be distinct,
+// banned at the Unix milliseconds.
+//
+// Returns any error from the database.
+func (s *Store) insertBans(tx *sql.Tx, entries []ban.StoreEntry, now int64) error {
+	var values []string
+	var args []any
+	for _, entry := range entries {
+		var pip, scope, key, fingerprint any
+		switch {
+		case entry.Key != "":
+			key = entry.Key
+		case entry.Fingerprint != "":
+			fingerprint = entry.Fingerprint
+		default:
+			pip = entry.PrefixedIP.String()
+			if entry.Scope != nil && entry.Scope.String() != "" {
+				scope = entry.Scope.String()
+			}
+		}
+		values = append(values, placeholders(len(args), 9))
+		args = append(
+			args, entry.String(), pip, scope, key, fingerprint,
+			entry.Meta.Reason, entry.Meta.Issuer, expiryMillis(entry.Expiry), now,
+		)
+	}
+	_, err := tx.Exec(
+		`INSERT INTO `+s.table+`
+		(entry, prefixed_ip, scope, ban_key, fingerprint, reason, issuer, expires_at, banned_at)
+		VALUES `+strings.Join(values, ", ")+`
+		ON CONFLICT (entry) DO UPDATE SET
+		reason = excluded.reason, issuer = excluded.issuer,
+		expires_at = excluded.expires_at, banned_at = excluded.banned_at`,
+		args...,
+	)
+	return err
+}
+
+// insertChanges appends the changes of the StoreEntries, which are removals if
+// removed is true, made at the Unix milliseconds.
+//
+// Returns any error from the database.
+func (s *Store) insertChanges(tx *sql.Tx, entries []ban.StoreEntry, removed bool, now int64) error {
+	var values []string
+	var args []any
+	r := 0
+	if removed {
+		r = 1
+	}
+	for _, entry := range entries {
+		values = append(values, placeholders(len(args), 7))
+		args = append(
+			args, entry.String(), r, entry.Meta.Reason, entry.Meta.Issuer,
+			expiryMillis(entry.Expiry), s.id, now,
+		)
+	}
+	_, err := tx.Exec(
+		`INSERT INTO `+s.table+`_changes
+		(entry, removed, reason, issuer, expires_at, origin, changed_at)
+		VALUES `+strings.Join(values, ", "),
+		args...,
+	)
+	return err
+}
+
+// placeholders returns a parenthesized row of n numbered placeholders after the
+// first.
+func placeholders(first, n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		ps[i] = "$" + strconv.Itoa(first+i+1)
+	}
+	return "(" + strings.Join(ps, ", ") + ")"
+}
+
+// parseEntry parses the String form of a StoreEntry with its Meta and the
+// Expiry in Unix milliseconds, which is NULL if it doesn't expire.
+//
+// Returns an error if the String form is bad.
+func parseEntry(line, reason, issuer string, expiry sql.NullInt64) (ban.StoreEntry, error) {
+	entry, err := ban.ParseStoreEntry(line)
+	if err != nil {
+		return ban.StoreEntry{}, err
+	}
+	entry.Meta = ban.Meta{Reason: reason, Issuer: issuer}
+	if expiry.Valid {
+		entry.Expiry = time.UnixMilli(expiry.Int64)
+	}
+	return entry, nil
+}
+
+// expiryMillis is the Expiry in Unix milliseconds, which is nil if it is the
+// zero time.Time.
+func expiryMillis(expiry time.Time) any {
+	if expiry.IsZero() {
+		return nil
+	}
+	return expiry.UnixMilli()
+}
@@ -0,0 +1,177 @@
+package sqlban
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jwowillo/ban"
+	_ "modernc.org/sqlite"
+)
+
+// TestStore tests that StoreEntries are added with their Meta and Expiry,
+// removed, looked up, and loaded, and that migrating twice does nothing.
+func TestStore(t *testing.T) {
+	t.Parallel()
+	db := testDB(t, filepath.Join(t.TempDir(), "bans.db"))
+	if _, err := New(db, Config{}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(db, Config{BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	pip, err := ban.ParsePrefixedIP("1.2.3.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	meta := ban.Meta{Reason: "scanner", Issuer: "http"}
+	entries := []ban.StoreEntry{
+		{PrefixedIP: pip, Meta: meta},
+		{PrefixedIP: pip, Scope: &ban.Scope{PathPrefix: "/login"}, Expiry: expiry, Meta: meta},
+		{Key: "k"},
+		{Fingerprint: "f"},
+		{PrefixedIP: pip, Scope: &ban.Scope{Host: "a.com"}, Expiry: time.Now().Add(-time.Second)},
+		{PrefixedIP: pip, Meta: ban.Meta{Reason: "later"}},
+	}
+	if err := s.AddAll(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(entries[2]); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 3 {
+		t.Fatalf("s.Load() = %v, want 3 StoreEntries", loaded)
+	}
+	cases := []struct {
+		Entry  ban.StoreEntry
+		Found  bool
+		Expiry time.Time
+		Meta   ban.Meta
+	}{
+		{Entry: entries[0], Found: true, Meta: ban.Meta{Reason: "later"}},
+		{Entry: entries[1], Found: true, Expiry: expiry, Meta: meta},
+		{Entry: entries[2], Found: false},
+		{Entry: entries[3], Found: true},
+		{Entry: entries[4], Found: false},
+	}
+	for _, c := range cases {
+		found, ok, err := s.Lookup(c.Entry)
+		if err != nil {
+			t.Error(err)
+		}
+		if ok != c.Found || !found.Expiry.Equal(c.Expiry) || found.Meta != c.Meta {
+			t.Errorf(
+				"s.Lookup(%v) = %v, %v, %v, %t, want %v, %v, %t",
+				c.Entry, found, found.Expiry, found.Meta, ok, c.Expiry, c.Meta, c.Found,
+			)
+		}
+	}
+	var reason string
+	if err := db.QueryRow(`SELECT reason FROM bans WHERE scope IS NOT NULL`).Scan(&reason); err != nil {
+		t.Fatal(err)
+	}
+	if reason != meta.Reason {
+		t.Errorf("reason = %v, want %v", reason, meta.Reason)
+	}
+	if _, err := New(db, Config{Table: "bans; DROP TABLE bans"}); err != ErrBadTable {
+		t.Errorf("New() = %v, want %v", err, ErrBadTable)
+	}
+}
+
+// TestSharedEngines tests that Bans issued and unbanned by a ban.Engine in one
+// process are polled by another sharing the database, and that PrefixedIPs
+// added together are inserted together.
+func TestSharedEngines(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "bans.db")
+	cfg := Config{PollInterval: 10 * time.Millisecond, ErrorHandler: func(err error) { t.Error(err) }}
+	sa, err := New(testDB(t, path), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sa.Close()
+	sb, err := New(testDB(t, path), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+	a := ban.NewEngine(ban.Config{Store: sa, ErrorHandler: func(err error) { t.Error(err) }})
+	b := ban.NewEngine(ban.Config{Store: sb, ErrorHandler: func(err error) { t.Error(err) }})
+	issued := make(chan ban.Meta, 1)
+	b.OnEvent(func(ev ban.Event) {
+		if ev.Type != ban.EventIssue {
+			return
+		}
+		select {
+		case issued <- ev.Meta:
+		default:
+		}
+	})
+	ip := ban.NewIPv4IP(ban.IPv4{1, 2, 3, 4})
+	meta := ban.Meta{Reason: "brute force", Issuer: "ssh"}
+	pip, err := a.Issue(ip, ban.IPBan.For(time.Hour), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-issued:
+		if got != meta {
+			t.Errorf("ev.Meta = %v, want %v", got, meta)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b didn't poll the Ban")
+	}
+	if !b.Check(ip) {
+		t.Errorf("b.Check(%v) = false, want true", ip)
+	}
+	if err := b.Unban(pip); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Check(ip) {
+		if time.Now().After(deadline) {
+			t.Fatalf("a.Check(%v) = true, want false", ip)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	pips := make([]*ban.PrefixedIP, 250)
+	for i := range pips {
+		pips[i], err = ban.NewPrefixedIP(ban.NewIPv4IP(ban.IPv4{10, 0, byte(i), 0}), 24)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Add(pips...); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := sa.db.QueryRow(`SELECT COUNT(*) FROM bans`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(pips) {
+		t.Errorf("count = %d, want %d", count, len(pips))
+	}
+	for i := 0; i < 2; i++ {
+		if err := sa.Close(); err != nil {
+			t.Errorf("sa.Close() = %v, want nil", err)
+		}
+	}
+}
+
+// testDB opens the SQLite database at path until the test ends.
+func testDB(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
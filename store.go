@@ -3,37 +3,185 @@ package ban
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// store can load and store PrefixedIPs.
-type store struct {
+// storeHeader is the first line of store files where prefix-lengths are native
+// to the family of each PrefixedIP.
+//
+// Store files without the header were written by earlier versions of the
+// package and have prefix-lengths which are always out of 128 bits.
+const storeHeader = "# ban prefix-lengths: native"
+
+// storeRemoval prefixes lines of store files which remove an entry.
+const storeRemoval = "-"
+
+// Store loads and stores the Bans of an Engine.
+type Store interface {
+	// Load the StoreEntries which were added to the Store and not removed
+	// since.
+	//
+	// Returns an error if the Store can't be read.
+	Load() ([]StoreEntry, error)
+	// Add the StoreEntry to the Store, replacing its Expiry if it was
+	// already added.
+	//
+	// Returns an error if the Store can't be written to.
+	Add(StoreEntry) error
+	// Remove the StoreEntry from the Store.
+	//
+	// The StoreEntry's Expiry is ignored. Returns an error if the Store can't
+	// be written to.
+	Remove(StoreEntry) error
+}
+
+// BatchStore is a Store which adds many StoreEntries at once more efficiently
+// than one at a time, like when an Engine is seeded with Add.
+type BatchStore interface {
+	Store
+	// AddAll adds the StoreEntries like Add.
+	//
+	// Returns an error if the Store can't be written to.
+	AddAll([]StoreEntry) error
+}
+
+// SharedStore is a Store which is shared by several Engines, like ones in
+// different instances, so changes made by one should be applied to the others.
+type SharedStore interface {
+	Store
+	// Watch calls the function with every StoreEntry added to or removed from
+	// the SharedStore by others.
+	Watch(func(entry StoreEntry, removed bool))
+}
+
+// StoreEntry is a banned PrefixedIP, PrefixedIP in a Scope, key, or TLS
+// ClientHello fingerprint in a Store.
+//
+// Exactly one of PrefixedIP, Key, and Fingerprint is assigned.
+type StoreEntry struct {
+	PrefixedIP *PrefixedIP
+	// Scope the PrefixedIP is banned in.
+	//
+	// Is nil for PrefixedIPs banned without a Scope.
+	Scope *Scope
+	// Key is the hash of a key returned by HashKey.
+	Key string
+	// Fingerprint is a TLS ClientHello fingerprint.
+	Fingerprint string
+	// Expiry after which the PrefixedIP, key, or fingerprint is no longer
+	// banned.
+	//
+	// Is the zero time.Time for StoreEntries which don't expire.
+	Expiry time.Time
+	// Meta the StoreEntry was banned with.
+	//
+	// Is only kept by some Stores and isn't part of the String form.
+	Meta Meta
+}
+
+// ParseStoreEntry parses the String form of a StoreEntry.
+//
+// Returns an error if the string isn't the String form of a StoreEntry.
+func ParseStoreEntry(s string) (StoreEntry, error) {
+	return parseStoreEntry(s, false)
+}
+
+// String form of the StoreEntry without its Expiry, which is the same for
+// StoreEntries of the same PrefixedIP, PrefixedIP in a Scope, key, or
+// fingerprint.
+func (e StoreEntry) String() string {
+	return e.identity(false)
+}
+
+// FileStore is a Store which appends every change to a file.
+//
+// Files start with a header saying prefix-lengths are native to the family of
+// each PrefixedIP. Files without it were written by earlier versions of the
+// package, where prefix-lengths are always out of 128 bits, and continue to be
+// read and written in that form.
+type FileStore struct {
 	path string
+
+	mu sync.Mutex
+	// known is true once legacy has been determined from the file.
+	known bool
+	// legacy is true if the file was written by an earlier version of the
+	// package.
+	legacy bool
+}
+
+// NewFileStore at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
 }
 
-// newStore at path.
-func newStore(path string) *store {
-	return &store{path: path}
+// Add the StoreEntry to the FileStore.
+//
+// New files are started with the storeHeader. PrefixedIPs added to legacy files
+// are written in the legacy form so the file stays readable.
+//
+// Return an error if the file can't be written to.
+func (s *FileStore) Add(entry StoreEntry) error {
+	return s.write("", entry)
 }
 
-// Add PrefixedIP to store.
+// Remove the StoreEntry from the FileStore.
+//
+// Removals are appended to the file as the StoreEntry prefixed by
+// storeRemoval.
 //
 // Return an error if the file can't be written to.
-func (s *store) Add(pip *PrefixedIP) error {
-	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0777)
+func (s *FileStore) Remove(entry StoreEntry) error {
+	entry.Expiry = time.Time{}
+	return s.write(storeRemoval, entry)
+}
+
+// write the line for the entry with the prefix to the file.
+//
+// Return an error if the file can't be written to.
+func (s *FileStore) write(prefix string, entry StoreEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	fmt.Fprintf(f, "%v\n", pip)
-	return nil
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		s.known, s.legacy = true, false
+		if _, err := fmt.Fprintf(f, "%s\n", storeHeader); err != nil {
+			return err
+		}
+	} else if !s.known {
+		legacy, err := isLegacyStore(f)
+		if err != nil {
+			return err
+		}
+		s.known, s.legacy = true, legacy
+	}
+	_, err = fmt.Fprintf(f, "%s%s\n", prefix, entry.line(s.legacy))
+	return err
 }
 
-// PrefixedIPs in store.
+// Load the StoreEntries in the file in the order they were first added with
+// the Expiry they were last added with.
+//
+// StoreEntries which were removed after they were last added aren't returned.
 //
 // Return an error if the file can't be read.
-func (s *store) PrefixedIPs() ([]*PrefixedIP, error) {
+func (s *FileStore) Load() ([]StoreEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	bs, err := ioutil.ReadFile(s.path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -41,16 +189,173 @@ func (s *store) PrefixedIPs() ([]*PrefixedIP, error) {
 		}
 		return nil, err
 	}
-	var pips []*PrefixedIP
-	for _, line := range bytes.Split(bs, []byte("\n")) {
+	lines := bytes.Split(bs, []byte("\n"))
+	legacy := string(lines[0]) != storeHeader
+	if len(bs) != 0 {
+		s.known, s.legacy = true, legacy
+	}
+	if !legacy {
+		lines = lines[1:]
+	}
+	var order []string
+	// latest holds the last line adding each StoreEntry by its identity.
+	latest := make(map[string]StoreEntry)
+	// present is true for StoreEntries whose last line adds them.
+	present := make(map[string]bool)
+	for _, line := range lines {
 		if len(line) == 0 {
 			continue
 		}
-		pip, err := ParsePrefixedIP(string(line))
+		remove := bytes.HasPrefix(line, []byte(storeRemoval))
+		entry, err := parseStoreEntry(string(bytes.TrimPrefix(line, []byte(storeRemoval))), legacy)
 		if err != nil {
 			return nil, err
 		}
-		pips = append(pips, pip)
+		id := entry.String()
+		if _, ok := present[id]; !ok && !remove {
+			order = append(order, id)
+		}
+		if !remove {
+			latest[id] = entry
+		}
+		if !remove || present[id] {
+			present[id] = !remove
+		}
+	}
+	var entries []StoreEntry
+	for _, id := range order {
+		if present[id] {
+			entries = append(entries, latest[id])
+		}
+	}
+	return entries, nil
+}
+
+// storeScope begins lines of store files holding PrefixedIPs in Scopes.
+const storeScope = "scope"
+
+// storeExpiry separates lines of store files from the Expiry of their
+// StoreEntry, which is in the RFC 3339 form.
+const storeExpiry = " expires "
+
+// parseStoreEntry parses the line, without any storeRemoval, of a store file
+// which is legacy or not.
+//
+// Lines holding keys are the keyKind and the quoted key separated by a space,
+// and lines holding PrefixedIPs in Scopes are storeScope, the quoted String
+// form of the Scope, and the PrefixedIP separated by spaces. Spaces never
+// appear in PrefixedIPs. Lines of StoreEntries with an Expiry end with
+// storeExpiry and the Expiry.
+//
+// Returns an error if the line is bad.
+func parseStoreEntry(line string, legacy bool) (StoreEntry, error) {
+	var expiry time.Time
+	if i := strings.LastIndex(line, storeExpiry); i >= 0 {
+		if t, err := time.Parse(time.RFC3339Nano, line[i+len(storeExpiry):]); err == nil {
+			line, expiry = line[:i], t
+		}
+	}
+	parse := ParsePrefixedIP
+	if legacy {
+		parse = ParseLegacyPrefixedIP
+	}
+	kind, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		pip, err := parse(line)
+		return StoreEntry{PrefixedIP: pip, Expiry: expiry}, err
+	}
+	if kind == storeScope {
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return StoreEntry{}, ErrBadScope
+		}
+		unquoted, _ := strconv.Unquote(quoted)
+		scope, err := parseScope(unquoted)
+		if err != nil || unquoted == "" {
+			return StoreEntry{}, ErrBadScope
+		}
+		pip, err := parse(strings.TrimPrefix(rest[len(quoted):], " "))
+		return StoreEntry{PrefixedIP: pip, Scope: &scope, Expiry: expiry}, err
+	}
+	if keyKind(kind) != requestKey && keyKind(kind) != fingerprintKey {
+		return StoreEntry{}, ErrBadPrefixedIP
+	}
+	key, err := strconv.Unquote(rest)
+	if err != nil {
+		return StoreEntry{}, err
+	}
+	entry := keyEntry(keyKind(kind), key)
+	entry.Expiry = expiry
+	return entry, nil
+}
+
+// line of a store file for the StoreEntry, which is legacy or not.
+func (e StoreEntry) line(legacy bool) string {
+	line := e.identity(legacy)
+	if !e.Expiry.IsZero() {
+		line += storeExpiry + e.Expiry.UTC().Format(time.RFC3339Nano)
+	}
+	return line
+}
+
+// identity is the line of a store file for the StoreEntry, which is legacy or
+// not, without its Expiry.
+func (e StoreEntry) identity(legacy bool) string {
+	if kind, key, ok := e.keyOf(); ok {
+		return string(kind) + " " + strconv.Quote(key)
+	}
+	if scope := e.scopeKey(); scope != "" {
+		return storeScope + " " + strconv.Quote(scope) + " " + pipLine(e.PrefixedIP, legacy)
+	}
+	return pipLine(e.PrefixedIP, legacy)
+}
+
+// keyOf returns the keyKind and key of the StoreEntry and true if it holds a
+// key or fingerprint.
+func (e StoreEntry) keyOf() (keyKind, string, bool) {
+	switch {
+	case e.Key != "":
+		return requestKey, e.Key, true
+	case e.Fingerprint != "":
+		return fingerprintKey, e.Fingerprint, true
+	}
+	return "", "", false
+}
+
+// scopeKey is the String form of the StoreEntry's Scope, which is "" for
+// PrefixedIPs banned without a Scope.
+func (e StoreEntry) scopeKey() string {
+	if e.Scope == nil {
+		return ""
+	}
+	return e.Scope.String()
+}
+
+// keyEntry returns the StoreEntry of the key of the keyKind.
+func keyEntry(kind keyKind, key string) StoreEntry {
+	if kind == fingerprintKey {
+		return StoreEntry{Fingerprint: key}
+	}
+	return StoreEntry{Key: key}
+}
+
+// pipLine is the line of a store file for the PrefixedIP.
+func pipLine(pip *PrefixedIP, legacy bool) string {
+	if legacy {
+		return pip.legacyString()
+	}
+	return pip.String()
+}
+
+// isLegacyStore returns true if the file read by the io.ReaderAt doesn't begin
+// with the storeHeader.
+//
+// Returns an error if the file can't be read.
+func isLegacyStore(r io.ReaderAt) (bool, error) {
+	header := make([]byte, len(storeHeader)+1)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return false, err
 	}
-	return pips, nil
+	return string(header[:n]) != storeHeader+"\n", nil
 }
@@ -0,0 +1,110 @@
+package ban
+
+import (
+	"net/http"
+	"time"
+)
+
+// TarpitConfig for responding to banned clients slowly instead of rejecting
+// them immediately.
+type TarpitConfig struct {
+	// Interval between each byte of the response.
+	//
+	// Defaults to a second if not assigned.
+	Interval time.Duration
+	// Timeout after which the response is ended. Bytes of tarpitFiller are
+	// dripped after the message until then, so every tarpitted response
+	// takes the Timeout unless the client goes away.
+	//
+	// Defaults to a minute if not assigned.
+	Timeout time.Duration
+	// MaxConcurrent is the number of responses which can be tarpitted at
+	// once. Banned clients past the limit are rejected immediately.
+	//
+	// Defaults to 100 if not assigned.
+	MaxConcurrent int
+}
+
+// DefaultTarpitConfig which drips a byte every second for a minute to at most
+// 100 clients at once.
+var DefaultTarpitConfig = TarpitConfig{}
+
+const (
+	// defaultTarpitInterval is the Interval if none is assigned.
+	defaultTarpitInterval = time.Second
+	// defaultTarpitTimeout is the Timeout if none is assigned.
+	defaultTarpitTimeout = time.Minute
+	// defaultTarpitMaxConcurrent is the MaxConcurrent if none is assigned.
+	defaultTarpitMaxConcurrent = 100
+	// tarpitFiller is dripped after the message until the timeout.
+	tarpitFiller = '\n'
+)
+
+// tarpit writes responses to banned clients one byte at a time.
+type tarpit struct {
+	interval time.Duration
+	timeout  time.Duration
+	// slots holds a value for every response being tarpitted.
+	slots chan struct{}
+}
+
+// newTarpit with behavior customized by TarpitConfig.
+func newTarpit(cfg TarpitConfig) *tarpit {
+	interval := cfg.Interval
+	if interval == 0 {
+		interval = defaultTarpitInterval
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultTarpitTimeout
+	}
+	maxConcurrent := cfg.MaxConcurrent
+	if maxConcurrent == 0 {
+		maxConcurrent = defaultTarpitMaxConcurrent
+	}
+	return &tarpit{
+		interval: interval,
+		timeout:  timeout,
+		slots:    make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Write the status code and message, followed by tarpitFiller, to the
+// http.ResponseWriter one byte every interval until the timeout passes or the
+// client goes away.
+//
+// Returns false without writing anything if too many responses are already
+// being tarpitted.
+func (t *tarpit) Write(rw http.ResponseWriter, r *http.Request, code int, message string) bool {
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() { <-t.slots }()
+	flusher, _ := rw.(http.Flusher)
+	rw.WriteHeader(code)
+	timeout := time.NewTimer(t.timeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-timeout.C:
+			return true
+		case <-r.Context().Done():
+			return true
+		case <-ticker.C:
+		}
+		b := byte(tarpitFiller)
+		if i < len(message) {
+			b = message[i]
+		}
+		if _, err := rw.Write([]byte{b}); err != nil {
+			return true
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
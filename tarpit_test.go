@@ -0,0 +1,85 @@
+package ban
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTarpit tests that banned clients are responded to slowly until the
+// timeout, even after the message, and are rejected immediately once too many
+// are being tarpitted.
+func TestTarpit(t *testing.T) {
+	t.Parallel()
+	const interval = 5 * time.Millisecond
+	const message = "1.2.3.4 is banned"
+	cases := []struct {
+		Name      string
+		Timeout   time.Duration
+		Full      bool
+		Truncated bool
+		WantMin   time.Duration
+	}{
+		{Name: "dripped", Timeout: time.Duration(3*len(message)) * interval, WantMin: time.Duration(3*len(message)) * interval},
+		{Name: "timed out", Timeout: 4 * interval, Truncated: true, WantMin: 4 * interval},
+		{Name: "full", Timeout: time.Minute, Full: true},
+	}
+	for _, c := range cases {
+		h := New(
+			http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+			BannerFunc(func(ip IP, r *http.Request) Ban { return IPBan }),
+			Config{
+				ErrorHandler: func(err error) { t.Error(err) },
+				Tarpit:       &TarpitConfig{Interval: interval, Timeout: c.Timeout, MaxConcurrent: 1},
+			},
+		)
+		if c.Full {
+			h.Engine().tarpit.slots <- struct{}{}
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "1.2.3.4:1"
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: rec.Code = %d, want %d", c.Name, rec.Code, http.StatusForbidden)
+		}
+		body := rec.Body.String()
+		if c.Truncated && (len(body) >= len(message) || !strings.HasPrefix(message, body)) {
+			t.Errorf("%s: rec.Body = %q, want a truncated %q", c.Name, body, message)
+		}
+		if c.Full && body != message {
+			t.Errorf("%s: rec.Body = %q, want %q", c.Name, body, message)
+		}
+		filler := strings.TrimPrefix(body, message)
+		if !c.Truncated && !c.Full && (filler == body || filler == "" || strings.Trim(filler, string(tarpitFiller)) != "") {
+			t.Errorf("%s: rec.Body = %q, want %q followed by filler", c.Name, body, message)
+		}
+		if elapsed < c.WantMin {
+			t.Errorf("%s: responded after %v, want at least %v", c.Name, elapsed, c.WantMin)
+		}
+	}
+}
+
+// TestTarpitDisconnect tests that tarpitting stops once the client goes away.
+func TestTarpitDisconnect(t *testing.T) {
+	t.Parallel()
+	tp := newTarpit(TarpitConfig{Interval: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	if !tp.Write(rec, r, http.StatusForbidden, "banned") {
+		t.Errorf("tp.Write() = false, want true")
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("rec.Body = %q, want empty", rec.Body)
+	}
+	if len(tp.slots) != 0 {
+		t.Errorf("len(tp.slots) = %d, want 0", len(tp.slots))
+	}
+}
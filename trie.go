@@ -11,45 +11,166 @@ type node struct {
 
 // trie is a trie which supports adding net.IPs and prefix-lengths and checking
 // for their presence efficiently.
+//
+// IPv4 and IPv6 addresses are kept in separate tries so IPv4 addresses don't
+// walk the 96 bits of the IPv4-prefix that every one of them shares. IPv6
+// PrefixedIPs which include every IPv4 address are counted so IPv4 addresses
+// only ever need to check the IPv4 trie.
 type trie struct {
-	root *node
+	ipv4 *node
+	ipv6 *node
+	// ipv4Includers is the number of IPv6 PrefixedIPs in the trie which
+	// include every IPv4 address.
+	ipv4Includers int
 }
 
 // newTrie creates an empty trie.
 func newTrie() *trie {
-	return &trie{root: &node{}}
+	return &trie{ipv4: &node{}, ipv6: &node{}}
 }
 
 // Add the PrefixedIP to the trie.
-func (m *trie) Add(pip *PrefixedIP) {
+//
+// Returns true if the PrefixedIP wasn't already in the trie.
+func (m *trie) Add(pip *PrefixedIP) bool {
+	if pip.IsIPv4() {
+		addr, _ := pip.IP().IPv4()
+		return addBits(m.ipv4, addr[:], pip.PrefixLength())
+	}
+	ip := pip.IP()
+	added := addBits(m.ipv6, ip[:], pip.PrefixLength())
+	if added && pip.includesIPv4() {
+		m.ipv4Includers++
+	}
+	return added
+}
+
+// Remove the PrefixedIP from the trie.
+//
+// Only the exact PrefixedIP is removed, so IPs included by other PrefixedIPs
+// in the trie remain.
+//
+// Returns true if the PrefixedIP was in the trie.
+func (m *trie) Remove(pip *PrefixedIP) bool {
+	if pip.IsIPv4() {
+		addr, _ := pip.IP().IPv4()
+		return removeBits(m.ipv4, addr[:], pip.PrefixLength())
+	}
 	ip := pip.IP()
-	pl := pip.PrefixLength()
-	current := m.root
+	removed := removeBits(m.ipv6, ip[:], pip.PrefixLength())
+	if removed && pip.includesIPv4() {
+		m.ipv4Includers--
+	}
+	return removed
+}
+
+// Has returns true if the IP matches a PrefixedIP stored in the trie.
+func (m *trie) Has(ip IP) bool {
+	if addr, ok := ip.IPv4(); ok {
+		return m.ipv4Includers > 0 || hasBits(m.ipv4, addr[:])
+	}
+	return hasBits(m.ipv6, ip[:])
+}
+
+// PrefixedIPs in the trie, IPv4 before IPv6 and each in ascending order.
+//
+// PrefixedIPs included by shorter PrefixedIPs of the same family aren't
+// returned.
+func (m *trie) PrefixedIPs() []*PrefixedIP {
+	var pips []*PrefixedIP
+	walkBits(m.ipv4, make([]byte, ipv4Length), 0, func(addr []byte, pl byte) {
+		var ipv4 IPv4
+		copy(ipv4[:], addr)
+		pips = append(pips, &PrefixedIP{ip: NewIPv4IP(ipv4), prefixLength: pl + ipv4PrefixLength})
+	})
+	walkBits(m.ipv6, make([]byte, ipv6Length), 0, func(addr []byte, pl byte) {
+		var ip IP
+		copy(ip[:], addr)
+		pips = append(pips, &PrefixedIP{ip: ip, prefixLength: pl})
+	})
+	return pips
+}
+
+// addBits adds the first pl bits of the address to the trie rooted at root.
+//
+// Returns true if the bits weren't already in the trie.
+func addBits(root *node, addr []byte, pl byte) bool {
+	current := root
 	for i := byte(0); i < pl; i++ {
-		child := (ip[i/bitsPerByte] >> (bitsPerByte - 1 - i%bitsPerByte)) & 1
+		child := bit(addr, i)
 		if current.Children[child] == nil {
 			current.Children[child] = &node{}
 		}
 		current = current.Children[child]
-		if current.IsEnd {
-			return
-		}
 	}
+	added := !current.IsEnd
 	current.IsEnd = true
+	return added
 }
 
-// Has returns true if the IP matches a PrefixedIP stored in the trie.
-func (m *trie) Has(ip IP) bool {
-	current := m.root
-	for i := byte(0); i < ipLength; i++ {
+// removeBits removes the first pl bits of the address from the trie rooted at
+// root along with any nodes left without a purpose.
+//
+// Returns true if the bits were in the trie.
+func removeBits(root *node, addr []byte, pl byte) bool {
+	path := make([]*node, 0, pl)
+	current := root
+	for i := byte(0); i < pl && current != nil; i++ {
+		path = append(path, current)
+		current = current.Children[bit(addr, i)]
+	}
+	if current == nil || !current.IsEnd {
+		return false
+	}
+	current.IsEnd = false
+	for i := len(path) - 1; i >= 0; i-- {
+		if current.IsEnd || current.Children[0] != nil || current.Children[1] != nil {
+			break
+		}
+		path[i].Children[bit(addr, byte(i))] = nil
+		current = path[i]
+	}
+	return true
+}
+
+// hasBits returns true if a prefix of the address is in the trie rooted at
+// root.
+func hasBits(root *node, addr []byte) bool {
+	current := root
+	for i := 0; i < len(addr)*bitsPerByte; i++ {
 		if current.IsEnd {
 			return true
 		}
-		child := (ip[i/bitsPerByte] >> (bitsPerByte - 1 - i%bitsPerByte)) & 1
-		current = current.Children[child]
+		current = current.Children[bit(addr, byte(i))]
 		if current == nil {
-			break
+			return false
 		}
 	}
-	return current != nil && current.IsEnd
+	return current.IsEnd
+}
+
+// walkBits calls f with the address and prefix-length of every end node in the
+// trie rooted at current which isn't below another end node.
+//
+// The address holds the bits of the path to current, which has depth pl.
+func walkBits(current *node, addr []byte, pl byte, f func([]byte, byte)) {
+	if current.IsEnd {
+		f(addr, pl)
+		return
+	}
+	for child, next := range current.Children {
+		if next == nil {
+			continue
+		}
+		if child == 1 {
+			addr[pl/bitsPerByte] |= 1 << (bitsPerByte - 1 - pl%bitsPerByte)
+		}
+		walkBits(next, addr, pl+1, f)
+		addr[pl/bitsPerByte] &^= 1 << (bitsPerByte - 1 - pl%bitsPerByte)
+	}
+}
+
+// bit i of the address read from left to right.
+func bit(addr []byte, i byte) byte {
+	return (addr[i/bitsPerByte] >> (bitsPerByte - 1 - i%bitsPerByte)) & 1
 }
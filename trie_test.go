@@ -29,6 +29,21 @@ func TestIPv4IPv6Different(t *testing.T) {
 	testIPv4IPv6Different(t, trieConstructor)
 }
 
+// TestIPv6IncludesIPv4 calls testIPv6IncludesIPv4 with trieConstructor.
+func TestIPv6IncludesIPv4(t *testing.T) {
+	testIPv6IncludesIPv4(t, trieConstructor)
+}
+
+// TestPrefixedIPs calls testPrefixedIPs with trieConstructor.
+func TestPrefixedIPs(t *testing.T) {
+	testPrefixedIPs(t, trieConstructor)
+}
+
+// TestRemove calls testRemove with trieConstructor.
+func TestRemove(t *testing.T) {
+	testRemove(t, trieConstructor)
+}
+
 // TestRandom calls testRandom with trieConstructor.
 func TestRandom(t *testing.T) {
 	testRandom(t, trieConstructor)